@@ -0,0 +1,304 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	journaldSocketPath = "/run/systemd/journal/socket"
+	timeNow            = time.Now
+)
+
+// ActivationEventType describes the type of an ActivationEvent.
+type ActivationEventType string
+
+const (
+	// ActivationEventKeyDataFound is emitted for each KeyData object that
+	// is found in the LUKS2 header of the volume or is supplied by the
+	// caller. If a KeyData object in the LUKS2 header could not be read,
+	// the Error field is set.
+	ActivationEventKeyDataFound ActivationEventType = "keydata-found"
+
+	// ActivationEventKeyDataAttemptStart is emitted before an attempt
+	// to activate the volume with a KeyData object.
+	ActivationEventKeyDataAttemptStart ActivationEventType = "keydata-attempt-start"
+
+	// ActivationEventKeyDataAttemptEnd is emitted after an attempt to
+	// activate the volume with a KeyData object. The Result field
+	// indicates whether the attempt succeeded, and the Error and
+	// PlatformError fields describe any failure.
+	ActivationEventKeyDataAttemptEnd ActivationEventType = "keydata-attempt-end"
+
+	// ActivationEventSnapModelAuthorization is emitted when checking
+	// whether the snap model is authorized by a KeyData object.
+	ActivationEventSnapModelAuthorization ActivationEventType = "snap-model-authorization"
+
+	// ActivationEventBootIdentityAuthorization is emitted when checking
+	// whether the boot identity is authorized by a KeyData object.
+	ActivationEventBootIdentityAuthorization ActivationEventType = "boot-identity-authorization"
+
+	// ActivationEventPassphraseRequest is emitted after requesting a
+	// passphrase from the AuthRequestor.
+	ActivationEventPassphraseRequest ActivationEventType = "passphrase-request"
+
+	// ActivationEventRecoveryKeyAttempt is emitted after each attempt to
+	// activate the volume with the recovery key.
+	ActivationEventRecoveryKeyAttempt ActivationEventType = "recovery-key-attempt"
+
+	// ActivationEventKeyringWrite is emitted after adding a key to the
+	// kernel keyring. The Purpose field indicates which key was added.
+	ActivationEventKeyringWrite ActivationEventType = "keyring-write"
+)
+
+const (
+	// ActivationResultSuccess indicates that an operation succeeded.
+	ActivationResultSuccess = "success"
+
+	// ActivationResultFailure indicates that an operation failed.
+	ActivationResultFailure = "failure"
+
+	// ActivationResultAuthorized indicates that an authorization check
+	// passed.
+	ActivationResultAuthorized = "authorized"
+
+	// ActivationResultUnauthorized indicates that an authorization check
+	// failed.
+	ActivationResultUnauthorized = "unauthorized"
+)
+
+// ActivationEvent is a structured event emitted during activation of a
+// volume, for the purposes of auditing and diagnosing activation failures.
+// It never contains any secret material.
+type ActivationEvent struct {
+	Time             time.Time           `json:"time"`
+	Type             ActivationEventType `json:"type"`
+	VolumeName       string              `json:"volume_name"`
+	SourceDevicePath string              `json:"source_device_path"`
+
+	// KeyData is the readable name of the KeyData object that this
+	// event relates to, if any.
+	KeyData string `json:"keydata,omitempty"`
+
+	// Token is the name of the LUKS2 token that the KeyData object
+	// was read from, if any.
+	Token string `json:"token,omitempty"`
+
+	// Purpose is the purpose of the key that was added to the kernel
+	// keyring for ActivationEventKeyringWrite events.
+	Purpose string `json:"purpose,omitempty"`
+
+	// Result is one of the ActivationResult* values, for events that
+	// describe the outcome of an operation.
+	Result string `json:"result,omitempty"`
+
+	// PlatformError describes the type of platform error that caused
+	// a KeyData attempt to fail, if any. It is one of "invalid-key-data",
+	// "uninitialized", "unavailable", "lockout" or "invalid-passphrase".
+	PlatformError string `json:"platform_error,omitempty"`
+
+	// Error is the error associated with this event, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// ActivationEventSink is implemented by types that receive events
+// emitted during activation of a volume, and can be supplied via the
+// EventSink field of ActivateVolumeOptions. Events are delivered
+// synchronously, so implementations should not block.
+type ActivationEventSink interface {
+	HandleActivationEvent(event *ActivationEvent)
+}
+
+func activationPlatformErrorType(err error) string {
+	var ikdErr *InvalidKeyDataError
+	var puErr *PlatformUninitializedError
+	var pduErr *PlatformDeviceUnavailableError
+	var plErr *PlatformLockoutError
+
+	switch {
+	case xerrors.As(err, &ikdErr):
+		return "invalid-key-data"
+	case xerrors.As(err, &puErr):
+		return "uninitialized"
+	case xerrors.As(err, &pduErr):
+		return "unavailable"
+	case xerrors.As(err, &plErr):
+		return "lockout"
+	case xerrors.Is(err, ErrInvalidPassphrase):
+		return "invalid-passphrase"
+	default:
+		return ""
+	}
+}
+
+func activationResult(err error) string {
+	if err != nil {
+		return ActivationResultFailure
+	}
+	return ActivationResultSuccess
+}
+
+func activationError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// activationEventEmitter emits events for the activation of a single
+// volume to an optional ActivationEventSink.
+type activationEventEmitter struct {
+	sink             ActivationEventSink
+	volumeName       string
+	sourceDevicePath string
+}
+
+func (e *activationEventEmitter) emit(event *ActivationEvent) {
+	if e == nil || e.sink == nil {
+		return
+	}
+	event.Time = timeNow()
+	event.VolumeName = e.volumeName
+	event.SourceDevicePath = e.sourceDevicePath
+	e.sink.HandleActivationEvent(event)
+}
+
+// JSONLinesActivationEventSink is an ActivationEventSink that writes each
+// event as a single line of JSON to an io.Writer, eg, a log file.
+type JSONLinesActivationEventSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLinesActivationEventSink returns a new JSONLinesActivationEventSink
+// that writes to the supplied io.Writer.
+func NewJSONLinesActivationEventSink(w io.Writer) *JSONLinesActivationEventSink {
+	return &JSONLinesActivationEventSink{w: w}
+}
+
+// HandleActivationEvent implements ActivationEventSink.HandleActivationEvent.
+// Errors are ignored because a failure to log an event must not affect
+// activation.
+func (s *JSONLinesActivationEventSink) HandleActivationEvent(event *ActivationEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.w.Write(append(b, '\n'))
+}
+
+// JournaldActivationEventSink is an ActivationEventSink that sends each
+// event to the systemd journal using its native protocol, with the
+// properties of each event as structured fields.
+type JournaldActivationEventSink struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewJournaldActivationEventSink returns a new JournaldActivationEventSink
+// that is connected to the systemd journal. Call Close when it is no longer
+// required.
+func NewJournaldActivationEventSink() (*JournaldActivationEventSink, error) {
+	conn, err := net.Dial("unixgram", journaldSocketPath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot connect to journal: %w", err)
+	}
+	return &JournaldActivationEventSink{conn: conn}, nil
+}
+
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if value == "" {
+		return
+	}
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	// Values containing newlines are serialized with an explicit length.
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (s *JournaldActivationEventSink) encodeEvent(event *ActivationEvent) []byte {
+	priority := "6" // info
+	if event.Error != "" {
+		priority = "4" // warning
+	}
+
+	message := fmt.Sprintf("%s for %s (%s)", event.Type, event.VolumeName, event.SourceDevicePath)
+	if event.KeyData != "" {
+		message += " with " + event.KeyData
+	}
+	if event.Result != "" {
+		message += ": " + event.Result
+	}
+	if event.Error != "" {
+		message += ": " + event.Error
+	}
+
+	buf := new(bytes.Buffer)
+	writeJournalField(buf, "MESSAGE", message)
+	writeJournalField(buf, "PRIORITY", priority)
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", "secboot")
+	writeJournalField(buf, "SECBOOT_EVENT", string(event.Type))
+	writeJournalField(buf, "SECBOOT_VOLUME_NAME", event.VolumeName)
+	writeJournalField(buf, "SECBOOT_SOURCE_DEVICE_PATH", event.SourceDevicePath)
+	writeJournalField(buf, "SECBOOT_KEYDATA", event.KeyData)
+	writeJournalField(buf, "SECBOOT_TOKEN", event.Token)
+	writeJournalField(buf, "SECBOOT_PURPOSE", event.Purpose)
+	writeJournalField(buf, "SECBOOT_RESULT", event.Result)
+	writeJournalField(buf, "SECBOOT_PLATFORM_ERROR", event.PlatformError)
+	writeJournalField(buf, "SECBOOT_ERROR", event.Error)
+	return buf.Bytes()
+}
+
+// HandleActivationEvent implements ActivationEventSink.HandleActivationEvent.
+// Errors are ignored because a failure to log an event must not affect
+// activation.
+func (s *JournaldActivationEventSink) HandleActivationEvent(event *ActivationEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.Write(s.encodeEvent(event))
+}
+
+// Close closes the connection to the systemd journal.
+func (s *JournaldActivationEventSink) Close() error {
+	return s.conn.Close()
+}
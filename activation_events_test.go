@@ -0,0 +1,148 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"time"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type mockActivationEventSink struct {
+	events []*ActivationEvent
+}
+
+func (s *mockActivationEventSink) HandleActivationEvent(event *ActivationEvent) {
+	s.events = append(s.events, event)
+}
+
+type activationEventsSuite struct {
+	snapd_testutil.BaseTest
+}
+
+var _ = Suite(&activationEventsSuite{})
+
+func (s *activationEventsSuite) TestJSONLinesSink(c *C) {
+	buf := new(bytes.Buffer)
+	sink := NewJSONLinesActivationEventSink(buf)
+
+	sink.HandleActivationEvent(&ActivationEvent{
+		Time:             time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC),
+		Type:             ActivationEventKeyDataFound,
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		KeyData:          "/dev/sda1:default",
+		Token:            "default"})
+	sink.HandleActivationEvent(&ActivationEvent{
+		Time:             time.Date(2023, 6, 1, 12, 0, 1, 0, time.UTC),
+		Type:             ActivationEventKeyDataAttemptEnd,
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		KeyData:          "/dev/sda1:default",
+		Result:           ActivationResultFailure,
+		PlatformError:    "unavailable",
+		Error:            "cannot recover key: the platform device is unavailable"})
+
+	c.Check(buf.String(), Equals,
+		`{"time":"2023-06-01T12:00:00Z","type":"keydata-found","volume_name":"data","source_device_path":"/dev/sda1","keydata":"/dev/sda1:default","token":"default"}
+{"time":"2023-06-01T12:00:01Z","type":"keydata-attempt-end","volume_name":"data","source_device_path":"/dev/sda1","keydata":"/dev/sda1:default","result":"failure","platform_error":"unavailable","error":"cannot recover key: the platform device is unavailable"}
+`)
+}
+
+func (s *activationEventsSuite) TestJournaldSink(c *C) {
+	path := filepath.Join(c.MkDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	s.AddCleanup(MockJournaldSocketPath(path))
+
+	sink, err := NewJournaldActivationEventSink()
+	c.Assert(err, IsNil)
+	defer sink.Close()
+
+	sink.HandleActivationEvent(&ActivationEvent{
+		Type:             ActivationEventRecoveryKeyAttempt,
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		Result:           ActivationResultFailure,
+		Error:            "cannot activate volume: systemd-cryptsetup failed with: exit status 1"})
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf[:n]), Equals, `MESSAGE=recovery-key-attempt for data (/dev/sda1): failure: cannot activate volume: systemd-cryptsetup failed with: exit status 1
+PRIORITY=4
+SYSLOG_IDENTIFIER=secboot
+SECBOOT_EVENT=recovery-key-attempt
+SECBOOT_VOLUME_NAME=data
+SECBOOT_SOURCE_DEVICE_PATH=/dev/sda1
+SECBOOT_RESULT=failure
+SECBOOT_ERROR=cannot activate volume: systemd-cryptsetup failed with: exit status 1
+`)
+}
+
+func (s *activationEventsSuite) TestJournaldSinkMultilineValue(c *C) {
+	path := filepath.Join(c.MkDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	s.AddCleanup(MockJournaldSocketPath(path))
+
+	sink, err := NewJournaldActivationEventSink()
+	c.Assert(err, IsNil)
+	defer sink.Close()
+
+	sink.HandleActivationEvent(&ActivationEvent{
+		Type:             ActivationEventKeyDataFound,
+		VolumeName:       "data",
+		SourceDevicePath: "/dev/sda1",
+		Token:            "default",
+		Error:            "foo\nbar"})
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	c.Assert(err, IsNil)
+
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len("keydata-found for data (/dev/sda1): foo\nbar")))
+	expectedMessage := "MESSAGE\n" + string(length[:]) + "keydata-found for data (/dev/sda1): foo\nbar\n"
+	c.Check(bytes.HasPrefix(buf[:n], []byte(expectedMessage)), testutil.IsTrue)
+
+	binary.LittleEndian.PutUint64(length[:], uint64(len("foo\nbar")))
+	c.Check(bytes.HasSuffix(buf[:n], []byte("SECBOOT_ERROR\n"+string(length[:])+"foo\nbar\n")), testutil.IsTrue)
+}
+
+func (s *activationEventsSuite) TestJournaldSinkNoJournal(c *C) {
+	s.AddCleanup(MockJournaldSocketPath(filepath.Join(c.MkDir(), "socket")))
+
+	_, err := NewJournaldActivationEventSink()
+	c.Check(err, ErrorMatches, `cannot connect to journal: dial unixgram .*/socket: connect: no such file or directory`)
+}
@@ -32,7 +32,8 @@ import (
 )
 
 var (
-	runtimeNumCPU = runtime.NumCPU
+	argon2GetMemoryLimits = argon2.GetMemoryLimits
+	runtimeNumCPU         = runtime.NumCPU
 )
 
 // KDFOptions specifies parameters for the Argon2 KDF used by cryptsetup
@@ -58,9 +59,77 @@ type KDFOptions struct {
 	// KDF (up to 4). This will be adjusted downwards based on the
 	// actual number of CPUs.
 	Parallel int
+
+	// MemoryLimitScale is the fraction of the available memory that
+	// may be used as the maximum memory cost when benchmarking the
+	// KDF. The available memory is the lesser of the MemAvailable value
+	// from /proc/meminfo and the memory remaining before reaching the
+	// limit of the memory cgroup that the current process belongs to.
+	// It must be greater than zero and no more than 1. If it is zero,
+	// then a default of 0.5 is used. If ForceIterations is not zero
+	// then this field is ignored.
+	MemoryLimitScale float64
+
+	// MemoryLimitsCallback is called with the memory limits that were
+	// used to compute the maximum memory cost when benchmarking the
+	// KDF, if it is not nil. It is not called if ForceIterations is not
+	// zero. Benchmarking does not fail if the detected limits are too
+	// low, so this is the only way to find out about that.
+	MemoryLimitsCallback func(limits *KDFMemoryLimits)
+
+	// Calibration can be used to supply the results of a previous
+	// call to CalibrateKDF in order to skip benchmarking. It is only
+	// used if ForceIterations is zero, the calibration was performed
+	// on the current hardware and it was benchmarked against the
+	// requested TargetDuration. Otherwise the cost parameters are
+	// benchmarked as normal. If it is used, then MemoryKiB, Parallel,
+	// MemoryLimitScale and MemoryLimitsCallback are ignored.
+	Calibration *KDFCalibration
+}
+
+// KDFMemoryLimits describes the memory limits that were used to compute
+// the maximum memory cost when benchmarking the KDF.
+type KDFMemoryLimits struct {
+	// TotalRAMKiB is the total amount of RAM in KiB.
+	TotalRAMKiB uint64
+
+	// AvailableRAMKiB is the amount of available RAM in KiB, as
+	// reported by MemAvailable in /proc/meminfo.
+	AvailableRAMKiB uint64
+
+	// CgroupLimitKiB is the memory cgroup limit in KiB, or zero if
+	// there is no limit.
+	CgroupLimitKiB uint64
+
+	// CgroupAvailableKiB is the amount of memory in KiB that remains
+	// before the memory cgroup limit is reached, or zero if there is
+	// no limit.
+	CgroupAvailableKiB uint64
+
+	// Scale is the fraction of the available memory that was used.
+	Scale float64
+
+	// MaxMemoryCostKiB is the maximum memory cost in KiB that was used
+	// for benchmarking, which takes into account the detected limits
+	// and the value of KDFOptions.MemoryKiB. It is never less than the
+	// minimum memory cost of 32MiB.
+	MaxMemoryCostKiB uint32
+
+	// InsufficientMemory indicates that the detected limits are lower
+	// than the minimum memory cost of 32MiB. The minimum memory cost is
+	// used anyway, so benchmarking may cause the system to swap or the
+	// process to be terminated by the OOM killer. The caller may want
+	// to warn about this.
+	InsufficientMemory bool
 }
 
 func (o *KDFOptions) luksOpts() luks2.KDFOptions {
+	if params := o.calibratedCostParams(); params != nil {
+		return luks2.KDFOptions{
+			MemoryKiB:       int(params.MemoryKiB),
+			ForceIterations: int(params.Time),
+			Parallel:        int(params.Threads)}
+	}
 	return luks2.KDFOptions{
 		TargetDuration:  o.TargetDuration,
 		MemoryKiB:       o.MemoryKiB,
@@ -102,9 +171,13 @@ func (o *KDFOptions) deriveCostParams(keyLen int, kdf KDF) (*KDFCostParams, erro
 
 		return params, nil
 	default:
+		if params := o.calibratedCostParams(); params != nil {
+			return params, nil
+		}
+
 		benchmarkParams := &argon2.BenchmarkParams{
 			MaxMemoryCostKiB: 1 * 1024 * 1024,
-			TargetDuration:   2 * time.Second}
+			TargetDuration:   defaultKDFTargetDuration}
 
 		if o.MemoryKiB != 0 {
 			benchmarkParams.MaxMemoryCostKiB = uint32(o.MemoryKiB)
@@ -119,6 +192,23 @@ func (o *KDFOptions) deriveCostParams(keyLen int, kdf KDF) (*KDFCostParams, erro
 			}
 		}
 
+		limits, err := argon2GetMemoryLimits(o.MemoryLimitScale)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine memory limits: %w", err)
+		}
+		benchmarkParams.MemoryLimits = limits
+
+		if o.MemoryLimitsCallback != nil {
+			o.MemoryLimitsCallback(&KDFMemoryLimits{
+				TotalRAMKiB:        limits.TotalRAMKiB,
+				AvailableRAMKiB:    limits.AvailableRAMKiB,
+				CgroupLimitKiB:     limits.CgroupLimitKiB,
+				CgroupAvailableKiB: limits.CgroupAvailableKiB,
+				Scale:              limits.Scale,
+				MaxMemoryCostKiB:   limits.MemoryCostCeilingKiB(benchmarkParams.MaxMemoryCostKiB),
+				InsufficientMemory: limits.Insufficient()})
+		}
+
 		params, err := argon2.Benchmark(benchmarkParams, func(params *argon2.CostParams) (time.Duration, error) {
 			return kdf.Time(&KDFCostParams{
 				Time:      params.Time,
@@ -140,15 +230,15 @@ func (o *KDFOptions) deriveCostParams(keyLen int, kdf KDF) (*KDFCostParams, erro
 type KDFCostParams struct {
 	// Time corresponds to the number of iterations of the algorithm
 	// that the key derivation will use.
-	Time uint32
+	Time uint32 `json:"time"`
 
 	// MemoryKiB is the amount of memory in KiB that the key derivation
 	// will use.
-	MemoryKiB uint32
+	MemoryKiB uint32 `json:"memory"`
 
 	// Threads is the number of parallel threads that will be used
 	// for the key derivation.
-	Threads uint8
+	Threads uint8 `json:"threads"`
 }
 
 func (p *KDFCostParams) internalParams() *argon2.CostParams {
@@ -185,7 +275,8 @@ var argon2iKDF = argon2iKDFImpl{}
 // Argon2iKDF returns the in-process Argon2i implementation of KDF. This
 // shouldn't be used in long-lived system processes - these processes should
 // instead provide their own KDF implementation which delegates to a short-lived
-// utility process which will use the in-process implementation.
+// utility process which will use the in-process implementation, such as the one
+// returned from NewOutOfProcessArgon2KDF.
 func Argon2iKDF() KDF {
 	return argon2iKDF
 }
@@ -0,0 +1,338 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// Argon2OutOfProcessHandlerArg is the command line argument that the
+	// default handler command created by NewOutOfProcessArgon2KDF supplies
+	// when it re-executes the current binary. A binary that uses the default
+	// handler command should check for this as its first argument at the
+	// start of main, and call RunArgon2OutOfProcessRequest if it is present.
+	Argon2OutOfProcessHandlerArg = "secboot-argon2-handler"
+
+	argon2OutOfProcessProtocolVersion = 1
+
+	// argon2OutOfProcessMemoryOverheadKiB is the amount of memory that
+	// the handler process is permitted to use in addition to the memory
+	// cost of the KDF.
+	argon2OutOfProcessMemoryOverheadKiB = 128 * 1024
+
+	defaultArgon2OutOfProcessMaxMemoryKiB = 1 * 1024 * 1024
+)
+
+// argon2OutOfProcessCommand is the type of request made to an out-of-process
+// Argon2 handler.
+type argon2OutOfProcessCommand string
+
+const (
+	argon2OutOfProcessCommandDerive argon2OutOfProcessCommand = "derive" // KDF.Derive
+	argon2OutOfProcessCommandTime   argon2OutOfProcessCommand = "time"   // KDF.Time
+)
+
+// argon2OutOfProcessHandshake is sent by the handler process to its parent
+// as soon as it starts, before it receives a request.
+type argon2OutOfProcessHandshake struct {
+	Version int `json:"version"`
+}
+
+// argon2OutOfProcessRequest is sent by the parent to the handler process
+// once the handshake has completed.
+type argon2OutOfProcessRequest struct {
+	Command      argon2OutOfProcessCommand `json:"command"`
+	Passphrase   string                    `json:"passphrase,omitempty"`
+	Salt         []byte                    `json:"salt,omitempty"`
+	Time         uint32                    `json:"time"`
+	MemoryKiB    uint32                    `json:"memory"`
+	Threads      uint8                     `json:"threads"`
+	KeyLen       uint32                    `json:"keylen"`
+	MaxMemoryKiB uint32                    `json:"max-memory"`
+}
+
+// argon2OutOfProcessResponse is sent by the handler process to its parent
+// once the request has been completed.
+type argon2OutOfProcessResponse struct {
+	Command  argon2OutOfProcessCommand `json:"command"`
+	Key      []byte                    `json:"key,omitempty"`
+	Duration time.Duration             `json:"duration,omitempty"`
+	Error    string                    `json:"error,omitempty"`
+}
+
+// Argon2OutOfProcessError is returned from a KDF created by
+// NewOutOfProcessArgon2KDF if the handler process returned an error.
+type Argon2OutOfProcessError struct {
+	Msg string
+}
+
+func (e *Argon2OutOfProcessError) Error() string {
+	return "error from argon2 handler process: " + e.Msg
+}
+
+func runArgon2OutOfProcessRequest(req *argon2OutOfProcessRequest) (*argon2OutOfProcessResponse, error) {
+	switch {
+	case req.MemoryKiB > req.MaxMemoryKiB:
+		return nil, fmt.Errorf("memory cost %d KiB exceeds the limit of %d KiB", req.MemoryKiB, req.MaxMemoryKiB)
+	case req.Threads == 0:
+		return nil, errors.New("invalid number of threads")
+	case req.KeyLen == 0:
+		return nil, errors.New("invalid key length")
+	}
+
+	params := &KDFCostParams{
+		Time:      req.Time,
+		MemoryKiB: req.MemoryKiB,
+		Threads:   req.Threads}
+
+	switch req.Command {
+	case argon2OutOfProcessCommandDerive:
+		key, err := argon2iKDF.Derive(req.Passphrase, req.Salt, params, req.KeyLen)
+		if err != nil {
+			return nil, err
+		}
+		return &argon2OutOfProcessResponse{Command: req.Command, Key: key}, nil
+	case argon2OutOfProcessCommandTime:
+		duration, err := argon2iKDF.Time(params, req.KeyLen)
+		if err != nil {
+			return nil, err
+		}
+		return &argon2OutOfProcessResponse{Command: req.Command, Duration: duration}, nil
+	default:
+		return nil, fmt.Errorf("invalid command \"%s\"", req.Command)
+	}
+}
+
+// RunArgon2OutOfProcessRequest is the entry point for an out-of-process Argon2
+// handler process, started by a KDF created by NewOutOfProcessArgon2KDF. It
+// sends a handshake to the parent process via out, waits for a single request
+// from in, runs it and sends the response via out.
+//
+// An error is returned if a request cannot be received or a response cannot be
+// sent. Errors that occur when running the request are returned to the parent
+// process in the response instead. The handler process should exit once this
+// returns, as the memory used by the KDF is not released back to the operating
+// system.
+func RunArgon2OutOfProcessRequest(in io.Reader, out io.Writer) error {
+	enc := json.NewEncoder(out)
+	if err := enc.Encode(&argon2OutOfProcessHandshake{Version: argon2OutOfProcessProtocolVersion}); err != nil {
+		return xerrors.Errorf("cannot send handshake: %w", err)
+	}
+
+	var req *argon2OutOfProcessRequest
+	if err := json.NewDecoder(in).Decode(&req); err != nil {
+		return xerrors.Errorf("cannot decode request: %w", err)
+	}
+	if req == nil {
+		return errors.New("no request")
+	}
+
+	rsp, err := runArgon2OutOfProcessRequest(req)
+	if err != nil {
+		rsp = &argon2OutOfProcessResponse{Command: req.Command, Error: err.Error()}
+	}
+
+	if err := enc.Encode(rsp); err != nil {
+		return xerrors.Errorf("cannot send response: %w", err)
+	}
+
+	return nil
+}
+
+// OutOfProcessArgon2KDFOptions provides options for NewOutOfProcessArgon2KDF.
+type OutOfProcessArgon2KDFOptions struct {
+	// NewHandlerCmd returns a new command for starting a handler process.
+	// The handler process must call RunArgon2OutOfProcessRequest with its
+	// standard input and standard output. If this is nil, the current
+	// binary is re-executed with Argon2OutOfProcessHandlerArg as its only
+	// argument.
+	NewHandlerCmd func() (*exec.Cmd, error)
+
+	// MaxMemoryKiB is the maximum memory cost in KiB that the KDF will
+	// permit. Requests with a larger memory cost are rejected, and the
+	// handler process's data segment is limited to this plus a fixed
+	// overhead. If this is zero, a limit of 1GiB is used.
+	MaxMemoryKiB uint32
+
+	// Timeout is the maximum amount of time to wait for each request
+	// to complete, after which the handler process is killed. If this is
+	// zero, there is no timeout.
+	Timeout time.Duration
+}
+
+type outOfProcessArgon2KDF struct {
+	mu           sync.Mutex
+	newHandler   func() (*exec.Cmd, error)
+	maxMemoryKiB uint32
+	timeout      time.Duration
+}
+
+func defaultArgon2OutOfProcessHandlerCmd() (*exec.Cmd, error) {
+	return exec.Command("/proc/self/exe", Argon2OutOfProcessHandlerArg), nil
+}
+
+// NewOutOfProcessArgon2KDF returns an implementation of KDF that runs each
+// request in a short-lived handler process, so that the memory used by the KDF
+// does not contribute to the memory usage of the calling process. This is
+// suitable for use in long-lived system processes. Requests are serialized, so
+// only a single handler process runs at any time.
+//
+// The handler process is created using the NewHandlerCmd field of options. On
+// startup, it sends a handshake containing its protocol version to the parent,
+// after which the parent applies the memory limit to it and sends the request.
+func NewOutOfProcessArgon2KDF(options *OutOfProcessArgon2KDFOptions) KDF {
+	if options == nil {
+		options = new(OutOfProcessArgon2KDFOptions)
+	}
+
+	kdf := &outOfProcessArgon2KDF{
+		newHandler:   options.NewHandlerCmd,
+		maxMemoryKiB: options.MaxMemoryKiB,
+		timeout:      options.Timeout}
+	if kdf.newHandler == nil {
+		kdf.newHandler = defaultArgon2OutOfProcessHandlerCmd
+	}
+	if kdf.maxMemoryKiB == 0 {
+		kdf.maxMemoryKiB = defaultArgon2OutOfProcessMaxMemoryKiB
+	}
+	return kdf
+}
+
+func (k *outOfProcessArgon2KDF) sendRequest(req *argon2OutOfProcessRequest) (rsp *argon2OutOfProcessResponse, err error) {
+	if req.MemoryKiB > k.maxMemoryKiB {
+		return nil, fmt.Errorf("memory cost %d KiB exceeds the limit of %d KiB", req.MemoryKiB, k.maxMemoryKiB)
+	}
+	req.MaxMemoryKiB = k.maxMemoryKiB
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	cmd, err := k.newHandler()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create handler command: %w", err)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create stdout pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, xerrors.Errorf("cannot start handler process: %w", err)
+	}
+
+	if k.timeout > 0 {
+		timer := time.AfterFunc(k.timeout, func() { cmd.Process.Kill() })
+		defer timer.Stop()
+	}
+
+	defer func() {
+		stdin.Close()
+		waitErr := cmd.Wait()
+		if err == nil && waitErr != nil {
+			rsp = nil
+			err = xerrors.Errorf("handler process failed: %w", waitErr)
+		}
+	}()
+
+	dec := json.NewDecoder(stdout)
+
+	var handshake argon2OutOfProcessHandshake
+	if err := dec.Decode(&handshake); err != nil {
+		cmd.Process.Kill()
+		return nil, xerrors.Errorf("cannot receive handshake from handler process: %w", err)
+	}
+	if handshake.Version != argon2OutOfProcessProtocolVersion {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("unexpected handler process protocol version %d", handshake.Version)
+	}
+
+	limit := uint64(k.maxMemoryKiB+argon2OutOfProcessMemoryOverheadKiB) * 1024
+	if err := unix.Prlimit(cmd.Process.Pid, unix.RLIMIT_DATA, &unix.Rlimit{Cur: limit, Max: limit}, nil); err != nil {
+		cmd.Process.Kill()
+		return nil, xerrors.Errorf("cannot set memory limit for handler process: %w", err)
+	}
+
+	if err := json.NewEncoder(stdin).Encode(req); err != nil {
+		cmd.Process.Kill()
+		return nil, xerrors.Errorf("cannot send request to handler process: %w", err)
+	}
+
+	if err := dec.Decode(&rsp); err != nil {
+		cmd.Process.Kill()
+		return nil, xerrors.Errorf("cannot receive response from handler process: %w", err)
+	}
+	if rsp == nil {
+		return nil, errors.New("no response from handler process")
+	}
+	if rsp.Error != "" {
+		return nil, &Argon2OutOfProcessError{Msg: rsp.Error}
+	}
+	if rsp.Command != req.Command {
+		return nil, fmt.Errorf("unexpected response for command \"%s\"", rsp.Command)
+	}
+
+	return rsp, nil
+}
+
+func (k *outOfProcessArgon2KDF) Derive(passphrase string, salt []byte, params *KDFCostParams, keyLen uint32) ([]byte, error) {
+	rsp, err := k.sendRequest(&argon2OutOfProcessRequest{
+		Command:    argon2OutOfProcessCommandDerive,
+		Passphrase: passphrase,
+		Salt:       salt,
+		Time:       params.Time,
+		MemoryKiB:  params.MemoryKiB,
+		Threads:    params.Threads,
+		KeyLen:     keyLen})
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(rsp.Key)) != keyLen {
+		return nil, errors.New("handler process returned a key with the wrong length")
+	}
+	return rsp.Key, nil
+}
+
+func (k *outOfProcessArgon2KDF) Time(params *KDFCostParams, keyLen uint32) (time.Duration, error) {
+	rsp, err := k.sendRequest(&argon2OutOfProcessRequest{
+		Command:   argon2OutOfProcessCommandTime,
+		Time:      params.Time,
+		MemoryKiB: params.MemoryKiB,
+		Threads:   params.Threads,
+		KeyLen:    keyLen})
+	if err != nil {
+		return 0, err
+	}
+	return rsp.Duration, nil
+}
@@ -0,0 +1,244 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+func init() {
+	// Run as an out-of-process argon2 handler when re-executed by the tests
+	// in this file.
+	if len(os.Args) == 2 && os.Args[1] == Argon2OutOfProcessHandlerArg {
+		if err := RunArgon2OutOfProcessRequest(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+}
+
+type argon2OutOfProcessSuite struct{}
+
+var _ = Suite(&argon2OutOfProcessSuite{})
+
+func (s *argon2OutOfProcessSuite) newHandlerCmd() (*exec.Cmd, error) {
+	return exec.Command(os.Args[0], Argon2OutOfProcessHandlerArg), nil
+}
+
+func (s *argon2OutOfProcessSuite) newKDF(maxMemoryKiB uint32) KDF {
+	return NewOutOfProcessArgon2KDF(&OutOfProcessArgon2KDFOptions{
+		NewHandlerCmd: s.newHandlerCmd,
+		MaxMemoryKiB:  maxMemoryKiB,
+		Timeout:       time.Minute})
+}
+
+type testOutOfProcessDeriveData struct {
+	passphrase string
+	salt       []byte
+	params     *KDFCostParams
+	keyLen     uint32
+}
+
+func (s *argon2OutOfProcessSuite) testDerive(c *C, data *testOutOfProcessDeriveData) {
+	kdf := s.newKDF(64 * 1024)
+
+	key, err := kdf.Derive(data.passphrase, data.salt, data.params, data.keyLen)
+	c.Check(err, IsNil)
+
+	expected, err := Argon2iKDF().Derive(data.passphrase, data.salt, data.params, data.keyLen)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, expected)
+}
+
+func (s *argon2OutOfProcessSuite) TestDerive(c *C) {
+	s.testDerive(c, &testOutOfProcessDeriveData{
+		passphrase: "foo",
+		salt:       []byte("0123456789abcdefghijklmnopqrstuv"),
+		params:     &KDFCostParams{Time: 4, MemoryKiB: 32, Threads: 4},
+		keyLen:     32})
+}
+
+func (s *argon2OutOfProcessSuite) TestDeriveDifferentPassphrase(c *C) {
+	s.testDerive(c, &testOutOfProcessDeriveData{
+		passphrase: "bar",
+		salt:       []byte("0123456789abcdefghijklmnopqrstuv"),
+		params:     &KDFCostParams{Time: 4, MemoryKiB: 32, Threads: 4},
+		keyLen:     32})
+}
+
+func (s *argon2OutOfProcessSuite) TestDeriveDifferentParams(c *C) {
+	s.testDerive(c, &testOutOfProcessDeriveData{
+		passphrase: "foo",
+		salt:       []byte("zyxwvutsrqponmlkjihgfedcba987654"),
+		params:     &KDFCostParams{Time: 1, MemoryKiB: 1024, Threads: 1},
+		keyLen:     48})
+}
+
+func (s *argon2OutOfProcessSuite) TestTime(c *C) {
+	kdf := s.newKDF(64 * 1024)
+
+	duration, err := kdf.Time(&KDFCostParams{Time: 4, MemoryKiB: 32, Threads: 4}, 32)
+	c.Check(err, IsNil)
+	c.Check(duration > 0, testutil.IsTrue)
+}
+
+func (s *argon2OutOfProcessSuite) TestConcurrentRequests(c *C) {
+	kdf := s.newKDF(64 * 1024)
+	params := &KDFCostParams{Time: 4, MemoryKiB: 32, Threads: 4}
+
+	var wg sync.WaitGroup
+	keys := make([][]byte, 4)
+	errs := make([]error, 4)
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys[i], errs[i] = kdf.Derive(fmt.Sprintf("passphrase%d", i), []byte("0123456789abcdef"), params, 32)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range keys {
+		c.Check(errs[i], IsNil)
+		expected, err := Argon2iKDF().Derive(fmt.Sprintf("passphrase%d", i), []byte("0123456789abcdef"), params, 32)
+		c.Check(err, IsNil)
+		c.Check(keys[i], DeepEquals, expected)
+	}
+}
+
+func (s *argon2OutOfProcessSuite) TestMemoryLimit(c *C) {
+	kdf := NewOutOfProcessArgon2KDF(&OutOfProcessArgon2KDFOptions{
+		NewHandlerCmd: func() (*exec.Cmd, error) {
+			c.Error("unexpected handler process")
+			return s.newHandlerCmd()
+		},
+		MaxMemoryKiB: 1024})
+
+	_, err := kdf.Derive("foo", nil, &KDFCostParams{Time: 4, MemoryKiB: 2048, Threads: 4}, 32)
+	c.Check(err, ErrorMatches, "memory cost 2048 KiB exceeds the limit of 1024 KiB")
+}
+
+func (s *argon2OutOfProcessSuite) TestHandlerError(c *C) {
+	kdf := s.newKDF(64 * 1024)
+
+	_, err := kdf.Derive("foo", nil, &KDFCostParams{Time: 4, MemoryKiB: 32, Threads: 0}, 32)
+	c.Check(err, ErrorMatches, "error from argon2 handler process: invalid number of threads")
+	c.Check(err, testutil.ConvertibleTo, &Argon2OutOfProcessError{})
+}
+
+func (s *argon2OutOfProcessSuite) TestHandlerFailsToStart(c *C) {
+	kdf := NewOutOfProcessArgon2KDF(&OutOfProcessArgon2KDFOptions{
+		NewHandlerCmd: func() (*exec.Cmd, error) {
+			return exec.Command("/bin/false"), nil
+		}})
+
+	_, err := kdf.Derive("foo", nil, &KDFCostParams{Time: 4, MemoryKiB: 32, Threads: 4}, 32)
+	c.Check(err, ErrorMatches, "cannot receive handshake from handler process: EOF")
+}
+
+func (s *argon2OutOfProcessSuite) TestHandlerWrongProtocolVersion(c *C) {
+	kdf := NewOutOfProcessArgon2KDF(&OutOfProcessArgon2KDFOptions{
+		NewHandlerCmd: func() (*exec.Cmd, error) {
+			return exec.Command("/bin/sh", "-c", `echo '{"version":2}'; cat > /dev/null`), nil
+		}})
+
+	_, err := kdf.Derive("foo", nil, &KDFCostParams{Time: 4, MemoryKiB: 32, Threads: 4}, 32)
+	c.Check(err, ErrorMatches, "unexpected handler process protocol version 2")
+}
+
+func (s *argon2OutOfProcessSuite) TestHandlerTimeout(c *C) {
+	kdf := NewOutOfProcessArgon2KDF(&OutOfProcessArgon2KDFOptions{
+		NewHandlerCmd: func() (*exec.Cmd, error) {
+			return exec.Command("/bin/sh", "-c", `echo '{"version":1}'; exec sleep 60`), nil
+		},
+		Timeout: 100 * time.Millisecond})
+
+	_, err := kdf.Derive("foo", nil, &KDFCostParams{Time: 4, MemoryKiB: 32, Threads: 4}, 32)
+	c.Check(err, ErrorMatches, "cannot receive response from handler process: EOF")
+}
+
+func (s *argon2OutOfProcessSuite) TestRunArgon2OutOfProcessRequest(c *C) {
+	in := bytes.NewReader([]byte(`{"command":"derive","passphrase":"foo","salt":"MDEyMzQ1Njc4OWFiY2RlZg==","time":4,"memory":32,"threads":4,"keylen":32,"max-memory":1024}`))
+	out := new(bytes.Buffer)
+	c.Check(RunArgon2OutOfProcessRequest(in, out), IsNil)
+
+	dec := json.NewDecoder(out)
+
+	var handshake map[string]interface{}
+	c.Check(dec.Decode(&handshake), IsNil)
+	c.Check(handshake, DeepEquals, map[string]interface{}{"version": float64(1)})
+
+	var rsp struct {
+		Command string `json:"command"`
+		Key     []byte `json:"key"`
+	}
+	c.Check(dec.Decode(&rsp), IsNil)
+	c.Check(rsp.Command, Equals, "derive")
+
+	expected, err := Argon2iKDF().Derive("foo", []byte("0123456789abcdef"), &KDFCostParams{Time: 4, MemoryKiB: 32, Threads: 4}, 32)
+	c.Check(err, IsNil)
+	c.Check(rsp.Key, DeepEquals, expected)
+}
+
+func (s *argon2OutOfProcessSuite) TestRunArgon2OutOfProcessRequestExceedsMemoryLimit(c *C) {
+	in := bytes.NewReader([]byte(`{"command":"time","time":4,"memory":2048,"threads":4,"keylen":32,"max-memory":1024}`))
+	out := new(bytes.Buffer)
+	c.Check(RunArgon2OutOfProcessRequest(in, out), IsNil)
+
+	dec := json.NewDecoder(out)
+
+	var handshake map[string]interface{}
+	c.Check(dec.Decode(&handshake), IsNil)
+
+	var rsp map[string]interface{}
+	c.Check(dec.Decode(&rsp), IsNil)
+	c.Check(rsp, DeepEquals, map[string]interface{}{
+		"command": "time",
+		"error":   "memory cost 2048 KiB exceeds the limit of 1024 KiB"})
+}
+
+func (s *argon2OutOfProcessSuite) TestRunArgon2OutOfProcessRequestInvalidCommand(c *C) {
+	in := bytes.NewReader([]byte(`{"command":"foo","time":4,"memory":32,"threads":4,"keylen":32,"max-memory":1024}`))
+	out := new(bytes.Buffer)
+	c.Check(RunArgon2OutOfProcessRequest(in, out), IsNil)
+
+	dec := json.NewDecoder(out)
+
+	var handshake map[string]interface{}
+	c.Check(dec.Decode(&handshake), IsNil)
+
+	var rsp map[string]interface{}
+	c.Check(dec.Decode(&rsp), IsNil)
+	c.Check(rsp, DeepEquals, map[string]interface{}{
+		"command": "foo",
+		"error":   "invalid command \"foo\""})
+}
@@ -201,6 +201,102 @@ func (s *argon2Suite) TestDeriveCostParamsForceThreads(c *C) {
 	s.checkParams(c, &opts, 1, params)
 }
 
+func (s *argon2Suite) TestDeriveCostParamsMemoryLimits(c *C) {
+	restore := MockArgon2GetMemoryLimits(func(scale float64) (*argon2.MemoryLimits, error) {
+		c.Check(scale, Equals, float64(0.25))
+		return &argon2.MemoryLimits{
+			TotalRAMKiB:        512 * 1024,
+			AvailableRAMKiB:    384 * 1024,
+			CgroupLimitKiB:     256 * 1024,
+			CgroupAvailableKiB: 192 * 1024,
+			Scale:              0.25,
+			MaxMemoryCostKiB:   48 * 1024}, nil
+	})
+	defer restore()
+
+	var kdf testutil.MockKDF
+
+	var limits *KDFMemoryLimits
+	opts := KDFOptions{
+		MemoryLimitScale: 0.25,
+		MemoryLimitsCallback: func(l *KDFMemoryLimits) {
+			limits = l
+		}}
+	params, err := opts.DeriveCostParams(48, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(params.MemoryKiB, Equals, uint32(48*1024))
+
+	c.Check(limits, DeepEquals, &KDFMemoryLimits{
+		TotalRAMKiB:        512 * 1024,
+		AvailableRAMKiB:    384 * 1024,
+		CgroupLimitKiB:     256 * 1024,
+		CgroupAvailableKiB: 192 * 1024,
+		Scale:              0.25,
+		MaxMemoryCostKiB:   48 * 1024})
+}
+
+func (s *argon2Suite) TestDeriveCostParamsMemoryLimitsReportsMemoryKiB(c *C) {
+	restore := MockArgon2GetMemoryLimits(func(scale float64) (*argon2.MemoryLimits, error) {
+		return &argon2.MemoryLimits{
+			TotalRAMKiB:      4 * 1024 * 1024,
+			AvailableRAMKiB:  4 * 1024 * 1024,
+			Scale:            argon2.DefaultMemoryLimitScale,
+			MaxMemoryCostKiB: 2 * 1024 * 1024}, nil
+	})
+	defer restore()
+
+	var kdf testutil.MockKDF
+
+	var limits *KDFMemoryLimits
+	opts := KDFOptions{
+		MemoryKiB: 64 * 1024,
+		MemoryLimitsCallback: func(l *KDFMemoryLimits) {
+			limits = l
+		}}
+	_, err := opts.DeriveCostParams(48, &kdf)
+	c.Assert(err, IsNil)
+
+	c.Assert(limits, NotNil)
+	c.Check(limits.MaxMemoryCostKiB, Equals, uint32(64*1024))
+}
+
+func (s *argon2Suite) TestDeriveCostParamsInsufficientMemory(c *C) {
+	restore := MockArgon2GetMemoryLimits(func(scale float64) (*argon2.MemoryLimits, error) {
+		return &argon2.MemoryLimits{
+			TotalRAMKiB:      64 * 1024,
+			AvailableRAMKiB:  32 * 1024,
+			Scale:            argon2.DefaultMemoryLimitScale,
+			MaxMemoryCostKiB: 16 * 1024}, nil
+	})
+	defer restore()
+
+	var kdf testutil.MockKDF
+
+	var limits *KDFMemoryLimits
+	opts := KDFOptions{
+		MemoryLimitsCallback: func(l *KDFMemoryLimits) {
+			limits = l
+		}}
+	params, err := opts.DeriveCostParams(48, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(params.MemoryKiB, Equals, uint32(32*1024))
+
+	c.Check(limits, DeepEquals, &KDFMemoryLimits{
+		TotalRAMKiB:        64 * 1024,
+		AvailableRAMKiB:    32 * 1024,
+		Scale:              argon2.DefaultMemoryLimitScale,
+		MaxMemoryCostKiB:   32 * 1024,
+		InsufficientMemory: true})
+}
+
+func (s *argon2Suite) TestDeriveCostParamsInvalidMemoryLimitScale(c *C) {
+	var kdf testutil.MockKDF
+
+	opts := KDFOptions{MemoryLimitScale: 2}
+	_, err := opts.DeriveCostParams(48, &kdf)
+	c.Check(err, ErrorMatches, "cannot determine memory limits: invalid memory limit scale")
+}
+
 type argon2SuiteExpensive struct{}
 
 func (s *argon2SuiteExpensive) SetUpSuite(c *C) {
@@ -0,0 +1,274 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+)
+
+var bootIdentityHMACKDFLabel = []byte("BOOT-IDENTITY-HMAC")
+
+// BootIdentity describes the identity of an operating system that can be
+// authorized to access the data protected by a KeyData, as a set of named
+// claims. Examples of claims are the ID and VERSION_ID fields from
+// os-release, or an image ID.
+type BootIdentity interface {
+	// Claims returns the claims that make up this identity. Claim
+	// names must not be empty.
+	Claims() (map[string]string, error)
+}
+
+// BootIdentityClaims is a BootIdentity that consists of a fixed set of
+// claims.
+type BootIdentityClaims map[string]string
+
+// Claims implements BootIdentity.Claims.
+func (c BootIdentityClaims) Claims() (map[string]string, error) {
+	return c, nil
+}
+
+// snapModelBootIdentity is a BootIdentity for a snap device model.
+type snapModelBootIdentity struct {
+	model SnapModel
+}
+
+func (i *snapModelBootIdentity) Claims() (map[string]string, error) {
+	return map[string]string{
+		"snap-model:series":      i.model.Series(),
+		"snap-model:brand-id":    i.model.BrandID(),
+		"snap-model:model":       i.model.Model(),
+		"snap-model:classic":     strconv.FormatBool(i.model.Classic()),
+		"snap-model:grade":       string(i.model.Grade()),
+		"snap-model:sign-key-id": i.model.SignKeyID()}, nil
+}
+
+// SnapModelBootIdentity returns a BootIdentity for the supplied snap device
+// model. When checked with KeyData.IsBootIdentityAuthorized, the model is
+// considered to be authorized if it has been authorized either with
+// KeyData.SetAuthorizedBootIdentities or with KeyData.SetAuthorizedSnapModels.
+func SnapModelBootIdentity(model SnapModel) BootIdentity {
+	return &snapModelBootIdentity{model: model}
+}
+
+// ReadOSReleaseBootIdentity returns a BootIdentity containing the specified
+// fields from the os-release file at the supplied path. If no fields are
+// specified, the ID and VERSION_ID fields are used. Each claim is named
+// "os-release:<field>". A field that is missing from the file results in a
+// claim with an empty value, so that its absence is still bound to the
+// identity.
+func ReadOSReleaseBootIdentity(path string, fields ...string) (BootIdentityClaims, error) {
+	if len(fields) == 0 {
+		fields = []string{"ID", "VERSION_ID"}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values, err := parseOSRelease(f)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse %s: %w", path, err)
+	}
+
+	claims := make(BootIdentityClaims)
+	for _, field := range fields {
+		claims["os-release:"+field] = values[field]
+	}
+	return claims, nil
+}
+
+// parseOSRelease parses the os-release format, which consists of
+// newline separated KEY=VALUE assignments where values may be quoted.
+func parseOSRelease(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		value := fields[1]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				if v, err := strconv.Unquote(value); err == nil {
+					value = v
+				} else {
+					value = value[1 : len(value)-1]
+				}
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		values[fields[0]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func computeBootIdentityHMAC(alg crypto.Hash, key []byte, id BootIdentity) (snapModelHMAC, error) {
+	claims, err := id.Claims()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain claims: %w", err)
+	}
+
+	names := make([]string, 0, len(claims))
+	for name := range claims {
+		if name == "" {
+			return nil, errors.New("empty claim name")
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := hmac.New(func() hash.Hash { return alg.New() }, key)
+	for _, name := range names {
+		value := claims[name]
+		binary.Write(h, binary.LittleEndian, uint32(len(name)))
+		io.WriteString(h, name)
+		binary.Write(h, binary.LittleEndian, uint32(len(value)))
+		io.WriteString(h, value)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// authorizedBootIdentities defines the boot identities that have been
+// authorized to access the data protected by a key.
+type authorizedBootIdentities struct {
+	Alg   hashAlg           `json:"alg"`   // Digest algorithm used for the HMACs and to derive the HMAC key
+	HMACs snapModelHMACList `json:"hmacs"` // the list of HMACs of authorized identities
+}
+
+func (d *KeyData) bootIdentityAuthKey(alg hashAlg, auxKey AuxiliaryKey) ([]byte, error) {
+	if !alg.Available() {
+		return nil, errors.New("invalid digest algorithm")
+	}
+
+	r := hkdf.Expand(func() hash.Hash { return alg.New() }, auxKey, bootIdentityHMACKDFLabel)
+	hmacKey := make([]byte, alg.Size())
+	if _, err := io.ReadFull(r, hmacKey); err != nil {
+		return nil, err
+	}
+	return hmacKey, nil
+}
+
+// IsBootIdentityAuthorized indicates whether the supplied boot identity is
+// trusted to access the data on the encrypted volume protected by this key
+// data. An identity is authorized if the set of claims it returns matches
+// one of the sets of claims previously supplied to SetAuthorizedBootIdentities
+// exactly.
+//
+// If the supplied identity was created with SnapModelBootIdentity, then it is
+// also authorized if the model was authorized with SetAuthorizedSnapModels.
+//
+// The supplied auxKey is obtained using one of the RecoverKeys* functions.
+func (d *KeyData) IsBootIdentityAuthorized(auxKey AuxiliaryKey, id BootIdentity) (bool, error) {
+	if m, ok := id.(*snapModelBootIdentity); ok {
+		authorized, err := d.IsSnapModelAuthorized(auxKey, m.model)
+		if err != nil {
+			return false, err
+		}
+		if authorized {
+			return true, nil
+		}
+	}
+
+	identities := d.data.AuthorizedBootIdentities
+	if identities == nil {
+		return false, nil
+	}
+
+	hmacKey, err := d.bootIdentityAuthKey(identities.Alg, auxKey)
+	if err != nil {
+		return false, xerrors.Errorf("cannot obtain auth key: %w", err)
+	}
+
+	h, err := computeBootIdentityHMAC(crypto.Hash(identities.Alg), hmacKey, id)
+	if err != nil {
+		return false, xerrors.Errorf("cannot compute HMAC of boot identity: %w", err)
+	}
+
+	return identities.HMACs.contains(h), nil
+}
+
+// SetAuthorizedBootIdentities marks the supplied boot identities as trusted to
+// access the data on the encrypted volume protected by this key data. This
+// function replaces all previously trusted boot identities, but does not affect
+// snap models authorized with SetAuthorizedSnapModels.
+//
+// This makes changes to the key data, which will need to persisted afterwards
+// using WriteAtomic.
+//
+// The supplied auxKey is obtained using one of the RecoverKeys* functions. If
+// the supplied auxKey is incorrect, then an error will be returned.
+func (d *KeyData) SetAuthorizedBootIdentities(auxKey AuxiliaryKey, ids ...BootIdentity) error {
+	if err := d.checkAuxKey(auxKey); err != nil {
+		return err
+	}
+
+	// Use the same digest algorithm as the snap model HMACs.
+	alg := d.data.AuthorizedSnapModels.alg
+	hmacKey, err := d.bootIdentityAuthKey(alg, auxKey)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain auth key: %w", err)
+	}
+
+	identities := &authorizedBootIdentities{Alg: alg}
+	for _, id := range ids {
+		h, err := computeBootIdentityHMAC(crypto.Hash(alg), hmacKey, id)
+		if err != nil {
+			return xerrors.Errorf("cannot compute HMAC of boot identity: %w", err)
+		}
+		identities.HMACs = append(identities.HMACs, h)
+	}
+
+	d.data.AuthorizedBootIdentities = identities
+
+	if d.data.MetadataMAC != nil {
+		if err := d.UpdateMetadataMAC(auxKey); err != nil {
+			return xerrors.Errorf("cannot update metadata MAC: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type mockBootIdentity struct {
+	claims map[string]string
+	err    error
+}
+
+func (i *mockBootIdentity) Claims() (map[string]string, error) {
+	return i.claims, i.err
+}
+
+type bootIdentitySuite struct {
+	keyDataTestBase
+}
+
+var _ = Suite(&bootIdentitySuite{})
+
+func (s *bootIdentitySuite) newKeyData(c *C) (*KeyData, AuxiliaryKey) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	return keyData, auxKey
+}
+
+func (s *bootIdentitySuite) TestBootIdentityClaims(c *C) {
+	id := BootIdentityClaims{"os-release:ID": "ubuntu"}
+	claims, err := id.Claims()
+	c.Check(err, IsNil)
+	c.Check(claims, DeepEquals, map[string]string{"os-release:ID": "ubuntu"})
+}
+
+func (s *bootIdentitySuite) TestSnapModelBootIdentity(c *C) {
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+
+	claims, err := SnapModelBootIdentity(model).Claims()
+	c.Check(err, IsNil)
+	c.Check(claims, DeepEquals, map[string]string{
+		"snap-model:series":      "16",
+		"snap-model:brand-id":    "fake-brand",
+		"snap-model:model":       "fake-model",
+		"snap-model:classic":     "false",
+		"snap-model:grade":       "secured",
+		"snap-model:sign-key-id": "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"})
+}
+
+func (s *bootIdentitySuite) writeOSRelease(c *C, content string) string {
+	path := filepath.Join(c.MkDir(), "os-release")
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+	return path
+}
+
+func (s *bootIdentitySuite) TestReadOSReleaseBootIdentityDefaultFields(c *C) {
+	path := s.writeOSRelease(c, `PRETTY_NAME="Ubuntu 22.04.3 LTS"
+NAME="Ubuntu"
+VERSION_ID="22.04"
+# comment
+ID=ubuntu
+ID_LIKE=debian
+`)
+
+	id, err := ReadOSReleaseBootIdentity(path)
+	c.Assert(err, IsNil)
+	c.Check(id, DeepEquals, BootIdentityClaims{
+		"os-release:ID":         "ubuntu",
+		"os-release:VERSION_ID": "22.04"})
+}
+
+func (s *bootIdentitySuite) TestReadOSReleaseBootIdentityCustomFields(c *C) {
+	path := s.writeOSRelease(c, `ID=ubuntu
+VERSION_ID='22.04'
+IMAGE_ID="ubuntu-core"
+`)
+
+	id, err := ReadOSReleaseBootIdentity(path, "ID", "IMAGE_ID", "IMAGE_VERSION")
+	c.Assert(err, IsNil)
+	c.Check(id, DeepEquals, BootIdentityClaims{
+		"os-release:ID":            "ubuntu",
+		"os-release:IMAGE_ID":      "ubuntu-core",
+		"os-release:IMAGE_VERSION": ""})
+}
+
+func (s *bootIdentitySuite) TestReadOSReleaseBootIdentityInvalid(c *C) {
+	path := s.writeOSRelease(c, "ID=ubuntu\nfoo\n")
+
+	_, err := ReadOSReleaseBootIdentity(path)
+	c.Check(err, ErrorMatches, `cannot parse .*/os-release: invalid line "foo"`)
+}
+
+func (s *bootIdentitySuite) TestReadOSReleaseBootIdentityMissingFile(c *C) {
+	_, err := ReadOSReleaseBootIdentity(filepath.Join(c.MkDir(), "os-release"))
+	c.Check(err, ErrorMatches, `open .*/os-release: no such file or directory`)
+}
+
+func (s *bootIdentitySuite) TestBootIdentityAuthorized(c *C) {
+	keyData, auxKey := s.newKeyData(c)
+
+	ids := []BootIdentity{
+		BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "22.04"},
+		BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "23.10"}}
+	c.Check(keyData.SetAuthorizedBootIdentities(auxKey, ids...), IsNil)
+
+	for _, id := range ids {
+		authorized, err := keyData.IsBootIdentityAuthorized(auxKey, id)
+		c.Check(err, IsNil)
+		c.Check(authorized, testutil.IsTrue)
+	}
+}
+
+func (s *bootIdentitySuite) TestBootIdentityNotAuthorized(c *C) {
+	keyData, auxKey := s.newKeyData(c)
+
+	c.Check(keyData.SetAuthorizedBootIdentities(auxKey,
+		BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "22.04"}), IsNil)
+
+	for _, id := range []BootIdentity{
+		BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "23.10"},
+		BootIdentityClaims{"os-release:ID": "ubuntu"},
+		BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "22.04", "os-release:IMAGE_ID": ""},
+		// Check that claims can't be shifted between names and values.
+		BootIdentityClaims{"os-release:IDu": "buntu", "os-release:VERSION_ID": "22.04"},
+	} {
+		authorized, err := keyData.IsBootIdentityAuthorized(auxKey, id)
+		c.Check(err, IsNil)
+		c.Check(authorized, testutil.IsFalse)
+	}
+}
+
+func (s *bootIdentitySuite) TestBootIdentityNoneAuthorized(c *C) {
+	keyData, auxKey := s.newKeyData(c)
+
+	authorized, err := keyData.IsBootIdentityAuthorized(auxKey, BootIdentityClaims{"os-release:ID": "ubuntu"})
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsFalse)
+}
+
+func (s *bootIdentitySuite) TestSnapModelBootIdentityAuthorizedAsSnapModel(c *C) {
+	keyData, auxKey := s.newKeyData(c)
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "other-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, models[0]), IsNil)
+	c.Check(keyData.SetAuthorizedBootIdentities(auxKey, SnapModelBootIdentity(models[1])), IsNil)
+
+	for _, model := range models {
+		authorized, err := keyData.IsBootIdentityAuthorized(auxKey, SnapModelBootIdentity(model))
+		c.Check(err, IsNil)
+		c.Check(authorized, testutil.IsTrue)
+	}
+
+	// A model authorized as a boot identity isn't authorized as a snap model.
+	authorized, err := keyData.IsSnapModelAuthorized(auxKey, models[1])
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsFalse)
+}
+
+func (s *bootIdentitySuite) TestSetAuthorizedBootIdentitiesWithWrongKey(c *C) {
+	keyData, _ := s.newKeyData(c)
+
+	c.Check(keyData.SetAuthorizedBootIdentities(make(AuxiliaryKey, 32), BootIdentityClaims{"os-release:ID": "ubuntu"}), ErrorMatches, "incorrect key supplied")
+}
+
+func (s *bootIdentitySuite) TestSetAuthorizedBootIdentitiesEmptyClaimName(c *C) {
+	keyData, auxKey := s.newKeyData(c)
+
+	c.Check(keyData.SetAuthorizedBootIdentities(auxKey, BootIdentityClaims{"": "ubuntu"}), ErrorMatches,
+		"cannot compute HMAC of boot identity: empty claim name")
+}
+
+func (s *bootIdentitySuite) TestSetAuthorizedBootIdentitiesClaimsError(c *C) {
+	keyData, auxKey := s.newKeyData(c)
+
+	c.Check(keyData.SetAuthorizedBootIdentities(auxKey, &mockBootIdentity{err: errors.New("some error")}), ErrorMatches,
+		"cannot compute HMAC of boot identity: cannot obtain claims: some error")
+}
+
+func (s *bootIdentitySuite) TestSetAuthorizedBootIdentitiesUpdatesMetadataMAC(c *C) {
+	keyData, auxKey := s.newKeyData(c)
+
+	c.Check(keyData.SetAuthorizedBootIdentities(auxKey, BootIdentityClaims{"os-release:ID": "ubuntu"}), IsNil)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.NumAuthorizedBootIdentities, Equals, 1)
+}
+
+func (s *bootIdentitySuite) TestBootIdentitiesPersisted(c *C) {
+	keyData, auxKey := s.newKeyData(c)
+
+	id := BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "22.04"}
+	c.Check(keyData.SetAuthorizedBootIdentities(auxKey, id), IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err := ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+
+	authorized, err := keyData.IsBootIdentityAuthorized(auxKey, id)
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsTrue)
+}
@@ -35,6 +35,7 @@ import (
 	"github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/luksview"
+	"github.com/snapcore/secboot/internal/secmem"
 )
 
 var (
@@ -43,14 +44,17 @@ var (
 	// required features.
 	ErrMissingCryptsetupFeature = luks2.ErrMissingCryptsetupFeature
 
-	luks2Activate        = luks2.Activate
-	luks2AddKey          = luks2.AddKey
-	luks2Deactivate      = luks2.Deactivate
-	luks2Format          = luks2.Format
-	luks2ImportToken     = luks2.ImportToken
-	luks2KillSlot        = luks2.KillSlot
-	luks2RemoveToken     = luks2.RemoveToken
-	luks2SetSlotPriority = luks2.SetSlotPriority
+	luks2Activate               = luks2.Activate
+	luks2AddKey                 = luks2.AddKey
+	luks2CheckKey               = luks2.CheckKey
+	luks2Deactivate             = luks2.Deactivate
+	luks2DetectActivateFeatures = luks2.DetectActivateFeatures
+	luks2Format                 = luks2.Format
+	luks2ImportToken            = luks2.ImportToken
+	luks2KillSlot               = luks2.KillSlot
+	luks2ReadHeader             = luks2.ReadHeader
+	luks2RemoveToken            = luks2.RemoveToken
+	luks2SetSlotPriority        = luks2.SetSlotPriority
 
 	newLUKSView = luksview.NewView
 
@@ -121,19 +125,27 @@ func (e *activateWithKeyDataError) Unwrap() error {
 
 type keyCandidate struct {
 	*KeyData
-	slot int
-	err  error
+	slot      int
+	tokenName string // the name of the LUKS2 token this was read from, if any
+	err       error
 }
 
 type activateWithKeyDataState struct {
 	volumeName       string
 	sourceDevicePath string
+	volumeUUID       string
 	model            SnapModel
+	bootIdentity     BootIdentity
 	keyringPrefix    string
+	activateOptions  *luks2.ActivateOptions
 
 	authRequestor   AuthRequestor
 	kdf             KDF
 	passphraseTries int
+	kdfUpgrade      *KDFUpgradeOptions
+	rootKeyCache    *RootKeyCache
+
+	events *activationEventEmitter
 
 	keys []*keyCandidate
 }
@@ -148,9 +160,45 @@ func (s *activateWithKeyDataState) errors() (out []*activateWithKeyDataError) {
 	return out
 }
 
-func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(key DiskUnlockKey, slot int, keyData *KeyData, auxKey AuxiliaryKey) error {
-	if s.model != SkipSnapModelCheck {
+// headerPath returns the path of the LUKS2 header for the volume being
+// activated, which is the source device unless a detached header is used.
+func (s *activateWithKeyDataState) headerPath() string {
+	if s.activateOptions != nil && s.activateOptions.HeaderPath != "" {
+		return s.activateOptions.HeaderPath
+	}
+	return s.sourceDevicePath
+}
+
+// moveKeysToSecureBuffers moves the supplied keys into secure buffers, wiping
+// the originals. The caller must free the returned buffers.
+func moveKeysToSecureBuffers(key DiskUnlockKey, auxKey AuxiliaryKey) (keyBuf, auxKeyBuf *secmem.Buffer, err error) {
+	keyBuf, err = secmem.Move(key)
+	if err != nil {
+		secmem.Wipe(auxKey)
+		return nil, nil, xerrors.Errorf("cannot allocate buffer for key: %w", err)
+	}
+	auxKeyBuf, err = secmem.Move(auxKey)
+	if err != nil {
+		keyBuf.Free()
+		return nil, nil, xerrors.Errorf("cannot allocate buffer for auxiliary key: %w", err)
+	}
+	return keyBuf, auxKeyBuf, nil
+}
+
+func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(keyBuf *secmem.Buffer, slot int, keyData *KeyData, auxKeyBuf *secmem.Buffer) error {
+	key := keyBuf.Bytes()
+	auxKey := auxKeyBuf.Bytes()
+
+	switch err := keyData.VerifyMetadataMAC(auxKey); {
+	case err == ErrNoMetadataMAC:
+		// Key data created before metadata MACs were introduced.
+	case err != nil:
+		return xerrors.Errorf("cannot verify key data metadata: %w", err)
+	}
+
+	if s.model != nil && s.model != SkipSnapModelCheck {
 		authorized, err := keyData.IsSnapModelAuthorized(auxKey, s.model)
+		s.emitAuthorization(ActivationEventSnapModelAuthorization, keyData, authorized, err)
 		switch {
 		case err != nil:
 			return xerrors.Errorf("cannot check if snap model is authorized: %w", err)
@@ -159,40 +207,182 @@ func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(key DiskUnlockKey
 		}
 	}
 
-	if err := luks2Activate(s.volumeName, s.sourceDevicePath, key, slot); err != nil {
-		return xerrors.Errorf("cannot activate volume: %w", err)
+	if s.bootIdentity != nil {
+		authorized, err := keyData.IsBootIdentityAuthorized(auxKey, s.bootIdentity)
+		s.emitAuthorization(ActivationEventBootIdentityAuthorization, keyData, authorized, err)
+		switch {
+		case err != nil:
+			return xerrors.Errorf("cannot check if boot identity is authorized: %w", err)
+		case !authorized:
+			return errors.New("boot identity is not authorized")
+		}
 	}
 
-	if err := keyring.AddKeyToUserKeyring(key, s.sourceDevicePath, keyringPurposeDiskUnlock, s.keyringPrefix); err != nil {
-		fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+	rootKey := key
+	if keyData.DerivesVolumeKeys() {
+		if s.volumeUUID == "" {
+			return errors.New("cannot determine the UUID of the LUKS2 container")
+		}
+		k, err := keyData.DeriveVolumeUnlockKey(rootKey, s.volumeUUID)
+		if err != nil {
+			return xerrors.Errorf("cannot derive volume key: %w", err)
+		}
+		volumeKeyBuf, err := secmem.Move(k)
+		if err != nil {
+			return xerrors.Errorf("cannot allocate buffer for volume key: %w", err)
+		}
+		defer volumeKeyBuf.Free()
+		key = volumeKeyBuf.Bytes()
 	}
 
-	if err := keyring.AddKeyToUserKeyring(auxKey, s.sourceDevicePath, keyringPurposeAuxiliary, s.keyringPrefix); err != nil {
-		fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+	if err := luks2Activate(s.volumeName, s.sourceDevicePath, key, slot, s.activateOptions); err != nil {
+		return xerrors.Errorf("cannot activate volume: %w", err)
 	}
 
+	if keyData.DerivesVolumeKeys() {
+		if err := s.rootKeyCache.add(keyData, rootKey, auxKey); err != nil {
+			fmt.Fprintf(osStderr, "secboot: cannot cache root key: %v\n", err)
+		}
+	}
+
+	volumeIDs := keyringVolumeIDs(s.sourceDevicePath, s.volumeUUID)
+	addKeyToUserKeyring(s.events, key, volumeIDs, keyringPurposeDiskUnlock, s.keyringPrefix)
+	addKeyToUserKeyring(s.events, auxKey, volumeIDs, keyringPurposeAuxiliary, s.keyringPrefix)
+
 	return nil
 }
 
+func (s *activateWithKeyDataState) emitAuthorization(eventType ActivationEventType, keyData *KeyData, authorized bool, err error) {
+	result := ActivationResultUnauthorized
+	if authorized {
+		result = ActivationResultAuthorized
+	}
+	s.events.emit(&ActivationEvent{
+		Type:    eventType,
+		KeyData: keyData.ReadableName(),
+		Result:  result,
+		Error:   activationError(err)})
+}
+
+// tryKeyData runs the supplied function to attempt activation with the
+// specified key, emitting events before and after the attempt.
+func (s *activateWithKeyDataState) tryKeyData(k *keyCandidate, fn func() error) error {
+	s.events.emit(&ActivationEvent{
+		Type:    ActivationEventKeyDataAttemptStart,
+		KeyData: k.ReadableName(),
+		Token:   k.tokenName})
+
+	err := fn()
+
+	s.events.emit(&ActivationEvent{
+		Type:          ActivationEventKeyDataAttemptEnd,
+		KeyData:       k.ReadableName(),
+		Token:         k.tokenName,
+		Result:        activationResult(err),
+		PlatformError: activationPlatformErrorType(err),
+		Error:         activationError(err)})
+	return err
+}
+
 func (s *activateWithKeyDataState) tryKeyDataAuthModeNone(k *KeyData, slot int) error {
 	key, auxKey, err := k.RecoverKeys()
 	if err != nil {
 		return xerrors.Errorf("cannot recover key: %w", err)
 	}
 
-	return s.tryActivateWithRecoveredKey(key, slot, k, auxKey)
+	keyBuf, auxKeyBuf, err := moveKeysToSecureBuffers(key, auxKey)
+	if err != nil {
+		return err
+	}
+	defer keyBuf.Free()
+	defer auxKeyBuf.Free()
+
+	return s.tryActivateWithRecoveredKey(keyBuf, slot, k, auxKeyBuf)
 }
 
-func (s *activateWithKeyDataState) tryKeyDataAuthModePassphrase(k *KeyData, slot int, passphrase string) error {
+func (s *activateWithKeyDataState) tryKeyDataAuthModePassphrase(k *keyCandidate, passphrase string) error {
 	key, auxKey, err := k.RecoverKeysWithPassphrase(passphrase, s.kdf)
 	if err != nil {
 		return xerrors.Errorf("cannot recover key: %w", err)
 	}
 
-	return s.tryActivateWithRecoveredKey(key, slot, k, auxKey)
+	keyBuf, auxKeyBuf, err := moveKeysToSecureBuffers(key, auxKey)
+	if err != nil {
+		return err
+	}
+	defer keyBuf.Free()
+	defer auxKeyBuf.Free()
+
+	if err := s.tryActivateWithRecoveredKey(keyBuf, k.slot, k.KeyData, auxKeyBuf); err != nil {
+		return err
+	}
+
+	if s.kdfUpgrade != nil {
+		if err := s.upgradeKDFCostParams(k, passphrase, auxKeyBuf.Bytes()); err != nil {
+			fmt.Fprintf(osStderr, "secboot: cannot upgrade KDF cost parameters for %s: %v\n", k.ReadableName(), err)
+		}
+	}
+
+	return nil
+}
+
+func (s *activateWithKeyDataState) upgradeKDFCostParams(k *keyCandidate, passphrase string, auxKey AuxiliaryKey) error {
+	if k.tokenName == "" && s.kdfUpgrade.NewExternalKeyDataWriter == nil {
+		// There's no way to persist the changes.
+		return nil
+	}
+
+	upgraded, err := k.upgradeKDFCostParams(passphrase, s.kdfUpgrade.KDFOptions, s.kdf, auxKey)
+	switch {
+	case err != nil:
+		return err
+	case !upgraded:
+		return nil
+	}
+
+	var w KeyDataWriter
+	if k.tokenName != "" {
+		w, err = NewLUKS2KeyDataWriter(s.headerPath(), k.tokenName)
+	} else {
+		w, err = s.kdfUpgrade.NewExternalKeyDataWriter(k.KeyData)
+	}
+	if err != nil {
+		return xerrors.Errorf("cannot create writer: %w", err)
+	}
+
+	if err := k.WriteAtomic(w); err != nil {
+		return xerrors.Errorf("cannot write key data: %w", err)
+	}
+
+	return nil
 }
 
 func (s *activateWithKeyDataState) run() (success bool, err error) {
+	// Try keys with a root key that was cached by a previous activation
+	// first. These don't require any authentication.
+	for _, k := range s.keys {
+		if !k.DerivesVolumeKeys() {
+			continue
+		}
+
+		rootKey, auxKey, ok := s.rootKeyCache.get(k.KeyData)
+		if !ok {
+			continue
+		}
+
+		err := s.tryKeyData(k, func() error {
+			return s.tryActivateWithRecoveredKey(rootKey, k.slot, k.KeyData, auxKey)
+		})
+		rootKey.Free()
+		auxKey.Free()
+		if err != nil {
+			// Fall back to recovering the key normally.
+			continue
+		}
+
+		return true, nil
+	}
+
 	numPassphraseKeys := 0
 
 	// Try keys that don't require any additional authentication first
@@ -205,7 +395,9 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 			continue
 		}
 
-		if err := s.tryKeyDataAuthModeNone(k.KeyData, k.slot); err != nil {
+		if err := s.tryKeyData(k, func() error {
+			return s.tryKeyDataAuthModeNone(k.KeyData, k.slot)
+		}); err != nil {
 			k.err = err
 			continue
 		}
@@ -229,6 +421,10 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 		// a UEFI+TPM platform with run+recovery and recovery-only protectors for
 		// ubuntu-data).
 		passphrase, err := s.authRequestor.RequestPassphrase(s.volumeName, s.sourceDevicePath)
+		s.events.emit(&ActivationEvent{
+			Type:   ActivationEventPassphraseRequest,
+			Result: activationResult(err),
+			Error:  activationError(err)})
 		if err != nil {
 			passphraseErr = xerrors.Errorf("cannot obtain passphrase: %w", err)
 			continue
@@ -244,7 +440,9 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 				continue
 			}
 
-			if err := s.tryKeyDataAuthModePassphrase(k.KeyData, k.slot, passphrase); err != nil {
+			if err := s.tryKeyData(k, func() error {
+				return s.tryKeyDataAuthModePassphrase(k, passphrase)
+			}); err != nil {
 				if !xerrors.Is(err, ErrInvalidPassphrase) {
 					numPassphraseKeys -= 1
 				}
@@ -260,19 +458,42 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 	return false, passphraseErr
 }
 
-func newActivateWithKeyDataState(volumeName, sourceDevicePath string, keyringPrefix string, model SnapModel, keys []*keyCandidate, authRequestor AuthRequestor, kdf KDF, passphraseTries int) *activateWithKeyDataState {
+func newActivateWithKeyDataState(volumeName, sourceDevicePath, volumeUUID string, keyringPrefix string, activateOptions *luks2.ActivateOptions, model SnapModel, bootIdentity BootIdentity, keys []*keyCandidate, authRequestor AuthRequestor, kdf KDF, passphraseTries int, kdfUpgrade *KDFUpgradeOptions, rootKeyCache *RootKeyCache, events *activationEventEmitter) *activateWithKeyDataState {
 	return &activateWithKeyDataState{
 		volumeName:       volumeName,
 		sourceDevicePath: sourceDevicePath,
+		volumeUUID:       volumeUUID,
 		keyringPrefix:    keyringPrefixOrDefault(keyringPrefix),
+		activateOptions:  activateOptions,
 		model:            model,
+		bootIdentity:     bootIdentity,
 		authRequestor:    authRequestor,
 		kdf:              kdf,
 		passphraseTries:  passphraseTries,
+		kdfUpgrade:       kdfUpgrade,
+		rootKeyCache:     rootKeyCache,
+		events:           events,
 		keys:             keys}
 }
 
-func activateWithRecoveryKey(volumeName, sourceDevicePath string, authRequestor AuthRequestor, tries int, keyringPrefix string) error {
+func addKeyToUserKeyring(events *activationEventEmitter, key []byte, volumeIDs []string, purpose, prefix string) {
+	var err error
+	for _, id := range volumeIDs {
+		if e := keyring.AddKeyToUserKeyring(key, id, purpose, prefix); e != nil {
+			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	events.emit(&ActivationEvent{
+		Type:    ActivationEventKeyringWrite,
+		Purpose: purpose,
+		Result:  activationResult(err),
+		Error:   activationError(err)})
+}
+
+func activateWithRecoveryKey(volumeName, sourceDevicePath, volumeUUID string, authRequestor AuthRequestor, tries int, keyringPrefix string, activateOptions *luks2.ActivateOptions, events *activationEventEmitter) error {
 	if tries == 0 {
 		return errors.New("no recovery key tries permitted")
 	}
@@ -282,21 +503,29 @@ func activateWithRecoveryKey(volumeName, sourceDevicePath string, authRequestor
 	for ; tries > 0; tries-- {
 		lastErr = nil
 
+		var keyBuf *secmem.Buffer
 		key, err := authRequestor.RequestRecoveryKey(volumeName, sourceDevicePath)
 		if err != nil {
 			lastErr = xerrors.Errorf("cannot obtain recovery key: %w", err)
-			continue
-		}
-
-		if err := luks2Activate(volumeName, sourceDevicePath, key[:], luks2.AnySlot); err != nil {
+		} else if keyBuf, err = secmem.Move(key[:]); err != nil {
+			lastErr = xerrors.Errorf("cannot allocate buffer for recovery key: %w", err)
+		} else if err := luks2Activate(volumeName, sourceDevicePath, keyBuf.Bytes(), luks2.AnySlot, activateOptions); err != nil {
 			lastErr = xerrors.Errorf("cannot activate volume: %w", err)
-			continue
 		}
 
-		if err := keyring.AddKeyToUserKeyring(key[:], sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+		events.emit(&ActivationEvent{
+			Type:   ActivationEventRecoveryKeyAttempt,
+			Result: activationResult(lastErr),
+			Error:  activationError(lastErr)})
+		if lastErr != nil {
+			if keyBuf != nil {
+				keyBuf.Free()
+			}
+			continue
 		}
 
+		addKeyToUserKeyring(events, keyBuf.Bytes(), keyringVolumeIDs(sourceDevicePath, volumeUUID), keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix))
+		keyBuf.Free()
 		break
 	}
 
@@ -365,12 +594,127 @@ type ActivateVolumeOptions struct {
 	// The caller of the ActivateVolumeWithKeyData API is responsible
 	// for validating the associated model assertion and snaps.
 	//
-	// Set this to SkipSnapModelCheck to skip the check. It cannot
-	// be left set as nil when calling ActivateVolumeWithKeyData.
+	// Set this to SkipSnapModelCheck to skip the check. It can only
+	// be left set as nil when calling ActivateVolumeWithKeyData if
+	// BootIdentity is set.
 	//
 	// It is ignored by ActivateVolumeWithRecoveryKey, and it is
 	// ok to leave it set as nil in this case.
 	Model SnapModel
+
+	// BootIdentity is the identity of the operating system that will
+	// access the data on the encrypted container. If set, the
+	// ActivateVolumeWithKeyData function will check that this identity
+	// is authorized via the KeyData binding before unlocking the
+	// encrypted container, in addition to any check of Model.
+	//
+	// As with Model, the caller is responsible for validating the
+	// claims that make up the identity.
+	//
+	// It is ignored by ActivateVolumeWithRecoveryKey.
+	BootIdentity BootIdentity
+
+	// RootKeyCache is used to cache the root keys recovered from
+	// KeyData objects with volume key derivation enabled, so that
+	// they can be used to activate subsequent volumes. The caller
+	// owns the cache and should clear it once the volumes that share
+	// a root key have been activated. If this is nil, root keys are
+	// not cached.
+	//
+	// It is ignored by ActivateVolumeWithRecoveryKey.
+	RootKeyCache *RootKeyCache
+
+	// KDFUpgrade enables upgrading the KDF cost parameters of
+	// passphrase protected KeyData objects that are used successfully
+	// for activation by ActivateVolumeWithKeyData. If this is nil,
+	// the KDF cost parameters are not upgraded.
+	//
+	// It is ignored by ActivateVolumeWithRecoveryKey.
+	KDFUpgrade *KDFUpgradeOptions
+
+	// The following options are passed to dm-crypt. If any of them
+	// require a feature that isn't supported by the system's
+	// systemd-cryptsetup or the kernel's dm-crypt target, or if this
+	// can't be determined, ErrMissingCryptsetupFeature is returned
+	// before any credentials are requested.
+
+	// AllowDiscards permits discard (TRIM) requests to be passed
+	// through to the underlying device. Note that this may leak
+	// information about which blocks are in use.
+	AllowDiscards bool
+
+	// ReadOnly creates a read-only mapping for the activated volume.
+	ReadOnly bool
+
+	// SameCPUCrypt performs encryption using the same CPU that the IO
+	// was submitted on. This requires systemd v242 and kernel v4.0
+	// or later.
+	SameCPUCrypt bool
+
+	// NoReadWorkqueue bypasses the dm-crypt workqueue for reads and
+	// processes them synchronously. This requires systemd v248 and
+	// kernel v5.9 or later.
+	NoReadWorkqueue bool
+
+	// NoWriteWorkqueue bypasses the dm-crypt workqueue for writes and
+	// processes them synchronously. This requires systemd v248 and
+	// kernel v5.9 or later.
+	NoWriteWorkqueue bool
+
+	// HeaderPath is the path of a detached LUKS2 header for the volume.
+	// If this is empty, the header is read from the source device.
+	HeaderPath string
+
+	// EventSink receives structured events that describe the progress
+	// of activation, for the purposes of auditing and diagnosing
+	// activation failures. See JSONLinesActivationEventSink and
+	// JournaldActivationEventSink for reference implementations.
+	//
+	// It is ignored by ActivateVolumeWithKey.
+	EventSink ActivationEventSink
+}
+
+func (o *ActivateVolumeOptions) luks2ActivateOptions() *luks2.ActivateOptions {
+	if o == nil {
+		return nil
+	}
+	return &luks2.ActivateOptions{
+		Discard:          o.AllowDiscards,
+		ReadOnly:         o.ReadOnly,
+		SameCPUCrypt:     o.SameCPUCrypt,
+		NoReadWorkqueue:  o.NoReadWorkqueue,
+		NoWriteWorkqueue: o.NoWriteWorkqueue,
+		HeaderPath:       o.HeaderPath}
+}
+
+// validateActivateOptions checks that the dm-crypt options are valid and
+// supported by the system's systemd-cryptsetup binary, so that this is
+// known before requesting any credentials from the user.
+func (o *ActivateVolumeOptions) validateActivateOptions() error {
+	if o == nil {
+		return nil
+	}
+	return o.luks2ActivateOptions().Validate(luks2DetectActivateFeatures())
+}
+
+// KDFUpgradeOptions provides options for upgrading the KDF cost parameters
+// of passphrase protected KeyData objects during activation. When a KeyData
+// is used successfully for activation with a passphrase, the KDF is benchmarked
+// and if the cost parameters used for the passphrase are significantly lower
+// than the benchmarked ones, the KeyData is updated to use the benchmarked ones
+// with the same passphrase (see KeyData.UpgradeKDFCostParams) and is written
+// back. Failure to upgrade does not cause activation to fail.
+type KDFUpgradeOptions struct {
+	// KDFOptions configures the Argon2 KDF settings used to benchmark
+	// the KDF. If this is nil, the defaults are used.
+	KDFOptions *KDFOptions
+
+	// NewExternalKeyDataWriter is used to obtain a KeyDataWriter for
+	// KeyData objects that are supplied to ActivateVolumeWithKeyData
+	// directly. KeyData objects that are read from the container's
+	// metadata area are written back using a LUKS2KeyDataWriter. If
+	// this is nil, externally supplied KeyData objects are not upgraded.
+	NewExternalKeyDataWriter func(k *KeyData) (KeyDataWriter, error)
 }
 
 type activateVolumeWithKeyDataError struct {
@@ -397,7 +741,8 @@ var ErrRecoveryKeyUsed = errors.New("cannot activate with platform protected key
 // sourceDevicePath and create a mapping with the name volumeName, using one of
 // the KeyData objects stored in the container's metadata area to recover the
 // disk unlock key from the platform's secure device. This makes use of
-// systemd-cryptsetup.
+// systemd-cryptsetup. The sourceDevicePath argument may be a device path or
+// any other volume locator accepted by ParseVolumeLocator.
 //
 // External KeyData objects can be supplied via the keys argument, and these
 // will be attempted first.
@@ -411,8 +756,21 @@ var ErrRecoveryKeyUsed = errors.New("cannot activate with platform protected key
 // 0, then no attempts will be made to request and use the fallback recovery key.
 //
 // If either the PassphraseTries or RecoveryKeyTries fields of options are less
-// than zero, an error will be returned. If the Model field of options is nil,
-// an error will be returned.
+// than zero, an error will be returned. If both the Model and BootIdentity
+// fields of options are nil, an error will be returned.
+//
+// Once the keys have been recovered from a KeyData object, its metadata MAC
+// is verified if it has one. A KeyData object that has been modified by
+// something without access to its auxiliary key will not be used for
+// activation.
+//
+// If a KeyData object has volume key derivation enabled (see
+// KeyData.EnableVolumeKeyDerivation), the unlock key for this volume is
+// derived from the recovered root key and the UUID of the LUKS2 container.
+// If ActivateVolumeOptions.RootKeyCache is set, the root key is cached
+// there after a successful activation so that subsequent volumes can be
+// activated with the same KeyData object without recovering it from the
+// platform's secure device again or requesting a passphrase.
 //
 // If the fallback recovery key is used for successfully for activation, an
 // ErrRecoveryKeyUsed error will be returned.
@@ -420,8 +778,8 @@ var ErrRecoveryKeyUsed = errors.New("cannot activate with platform protected key
 // If activation fails, an error will be returned.
 //
 // If activation with one of the KeyData objects succeeds (ie, no error is
-// returned), then the supplied SnapModel is authorized to access the data on
-// this volume.
+// returned), then the supplied SnapModel and BootIdentity are authorized to
+// access the data on this volume.
 func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, authRequestor AuthRequestor, kdf KDF, options *ActivateVolumeOptions, keys ...*KeyData) error {
 	if options.PassphraseTries < 0 {
 		return errors.New("invalid PassphraseTries")
@@ -429,8 +787,8 @@ func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, authRequesto
 	if options.RecoveryKeyTries < 0 {
 		return errors.New("invalid RecoveryKeyTries")
 	}
-	if options.Model == nil {
-		return errors.New("nil Model")
+	if options.Model == nil && options.BootIdentity == nil {
+		return errors.New("nil Model and BootIdentity")
 	}
 
 	if (options.PassphraseTries > 0 || options.RecoveryKeyTries > 0) && authRequestor == nil {
@@ -439,16 +797,40 @@ func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, authRequesto
 	if options.PassphraseTries > 0 && kdf == nil {
 		return errors.New("nil kdf")
 	}
+	if err := options.validateActivateOptions(); err != nil {
+		return err
+	}
+
+	path, err := resolveDevicePath(sourceDevicePath)
+	if err != nil {
+		return xerrors.Errorf("cannot resolve source device path: %w", err)
+	}
+	sourceDevicePath = path
+
+	events := &activationEventEmitter{
+		sink:             options.EventSink,
+		volumeName:       volumeName,
+		sourceDevicePath: sourceDevicePath}
 
 	var candidates []*keyCandidate
 	for _, key := range keys {
 		candidates = append(candidates, &keyCandidate{KeyData: key, slot: luks2.AnySlot})
+		events.emit(&ActivationEvent{Type: ActivationEventKeyDataFound, KeyData: key.ReadableName()})
 	}
 
-	view, err := newLUKSView(sourceDevicePath, luks2.LockModeBlocking)
+	headerPath := sourceDevicePath
+	if options.HeaderPath != "" {
+		headerPath = options.HeaderPath
+	}
+
+	// The UUID of the container is obtained once here and used both for
+	// deriving volume keys and for the description of kernel keys.
+	var volumeUUID string
+	view, err := newLUKSView(headerPath, luks2.LockModeBlocking)
 	if err != nil {
 		fmt.Fprintf(osStderr, "secboot: cannot obtain LUKS2 header view: %v\n", err)
 	} else {
+		volumeUUID = view.UUID()
 		tokens := view.KeyDataTokensByPriority()
 		for _, token := range tokens {
 			if token.Data == nil {
@@ -462,20 +844,22 @@ func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, authRequesto
 			kd, err := ReadKeyData(r)
 			if err != nil {
 				fmt.Fprintf(osStderr, "secboot: cannot read keydata from token %s: %v\n", token.Name(), err)
+				events.emit(&ActivationEvent{Type: ActivationEventKeyDataFound, Token: token.Name(), Error: err.Error()})
 				continue
 			}
 
-			candidates = append(candidates, &keyCandidate{KeyData: kd, slot: token.Keyslots()[0]})
+			candidates = append(candidates, &keyCandidate{KeyData: kd, slot: token.Keyslots()[0], tokenName: token.Name()})
+			events.emit(&ActivationEvent{Type: ActivationEventKeyDataFound, KeyData: kd.ReadableName(), Token: token.Name()})
 		}
 	}
 
-	s := newActivateWithKeyDataState(volumeName, sourceDevicePath, options.KeyringPrefix, options.Model, candidates, authRequestor, kdf, options.PassphraseTries)
+	s := newActivateWithKeyDataState(volumeName, sourceDevicePath, volumeUUID, options.KeyringPrefix, options.luks2ActivateOptions(), options.Model, options.BootIdentity, candidates, authRequestor, kdf, options.PassphraseTries, options.KDFUpgrade, options.RootKeyCache, events)
 	success, err := s.run()
 	switch {
 	case success:
 		return nil
 	default: // failed - try recovery key
-		if rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, authRequestor, options.RecoveryKeyTries, options.KeyringPrefix); rErr != nil {
+		if rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, volumeUUID, authRequestor, options.RecoveryKeyTries, options.KeyringPrefix, options.luks2ActivateOptions(), events); rErr != nil {
 			// failed with recovery key - return errors
 			var kdErrs []error
 			for _, e := range s.errors() {
@@ -493,7 +877,9 @@ func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, authRequesto
 
 // ActivateVolumeWithRecoveryKey attempts to activate the LUKS encrypted volume at
 // sourceDevicePath and create a mapping with the name volumeName, using the fallback
-// recovery key. This makes use of systemd-cryptsetup.
+// recovery key. This makes use of systemd-cryptsetup. The sourceDevicePath
+// argument may be a device path or any other volume locator accepted by
+// ParseVolumeLocator.
 //
 // The recovery key is requested via the supplied AuthRequestor. If an AuthRequestor
 // is not supplied, an error will be returned. The RecoveryKeyTries field of options
@@ -509,15 +895,44 @@ func ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, authRequ
 	if options.RecoveryKeyTries < 0 {
 		return errors.New("invalid RecoveryKeyTries")
 	}
+	if err := options.validateActivateOptions(); err != nil {
+		return err
+	}
+
+	path, err := resolveDevicePath(sourceDevicePath)
+	if err != nil {
+		return xerrors.Errorf("cannot resolve source device path: %w", err)
+	}
+	sourceDevicePath = path
+
+	events := &activationEventEmitter{
+		sink:             options.EventSink,
+		volumeName:       volumeName,
+		sourceDevicePath: sourceDevicePath}
+
+	headerPath := sourceDevicePath
+	if options.HeaderPath != "" {
+		headerPath = options.HeaderPath
+	}
 
-	return activateWithRecoveryKey(volumeName, sourceDevicePath, authRequestor, options.RecoveryKeyTries, options.KeyringPrefix)
+	return activateWithRecoveryKey(volumeName, sourceDevicePath, readVolumeUUID(headerPath, luks2.LockModeBlocking), authRequestor, options.RecoveryKeyTries, options.KeyringPrefix, options.luks2ActivateOptions(), events)
 }
 
 // ActivateVolumeWithKey attempts to activate the LUKS encrypted volume at
 // sourceDevicePath and create a mapping with the name volumeName, using the
-// provided key. This makes use of systemd-cryptsetup.
+// provided key. This makes use of systemd-cryptsetup. The sourceDevicePath
+// argument may be a device path or any other volume locator accepted by
+// ParseVolumeLocator.
 func ActivateVolumeWithKey(volumeName, sourceDevicePath string, key []byte, options *ActivateVolumeOptions) error {
-	return luks2Activate(volumeName, sourceDevicePath, key, luks2.AnySlot)
+	if err := options.validateActivateOptions(); err != nil {
+		return err
+	}
+
+	path, err := resolveDevicePath(sourceDevicePath)
+	if err != nil {
+		return xerrors.Errorf("cannot resolve source device path: %w", err)
+	}
+	return luks2Activate(volumeName, path, key, luks2.AnySlot, options.luks2ActivateOptions())
 }
 
 // DeactivateVolume attempts to deactivate the LUKS encrypted volumeName.
@@ -646,6 +1061,16 @@ func removeOrphanedTokens(devicePath string, view *luksview.View) {
 	}
 }
 
+func firstFreeKeyslot(view *luksview.View) (freeSlot int) {
+	for _, slot := range view.UsedKeyslots() {
+		if slot != freeSlot {
+			break
+		}
+		freeSlot++
+	}
+	return freeSlot
+}
+
 func addLUKS2ContainerKey(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey, options *KDFOptions,
 	newToken func(base *luksview.TokenBase) luks2.Token, priority luks2.SlotPriority) error {
 	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
@@ -659,13 +1084,7 @@ func addLUKS2ContainerKey(devicePath, keyslotName string, existingKey, newKey Di
 
 	removeOrphanedTokens(devicePath, view)
 
-	freeSlot := 0
-	for _, slot := range view.UsedKeyslots() {
-		if slot != freeSlot {
-			break
-		}
-		freeSlot++
-	}
+	freeSlot := firstFreeKeyslot(view)
 
 	if err := luks2AddKey(devicePath, existingKey, newKey, &luks2.AddKeyOptions{KDFOptions: options.luksOpts(), Slot: freeSlot}); err != nil {
 		return xerrors.Errorf("cannot add key: %w", err)
@@ -906,3 +1325,273 @@ func RenameLUKS2ContainerKey(devicePath, oldName, newName string) error {
 
 	return nil
 }
+
+func rotatingRecoveryKeyslotName(keyslotName string) string {
+	return keyslotName + "-rotating"
+}
+
+// isUnreferencedKeyslot indicates whether the specified keyslot is in use
+// without being referenced by any named token.
+func isUnreferencedKeyslot(view *luksview.View, slot int) bool {
+	inUse := false
+	for _, s := range view.UsedKeyslots() {
+		if s == slot {
+			inUse = true
+			break
+		}
+	}
+	if !inUse {
+		return false
+	}
+
+	for _, name := range view.TokenNames() {
+		token, _, _ := view.TokenByName(name)
+		for _, s := range token.Keyslots() {
+			if s == slot {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// completeRecoveryKeyRotation completes a previously interrupted attempt to
+// rotate the recovery key associated with the keyslot with the specified name,
+// by deleting the original keyslot and renaming the token for the new keyslot.
+// The supplied key must unlock the new keyslot, and is used to authorize the
+// deletion of the original keyslot.
+func completeRecoveryKeyRotation(devicePath, keyslotName string, existingKey DiskUnlockKey, oldSlot, oldId, newSlot, newId int) error {
+	if err := luks2KillSlot(devicePath, oldSlot, existingKey); err != nil {
+		return xerrors.Errorf("cannot kill existing slot %d: %w", oldSlot, err)
+	}
+	if err := luks2RemoveToken(devicePath, oldId); err != nil {
+		return xerrors.Errorf("cannot remove existing token %d: %w", oldId, err)
+	}
+
+	token := &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: newSlot,
+			TokenName:    keyslotName}}
+	if err := luks2ImportToken(devicePath, token, &luks2.ImportTokenOptions{Id: newId, Replace: true}); err != nil {
+		return xerrors.Errorf("cannot import new token: %w", err)
+	}
+	return nil
+}
+
+// recoverInterruptedRecoveryKeyRotation completes or rolls back a previously
+// interrupted attempt to rotate the recovery key associated with the keyslot
+// with the specified name. An interrupted rotation is completed if the original
+// keyslot has already been deleted or if the supplied key is the new recovery
+// key, else it is rolled back.
+//
+// The new recovery key can't be used to roll back, because cryptsetup doesn't
+// permit a keyslot to be deleted using a key that only unlocks that keyslot.
+func recoverInterruptedRecoveryKeyRotation(devicePath, keyslotName string, existingKey DiskUnlockKey, view *luksview.View) error {
+	current, currentId, currentExists := view.TokenByName(keyslotName)
+
+	pendingName := rotatingRecoveryKeyslotName(keyslotName)
+	pending, pendingId, pendingExists := view.TokenByName(pendingName)
+	if pendingExists {
+		pendingToken, ok := pending.(*luksview.RecoveryToken)
+		if !ok || pendingToken.Replaces != keyslotName {
+			return errors.New("the name used for the new recovery keyslot is already in use")
+		}
+
+		if !currentExists {
+			// The original keyslot has already been deleted, so the new
+			// recovery key is the only one left. Complete the rotation.
+			token := &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: pendingToken.TokenKeyslot,
+					TokenName:    keyslotName}}
+			if err := luks2ImportToken(devicePath, token, &luks2.ImportTokenOptions{Id: pendingId, Replace: true}); err != nil {
+				return xerrors.Errorf("cannot import new token: %w", err)
+			}
+			return nil
+		}
+
+		if luks2CheckKey(devicePath, pendingToken.TokenKeyslot, existingKey) == nil {
+			// The supplied key is the new recovery key, so complete the
+			// rotation.
+			return completeRecoveryKeyRotation(devicePath, keyslotName, existingKey,
+				current.Keyslots()[0], currentId, pendingToken.TokenKeyslot, pendingId)
+		}
+
+		// The original keyslot still exists, so roll back by deleting
+		// the new keyslot.
+		if err := luks2KillSlot(devicePath, pendingToken.TokenKeyslot, existingKey); err != nil {
+			return xerrors.Errorf("cannot kill new slot %d: %w", pendingToken.TokenKeyslot, err)
+		}
+		if err := luks2RemoveToken(devicePath, pendingId); err != nil {
+			return xerrors.Errorf("cannot remove new token %d: %w", pendingId, err)
+		}
+	}
+
+	if !currentExists {
+		return nil
+	}
+
+	currentToken, ok := current.(*luksview.RecoveryToken)
+	if !ok || currentToken.RotationKeyslot == nil {
+		return nil
+	}
+
+	// If there was no token for the new keyslot, the rotation was interrupted
+	// before it was imported. The new keyslot may have been created already,
+	// in which case it needs to be deleted as long as no other token references
+	// it.
+	slot := *currentToken.RotationKeyslot
+	if !pendingExists && isUnreferencedKeyslot(view, slot) {
+		if luks2CheckKey(devicePath, slot, existingKey) == nil {
+			// The supplied key is the new recovery key, so import the
+			// missing token for the new keyslot and complete the rotation.
+			token := &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: slot,
+					TokenName:    pendingName},
+				Replaces: keyslotName}
+			if err := luks2ImportToken(devicePath, token, nil); err != nil {
+				return xerrors.Errorf("cannot import new token: %w", err)
+			}
+			if err := view.Reread(); err != nil {
+				return xerrors.Errorf("cannot reread LUKS header view: %w", err)
+			}
+			_, pendingId, exists := view.TokenByName(pendingName)
+			if !exists {
+				return errors.New("cannot find token for new keyslot")
+			}
+			return completeRecoveryKeyRotation(devicePath, keyslotName, existingKey,
+				currentToken.TokenKeyslot, currentId, slot, pendingId)
+		}
+
+		if err := luks2KillSlot(devicePath, slot, existingKey); err != nil {
+			return xerrors.Errorf("cannot kill new slot %d: %w", slot, err)
+		}
+	}
+
+	token := &luksview.RecoveryToken{TokenBase: currentToken.TokenBase}
+	if err := luks2ImportToken(devicePath, token, &luks2.ImportTokenOptions{Id: currentId, Replace: true}); err != nil {
+		return xerrors.Errorf("cannot import token: %w", err)
+	}
+
+	return nil
+}
+
+// RotateLUKS2ContainerRecoveryKey replaces the recovery key associated with the
+// recovery keyslot with the specified name on the LUKS2 container at the specified
+// path with the supplied recovery key. The new key is added to a new keyslot
+// before the keyslot containing the old key is deleted, so that the container
+// always has at least one working recovery keyslot.
+//
+// If the specified name is empty, the name "default-recovery" will be used.
+//
+// The recovery key must be generated by a cryptographically strong random
+// number source.
+//
+// The progress of the rotation is recorded in the metadata of the tokens
+// associated with the affected keyslots. If a previous call was interrupted,
+// this function will first complete the interrupted rotation if the keyslot
+// containing the old key has already been deleted or if the supplied existing
+// key is the new recovery key from the interrupted rotation, or roll it back
+// otherwise, before performing the requested rotation.
+//
+// In order to perform this action, an existing key must be supplied. This may be
+// the recovery key that is being replaced.
+func RotateLUKS2ContainerRecoveryKey(devicePath, keyslotName string, existingKey DiskUnlockKey, recoveryKey RecoveryKey, options *KDFOptions) error {
+	if keyslotName == "" {
+		keyslotName = defaultRecoveryKeyslotName
+	}
+
+	if options == nil {
+		options = &KDFOptions{}
+	}
+
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	removeOrphanedTokens(devicePath, view)
+
+	if err := recoverInterruptedRecoveryKeyRotation(devicePath, keyslotName, existingKey, view); err != nil {
+		return xerrors.Errorf("cannot recover from interrupted rotation: %w", err)
+	}
+	if err := view.Reread(); err != nil {
+		return xerrors.Errorf("cannot reread LUKS header view: %w", err)
+	}
+
+	token, id, exists := view.TokenByName(keyslotName)
+	if !exists {
+		return errors.New("no key with the specified name exists")
+	}
+
+	oldToken, ok := token.(*luksview.RecoveryToken)
+	if !ok {
+		return errors.New("named keyslot is not a recovery keyslot")
+	}
+
+	pendingName := rotatingRecoveryKeyslotName(keyslotName)
+	if _, _, exists := view.TokenByName(pendingName); exists {
+		return errors.New("the name used for the new recovery keyslot is already in use")
+	}
+
+	newSlot := firstFreeKeyslot(view)
+
+	// Record the keyslot that the new key is going to be added to, so that
+	// it can be removed if we are interrupted before importing its token.
+	journaledToken := &luksview.RecoveryToken{
+		TokenBase:       oldToken.TokenBase,
+		RotationKeyslot: &newSlot}
+	if err := luks2ImportToken(devicePath, journaledToken, &luks2.ImportTokenOptions{Id: id, Replace: true}); err != nil {
+		return xerrors.Errorf("cannot import token: %w", err)
+	}
+
+	if err := luks2AddKey(devicePath, existingKey, recoveryKey[:], &luks2.AddKeyOptions{KDFOptions: options.luksOpts(), Slot: newSlot}); err != nil {
+		return xerrors.Errorf("cannot add key: %w", err)
+	}
+
+	pendingToken := &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: newSlot,
+			TokenName:    pendingName},
+		Replaces: keyslotName}
+	if err := luks2ImportToken(devicePath, pendingToken, nil); err != nil {
+		return xerrors.Errorf("cannot import new token: %w", err)
+	}
+
+	if err := luks2SetSlotPriority(devicePath, newSlot, luks2.SlotPriorityNormal); err != nil {
+		return xerrors.Errorf("cannot change keyslot priority: %w", err)
+	}
+
+	// Use the new recovery key to authorize the removal of the old keyslot,
+	// as the supplied existing key might be the old recovery key. The old
+	// token becomes orphaned once its keyslot is deleted, so an interruption
+	// from here onwards will result in the rotation being completed by the
+	// next call.
+	if err := luks2KillSlot(devicePath, oldToken.TokenKeyslot, recoveryKey[:]); err != nil {
+		return xerrors.Errorf("cannot kill existing slot %d: %w", oldToken.TokenKeyslot, err)
+	}
+
+	if err := luks2RemoveToken(devicePath, id); err != nil {
+		return xerrors.Errorf("cannot remove existing token %d: %w", id, err)
+	}
+
+	if err := view.Reread(); err != nil {
+		return xerrors.Errorf("cannot reread LUKS header view: %w", err)
+	}
+	_, pendingId, exists := view.TokenByName(pendingName)
+	if !exists {
+		return errors.New("cannot find token for new keyslot")
+	}
+
+	newToken := &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: newSlot,
+			TokenName:    keyslotName}}
+	if err := luks2ImportToken(devicePath, newToken, &luks2.ImportTokenOptions{Id: pendingId, Replace: true}); err != nil {
+		return xerrors.Errorf("cannot import new token: %w", err)
+	}
+
+	return nil
+}
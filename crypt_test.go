@@ -22,11 +22,14 @@ package secboot_test
 import (
 	"bytes"
 	"crypto"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"time"
@@ -36,6 +39,7 @@ import (
 	. "gopkg.in/check.v1"
 
 	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/luks2/luks2test"
 	"github.com/snapcore/secboot/internal/luksview"
@@ -123,6 +127,7 @@ func (r *mockAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath stri
 
 // mockLUKS2Container represents a LUKS2 container and its associated state
 type mockLUKS2Container struct {
+	uuid     string
 	keyslots map[int][]byte
 	tokens   map[int]luks2.Token
 }
@@ -135,6 +140,7 @@ func newMockLUKS2Container() *mockLUKS2Container {
 
 func (c *mockLUKS2Container) ReadHeader() (*luks2.HeaderInfo, error) {
 	hdr := &luks2.HeaderInfo{
+		UUID: c.uuid,
 		Metadata: luks2.Metadata{
 			Keyslots: make(map[int]*luks2.Keyslot),
 			Tokens:   make(map[int]luks2.Token)}}
@@ -196,13 +202,16 @@ func (l *mockLUKS2) enableMocks() (restore func()) {
 
 	restores = append(restores, MockLUKS2Activate(l.activate))
 	restores = append(restores, MockLUKS2AddKey(l.addKey))
+	restores = append(restores, MockLUKS2CheckKey(l.checkKey))
 	restores = append(restores, MockLUKS2Deactivate(l.deactivate))
+	restores = append(restores, MockLUKS2DetectActivateFeatures(luks2.ActivateFeatureSameCPUCrypt|luks2.ActivateFeatureNoWorkqueue))
 	restores = append(restores, MockLUKS2Format(l.format))
 	restores = append(restores, MockLUKS2ImportToken(l.importToken))
 	restores = append(restores, MockLUKS2KillSlot(l.killSlot))
 	restores = append(restores, MockLUKS2RemoveToken(l.removeToken))
 	restores = append(restores, MockLUKS2SetSlotPriority(l.setSlotPriority))
 	restores = append(restores, MockNewLUKSView(l.newLUKSView))
+	restores = append(restores, MockLUKS2ReadHeader(l.readHeader))
 
 	return func() {
 		for _, fn := range restores {
@@ -211,8 +220,12 @@ func (l *mockLUKS2) enableMocks() (restore func()) {
 	}
 }
 
-func (l *mockLUKS2) activate(volumeName, sourceDevicePath string, key []byte, slot int) error {
-	l.operations = append(l.operations, "Activate("+volumeName+","+sourceDevicePath+","+strconv.Itoa(slot)+")")
+func (l *mockLUKS2) activate(volumeName, sourceDevicePath string, key []byte, slot int, options *luks2.ActivateOptions) error {
+	op := "Activate(" + volumeName + "," + sourceDevicePath + "," + strconv.Itoa(slot)
+	if options != nil && *options != (luks2.ActivateOptions{}) {
+		op += fmt.Sprintf(",%+v", *options)
+	}
+	l.operations = append(l.operations, op+")")
 
 	if _, exists := l.activated[volumeName]; exists {
 		return errors.New("systemd-cryptsetup failed with: exit status 1")
@@ -284,6 +297,24 @@ func (l *mockLUKS2) addKey(devicePath string, existingKey, key []byte, options *
 	return nil
 }
 
+func (l *mockLUKS2) checkKey(devicePath string, slot int, key []byte) error {
+	l.operations = append(l.operations, fmt.Sprint("CheckKey(", devicePath, ",", slot, ")"))
+
+	dev, ok := l.devices[devicePath]
+	if !ok {
+		return errors.New("no container")
+	}
+
+	k, exists := dev.keyslots[slot]
+	if !exists {
+		return errors.New("no slot")
+	}
+	if !bytes.Equal(key, k) {
+		return errors.New("invalid key")
+	}
+	return nil
+}
+
 func (l *mockLUKS2) deactivate(volumeName string) error {
 	l.operations = append(l.operations, "Deactivate("+volumeName+")")
 
@@ -349,6 +380,8 @@ func (l *mockLUKS2) killSlot(devicePath string, slot int, key []byte) error {
 		return errors.New("no slot")
 	}
 
+	// Like cryptsetup, only accept a key for the keyslot being killed if
+	// it is the last one.
 	if len(dev.keyslots) == 1 {
 		if !bytes.Equal(key, dev.keyslots[slot]) {
 			return errors.New("invalid key")
@@ -408,6 +441,16 @@ func (l *mockLUKS2) newLUKSView(devicePath string, lockMode luks2.LockMode) (*lu
 	return dev.newLUKSView()
 }
 
+// readHeader isn't recorded in the operations log because it is only used
+// to obtain the container's UUID.
+func (l *mockLUKS2) readHeader(devicePath string, lockMode luks2.LockMode) (*luks2.HeaderInfo, error) {
+	dev, ok := l.devices[devicePath]
+	if !ok {
+		return nil, errors.New("no container")
+	}
+	return dev.ReadHeader()
+}
+
 type cryptSuite struct {
 	cryptTestBase
 	keyDataTestBase
@@ -819,6 +862,9 @@ type testActivateVolumeWithKeyDataData struct {
 	authResponses    []interface{}
 	model            SnapModel
 
+	authorizedBootIdentities []BootIdentity
+	bootIdentity             BootIdentity
+
 	tokenName string
 }
 
@@ -828,6 +874,7 @@ func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolum
 	slot := s.addMockKeyslot(data.sourceDevicePath, key)
 
 	c.Check(keyData.SetAuthorizedSnapModels(auxKey, data.authorizedModels...), IsNil)
+	c.Check(keyData.SetAuthorizedBootIdentities(auxKey, data.authorizedBootIdentities...), IsNil)
 
 	authRequestor := &mockAuthRequestor{passphraseResponses: data.authResponses}
 
@@ -839,7 +886,8 @@ func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolum
 	options := &ActivateVolumeOptions{
 		PassphraseTries: data.passphraseTries,
 		KeyringPrefix:   data.keyringPrefix,
-		Model:           data.model}
+		Model:           data.model,
+		BootIdentity:    data.bootIdentity}
 
 	if data.tokenName != "" {
 		w := makeMockKeyDataWriter()
@@ -966,6 +1014,255 @@ func (s *cryptSuite) TestActivateVolumeWithKeyData5(c *C) {
 		model:            models[0]})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithPassphraseOnlyKeyData(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	slot := s.addMockKeyslot("/dev/sda1", key)
+
+	var kdf testutil.MockKDF
+	keyData, err := NewKeyDataWithPassphrase(&PassphraseKeyParams{
+		Key:          key,
+		AuxiliaryKey: auxKey}, "1234", nil, &kdf)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	s.addMockToken("/dev/sda1", &luksview.KeyDataToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: slot,
+			TokenName:    "default"},
+		Data: w.final.Bytes()})
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"foo", "1234"}}
+	options := &ActivateVolumeOptions{
+		PassphraseTries: 2,
+		Model:           SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprintf("Activate(data,/dev/sda1,%d)", slot),
+	})
+	c.Check(authRequestor.passphraseRequests, HasLen, 2)
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", key, auxKey)
+}
+
+func (s *cryptSuite) TestMoveKeysToSecureBuffers(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	origKey := append(DiskUnlockKey(nil), key...)
+	origAuxKey := append(AuxiliaryKey(nil), auxKey...)
+
+	keyBuf, auxKeyBuf, err := MoveKeysToSecureBuffers(key, auxKey)
+	c.Assert(err, IsNil)
+	defer keyBuf.Free()
+	defer auxKeyBuf.Free()
+
+	c.Check(keyBuf.Bytes(), DeepEquals, []byte(origKey))
+	c.Check(auxKeyBuf.Bytes(), DeepEquals, []byte(origAuxKey))
+	c.Check(key, DeepEquals, make(DiskUnlockKey, 32))
+	c.Check(auxKey, DeepEquals, make(AuxiliaryKey, 32))
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataUpgradesKDFCostParams(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	slot := s.addMockKeyslot("/dev/sda1", key)
+
+	var kdf testutil.MockKDF
+	keyData, err := NewKeyDataWithPassphrase(&PassphraseKeyParams{
+		Key:          key,
+		AuxiliaryKey: auxKey}, "1234", &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024}, &kdf)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	id := s.addMockToken("/dev/sda1", &luksview.KeyDataToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: slot,
+			TokenName:    "default"},
+		Priority: 5,
+		Data:     w.final.Bytes()})
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}}
+	options := &ActivateVolumeOptions{
+		PassphraseTries: 1,
+		Model:           SkipSnapModelCheck,
+		KDFUpgrade: &KDFUpgradeOptions{
+			KDFOptions: &KDFOptions{ForceIterations: 10, MemoryKiB: 32 * 1024}}}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprintf("Activate(data,/dev/sda1,%d)", slot),
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("ImportToken(/dev/sda1,", &luks2.ImportTokenOptions{Id: id, Replace: true}, ")"),
+	})
+
+	token, ok := s.luks2.devices["/dev/sda1"].tokens[id].(*luksview.KeyDataToken)
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(token.Name(), Equals, "default")
+	c.Check(token.Keyslots(), DeepEquals, []int{slot})
+	c.Check(token.Priority, Equals, 5)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(token.Data)})
+	c.Assert(err, IsNil)
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.Passphrase.KDF.Time, Equals, 10)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataUpgradeKDFCostParamsNotRequired(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	slot := s.addMockKeyslot("/dev/sda1", key)
+
+	var kdf testutil.MockKDF
+	keyData, err := NewKeyDataWithPassphrase(&PassphraseKeyParams{
+		Key:          key,
+		AuxiliaryKey: auxKey}, "1234", &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024}, &kdf)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	s.addMockToken("/dev/sda1", &luksview.KeyDataToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: slot,
+			TokenName:    "default"},
+		Data: w.final.Bytes()})
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}}
+	options := &ActivateVolumeOptions{
+		PassphraseTries: 1,
+		Model:           SkipSnapModelCheck,
+		KDFUpgrade: &KDFUpgradeOptions{
+			KDFOptions: &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024}}}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprintf("Activate(data,/dev/sda1,%d)", slot),
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataUpgradesKDFCostParamsDetachedHeader(c *C) {
+	// Test that the upgraded key data is written to the detached header.
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	slot := s.addMockKeyslot("/dev/sda1", key)
+	s.luks2.devices["/run/data.hdr"] = s.luks2.devices["/dev/sda1"]
+
+	var kdf testutil.MockKDF
+	keyData, err := NewKeyDataWithPassphrase(&PassphraseKeyParams{
+		Key:          key,
+		AuxiliaryKey: auxKey}, "1234", &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024}, &kdf)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	id := s.addMockToken("/run/data.hdr", &luksview.KeyDataToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: slot,
+			TokenName:    "default"},
+		Data: w.final.Bytes()})
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}}
+	options := &ActivateVolumeOptions{
+		PassphraseTries: 1,
+		Model:           SkipSnapModelCheck,
+		HeaderPath:      "/run/data.hdr",
+		KDFUpgrade: &KDFUpgradeOptions{
+			KDFOptions: &KDFOptions{ForceIterations: 10, MemoryKiB: 32 * 1024}}}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/run/data.hdr,0)",
+		fmt.Sprintf("Activate(data,/dev/sda1,%d,{Discard:false ReadOnly:false SameCPUCrypt:false NoReadWorkqueue:false NoWriteWorkqueue:false HeaderPath:/run/data.hdr})", slot),
+		"newLUKSView(/run/data.hdr,0)",
+		fmt.Sprint("ImportToken(/run/data.hdr,", &luks2.ImportTokenOptions{Id: id, Replace: true}, ")"),
+	})
+
+	token, ok := s.luks2.devices["/run/data.hdr"].tokens[id].(*luksview.KeyDataToken)
+	c.Assert(ok, testutil.IsTrue)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(token.Data)})
+	c.Assert(err, IsNil)
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.Passphrase.KDF.Time, Equals, 10)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithExternalKeyDataUpgradesKDFCostParams(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	s.addMockKeyslot("/dev/sda1", key)
+
+	var kdf testutil.MockKDF
+	keyData, err := NewKeyDataWithPassphrase(&PassphraseKeyParams{
+		Key:          key,
+		AuxiliaryKey: auxKey}, "1234", &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024}, &kdf)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}}
+	options := &ActivateVolumeOptions{
+		PassphraseTries: 1,
+		Model:           SkipSnapModelCheck,
+		KDFUpgrade: &KDFUpgradeOptions{
+			KDFOptions: &KDFOptions{ForceIterations: 10, MemoryKiB: 32 * 1024},
+			NewExternalKeyDataWriter: func(k *KeyData) (KeyDataWriter, error) {
+				c.Check(k, Equals, keyData)
+				return w, nil
+			}}}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options, keyData), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,-1)",
+	})
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.Passphrase.KDF.Time, Equals, 10)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithExternalKeyDataNoKDFUpgradeWriter(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	s.addMockKeyslot("/dev/sda1", key)
+
+	var kdf testutil.MockKDF
+	keyData, err := NewKeyDataWithPassphrase(&PassphraseKeyParams{
+		Key:          key,
+		AuxiliaryKey: auxKey}, "1234", &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024}, &kdf)
+	c.Assert(err, IsNil)
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}}
+	options := &ActivateVolumeOptions{
+		PassphraseTries: 1,
+		Model:           SkipSnapModelCheck,
+		KDFUpgrade: &KDFUpgradeOptions{
+			KDFOptions: &KDFOptions{ForceIterations: 10, MemoryKiB: 32 * 1024}}}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options, keyData), IsNil)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.Passphrase.KDF.Time, Equals, 4)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,-1)",
+	})
+}
+
 func (s *cryptSuite) TestActivateVolumeWithKeyData6(c *C) {
 	// Test with passphrase using multiple tries
 	models := []SnapModel{
@@ -1052,128 +1349,585 @@ func (s *cryptSuite) TestActivateVolumeWithKeyData9(c *C) {
 	})
 }
 
-type testActivateVolumeWithKeyDataErrorHandlingData struct {
-	primaryKey  DiskUnlockKey
-	recoveryKey RecoveryKey
+func (s *cryptSuite) TestActivateVolumeWithKeyDataSnapModelAuthRule(c *C) {
+	// Test with a snap model authorized by a rule rather than explicitly
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
 
-	authRequestor *mockAuthRequestor
+	c.Check(keyData.SetSnapModelAuthRules(auxKey, SnapModelAuthRule{BrandID: "fake-brand", Grade: "secured", ModelPrefix: "fake-"}), IsNil)
 
-	passphraseTries  int
-	recoveryKeyTries int
-	keyringPrefix    string
-	kdf              KDF
+	options := &ActivateVolumeOptions{
+		Model: testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
 
-	keyData *KeyData
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,-1)",
+	})
+}
 
-	model SnapModel
+func (s *cryptSuite) TestActivateVolumeWithKeyDataKeyringUsesLUKSUUID(c *C) {
+	// Test that keys added to the keyring can be retrieved using a
+	// different path to the same container.
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+	s.luks2.devices["/dev/sda1"].uuid = "6503ce5c-c2fb-49e9-a560-71928d8ded0e"
+	s.luks2.devices["/dev/disk/by-partuuid/7d0fc8c4-5b8b-4c4e-8e4e-2bd1e9a0f1c3"] = s.luks2.devices["/dev/sda1"]
 
-	activateTries int
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
+
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/disk/by-partuuid/7d0fc8c4-5b8b-4c4e-8e4e-2bd1e9a0f1c3", key, auxKey)
 }
 
-func (s *cryptSuite) testActivateVolumeWithKeyDataErrorHandling(c *C, data *testActivateVolumeWithKeyDataErrorHandlingData) error {
-	s.addMockKeyslot("/dev/sda1", data.primaryKey)
-	s.addMockKeyslot("/dev/sda1", data.recoveryKey[:])
+func (s *cryptSuite) TestActivateVolumeWithKeyDataKeyringAddsPathDescription(c *C) {
+	// Test that keys are also added to the keyring with the source device
+	// path in the description, for consumers that look them up by path.
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+	s.luks2.devices["/dev/sda1"].uuid = "6503ce5c-c2fb-49e9-a560-71928d8ded0e"
 
-	var authRequestor AuthRequestor
-	var numPassphraseResponses int
-	var numRecoveryResponses int
-	if data.authRequestor != nil {
-		authRequestor = data.authRequestor
-		numPassphraseResponses = len(data.authRequestor.passphraseResponses)
-		numRecoveryResponses = len(data.authRequestor.recoveryKeyResponses)
-	}
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
 
-	options := &ActivateVolumeOptions{
-		PassphraseTries:  data.passphraseTries,
-		RecoveryKeyTries: data.recoveryKeyTries,
-		KeyringPrefix:    data.keyringPrefix,
-		Model:            data.model}
-	err := ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, data.kdf, options, data.keyData)
+	if !s.ProcessPossessesUserKeyringKeys && !c.Failed() {
+		c.ExpectFailure("Cannot possess user keys because the user keyring isn't reachable from the session keyring")
+	}
 
-	if data.authRequestor != nil {
-		c.Check(data.authRequestor.passphraseRequests, HasLen, numPassphraseResponses)
-		for _, rsp := range data.authRequestor.passphraseRequests {
-			c.Check(rsp.volumeName, Equals, "data")
-			c.Check(rsp.sourceDevicePath, Equals, "/dev/sda1")
-		}
+	for _, id := range []string{"UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e", "/dev/sda1"} {
+		k, err := keyring.GetKeyFromUserKeyring(id, "unlock", "ubuntu-fde")
+		c.Check(err, IsNil)
+		c.Check(k, DeepEquals, []byte(key))
 
-		c.Check(data.authRequestor.recoveryKeyRequests, HasLen, numRecoveryResponses)
-		for _, rsp := range data.authRequestor.recoveryKeyRequests {
-			c.Check(rsp.volumeName, Equals, "data")
-			c.Check(rsp.sourceDevicePath, Equals, "/dev/sda1")
-		}
+		k, err = keyring.GetKeyFromUserKeyring(id, "aux", "ubuntu-fde")
+		c.Check(err, IsNil)
+		c.Check(k, DeepEquals, []byte(auxKey))
 	}
+}
 
-	if data.activateTries > 0 {
-		c.Assert(s.luks2.operations, HasLen, data.activateTries+1)
-		c.Check(s.luks2.operations[0], Equals, "newLUKSView(/dev/sda1,0)")
-		for _, op := range s.luks2.operations[1:] {
-			c.Check(op, Equals, "Activate(data,/dev/sda1,-1)")
-		}
-	} else if len(s.luks2.operations) == 1 {
-		c.Check(s.luks2.operations[0], Equals, "newLUKSView(/dev/sda1,0)")
-	} else {
-		c.Check(s.luks2.operations, HasLen, 0)
-	}
+func (s *cryptSuite) TestActivateVolumeWithKeyDataVolumeLocator(c *C) {
+	// Test that the source device can be supplied as a volume locator.
+	dir := c.MkDir()
+	devicePath := filepath.Join(dir, "dev/sda1")
+	c.Assert(os.MkdirAll(filepath.Dir(devicePath), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(devicePath, nil, 0644), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "dev/disk/by-uuid"), 0755), IsNil)
+	c.Assert(os.Symlink("../../sda1", filepath.Join(dir, "dev/disk/by-uuid/6503ce5c-c2fb-49e9-a560-71928d8ded0e")), IsNil)
+	s.AddCleanup(MockDevDiskPath(filepath.Join(dir, "dev/disk")))
 
-	if err == ErrRecoveryKeyUsed {
-		// This should be done last because it may fail in some circumstances.
-		s.checkRecoveryKeyInKeyring(c, data.keyringPrefix, "/dev/sda1", data.recoveryKey)
-	}
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot(devicePath, key)
+	s.luks2.devices[devicePath].uuid = "6503ce5c-c2fb-49e9-a560-71928d8ded0e"
 
-	return err
-}
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e", nil, nil, options, keyData), IsNil)
 
-func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling1(c *C) {
-	// Test with an invalid value for RecoveryKeyTries.
-	keyData, _, _ := s.newNamedKeyData(c, "")
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(" + devicePath + ",0)",
+		"Activate(data," + devicePath + ",-1)",
+	})
 
-	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
-		recoveryKeyTries: -1,
-		keyData:          keyData,
-	}), ErrorMatches, "invalid RecoveryKeyTries")
+	s.checkKeyDataKeysInKeyring(c, "", "UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e", key, auxKey)
 }
 
-func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling2(c *C) {
-	// Test that recovery fallback works with the platform is unavailable
-	keyData, key, _ := s.newNamedKeyData(c, "")
-	recoveryKey := s.newRecoveryKey()
+func (s *cryptSuite) TestActivateVolumeWithKeyDataUnresolvedVolumeLocator(c *C) {
+	s.AddCleanup(MockDevDiskPath(filepath.Join(c.MkDir(), "dev/disk")))
 
-	s.handler.state = mockPlatformDeviceStateUnavailable
+	keyData, _, _ := s.newNamedKeyData(c, "")
 
-	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
-		primaryKey:       key,
-		recoveryKey:      recoveryKey,
-		authRequestor:    &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}},
-		recoveryKeyTries: 1,
-		keyData:          keyData,
-		model:            SkipSnapModelCheck,
-		activateTries:    1,
-	}), Equals, ErrRecoveryKeyUsed)
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "LABEL=ubuntu-data-enc", nil, nil, options, keyData), ErrorMatches,
+		"cannot resolve source device path: cannot resolve LABEL=ubuntu-data-enc: lstat .*: no such file or directory")
+	c.Check(s.luks2.operations, HasLen, 0)
 }
 
-func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling3(c *C) {
-	// Test that recovery fallback works when the platform device isn't properly initialized
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDetachedHeader(c *C) {
+	// Test that the LUKS2 header view is obtained from a detached header,
+	// and that the header path and other dm-crypt options are passed through.
 	keyData, key, _ := s.newNamedKeyData(c, "")
-	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+	s.luks2.devices["/run/data.hdr"] = s.luks2.devices["/dev/sda1"]
 
-	s.handler.state = mockPlatformDeviceStateUninitialized
+	options := &ActivateVolumeOptions{
+		Model:      SkipSnapModelCheck,
+		ReadOnly:   true,
+		HeaderPath: "/run/data.hdr"}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
 
-	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
-		primaryKey:       key,
-		recoveryKey:      recoveryKey,
-		authRequestor:    &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}},
-		recoveryKeyTries: 1,
-		keyData:          keyData,
-		model:            SkipSnapModelCheck,
-		activateTries:    1,
-	}), Equals, ErrRecoveryKeyUsed)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/run/data.hdr,0)",
+		"Activate(data,/dev/sda1,-1,{Discard:false ReadOnly:true SameCPUCrypt:false NoReadWorkqueue:false NoWriteWorkqueue:false HeaderPath:/run/data.hdr})",
+	})
 }
 
-func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling4(c *C) {
-	// Test that recovery fallback works when the recovered key is incorrect
-	keyData, _, _ := s.newNamedKeyData(c, "")
-	recoveryKey := s.newRecoveryKey()
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDetachedHeaderKeyringUsesLUKSUUID(c *C) {
+	// Test that the UUID used in the description of kernel keys is
+	// obtained from the detached header.
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+	hdr := newMockLUKS2Container()
+	hdr.uuid = "6503ce5c-c2fb-49e9-a560-71928d8ded0e"
+	s.luks2.devices["/run/data.hdr"] = hdr
+
+	options := &ActivateVolumeOptions{
+		Model:      SkipSnapModelCheck,
+		HeaderPath: "/run/data.hdr"}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
+
+	if !s.ProcessPossessesUserKeyringKeys && !c.Failed() {
+		c.ExpectFailure("Cannot possess user keys because the user keyring isn't reachable from the session keyring")
+	}
+
+	k, err := keyring.GetKeyFromUserKeyring("UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e", "unlock", "ubuntu-fde")
+	c.Check(err, IsNil)
+	c.Check(k, DeepEquals, []byte(key))
+
+	k, err = keyring.GetKeyFromUserKeyring("UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e", "aux", "ubuntu-fde")
+	c.Check(err, IsNil)
+	c.Check(k, DeepEquals, []byte(auxKey))
+}
+
+func (s *cryptSuite) newVolumeKeyDerivationKeyData(c *C, devices map[string]string) (*KeyData, map[string]DiskUnlockKey, AuxiliaryKey) {
+	keyData, rootKey, auxKey := s.newNamedKeyData(c, "")
+	c.Assert(keyData.EnableVolumeKeyDerivation(auxKey, crypto.SHA256), IsNil)
+
+	keys := make(map[string]DiskUnlockKey)
+	for path, uuid := range devices {
+		key, err := keyData.DeriveVolumeUnlockKey(rootKey, uuid)
+		c.Assert(err, IsNil)
+		s.addMockKeyslot(path, key)
+		s.luks2.devices[path].uuid = uuid
+		keys[path] = key
+	}
+
+	return keyData, keys, auxKey
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDerivedVolumeKeys(c *C) {
+	// Test that per-volume keys are derived from a single root key, and
+	// that the root key is only recovered once.
+	keyData, keys, auxKey := s.newVolumeKeyDerivationKeyData(c, map[string]string{
+		"/dev/sda1": "6503ce5c-c2fb-49e9-a560-71928d8ded0e",
+		"/dev/sda2": "971ccc5f-5843-445b-9cac-65234c203543"})
+
+	var cache RootKeyCache
+	defer cache.Clear()
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck, RootKeyCache: &cache}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
+	c.Check(ActivateVolumeWithKeyData("save", "/dev/sda2", nil, nil, options, keyData), IsNil)
+
+	c.Check(s.handler.recoveredPayloads, HasLen, 1)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1", "save": "/dev/sda2"})
+
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", keys["/dev/sda1"], auxKey)
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda2", keys["/dev/sda2"], auxKey)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDerivedVolumeKeysReadsHeaderOnce(c *C) {
+	// Test that the UUID used for deriving the volume key and for the
+	// description of kernel keys is obtained from the header view that is
+	// read at the start of activation, rather than by reading the header
+	// again.
+	keyData, keys, auxKey := s.newVolumeKeyDerivationKeyData(c, map[string]string{
+		"/dev/sda1": "6503ce5c-c2fb-49e9-a560-71928d8ded0e"})
+
+	s.AddCleanup(MockLUKS2ReadHeader(func(string, luks2.LockMode) (*luks2.HeaderInfo, error) {
+		c.Error("unexpected header read")
+		return nil, errors.New("unexpected header read")
+	}))
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Activate(data,/dev/sda1,-1)",
+	})
+
+	if !s.ProcessPossessesUserKeyringKeys && !c.Failed() {
+		c.ExpectFailure("Cannot possess user keys because the user keyring isn't reachable from the session keyring")
+	}
+
+	k, err := keyring.GetKeyFromUserKeyring("UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e", "unlock", "ubuntu-fde")
+	c.Check(err, IsNil)
+	c.Check(k, DeepEquals, []byte(keys["/dev/sda1"]))
+
+	k, err = keyring.GetKeyFromUserKeyring("UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e", "aux", "ubuntu-fde")
+	c.Check(err, IsNil)
+	c.Check(k, DeepEquals, []byte(auxKey))
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDerivedVolumeKeysPassphrase(c *C) {
+	// Test that a passphrase is only requested once when activating
+	// multiple volumes with the same root key.
+	keyData, _, _ := s.newVolumeKeyDerivationKeyData(c, map[string]string{
+		"/dev/sda1": "6503ce5c-c2fb-49e9-a560-71928d8ded0e",
+		"/dev/sda2": "971ccc5f-5843-445b-9cac-65234c203543"})
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.SetPassphrase("1234", nil, &kdf), IsNil)
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}}
+	var cache RootKeyCache
+	defer cache.Clear()
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck, PassphraseTries: 1, RootKeyCache: &cache}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options, keyData), IsNil)
+	c.Check(ActivateVolumeWithKeyData("save", "/dev/sda2", authRequestor, &kdf, options, keyData), IsNil)
+
+	c.Check(authRequestor.passphraseRequests, HasLen, 1)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1", "save": "/dev/sda2"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDerivedVolumeKeysClearCache(c *C) {
+	keyData, _, _ := s.newVolumeKeyDerivationKeyData(c, map[string]string{
+		"/dev/sda1": "6503ce5c-c2fb-49e9-a560-71928d8ded0e",
+		"/dev/sda2": "971ccc5f-5843-445b-9cac-65234c203543"})
+
+	var cache RootKeyCache
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck, RootKeyCache: &cache}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
+	cache.Clear()
+	c.Check(ActivateVolumeWithKeyData("save", "/dev/sda2", nil, nil, options, keyData), IsNil)
+
+	c.Check(s.handler.recoveredPayloads, HasLen, 2)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDerivedVolumeKeysNoCache(c *C) {
+	// Test that root keys aren't cached unless the caller supplies a cache.
+	keyData, _, _ := s.newVolumeKeyDerivationKeyData(c, map[string]string{
+		"/dev/sda1": "6503ce5c-c2fb-49e9-a560-71928d8ded0e",
+		"/dev/sda2": "971ccc5f-5843-445b-9cac-65234c203543"})
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
+	c.Check(ActivateVolumeWithKeyData("save", "/dev/sda2", nil, nil, options, keyData), IsNil)
+
+	c.Check(s.handler.recoveredPayloads, HasLen, 2)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDerivedVolumeKeysWrongVolume(c *C) {
+	// Test that the root key itself can't unlock a volume.
+	keyData, rootKey, auxKey := s.newNamedKeyData(c, "foo")
+	c.Assert(keyData.EnableVolumeKeyDerivation(auxKey, crypto.SHA256), IsNil)
+	s.addMockKeyslot("/dev/sda1", rootKey)
+	s.luks2.devices["/dev/sda1"].uuid = "6503ce5c-c2fb-49e9-a560-71928d8ded0e"
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), ErrorMatches,
+		"cannot activate with platform protected keys:\n"+
+			"- foo: cannot activate volume: systemd-cryptsetup failed with: exit status 1\n"+
+			"and activation with recovery key failed: no recovery key tries permitted")
+}
+
+func (s *cryptSuite) mockEventTime() time.Time {
+	return time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataEvents(c *C) {
+	s.AddCleanup(MockTimeNow(s.mockEventTime))
+
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+
+	sink := new(mockActivationEventSink)
+	options := &ActivateVolumeOptions{Model: model, EventSink: sink}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), ErrorMatches,
+		"(?s)cannot activate with platform protected keys:.*")
+
+	event := func(e ActivationEvent) *ActivationEvent {
+		e.Time = s.mockEventTime()
+		e.VolumeName = "data"
+		e.SourceDevicePath = "/dev/sda1"
+		return &e
+	}
+	c.Check(sink.events, DeepEquals, []*ActivationEvent{
+		event(ActivationEvent{Type: ActivationEventKeyDataFound, KeyData: "foo"}),
+		event(ActivationEvent{Type: ActivationEventKeyDataAttemptStart, KeyData: "foo"}),
+		event(ActivationEvent{Type: ActivationEventSnapModelAuthorization, KeyData: "foo", Result: ActivationResultUnauthorized}),
+		event(ActivationEvent{Type: ActivationEventKeyDataAttemptEnd, KeyData: "foo", Result: ActivationResultFailure, Error: "snap model is not authorized"}),
+	})
+
+	// Authorize the model and try again.
+	_, auxKey, err := keyData.RecoverKeys()
+	c.Assert(err, IsNil)
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, model), IsNil)
+
+	sink.events = nil
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), IsNil)
+	c.Check(sink.events, DeepEquals, []*ActivationEvent{
+		event(ActivationEvent{Type: ActivationEventKeyDataFound, KeyData: "foo"}),
+		event(ActivationEvent{Type: ActivationEventKeyDataAttemptStart, KeyData: "foo"}),
+		event(ActivationEvent{Type: ActivationEventSnapModelAuthorization, KeyData: "foo", Result: ActivationResultAuthorized}),
+		event(ActivationEvent{Type: ActivationEventKeyringWrite, Purpose: "unlock", Result: ActivationResultSuccess}),
+		event(ActivationEvent{Type: ActivationEventKeyringWrite, Purpose: "aux", Result: ActivationResultSuccess}),
+		event(ActivationEvent{Type: ActivationEventKeyDataAttemptEnd, KeyData: "foo", Result: ActivationResultSuccess}),
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataEventsPlatformErrorAndRecovery(c *C) {
+	s.AddCleanup(MockTimeNow(s.mockEventTime))
+
+	keyData, _, _ := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.SetPassphrase("1234", nil, &kdf), IsNil)
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	sink := new(mockActivationEventSink)
+	authRequestor := &mockAuthRequestor{
+		passphraseResponses:  []interface{}{"1234"},
+		recoveryKeyResponses: []interface{}{RecoveryKey{}, recoveryKey}}
+	options := &ActivateVolumeOptions{
+		Model:            SkipSnapModelCheck,
+		PassphraseTries:  1,
+		RecoveryKeyTries: 2,
+		EventSink:        sink}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options, keyData), Equals, ErrRecoveryKeyUsed)
+
+	event := func(e ActivationEvent) *ActivationEvent {
+		e.Time = s.mockEventTime()
+		e.VolumeName = "data"
+		e.SourceDevicePath = "/dev/sda1"
+		return &e
+	}
+	c.Check(sink.events, DeepEquals, []*ActivationEvent{
+		event(ActivationEvent{Type: ActivationEventKeyDataFound, KeyData: "foo"}),
+		event(ActivationEvent{Type: ActivationEventPassphraseRequest, Result: ActivationResultSuccess}),
+		event(ActivationEvent{Type: ActivationEventKeyDataAttemptStart, KeyData: "foo"}),
+		event(ActivationEvent{
+			Type:          ActivationEventKeyDataAttemptEnd,
+			KeyData:       "foo",
+			Result:        ActivationResultFailure,
+			PlatformError: "unavailable",
+			Error:         "cannot recover key: the platform's secure device is unavailable: the platform device is unavailable"}),
+		event(ActivationEvent{
+			Type:   ActivationEventRecoveryKeyAttempt,
+			Result: ActivationResultFailure,
+			Error:  "cannot activate volume: systemd-cryptsetup failed with: exit status 1"}),
+		event(ActivationEvent{Type: ActivationEventRecoveryKeyAttempt, Result: ActivationResultSuccess}),
+		event(ActivationEvent{Type: ActivationEventKeyringWrite, Purpose: "unlock", Result: ActivationResultSuccess}),
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataEventsPlatformLockout(c *C) {
+	s.AddCleanup(MockTimeNow(s.mockEventTime))
+
+	keyData, _, _ := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.SetPassphrase("1234", nil, &kdf), IsNil)
+	s.handler.state = mockPlatformDeviceStateLockout
+
+	sink := new(mockActivationEventSink)
+	authRequestor := &mockAuthRequestor{
+		passphraseResponses:  []interface{}{"1234"},
+		recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{
+		Model:            SkipSnapModelCheck,
+		PassphraseTries:  1,
+		RecoveryKeyTries: 1,
+		EventSink:        sink}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options, keyData), Equals, ErrRecoveryKeyUsed)
+
+	event := func(e ActivationEvent) *ActivationEvent {
+		e.Time = s.mockEventTime()
+		e.VolumeName = "data"
+		e.SourceDevicePath = "/dev/sda1"
+		return &e
+	}
+	c.Check(sink.events, DeepEquals, []*ActivationEvent{
+		event(ActivationEvent{Type: ActivationEventKeyDataFound, KeyData: "foo"}),
+		event(ActivationEvent{Type: ActivationEventPassphraseRequest, Result: ActivationResultSuccess}),
+		event(ActivationEvent{Type: ActivationEventKeyDataAttemptStart, KeyData: "foo"}),
+		event(ActivationEvent{
+			Type:          ActivationEventKeyDataAttemptEnd,
+			KeyData:       "foo",
+			Result:        ActivationResultFailure,
+			PlatformError: "lockout",
+			Error:         "cannot recover key: the platform's secure device is locked out: the platform device is locked out"}),
+		event(ActivationEvent{Type: ActivationEventRecoveryKeyAttempt, Result: ActivationResultSuccess}),
+		event(ActivationEvent{Type: ActivationEventKeyringWrite, Purpose: "unlock", Result: ActivationResultSuccess}),
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyData10(c *C) {
+	// Test with a boot identity and no snap model
+	ids := []BootIdentity{
+		BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "22.04"}}
+
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		authorizedBootIdentities: ids,
+		volumeName:               "data",
+		sourceDevicePath:         "/dev/sda1",
+		bootIdentity:             ids[0]})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyData11(c *C) {
+	// Test with both a snap model and a boot identity
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+	ids := []BootIdentity{
+		BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "22.04"}}
+
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		authorizedModels:         models,
+		authorizedBootIdentities: ids,
+		volumeName:               "data",
+		sourceDevicePath:         "/dev/sda1",
+		model:                    models[0],
+		bootIdentity:             ids[0]})
+}
+
+type testActivateVolumeWithKeyDataErrorHandlingData struct {
+	primaryKey  DiskUnlockKey
+	recoveryKey RecoveryKey
+
+	authRequestor *mockAuthRequestor
+
+	passphraseTries  int
+	recoveryKeyTries int
+	keyringPrefix    string
+	kdf              KDF
+
+	keyData *KeyData
+
+	model        SnapModel
+	bootIdentity BootIdentity
+
+	activateTries int
+}
+
+func (s *cryptSuite) testActivateVolumeWithKeyDataErrorHandling(c *C, data *testActivateVolumeWithKeyDataErrorHandlingData) error {
+	s.addMockKeyslot("/dev/sda1", data.primaryKey)
+	s.addMockKeyslot("/dev/sda1", data.recoveryKey[:])
+
+	var authRequestor AuthRequestor
+	var numPassphraseResponses int
+	var numRecoveryResponses int
+	if data.authRequestor != nil {
+		authRequestor = data.authRequestor
+		numPassphraseResponses = len(data.authRequestor.passphraseResponses)
+		numRecoveryResponses = len(data.authRequestor.recoveryKeyResponses)
+	}
+
+	options := &ActivateVolumeOptions{
+		PassphraseTries:  data.passphraseTries,
+		RecoveryKeyTries: data.recoveryKeyTries,
+		KeyringPrefix:    data.keyringPrefix,
+		Model:            data.model,
+		BootIdentity:     data.bootIdentity}
+	err := ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, data.kdf, options, data.keyData)
+
+	if data.authRequestor != nil {
+		c.Check(data.authRequestor.passphraseRequests, HasLen, numPassphraseResponses)
+		for _, rsp := range data.authRequestor.passphraseRequests {
+			c.Check(rsp.volumeName, Equals, "data")
+			c.Check(rsp.sourceDevicePath, Equals, "/dev/sda1")
+		}
+
+		c.Check(data.authRequestor.recoveryKeyRequests, HasLen, numRecoveryResponses)
+		for _, rsp := range data.authRequestor.recoveryKeyRequests {
+			c.Check(rsp.volumeName, Equals, "data")
+			c.Check(rsp.sourceDevicePath, Equals, "/dev/sda1")
+		}
+	}
+
+	if data.activateTries > 0 {
+		c.Assert(s.luks2.operations, HasLen, data.activateTries+1)
+		c.Check(s.luks2.operations[0], Equals, "newLUKSView(/dev/sda1,0)")
+		for _, op := range s.luks2.operations[1:] {
+			c.Check(op, Equals, "Activate(data,/dev/sda1,-1)")
+		}
+	} else if len(s.luks2.operations) == 1 {
+		c.Check(s.luks2.operations[0], Equals, "newLUKSView(/dev/sda1,0)")
+	} else {
+		c.Check(s.luks2.operations, HasLen, 0)
+	}
+
+	if err == ErrRecoveryKeyUsed {
+		// This should be done last because it may fail in some circumstances.
+		s.checkRecoveryKeyInKeyring(c, data.keyringPrefix, "/dev/sda1", data.recoveryKey)
+	}
+
+	return err
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling1(c *C) {
+	// Test with an invalid value for RecoveryKeyTries.
+	keyData, _, _ := s.newNamedKeyData(c, "")
+
+	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
+		recoveryKeyTries: -1,
+		keyData:          keyData,
+	}), ErrorMatches, "invalid RecoveryKeyTries")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling2(c *C) {
+	// Test that recovery fallback works with the platform is unavailable
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	recoveryKey := s.newRecoveryKey()
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
+		primaryKey:       key,
+		recoveryKey:      recoveryKey,
+		authRequestor:    &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}},
+		recoveryKeyTries: 1,
+		keyData:          keyData,
+		model:            SkipSnapModelCheck,
+		activateTries:    1,
+	}), Equals, ErrRecoveryKeyUsed)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling3(c *C) {
+	// Test that recovery fallback works when the platform device isn't properly initialized
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	recoveryKey := s.newRecoveryKey()
+
+	s.handler.state = mockPlatformDeviceStateUninitialized
+
+	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
+		primaryKey:       key,
+		recoveryKey:      recoveryKey,
+		authRequestor:    &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}},
+		recoveryKeyTries: 1,
+		keyData:          keyData,
+		model:            SkipSnapModelCheck,
+		activateTries:    1,
+	}), Equals, ErrRecoveryKeyUsed)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling4(c *C) {
+	// Test that recovery fallback works when the recovered key is incorrect
+	keyData, _, _ := s.newNamedKeyData(c, "")
+	recoveryKey := s.newRecoveryKey()
 
 	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
 		recoveryKey:      recoveryKey,
@@ -1351,12 +2105,12 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling13(c *C) {
 }
 
 func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling14(c *C) {
-	// Test with an invalid value for SnapModel
+	// Test with neither a snap model nor a boot identity
 	keyData, _, _ := s.newNamedKeyData(c, "")
 
 	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
 		keyData: keyData,
-	}), ErrorMatches, "nil Model")
+	}), ErrorMatches, "nil Model and BootIdentity")
 }
 
 func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling15(c *C) {
@@ -1408,27 +2162,123 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling16(c *C) {
 		"systemd-cryptsetup failed with: exit status 1")
 }
 
-type testActivateVolumeWithMultipleKeyDataData struct {
-	volumeName       string
-	sourceDevicePath string
-	passphraseTries  int
-	keyringPrefix    string
-	authResponses    []interface{}
-	model            SnapModel
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling17(c *C) {
+	// Test that activation fails if the key data metadata has been modified
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
 
-	keys          []DiskUnlockKey
-	keyData       []*KeyData
-	activateSlots []int
-	validKey      DiskUnlockKey
-	validAuxKey   AuxiliaryKey
-}
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
 
-func (s *cryptSuite) testActivateVolumeWithMultipleKeyData(c *C, data *testActivateVolumeWithMultipleKeyDataData) {
-	for _, k := range data.keys {
-		s.addMockKeyslot(data.sourceDevicePath, k)
-	}
+	var j map[string]interface{}
+	c.Check(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	m, ok := j["authorized_snap_models"].(map[string]interface{})
+	c.Assert(ok, testutil.IsTrue)
+	m["hmacs"] = []interface{}{base64.StdEncoding.EncodeToString(make([]byte, 32))}
 
-	authRequestor := &mockAuthRequestor{passphraseResponses: data.authResponses}
+	b, err := json.Marshal(j)
+	c.Check(err, IsNil)
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(b)})
+	c.Assert(err, IsNil)
+
+	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
+		primaryKey:       key,
+		recoveryKey:      recoveryKey,
+		recoveryKeyTries: 0,
+		keyData:          keyData,
+		model:            SkipSnapModelCheck,
+		activateTries:    0,
+	}), ErrorMatches, "cannot activate with platform protected keys:\n"+
+		"- foo: cannot verify key data metadata: invalid key data: metadata MAC check failed\n"+
+		"and activation with recovery key failed: no recovery key tries permitted")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling18(c *C) {
+	// Test that activation fails if the supplied boot identity is not authorized
+	keyData, key, auxKey := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
+
+	c.Check(keyData.SetAuthorizedBootIdentities(auxKey, BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "22.04"}), IsNil)
+
+	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
+		primaryKey:       key,
+		recoveryKey:      recoveryKey,
+		recoveryKeyTries: 0,
+		keyData:          keyData,
+		model:            SkipSnapModelCheck,
+		bootIdentity:     BootIdentityClaims{"os-release:ID": "ubuntu", "os-release:VERSION_ID": "23.10"},
+		activateTries:    0,
+	}), ErrorMatches, "cannot activate with platform protected keys:\n"+
+		"- foo: boot identity is not authorized\n"+
+		"and activation with recovery key failed: no recovery key tries permitted")
+}
+
+func (s *cryptSuite) testActivateVolumeWithKeyDataErrorHandlingRemovedMetadata(c *C, fields ...string) error {
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Check(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	for _, f := range fields {
+		delete(j, f)
+	}
+
+	b, err := json.Marshal(j)
+	c.Check(err, IsNil)
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", bytes.NewReader(b)})
+	c.Assert(err, IsNil)
+
+	return s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
+		primaryKey:       key,
+		recoveryKey:      recoveryKey,
+		recoveryKeyTries: 0,
+		keyData:          keyData,
+		model:            SkipSnapModelCheck,
+		activateTries:    0,
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling19(c *C) {
+	// Test that activation fails if the metadata MAC has been removed
+	c.Check(s.testActivateVolumeWithKeyDataErrorHandlingRemovedMetadata(c, "metadata_mac"), ErrorMatches,
+		"cannot activate with platform protected keys:\n"+
+			"- foo: cannot verify key data metadata: invalid key data: missing metadata MAC\n"+
+			"and activation with recovery key failed: no recovery key tries permitted")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling20(c *C) {
+	// Test that activation fails if the metadata MAC and generation have been
+	// removed in order to make the key data look like it predates metadata MACs.
+	c.Check(s.testActivateVolumeWithKeyDataErrorHandlingRemovedMetadata(c, "metadata_mac", "generation"), ErrorMatches,
+		"cannot activate with platform protected keys:\n"+
+			"- foo: cannot verify key data metadata: invalid key data: cannot verify auxiliary key: incorrect key supplied\n"+
+			"and activation with recovery key failed: no recovery key tries permitted")
+}
+
+type testActivateVolumeWithMultipleKeyDataData struct {
+	volumeName       string
+	sourceDevicePath string
+	passphraseTries  int
+	keyringPrefix    string
+	authResponses    []interface{}
+	model            SnapModel
+
+	keys          []DiskUnlockKey
+	keyData       []*KeyData
+	activateSlots []int
+	validKey      DiskUnlockKey
+	validAuxKey   AuxiliaryKey
+}
+
+func (s *cryptSuite) testActivateVolumeWithMultipleKeyData(c *C, data *testActivateVolumeWithMultipleKeyDataData) {
+	for _, k := range data.keys {
+		s.addMockKeyslot(data.sourceDevicePath, k)
+	}
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: data.authResponses}
 
 	var kdf testutil.MockKDF
 	options := &ActivateVolumeOptions{
@@ -2324,12 +3174,12 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling13(c *C)
 }
 
 func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling14(c *C) {
-	// Test with an invalid value for SnapModel.
+	// Test with neither a snap model nor a boot identity.
 	keyData, _, _ := s.newMultipleNamedKeyData(c, "", "")
 
 	c.Check(s.testActivateVolumeWithMultipleKeyDataErrorHandling(c, &testActivateVolumeWithMultipleKeyDataErrorHandlingData{
 		keyData: keyData,
-	}), ErrorMatches, "nil Model")
+	}), ErrorMatches, "nil Model and BootIdentity")
 }
 
 func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling15(c *C) {
@@ -2403,6 +3253,72 @@ func (s *cryptSuite) TestActivateVolumeWithKeyMismatchErr(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyDMCryptOptions(c *C) {
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{
+		AllowDiscards:    true,
+		SameCPUCrypt:     true,
+		NoReadWorkqueue:  true,
+		NoWriteWorkqueue: true}
+	c.Check(ActivateVolumeWithKey("luks-volume", "/dev/sda1", key, options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"Activate(luks-volume,/dev/sda1,-1,{Discard:true ReadOnly:false SameCPUCrypt:true NoReadWorkqueue:true NoWriteWorkqueue:true HeaderPath:})"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyMissingCryptsetupFeature(c *C) {
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	s.addMockKeyslot("/dev/sda1", key)
+	s.AddCleanup(MockLUKS2DetectActivateFeatures(luks2.ActivateFeatureSameCPUCrypt))
+
+	options := &ActivateVolumeOptions{NoReadWorkqueue: true}
+	c.Check(ActivateVolumeWithKey("luks-volume", "/dev/sda1", key, options), Equals, ErrMissingCryptsetupFeature)
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataMissingCryptsetupFeature(c *C) {
+	// Test that unsupported dm-crypt options are detected before
+	// requesting any credentials from the user.
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+	s.AddCleanup(MockLUKS2DetectActivateFeatures(0))
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"1234"}, recoveryKeyResponses: []interface{}{RecoveryKey{}}}
+	options := &ActivateVolumeOptions{
+		PassphraseTries:  1,
+		RecoveryKeyTries: 1,
+		Model:            SkipSnapModelCheck,
+		SameCPUCrypt:     true}
+	var kdf testutil.MockKDF
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", authRequestor, &kdf, options, keyData), Equals, ErrMissingCryptsetupFeature)
+	c.Check(s.luks2.operations, HasLen, 0)
+	c.Check(authRequestor.passphraseRequests, HasLen, 0)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyMissingCryptsetupFeature(c *C) {
+	s.AddCleanup(MockLUKS2DetectActivateFeatures(0))
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{RecoveryKey{}}}
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		NoWriteWorkqueue: true}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), Equals, ErrMissingCryptsetupFeature)
+	c.Check(s.luks2.operations, HasLen, 0)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataInvalidHeaderPath(c *C) {
+	keyData, _, _ := s.newNamedKeyData(c, "")
+
+	options := &ActivateVolumeOptions{
+		Model:      SkipSnapModelCheck,
+		HeaderPath: "/run/data.hdr,discard"}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", nil, nil, options, keyData), ErrorMatches, "invalid header path")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
 func (s *cryptSuite) TestDeactivateVolume(c *C) {
 	s.luks2.activated["luks-volume"] = "/dev/sda1"
 	err := DeactivateVolume("luks-volume")
@@ -3541,6 +4457,520 @@ func (s *cryptSuite) TestRenameLUKS2ContainerKeyNameInUse(c *C) {
 	c.Check(RenameLUKS2ContainerKey("/dev/sda1", "foo", "bar"), ErrorMatches, "the new name is already in use")
 }
 
+type testRotateLUKS2ContainerRecoveryKeyData struct {
+	devicePath  string
+	dev         *mockLUKS2Container
+	existingKey []byte
+	key         RecoveryKey
+	keyslotName string
+
+	expectedOperations []string
+	expectedSlot       int
+	expectedTokenId    int
+}
+
+func (s *cryptSuite) testRotateLUKS2ContainerRecoveryKey(c *C, data *testRotateLUKS2ContainerRecoveryKeyData) {
+	s.luks2.devices[data.devicePath] = data.dev
+
+	keyslotName := data.keyslotName
+	if keyslotName == "" {
+		keyslotName = "default-recovery"
+	}
+
+	c.Check(RotateLUKS2ContainerRecoveryKey(data.devicePath, data.keyslotName, data.existingKey, data.key, nil), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, data.expectedOperations)
+
+	c.Check(data.dev.keyslots, HasLen, 2)
+	key, ok := data.dev.keyslots[data.expectedSlot]
+	c.Check(ok, testutil.IsTrue)
+	c.Check(key, DeepEquals, []byte(data.key[:]))
+
+	c.Check(data.dev.tokens, HasLen, 2)
+	var expectedToken luks2.Token = &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: data.expectedSlot,
+			TokenName:    keyslotName}}
+	c.Check(data.dev.tokens[data.expectedTokenId], DeepEquals, expectedToken)
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKey(c *C) {
+	existingKey := s.newPrimaryKey()
+	oldRecoveryKey := s.newRecoveryKey()
+
+	s.testRotateLUKS2ContainerRecoveryKey(c, &testRotateLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "default-recovery"}},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: oldRecoveryKey[:],
+			},
+		},
+		existingKey: existingKey,
+		key:         s.newRecoveryKey(),
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"ImportToken(/dev/sda1,&{1 true})",
+			fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 2}, ")"),
+			"ImportToken(/dev/sda1,<nil>)",
+			"SetSlotPriority(/dev/sda1,2,normal)",
+			"KillSlot(/dev/sda1,1)",
+			"RemoveToken(/dev/sda1,1)",
+			"ImportToken(/dev/sda1,&{2 true})",
+		},
+		expectedSlot:    2,
+		expectedTokenId: 2,
+	})
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyDifferentName(c *C) {
+	existingKey := s.newPrimaryKey()
+	oldRecoveryKey := s.newRecoveryKey()
+
+	s.testRotateLUKS2ContainerRecoveryKey(c, &testRotateLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/vdb2",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "foo"}},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: oldRecoveryKey[:],
+			},
+		},
+		existingKey: existingKey,
+		key:         s.newRecoveryKey(),
+		keyslotName: "foo",
+		expectedOperations: []string{
+			"newLUKSView(/dev/vdb2,0)",
+			"ImportToken(/dev/vdb2,&{1 true})",
+			fmt.Sprint("AddKey(/dev/vdb2,", &luks2.AddKeyOptions{Slot: 2}, ")"),
+			"ImportToken(/dev/vdb2,<nil>)",
+			"SetSlotPriority(/dev/vdb2,2,normal)",
+			"KillSlot(/dev/vdb2,1)",
+			"RemoveToken(/dev/vdb2,1)",
+			"ImportToken(/dev/vdb2,&{2 true})",
+		},
+		expectedSlot:    2,
+		expectedTokenId: 2,
+	})
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyWithOldRecoveryKey(c *C) {
+	existingKey := s.newPrimaryKey()
+	oldRecoveryKey := s.newRecoveryKey()
+
+	s.testRotateLUKS2ContainerRecoveryKey(c, &testRotateLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "default-recovery"}},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: oldRecoveryKey[:],
+			},
+		},
+		existingKey: oldRecoveryKey[:],
+		key:         s.newRecoveryKey(),
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"ImportToken(/dev/sda1,&{1 true})",
+			fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 2}, ")"),
+			"ImportToken(/dev/sda1,<nil>)",
+			"SetSlotPriority(/dev/sda1,2,normal)",
+			"KillSlot(/dev/sda1,1)",
+			"RemoveToken(/dev/sda1,1)",
+			"ImportToken(/dev/sda1,&{2 true})",
+		},
+		expectedSlot:    2,
+		expectedTokenId: 2,
+	})
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyCompletesInterrupted(c *C) {
+	// Test that a rotation which was interrupted after the old keyslot
+	// was deleted is completed.
+	existingKey := s.newPrimaryKey()
+	interruptedRecoveryKey := s.newRecoveryKey()
+
+	s.testRotateLUKS2ContainerRecoveryKey(c, &testRotateLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+				1: luksview.MockOrphanedToken(luksview.RecoveryTokenType, "default-recovery"),
+				2: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 2,
+						TokenName:    "default-recovery-rotating"},
+					Replaces: "default-recovery"},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				2: interruptedRecoveryKey[:],
+			},
+		},
+		existingKey: existingKey,
+		key:         s.newRecoveryKey(),
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"RemoveToken(/dev/sda1,1)",
+			"ImportToken(/dev/sda1,&{2 true})",
+			"ImportToken(/dev/sda1,&{2 true})",
+			fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 1}, ")"),
+			"ImportToken(/dev/sda1,<nil>)",
+			"SetSlotPriority(/dev/sda1,1,normal)",
+			"KillSlot(/dev/sda1,2)",
+			"RemoveToken(/dev/sda1,2)",
+			"ImportToken(/dev/sda1,&{1 true})",
+		},
+		expectedSlot:    1,
+		expectedTokenId: 1,
+	})
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyRollsBackInterrupted(c *C) {
+	// Test that a rotation which was interrupted after the new token
+	// was imported but before the old keyslot was deleted is rolled back.
+	existingKey := s.newPrimaryKey()
+	oldRecoveryKey := s.newRecoveryKey()
+	interruptedRecoveryKey := s.newRecoveryKey()
+	rotationSlot := 2
+
+	s.testRotateLUKS2ContainerRecoveryKey(c, &testRotateLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "default-recovery"},
+					RotationKeyslot: &rotationSlot},
+				2: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 2,
+						TokenName:    "default-recovery-rotating"},
+					Replaces: "default-recovery"},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: oldRecoveryKey[:],
+				2: interruptedRecoveryKey[:],
+			},
+		},
+		existingKey: existingKey,
+		key:         s.newRecoveryKey(),
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"CheckKey(/dev/sda1,2)",
+			"KillSlot(/dev/sda1,2)",
+			"RemoveToken(/dev/sda1,2)",
+			"ImportToken(/dev/sda1,&{1 true})",
+			"ImportToken(/dev/sda1,&{1 true})",
+			fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 2}, ")"),
+			"ImportToken(/dev/sda1,<nil>)",
+			"SetSlotPriority(/dev/sda1,2,normal)",
+			"KillSlot(/dev/sda1,1)",
+			"RemoveToken(/dev/sda1,1)",
+			"ImportToken(/dev/sda1,&{2 true})",
+		},
+		expectedSlot:    2,
+		expectedTokenId: 2,
+	})
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyRollsBackInterruptedBeforeNewToken(c *C) {
+	// Test that a rotation which was interrupted after the new keyslot
+	// was added but before its token was imported is rolled back.
+	existingKey := s.newPrimaryKey()
+	oldRecoveryKey := s.newRecoveryKey()
+	interruptedRecoveryKey := s.newRecoveryKey()
+	rotationSlot := 2
+
+	s.testRotateLUKS2ContainerRecoveryKey(c, &testRotateLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "default-recovery"},
+					RotationKeyslot: &rotationSlot},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: oldRecoveryKey[:],
+				2: interruptedRecoveryKey[:],
+			},
+		},
+		existingKey: existingKey,
+		key:         s.newRecoveryKey(),
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"CheckKey(/dev/sda1,2)",
+			"KillSlot(/dev/sda1,2)",
+			"ImportToken(/dev/sda1,&{1 true})",
+			"ImportToken(/dev/sda1,&{1 true})",
+			fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 2}, ")"),
+			"ImportToken(/dev/sda1,<nil>)",
+			"SetSlotPriority(/dev/sda1,2,normal)",
+			"KillSlot(/dev/sda1,1)",
+			"RemoveToken(/dev/sda1,1)",
+			"ImportToken(/dev/sda1,&{2 true})",
+		},
+		expectedSlot:    2,
+		expectedTokenId: 2,
+	})
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyCompletesInterruptedWithNewKey(c *C) {
+	// Test that a rotation which was interrupted before the old keyslot
+	// was deleted is completed rather than rolled back if the supplied key
+	// is the new recovery key, because cryptsetup won't permit the new
+	// keyslot to be deleted with it.
+	existingKey := s.newPrimaryKey()
+	oldRecoveryKey := s.newRecoveryKey()
+	interruptedRecoveryKey := s.newRecoveryKey()
+	rotationSlot := 2
+
+	s.testRotateLUKS2ContainerRecoveryKey(c, &testRotateLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "default-recovery"},
+					RotationKeyslot: &rotationSlot},
+				2: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 2,
+						TokenName:    "default-recovery-rotating"},
+					Replaces: "default-recovery"},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: oldRecoveryKey[:],
+				2: interruptedRecoveryKey[:],
+			},
+		},
+		existingKey: interruptedRecoveryKey[:],
+		key:         s.newRecoveryKey(),
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"CheckKey(/dev/sda1,2)",
+			"KillSlot(/dev/sda1,1)",
+			"RemoveToken(/dev/sda1,1)",
+			"ImportToken(/dev/sda1,&{2 true})",
+			"ImportToken(/dev/sda1,&{2 true})",
+			fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 1}, ")"),
+			"ImportToken(/dev/sda1,<nil>)",
+			"SetSlotPriority(/dev/sda1,1,normal)",
+			"KillSlot(/dev/sda1,2)",
+			"RemoveToken(/dev/sda1,2)",
+			"ImportToken(/dev/sda1,&{1 true})",
+		},
+		expectedSlot:    1,
+		expectedTokenId: 1,
+	})
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyCompletesInterruptedBeforeNewTokenWithNewKey(c *C) {
+	// Test that a rotation which was interrupted after the new keyslot
+	// was added but before its token was imported is completed rather than
+	// rolled back if the supplied key is the new recovery key.
+	existingKey := s.newPrimaryKey()
+	oldRecoveryKey := s.newRecoveryKey()
+	interruptedRecoveryKey := s.newRecoveryKey()
+	rotationSlot := 2
+
+	s.testRotateLUKS2ContainerRecoveryKey(c, &testRotateLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "default-recovery"},
+					RotationKeyslot: &rotationSlot},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: oldRecoveryKey[:],
+				2: interruptedRecoveryKey[:],
+			},
+		},
+		existingKey: interruptedRecoveryKey[:],
+		key:         s.newRecoveryKey(),
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"CheckKey(/dev/sda1,2)",
+			"ImportToken(/dev/sda1,<nil>)",
+			"KillSlot(/dev/sda1,1)",
+			"RemoveToken(/dev/sda1,1)",
+			"ImportToken(/dev/sda1,&{2 true})",
+			"ImportToken(/dev/sda1,&{2 true})",
+			fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 1}, ")"),
+			"ImportToken(/dev/sda1,<nil>)",
+			"SetSlotPriority(/dev/sda1,1,normal)",
+			"KillSlot(/dev/sda1,2)",
+			"RemoveToken(/dev/sda1,2)",
+			"ImportToken(/dev/sda1,&{1 true})",
+		},
+		expectedSlot:    1,
+		expectedTokenId: 1,
+	})
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyRecoversFromFailedAddKey(c *C) {
+	existingKey := s.newPrimaryKey()
+	oldRecoveryKey := s.newRecoveryKey()
+
+	dev := &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 1,
+					TokenName:    "default-recovery"}},
+		},
+		keyslots: map[int][]byte{
+			0: existingKey,
+			1: oldRecoveryKey[:],
+		},
+	}
+	s.luks2.devices["/dev/sda1"] = dev
+
+	c.Check(RotateLUKS2ContainerRecoveryKey("/dev/sda1", "", s.newPrimaryKey(), s.newRecoveryKey(), nil), ErrorMatches, "cannot add key: invalid key")
+
+	rotationSlot := 2
+	c.Check(dev.tokens[1], DeepEquals, &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 1,
+			TokenName:    "default-recovery"},
+		RotationKeyslot: &rotationSlot})
+
+	recoveryKey := s.newRecoveryKey()
+	c.Check(RotateLUKS2ContainerRecoveryKey("/dev/sda1", "", existingKey, recoveryKey, nil), IsNil)
+
+	c.Check(dev.keyslots, DeepEquals, map[int][]byte{
+		0: existingKey,
+		2: recoveryKey[:]})
+	c.Check(dev.tokens, DeepEquals, map[int]luks2.Token{
+		0: &luksview.KeyDataToken{
+			TokenBase: luksview.TokenBase{
+				TokenKeyslot: 0,
+				TokenName:    "default"}},
+		2: &luksview.RecoveryToken{
+			TokenBase: luksview.TokenBase{
+				TokenKeyslot: 2,
+				TokenName:    "default-recovery"}},
+	})
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyNonExistant(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+		},
+		keyslots: map[int][]byte{0: existingKey},
+	}
+
+	c.Check(RotateLUKS2ContainerRecoveryKey("/dev/sda1", "", existingKey, s.newRecoveryKey(), nil), ErrorMatches, "no key with the specified name exists")
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyNotRecoveryKey(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+		},
+		keyslots: map[int][]byte{0: existingKey},
+	}
+
+	c.Check(RotateLUKS2ContainerRecoveryKey("/dev/sda1", "default", existingKey, s.newRecoveryKey(), nil), ErrorMatches, "named keyslot is not a recovery keyslot")
+}
+
+func (s *cryptSuite) TestRotateLUKS2ContainerRecoveryKeyPendingNameInUse(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 1,
+					TokenName:    "default-recovery"}},
+			2: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 2,
+					TokenName:    "default-recovery-rotating"}},
+		},
+		keyslots: map[int][]byte{0: existingKey, 1: nil, 2: nil},
+	}
+
+	c.Check(RotateLUKS2ContainerRecoveryKey("/dev/sda1", "", existingKey, s.newRecoveryKey(), nil), ErrorMatches,
+		"cannot recover from interrupted rotation: the name used for the new recovery keyslot is already in use")
+}
+
 type cryptSuiteUnmockedBase struct {
 	snapd_testutil.BaseTest
 	cryptTestBase
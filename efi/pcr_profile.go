@@ -139,6 +139,11 @@ func WithBootManagerCodeProfile() PCRProfileOption {
 // secboot_tpm2.PCRProtectionProfileBranch, using the specified digest algorithm
 // for the PCR digest. The generated profile is defined by the supplied load
 // sequences and options.
+//
+// If pcrAlg is tpm2.HashAlgorithmNull, the strongest supported digest algorithm
+// that is present in the TCG event log is selected automatically. If the
+// WithActivePCRBanks option is supplied, the selected algorithm must also be
+// one of the PCR banks that are active on the TPM.
 func AddPCRProfile(pcrAlg tpm2.HashAlgorithmId, branch *secboot_tpm2.PCRProtectionProfileBranch, loadSequences *ImageLoadSequences, options ...PCRProfileOption) error {
 	gen := newPcrProfileGenerator(pcrAlg, loadSequences, options...)
 
@@ -149,6 +154,72 @@ func AddPCRProfile(pcrAlg tpm2.HashAlgorithmId, branch *secboot_tpm2.PCRProtecti
 	return gen.addPCRProfile(branch)
 }
 
+// AddMultiBankPCRProfile adds a profile defined by the supplied options to the
+// supplied secboot_tpm2.PCRProtectionProfileBranch, with values for each of the
+// specified PCR banks. This generates a profile for each bank in the same way as
+// AddPCRProfile, and then combines these so that each branch of the added profile
+// contains the values for every bank. This makes it possible to create a PCR
+// policy that covers several banks without creating a branch for every
+// combination of values across banks.
+func AddMultiBankPCRProfile(pcrAlgs []tpm2.HashAlgorithmId, branch *secboot_tpm2.PCRProtectionProfileBranch, loadSequences *ImageLoadSequences, options ...PCRProfileOption) error {
+	if len(pcrAlgs) == 0 {
+		return errors.New("must specify at least one PCR bank")
+	}
+
+	var bankValues [][]tpm2.PCRValues
+	for _, alg := range pcrAlgs {
+		profile := secboot_tpm2.NewPCRProtectionProfile()
+		if err := AddPCRProfile(alg, profile.RootBranch(), loadSequences, options...); err != nil {
+			return xerrors.Errorf("cannot add profile for %v: %w", alg, err)
+		}
+
+		values, err := profile.ComputePCRValues(nil)
+		if err != nil {
+			return xerrors.Errorf("cannot compute PCR values for %v: %w", alg, err)
+		}
+		if len(bankValues) > 0 && len(values) != len(bankValues[0]) {
+			return xerrors.Errorf("profile for %v has an unexpected number of branches", alg)
+		}
+		bankValues = append(bankValues, values)
+	}
+
+	bp := branch.AddBranchPoint()
+	defer bp.EndBranchPoint()
+
+	for i := range bankValues[0] {
+		b := bp.AddBranch()
+		for _, values := range bankValues {
+			pcrs, err := values[i].SelectionList()
+			if err != nil {
+				return xerrors.Errorf("cannot compute selection list: %w", err)
+			}
+			for _, s := range pcrs {
+				for _, pcr := range s.Select {
+					b.AddPCRValue(s.Hash, pcr, values[i][s.Hash][pcr])
+				}
+			}
+		}
+		b.EndBranch()
+	}
+
+	return nil
+}
+
+type activePCRBanksOption []tpm2.HashAlgorithmId
+
+// WithActivePCRBanks indicates the PCR banks that are active on the TPM, and is
+// used to select the PCR bank automatically when AddPCRProfile is called with
+// tpm2.HashAlgorithmNull. The active PCR banks can be obtained with
+// secboot_tpm2.Connection.ActivePCRBanks. Without this option, the PCR bank is
+// selected using the TCG event log alone.
+func WithActivePCRBanks(algs ...tpm2.HashAlgorithmId) PCRProfileOption {
+	return activePCRBanksOption(algs)
+}
+
+func (o activePCRBanksOption) applyOptionTo(gen *pcrProfileGenerator) {
+	gen.activePCRBanks = []tpm2.HashAlgorithmId(o)
+}
+
 type pcrProfileFlags int
 
 const (
@@ -183,6 +254,11 @@ type pcrProfileGenerator struct {
 	// SbatPolicy.
 	varModifiers []rootVarsModifier
 
+	// activePCRBanks are the PCR banks that are active on the TPM, used
+	// to select a PCR bank if pcrAlg is tpm2.HashAlgorithmNull. This can
+	// be set with the WithActivePCRBanks option.
+	activePCRBanks []tpm2.HashAlgorithmId
+
 	// log is the host TCG log, which is read from the associated env.
 	log *tcglog.Log
 }
@@ -210,6 +286,18 @@ func (g *pcrProfileGenerator) addPCRProfile(branch *secboot_tpm2.PCRProtectionPr
 	}
 	g.log = log
 
+	if g.pcrAlg == tpm2.HashAlgorithmNull {
+		algLists := [][]tpm2.HashAlgorithmId{log.Algorithms}
+		if g.activePCRBanks != nil {
+			algLists = append(algLists, g.activePCRBanks)
+		}
+		alg, err := secboot_tpm2.StrongestPCRBank(algLists...)
+		if err != nil {
+			return xerrors.Errorf("cannot select PCR bank: %w", err)
+		}
+		g.pcrAlg = alg
+	}
+
 	// Collect all of the starting EFI variable states that we need to
 	// generate branches for.
 	collector := newRootVarsCollector(g.env)
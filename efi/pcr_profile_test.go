@@ -1064,3 +1064,158 @@ func (s *pcrProfileSuite) TestAddPCRProfileLoadFailsFromLeafImage(c *C) {
 	}, WithSecureBootPolicyProfile(), WithBootManagerCodeProfile())
 	c.Check(err, ErrorMatches, `cannot measure image 0x[[:xdigit:]]{10}: cannot measure image load: kernel is a leaf image`)
 }
+
+func (s *pcrProfileSuite) TestAddPCRProfileSelectsStrongestAlg(c *C) {
+	// Test that the PCR digest algorithm is selected from the TCG log
+	// when one isn't specified.
+	shim := newMockUbuntuShimImage15_7(c)
+	grub := newMockUbuntuGrubImage3(c)
+	kernel := newMockUbuntuKernelImage3(c)
+
+	err := s.testAddPCRProfile(c, &testAddPCRProfileData{
+		vars: makeMockVars(c, withMsSecureBootConfig(), withSbatLevel([]byte("sbat,1,2022052400\ngrub,2\n"))),
+		log: efitest.NewLog(c, &efitest.LogOptions{
+			Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA1},
+		}),
+		alg: tpm2.HashAlgorithmNull,
+		loadSequences: NewImageLoadSequences().Append(
+			NewImageLoadActivity(shim).Loads(
+				NewImageLoadActivity(grub).Loads(
+					NewImageLoadActivity(grub).Loads(
+						NewImageLoadActivity(kernel),
+					),
+				),
+			),
+		),
+		expected: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "bec6121586508581e08a41244944292ef452879f8e19c7f93d166e912c6aac5e"),
+					7: testutil.DecodeHexString(c, "3d65dbe406e9427d402488ea4f87e07e8b584c79c578a735d48d21a6405fc8bb"),
+				},
+			},
+		},
+	}, WithSecureBootPolicyProfile(), WithBootManagerCodeProfile())
+	c.Check(err, IsNil)
+}
+
+func (s *pcrProfileSuite) TestAddPCRProfileSelectsStrongestActiveAlg(c *C) {
+	// Test that the PCR digest algorithm is selected from the TCG log
+	// and the active PCR banks when one isn't specified.
+	shim := newMockUbuntuShimImage15_7(c)
+	grub := newMockUbuntuGrubImage3(c)
+	kernel := newMockUbuntuKernelImage3(c)
+
+	vars := makeMockVars(c, withMsSecureBootConfig(), withSbatLevel([]byte("sbat,1,2022052400\ngrub,2\n")))
+	log := efitest.NewLog(c, &efitest.LogOptions{
+		Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA1},
+	})
+	sequences := NewImageLoadSequences().Append(
+		NewImageLoadActivity(shim).Loads(
+			NewImageLoadActivity(grub).Loads(
+				NewImageLoadActivity(grub).Loads(
+					NewImageLoadActivity(kernel),
+				),
+			),
+		),
+	)
+	options := []PCRProfileOption{
+		WithHostEnvironment(efitest.NewMockHostEnvironment(vars, log)),
+		WithSecureBootPolicyProfile(),
+	}
+
+	expectedProfile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Assert(AddPCRProfile(tpm2.HashAlgorithmSHA1, expectedProfile.RootBranch(), sequences, options...), IsNil)
+	expected, err := expectedProfile.ComputePCRValues(nil)
+	c.Assert(err, IsNil)
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddPCRProfile(tpm2.HashAlgorithmNull, profile.RootBranch(), sequences,
+		append(options, WithActivePCRBanks(tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA384))...), IsNil)
+
+	values, err := profile.ComputePCRValues(nil)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, expected)
+	c.Check(values[0], HasLen, 1)
+	c.Check(values[0][tpm2.HashAlgorithmSHA1], HasLen, 1)
+}
+
+func (s *pcrProfileSuite) TestAddPCRProfileNoSuitableAlg(c *C) {
+	vars := makeMockVars(c, withMsSecureBootConfig())
+	log := efitest.NewLog(c, &efitest.LogOptions{
+		Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256},
+	})
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	err := AddPCRProfile(tpm2.HashAlgorithmNull, profile.RootBranch(), NewImageLoadSequences(),
+		WithHostEnvironment(efitest.NewMockHostEnvironment(vars, log)),
+		WithSecureBootPolicyProfile(),
+		WithActivePCRBanks(tpm2.HashAlgorithmSHA1))
+	c.Check(err, ErrorMatches, `cannot select PCR bank: .*`)
+	c.Check(errors.Is(err, secboot_tpm2.ErrNoSuitablePCRBank), testutil.IsTrue)
+}
+
+func (s *pcrProfileSuite) TestAddMultiBankPCRProfile(c *C) {
+	shim := newMockUbuntuShimImage15_7(c)
+	grub := newMockUbuntuGrubImage3(c)
+	recoverKernel := newMockUbuntuKernelImage2(c)
+	runKernel := newMockUbuntuKernelImage3(c)
+
+	vars := makeMockVars(c, withMsSecureBootConfig(), withSbatLevel([]byte("sbat,1,2022052400\ngrub,2\n")))
+	log := efitest.NewLog(c, &efitest.LogOptions{
+		Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA1},
+	})
+	sequences := NewImageLoadSequences().Append(
+		NewImageLoadActivity(shim).Loads(
+			NewImageLoadActivity(grub).Loads(
+				NewImageLoadActivity(grub).Loads(
+					NewImageLoadActivity(runKernel),
+				),
+				NewImageLoadActivity(recoverKernel),
+			),
+		),
+	)
+	options := []PCRProfileOption{
+		WithHostEnvironment(efitest.NewMockHostEnvironment(vars, log)),
+		WithSecureBootPolicyProfile(),
+	}
+
+	var expected []tpm2.PCRValues
+	for _, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256} {
+		profile := secboot_tpm2.NewPCRProtectionProfile()
+		c.Assert(AddPCRProfile(alg, profile.RootBranch(), sequences, options...), IsNil)
+		values, err := profile.ComputePCRValues(nil)
+		c.Assert(err, IsNil)
+		c.Assert(values, HasLen, 2)
+
+		if expected == nil {
+			expected = make([]tpm2.PCRValues, len(values))
+			for i := range expected {
+				expected[i] = make(tpm2.PCRValues)
+			}
+		}
+		for i, v := range values {
+			expected[i][alg] = v[alg]
+		}
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddMultiBankPCRProfile([]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256}, profile.RootBranch(), sequences, options...), IsNil)
+
+	values, err := profile.ComputePCRValues(nil)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, expected)
+	c.Check(values[0][tpm2.HashAlgorithmSHA256][7], DeepEquals, tpm2.Digest(testutil.DecodeHexString(c, "3d65dbe406e9427d402488ea4f87e07e8b584c79c578a735d48d21a6405fc8bb")))
+}
+
+func (s *pcrProfileSuite) TestAddMultiBankPCRProfileNoBanks(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddMultiBankPCRProfile(nil, profile.RootBranch(), NewImageLoadSequences(), WithSecureBootPolicyProfile()), ErrorMatches,
+		"must specify at least one PCR bank")
+}
+
+func (s *pcrProfileSuite) TestAddMultiBankPCRProfileNoProfile(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddMultiBankPCRProfile([]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}, profile.RootBranch(), NewImageLoadSequences()), ErrorMatches,
+		"cannot add profile for TPM_ALG_SHA256: must specify a profile to add")
+}
@@ -21,16 +21,20 @@ package secboot
 
 import (
 	"io"
+	"time"
 
+	"github.com/snapcore/secboot/internal/argon2"
 	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/luksview"
 )
 
+var MoveKeysToSecureBuffers = moveKeysToSecureBuffers
+
 func (o *KDFOptions) DeriveCostParams(keyLen int, kdf KDF) (*KDFCostParams, error) {
 	return o.deriveCostParams(keyLen, kdf)
 }
 
-func MockLUKS2Activate(fn func(string, string, []byte, int) error) (restore func()) {
+func MockLUKS2Activate(fn func(string, string, []byte, int, *luks2.ActivateOptions) error) (restore func()) {
 	origActivate := luks2Activate
 	luks2Activate = fn
 	return func() {
@@ -54,6 +58,24 @@ func MockLUKS2Deactivate(fn func(string) error) (restore func()) {
 	}
 }
 
+func MockLUKS2CheckKey(fn func(string, int, []byte) error) (restore func()) {
+	origCheckKey := luks2CheckKey
+	luks2CheckKey = fn
+	return func() {
+		luks2CheckKey = origCheckKey
+	}
+}
+
+func MockLUKS2DetectActivateFeatures(features luks2.ActivateFeatures) (restore func()) {
+	origDetectActivateFeatures := luks2DetectActivateFeatures
+	luks2DetectActivateFeatures = func() luks2.ActivateFeatures {
+		return features
+	}
+	return func() {
+		luks2DetectActivateFeatures = origDetectActivateFeatures
+	}
+}
+
 func MockLUKS2Format(fn func(string, string, []byte, *luks2.FormatOptions) error) (restore func()) {
 	origFormat := luks2Format
 	luks2Format = fn
@@ -102,6 +124,38 @@ func MockNewLUKSView(fn func(string, luks2.LockMode) (*luksview.View, error)) (r
 	}
 }
 
+func MockLUKS2ReadHeader(fn func(string, luks2.LockMode) (*luks2.HeaderInfo, error)) (restore func()) {
+	origReadHeader := luks2ReadHeader
+	luks2ReadHeader = fn
+	return func() {
+		luks2ReadHeader = origReadHeader
+	}
+}
+
+func MockDevDiskPath(path string) (restore func()) {
+	origDevDiskPath := devDiskPath
+	devDiskPath = path
+	return func() {
+		devDiskPath = origDevDiskPath
+	}
+}
+
+func MockJournaldSocketPath(path string) (restore func()) {
+	orig := journaldSocketPath
+	journaldSocketPath = path
+	return func() {
+		journaldSocketPath = orig
+	}
+}
+
+func MockTimeNow(fn func() time.Time) (restore func()) {
+	orig := timeNow
+	timeNow = fn
+	return func() {
+		timeNow = orig
+	}
+}
+
 func MockRuntimeNumCPU(n int) (restore func()) {
 	orig := runtimeNumCPU
 	runtimeNumCPU = func() int {
@@ -119,3 +173,23 @@ func MockStderr(w io.Writer) (restore func()) {
 		osStderr = orig
 	}
 }
+
+func MockArgon2GetMemoryLimits(fn func(float64) (*argon2.MemoryLimits, error)) (restore func()) {
+	orig := argon2GetMemoryLimits
+	argon2GetMemoryLimits = fn
+	return func() {
+		argon2GetMemoryLimits = orig
+	}
+}
+
+func MockProcCpuinfoPath(path string) (restore func()) {
+	orig := procCpuinfoPath
+	procCpuinfoPath = path
+	return func() {
+		procCpuinfoPath = orig
+	}
+}
+
+func (o *KDFOptions) LUKSOpts() luks2.KDFOptions {
+	return o.luksOpts()
+}
@@ -21,11 +21,9 @@ package argon2
 
 import (
 	"errors"
-	"math"
 	"time"
 
 	"golang.org/x/crypto/argon2"
-	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 )
 
@@ -36,10 +34,12 @@ const (
 	initialTargetDuration = 250 * time.Millisecond
 
 	minTimeCost      = 4
-	minMemoryCostKiB = 32 * 1024
 	maxMemoryCostKiB = 4 * 1024 * 1024
 
 	tolerance = 0.05
+
+	// MinMemoryCostKiB is the minimum memory cost used for benchmarking.
+	MinMemoryCostKiB = 32 * 1024
 )
 
 var (
@@ -60,6 +60,11 @@ type BenchmarkParams struct {
 	// for the key derivation. Set this to zero to derive it from
 	// the number of CPUs.
 	Threads uint8
+
+	// MemoryLimits provides the memory limits that are used to compute
+	// a ceiling for MaxMemoryCostKiB. If this is nil, then they are
+	// obtained by calling GetMemoryLimits with the default scale.
+	MemoryLimits *MemoryLimits
 }
 
 // CostParams defines the cost parameters for key derivation using Argon2. It
@@ -169,20 +174,20 @@ func (c *benchmarkContext) computeNextCostParams(targetDuration time.Duration) (
 				// and decrease the memory cost by a proportionate amount.
 				newTimeCost = minTimeCost
 				newMemoryCostKiB = uint32((int64(c.cost.MemoryKiB*c.cost.Time) * int64(targetDuration)) / (int64(c.duration) * minTimeCost))
-				if newMemoryCostKiB < minMemoryCostKiB {
+				if newMemoryCostKiB < MinMemoryCostKiB {
 					// New memory cost undershoots the minimum, so set it to the
 					// minimum and end the benchmarking.
-					newMemoryCostKiB = minMemoryCostKiB
+					newMemoryCostKiB = MinMemoryCostKiB
 					done = true
 				}
 			}
 		default:
 			// Current time cost is at the minimum, so decrease the memory cost.
 			newMemoryCostKiB = uint32((int64(c.cost.MemoryKiB) * int64(targetDuration)) / int64(c.duration))
-			if newMemoryCostKiB < minMemoryCostKiB {
+			if newMemoryCostKiB < MinMemoryCostKiB {
 				// New memory cost undershoots the minimum, so set it to the
 				// minimum and end the benchmarking.
-				newMemoryCostKiB = minMemoryCostKiB
+				newMemoryCostKiB = MinMemoryCostKiB
 				done = true
 			}
 		}
@@ -200,23 +205,13 @@ func (c *benchmarkContext) computeNextCostParams(targetDuration time.Duration) (
 	return done
 }
 
-func (c *benchmarkContext) run(params *BenchmarkParams, keyFn KeyDurationFunc, sysInfo *unix.Sysinfo_t, numCpu int) (*CostParams, error) {
+func (c *benchmarkContext) run(params *BenchmarkParams, keyFn KeyDurationFunc, limits *MemoryLimits, numCpu int) (*CostParams, error) {
 	c.keyFn = keyFn
 
-	// Set a ceiling on the maximum memory cost of half of the
-	// available RAM or 4GB, whichever is less.
-	halfTotalRamKiB := uint64(sysInfo.Totalram) * uint64(sysInfo.Unit) / 2048
-	if halfTotalRamKiB > math.MaxUint32 {
-		halfTotalRamKiB = math.MaxUint32
-	}
-
-	c.maxMemoryCostKiB = uint32(maxMemoryCostKiB)
-	if uint32(halfTotalRamKiB) < c.maxMemoryCostKiB {
-		c.maxMemoryCostKiB = uint32(halfTotalRamKiB)
-	}
-	if params.MaxMemoryCostKiB < c.maxMemoryCostKiB {
-		c.maxMemoryCostKiB = params.MaxMemoryCostKiB
-	}
+	// Set a ceiling on the maximum memory cost from the supplied
+	// memory limits. Don't fail on systems with little memory - the
+	// minimum memory cost is used anyway.
+	c.maxMemoryCostKiB = limits.MemoryCostCeilingKiB(params.MaxMemoryCostKiB)
 
 	// Set the number of threads to the number of CPUs or use
 	// the number supplied (maximum 4)
@@ -231,7 +226,7 @@ func (c *benchmarkContext) run(params *BenchmarkParams, keyFn KeyDurationFunc, s
 
 	// Set the time and memory cost to their minimum values.
 	c.cost.Time = minTimeCost
-	c.cost.MemoryKiB = minMemoryCostKiB
+	c.cost.MemoryKiB = MinMemoryCostKiB
 
 	// Perform an initial benchmark with a target duration of 250ms
 	for i := 0; c.duration < initialTargetDuration; i++ {
@@ -300,9 +295,11 @@ type KeyDurationFunc func(params *CostParams) (time.Duration, error)
 // hard-coded minimum time cost has been reached.
 //
 // The package hard codes a minimum time cost of 4 iterations, and a minimum
-// memory cost of 32MiB. A maximum memory cost of half of the total RAM or 4GB
-// provides a ceiling to the supplied maximum memory cost. The algorithm will
-// set 1 thread per CPU, up to a limit of 4 threads.
+// memory cost of 32MiB. The MaxMemoryCostKiB field of the supplied memory limits,
+// which is derived from the available RAM and any cgroup memory limit and is
+// never more than 4GB, provides a ceiling to the supplied maximum memory cost.
+// If this ceiling is less than the minimum memory cost, the minimum memory cost
+// is used. The algorithm will set 1 thread per CPU, up to a limit of 4 threads.
 //
 // The supplied callback is used to actually run the key derivation measurement,
 // which will consume a lot of memory depending on the supplied parameters. Each
@@ -311,13 +308,17 @@ type KeyDurationFunc func(params *CostParams) (time.Duration, error)
 // is performed in the current process, the garbage collector must be executed at
 // the end of each measurement.
 func Benchmark(params *BenchmarkParams, keyFn KeyDurationFunc) (*CostParams, error) {
-	var sysInfo unix.Sysinfo_t
-	if err := unixSysinfo(&sysInfo); err != nil {
-		return nil, xerrors.Errorf("cannot determine available memory: %w", err)
+	limits := params.MemoryLimits
+	if limits == nil {
+		var err error
+		limits, err = GetMemoryLimits(0)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine memory limits: %w", err)
+		}
 	}
 
 	context := new(benchmarkContext)
-	return context.run(params, keyFn, &sysInfo, runtimeNumCPU())
+	return context.run(params, keyFn, limits, runtimeNumCPU())
 }
 
 // Key derives a key of the desired length from the supplied passphrase and salt using the
@@ -22,6 +22,7 @@ package argon2_test
 import (
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
@@ -79,6 +80,10 @@ func (s *argon2Suite) testBenchmark(c *C, data *testBenchmarkData) {
 	restoreSysinfo := MockUnixSysinfo(&si)
 	defer restoreSysinfo()
 
+	dir := c.MkDir()
+	restorePaths := MockMemoryLimitsPaths(filepath.Join(dir, "meminfo"), filepath.Join(dir, "cgroup"), filepath.Join(dir, "sys/fs/cgroup"))
+	defer restorePaths()
+
 	costParams, err := Benchmark(data.params, s.newMockKeyDurationFunc(c, data.memBandwidthKiBPerMs, data.expected.Threads))
 	c.Assert(err, IsNil)
 	c.Check(costParams, DeepEquals, data.expected)
@@ -329,6 +334,37 @@ func (s *argon2Suite) TestBenchmarkNoProgress(c *C) {
 	c.Check(err, ErrorMatches, "not making sufficient progress")
 }
 
+func (s *argon2Suite) TestBenchmarkSuppliedMemoryLimits(c *C) {
+	restoreNumCPU := MockRuntimeNumCPU(2)
+	defer restoreNumCPU()
+
+	params := &BenchmarkParams{
+		MaxMemoryCostKiB: 1 * 1024 * 1024,
+		TargetDuration:   2 * time.Second,
+		MemoryLimits:     &MemoryLimits{MaxMemoryCostKiB: 128 * 1024}}
+
+	costParams, err := Benchmark(params, s.newMockKeyDurationFunc(c, 2048, 2))
+	c.Assert(err, IsNil)
+	c.Check(costParams, DeepEquals, &CostParams{Time: 31, MemoryKiB: 131072, Threads: 2})
+}
+
+func (s *argon2Suite) TestBenchmarkInsufficientMemory(c *C) {
+	// Test that the minimum memory cost is used rather than failing if
+	// the memory limits are lower than it.
+	restoreNumCPU := MockRuntimeNumCPU(2)
+	defer restoreNumCPU()
+
+	params := &BenchmarkParams{
+		MaxMemoryCostKiB: 1 * 1024 * 1024,
+		TargetDuration:   2 * time.Second,
+		MemoryLimits:     &MemoryLimits{MaxMemoryCostKiB: 16 * 1024}}
+
+	costParams, err := Benchmark(params, s.newMockKeyDurationFunc(c, 2048, 2))
+	c.Assert(err, IsNil)
+	c.Check(costParams.MemoryKiB, Equals, uint32(MinMemoryCostKiB))
+	c.Check(costParams.Threads, Equals, uint8(2))
+}
+
 type argon2SuiteExpensive struct{}
 
 var _ = Suite(&argon2SuiteExpensive{})
@@ -24,8 +24,7 @@ import (
 )
 
 const (
-	MinTimeCost      = minTimeCost
-	MinMemoryCostKiB = minMemoryCostKiB
+	MinTimeCost = minTimeCost
 )
 
 func MockRuntimeNumCPU(n int) (restore func()) {
@@ -48,3 +47,17 @@ func MockUnixSysinfo(info *unix.Sysinfo_t) (restore func()) {
 		unixSysinfo = orig
 	}
 }
+
+func MockMemoryLimitsPaths(meminfo, selfCgroup, cgroupMount string) (restore func()) {
+	origMeminfo := procMeminfoPath
+	origSelfCgroup := procSelfCgroupPath
+	origCgroupMount := cgroupMountPath
+	procMeminfoPath = meminfo
+	procSelfCgroupPath = selfCgroup
+	cgroupMountPath = cgroupMount
+	return func() {
+		procMeminfoPath = origMeminfo
+		procSelfCgroupPath = origSelfCgroup
+		cgroupMountPath = origCgroupMount
+	}
+}
@@ -0,0 +1,315 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package argon2
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// DefaultMemoryLimitScale is the fraction of the available memory that
+	// is used as the ceiling for the memory cost if no other value is
+	// supplied.
+	DefaultMemoryLimitScale = 0.5
+)
+
+var (
+	procMeminfoPath    = "/proc/meminfo"
+	procSelfCgroupPath = "/proc/self/cgroup"
+	cgroupMountPath    = "/sys/fs/cgroup"
+)
+
+// MemoryLimits describes the memory limits of the current process and
+// the memory cost ceiling that is derived from them.
+type MemoryLimits struct {
+	// TotalRAMKiB is the total amount of RAM in KiB.
+	TotalRAMKiB uint64
+
+	// AvailableRAMKiB is the amount of RAM in KiB that is available
+	// for starting new applications without swapping, as reported by
+	// MemAvailable in /proc/meminfo. This is the same as TotalRAMKiB
+	// if the kernel does not report this.
+	AvailableRAMKiB uint64
+
+	// CgroupLimitKiB is the memory limit in KiB imposed by the memory
+	// cgroup that the current process belongs to, or the lowest limit
+	// of any of its ancestors. This is zero if there is no limit.
+	CgroupLimitKiB uint64
+
+	// CgroupAvailableKiB is the amount of memory in KiB that can still
+	// be charged to the memory cgroup before the limit is reached. This
+	// is zero if there is no limit.
+	CgroupAvailableKiB uint64
+
+	// Scale is the fraction of the available memory used to compute
+	// MaxMemoryCostKiB.
+	Scale float64
+
+	// MaxMemoryCostKiB is the maximum memory cost in KiB that should be
+	// used for key derivation, computed by applying Scale to the lesser
+	// of AvailableRAMKiB and CgroupAvailableKiB, and capped to the
+	// hard-coded maximum of 4GiB.
+	MaxMemoryCostKiB uint32
+}
+
+// readMeminfoAvailableKiB returns the value of MemAvailable from
+// /proc/meminfo in KiB. It returns false if this isn't available.
+func readMeminfoAvailableKiB() (uint64, bool, error) {
+	f, err := os.Open(procMeminfoPath)
+	switch {
+	case os.IsNotExist(err):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		if len(fields) != 3 || fields[2] != "kB" {
+			return 0, false, fmt.Errorf("invalid MemAvailable entry %q", scanner.Text())
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, false, xerrors.Errorf("invalid MemAvailable value: %w", err)
+		}
+		return n, true, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, false, err
+	}
+
+	return 0, false, nil
+}
+
+// readCgroupValue reads a single numeric value from the specified cgroup
+// control file. It returns false if the file doesn't exist or contains
+// "max", which indicates that there is no limit.
+func readCgroupValue(path string) (uint64, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	}
+
+	str := string(bytes.TrimSpace(data))
+	if str == "max" {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, false, xerrors.Errorf("invalid value in %s: %w", path, err)
+	}
+	return n, true, nil
+}
+
+// cgroupMemoryPaths returns the paths of the v2 unified hierarchy cgroup
+// and the v1 memory controller cgroup of the current process, relative to
+// their hierarchy roots. An empty string is returned for a hierarchy that
+// the process isn't part of.
+func cgroupMemoryPaths() (v2, v1 string, err error) {
+	f, err := os.Open(procSelfCgroupPath)
+	switch {
+	case os.IsNotExist(err):
+		return "", "", nil
+	case err != nil:
+		return "", "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			v2 = fields[2]
+		default:
+			for _, controller := range strings.Split(fields[1], ",") {
+				if controller == "memory" {
+					v1 = fields[2]
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	return v2, v1, nil
+}
+
+// cgroupMemoryLimit walks from the supplied cgroup directory up to the
+// hierarchy root and returns the lowest limit found, along with the amount
+// of memory that can still be charged to the cgroup with that limit. It
+// returns false if no limit is found.
+func cgroupMemoryLimit(root, path, limitFile, usageFile string) (limit, available uint64, found bool, err error) {
+	for dir := filepath.Join(root, path); ; dir = filepath.Dir(dir) {
+		l, ok, err := readCgroupValue(filepath.Join(dir, limitFile))
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if ok && (!found || l < limit) {
+			usage, _, err := readCgroupValue(filepath.Join(dir, usageFile))
+			if err != nil {
+				return 0, 0, false, err
+			}
+
+			limit = l
+			available = 0
+			if usage < l {
+				available = l - usage
+			}
+			found = true
+		}
+
+		if dir == root || len(dir) <= len(root) {
+			break
+		}
+	}
+
+	return limit, available, found, nil
+}
+
+// readCgroupMemoryLimit returns the memory limit and the remaining memory
+// in bytes for the memory cgroup that the current process belongs to. It
+// supports both the v2 unified hierarchy and the v1 memory controller.
+// It returns false if there is no limit.
+func readCgroupMemoryLimit() (limit, available uint64, found bool, err error) {
+	v2, v1, err := cgroupMemoryPaths()
+	if err != nil {
+		return 0, 0, false, xerrors.Errorf("cannot determine cgroup: %w", err)
+	}
+
+	if v2 != "" {
+		limit, available, found, err = cgroupMemoryLimit(cgroupMountPath, v2, "memory.max", "memory.current")
+		if err != nil {
+			return 0, 0, false, xerrors.Errorf("cannot read cgroup v2 memory limit: %w", err)
+		}
+		if found {
+			return limit, available, true, nil
+		}
+	}
+
+	if v1 != "" {
+		limit, available, found, err = cgroupMemoryLimit(filepath.Join(cgroupMountPath, "memory"), v1, "memory.limit_in_bytes", "memory.usage_in_bytes")
+		if err != nil {
+			return 0, 0, false, xerrors.Errorf("cannot read cgroup v1 memory limit: %w", err)
+		}
+	}
+
+	return limit, available, found, nil
+}
+
+// GetMemoryLimits determines the memory limits of the current process
+// from the total amount of RAM, the amount of available memory reported in
+// /proc/meminfo and any cgroup v1 or v2 memory limit, and then computes a
+// ceiling for the memory cost by applying the supplied scale to the lesser
+// of the available memory and the memory remaining in the cgroup. The scale
+// must be greater than zero and no more than 1. If it is zero, then
+// DefaultMemoryLimitScale is used.
+func GetMemoryLimits(scale float64) (*MemoryLimits, error) {
+	switch {
+	case scale == 0:
+		scale = DefaultMemoryLimitScale
+	case scale < 0 || scale > 1 || math.IsNaN(scale):
+		return nil, errors.New("invalid memory limit scale")
+	}
+
+	var sysInfo unix.Sysinfo_t
+	if err := unixSysinfo(&sysInfo); err != nil {
+		return nil, xerrors.Errorf("cannot determine total memory: %w", err)
+	}
+
+	limits := &MemoryLimits{
+		TotalRAMKiB: uint64(sysInfo.Totalram) * uint64(sysInfo.Unit) / 1024,
+		Scale:       scale}
+
+	availableKiB, ok, err := readMeminfoAvailableKiB()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine available memory: %w", err)
+	}
+	if !ok || availableKiB > limits.TotalRAMKiB {
+		availableKiB = limits.TotalRAMKiB
+	}
+	limits.AvailableRAMKiB = availableKiB
+
+	cgroupLimit, cgroupAvailable, ok, err := readCgroupMemoryLimit()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		limits.CgroupLimitKiB = cgroupLimit / 1024
+		limits.CgroupAvailableKiB = cgroupAvailable / 1024
+		if limits.CgroupAvailableKiB < availableKiB {
+			availableKiB = limits.CgroupAvailableKiB
+		}
+	}
+
+	maxKiB := uint64(float64(availableKiB) * scale)
+	if maxKiB > maxMemoryCostKiB {
+		maxKiB = maxMemoryCostKiB
+	}
+	limits.MaxMemoryCostKiB = uint32(maxKiB)
+
+	return limits, nil
+}
+
+// Insufficient indicates that MaxMemoryCostKiB is less than the minimum
+// memory cost.
+func (l *MemoryLimits) Insufficient() bool {
+	return l.MaxMemoryCostKiB < MinMemoryCostKiB
+}
+
+// MemoryCostCeilingKiB returns the ceiling for the memory cost in KiB
+// when benchmarking with the supplied maximum memory cost. This is the
+// lesser of the supplied value and MaxMemoryCostKiB, but is never less
+// than the minimum memory cost. It is up to the caller to warn if the
+// limits are insufficient.
+func (l *MemoryLimits) MemoryCostCeilingKiB(maxMemoryCostKiB uint32) uint32 {
+	ceiling := l.MaxMemoryCostKiB
+	if maxMemoryCostKiB < ceiling {
+		ceiling = maxMemoryCostKiB
+	}
+	if ceiling < MinMemoryCostKiB {
+		ceiling = MinMemoryCostKiB
+	}
+	return ceiling
+}
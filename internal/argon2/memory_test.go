@@ -0,0 +1,244 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package argon2_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/argon2"
+)
+
+type memorySuite struct {
+	dir      string
+	restores []func()
+}
+
+var _ = Suite(&memorySuite{})
+
+func (s *memorySuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+
+	var si unix.Sysinfo_t
+	// See the comment in argon2Suite.testBenchmark.
+	*(*uint)(unsafe.Pointer(&si.Totalram)) = 2 * 1024 * 1024 * 1024
+	si.Unit = 1
+
+	s.restores = []func(){
+		MockUnixSysinfo(&si),
+		MockMemoryLimitsPaths(filepath.Join(s.dir, "proc/meminfo"), filepath.Join(s.dir, "proc/self/cgroup"), filepath.Join(s.dir, "sys/fs/cgroup"))}
+}
+
+func (s *memorySuite) TearDownTest(c *C) {
+	for i := len(s.restores) - 1; i >= 0; i-- {
+		s.restores[i]()
+	}
+	s.restores = nil
+}
+
+func (s *memorySuite) writeFile(c *C, path, content string) {
+	path = filepath.Join(s.dir, path)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+func (s *memorySuite) writeMeminfo(c *C, availableKiB string) {
+	s.writeFile(c, "proc/meminfo", `MemTotal:        2097152 kB
+MemFree:          102400 kB
+MemAvailable:   `+availableKiB+` kB
+Buffers:           65536 kB
+`)
+}
+
+func (s *memorySuite) TestGetMemoryLimitsNoMeminfo(c *C) {
+	limits, err := GetMemoryLimits(0)
+	c.Assert(err, IsNil)
+	c.Check(limits, DeepEquals, &MemoryLimits{
+		TotalRAMKiB:      2 * 1024 * 1024,
+		AvailableRAMKiB:  2 * 1024 * 1024,
+		Scale:            DefaultMemoryLimitScale,
+		MaxMemoryCostKiB: 1024 * 1024})
+}
+
+func (s *memorySuite) TestGetMemoryLimitsMeminfo(c *C) {
+	s.writeMeminfo(c, "409600")
+
+	limits, err := GetMemoryLimits(0)
+	c.Assert(err, IsNil)
+	c.Check(limits, DeepEquals, &MemoryLimits{
+		TotalRAMKiB:      2 * 1024 * 1024,
+		AvailableRAMKiB:  400 * 1024,
+		Scale:            DefaultMemoryLimitScale,
+		MaxMemoryCostKiB: 200 * 1024})
+}
+
+func (s *memorySuite) TestGetMemoryLimitsScale(c *C) {
+	s.writeMeminfo(c, "409600")
+
+	limits, err := GetMemoryLimits(0.25)
+	c.Assert(err, IsNil)
+	c.Check(limits, DeepEquals, &MemoryLimits{
+		TotalRAMKiB:      2 * 1024 * 1024,
+		AvailableRAMKiB:  400 * 1024,
+		Scale:            0.25,
+		MaxMemoryCostKiB: 100 * 1024})
+}
+
+func (s *memorySuite) TestGetMemoryLimitsInvalidScale(c *C) {
+	_, err := GetMemoryLimits(1.5)
+	c.Check(err, ErrorMatches, "invalid memory limit scale")
+
+	_, err = GetMemoryLimits(-0.5)
+	c.Check(err, ErrorMatches, "invalid memory limit scale")
+}
+
+func (s *memorySuite) TestGetMemoryLimitsInvalidMeminfo(c *C) {
+	s.writeMeminfo(c, "foo")
+
+	_, err := GetMemoryLimits(0)
+	c.Check(err, ErrorMatches, `cannot determine available memory: invalid MemAvailable value: .*`)
+}
+
+func (s *memorySuite) TestGetMemoryLimitsBuiltinMax(c *C) {
+	var si unix.Sysinfo_t
+	*(*uint)(unsafe.Pointer(&si.Totalram)) = 16 * 1024 * 1024
+	si.Unit = 1024
+	restore := MockUnixSysinfo(&si)
+	defer restore()
+
+	limits, err := GetMemoryLimits(1)
+	c.Assert(err, IsNil)
+	c.Check(limits.MaxMemoryCostKiB, Equals, uint32(4*1024*1024))
+}
+
+func (s *memorySuite) TestGetMemoryLimitsCgroupV2(c *C) {
+	s.writeMeminfo(c, "1048576")
+	s.writeFile(c, "proc/self/cgroup", "0::/system.slice/foo.service\n")
+	s.writeFile(c, "sys/fs/cgroup/system.slice/foo.service/memory.max", "268435456\n")
+	s.writeFile(c, "sys/fs/cgroup/system.slice/foo.service/memory.current", "67108864\n")
+	s.writeFile(c, "sys/fs/cgroup/system.slice/memory.max", "max\n")
+
+	limits, err := GetMemoryLimits(0)
+	c.Assert(err, IsNil)
+	c.Check(limits, DeepEquals, &MemoryLimits{
+		TotalRAMKiB:        2 * 1024 * 1024,
+		AvailableRAMKiB:    1024 * 1024,
+		CgroupLimitKiB:     256 * 1024,
+		CgroupAvailableKiB: 192 * 1024,
+		Scale:              DefaultMemoryLimitScale,
+		MaxMemoryCostKiB:   96 * 1024})
+}
+
+func (s *memorySuite) TestGetMemoryLimitsCgroupV2Ancestor(c *C) {
+	s.writeMeminfo(c, "1048576")
+	s.writeFile(c, "proc/self/cgroup", "0::/system.slice/foo.service\n")
+	s.writeFile(c, "sys/fs/cgroup/system.slice/foo.service/memory.max", "max\n")
+	s.writeFile(c, "sys/fs/cgroup/system.slice/memory.max", "536870912\n")
+	s.writeFile(c, "sys/fs/cgroup/system.slice/memory.current", "134217728\n")
+
+	limits, err := GetMemoryLimits(0)
+	c.Assert(err, IsNil)
+	c.Check(limits, DeepEquals, &MemoryLimits{
+		TotalRAMKiB:        2 * 1024 * 1024,
+		AvailableRAMKiB:    1024 * 1024,
+		CgroupLimitKiB:     512 * 1024,
+		CgroupAvailableKiB: 384 * 1024,
+		Scale:              DefaultMemoryLimitScale,
+		MaxMemoryCostKiB:   192 * 1024})
+}
+
+func (s *memorySuite) TestGetMemoryLimitsCgroupV2NoLimit(c *C) {
+	s.writeMeminfo(c, "1048576")
+	s.writeFile(c, "proc/self/cgroup", "0::/user.slice\n")
+	s.writeFile(c, "sys/fs/cgroup/user.slice/memory.max", "max\n")
+
+	limits, err := GetMemoryLimits(0)
+	c.Assert(err, IsNil)
+	c.Check(limits, DeepEquals, &MemoryLimits{
+		TotalRAMKiB:      2 * 1024 * 1024,
+		AvailableRAMKiB:  1024 * 1024,
+		Scale:            DefaultMemoryLimitScale,
+		MaxMemoryCostKiB: 512 * 1024})
+}
+
+func (s *memorySuite) TestGetMemoryLimitsCgroupV1(c *C) {
+	s.writeMeminfo(c, "1048576")
+	s.writeFile(c, "proc/self/cgroup", "12:cpu,cpuacct:/foo\n5:memory:/foo\n0::/foo\n")
+	s.writeFile(c, "sys/fs/cgroup/memory/foo/memory.limit_in_bytes", "134217728\n")
+	s.writeFile(c, "sys/fs/cgroup/memory/foo/memory.usage_in_bytes", "33554432\n")
+
+	limits, err := GetMemoryLimits(0)
+	c.Assert(err, IsNil)
+	c.Check(limits, DeepEquals, &MemoryLimits{
+		TotalRAMKiB:        2 * 1024 * 1024,
+		AvailableRAMKiB:    1024 * 1024,
+		CgroupLimitKiB:     128 * 1024,
+		CgroupAvailableKiB: 96 * 1024,
+		Scale:              DefaultMemoryLimitScale,
+		MaxMemoryCostKiB:   48 * 1024})
+}
+
+func (s *memorySuite) TestGetMemoryLimitsCgroupUsageExceedsLimit(c *C) {
+	s.writeMeminfo(c, "1048576")
+	s.writeFile(c, "proc/self/cgroup", "0::/foo\n")
+	s.writeFile(c, "sys/fs/cgroup/foo/memory.max", "134217728\n")
+	s.writeFile(c, "sys/fs/cgroup/foo/memory.current", "268435456\n")
+
+	limits, err := GetMemoryLimits(0)
+	c.Assert(err, IsNil)
+	c.Check(limits.CgroupLimitKiB, Equals, uint64(128*1024))
+	c.Check(limits.CgroupAvailableKiB, Equals, uint64(0))
+	c.Check(limits.MaxMemoryCostKiB, Equals, uint32(0))
+}
+
+func (s *memorySuite) TestGetMemoryLimitsInvalidCgroupValue(c *C) {
+	s.writeFile(c, "proc/self/cgroup", "0::/foo\n")
+	s.writeFile(c, "sys/fs/cgroup/foo/memory.max", "foo\n")
+
+	_, err := GetMemoryLimits(0)
+	c.Check(err, ErrorMatches, `cannot read cgroup v2 memory limit: invalid value in .*/sys/fs/cgroup/foo/memory.max: .*`)
+}
+
+func (s *memorySuite) TestMemoryCostCeilingKiBFromLimits(c *C) {
+	limits := &MemoryLimits{MaxMemoryCostKiB: 200 * 1024}
+	c.Check(limits.MemoryCostCeilingKiB(1024*1024), Equals, uint32(200*1024))
+	c.Check(limits.Insufficient(), Equals, false)
+}
+
+func (s *memorySuite) TestMemoryCostCeilingKiBFromSuppliedMax(c *C) {
+	limits := &MemoryLimits{MaxMemoryCostKiB: 200 * 1024}
+	c.Check(limits.MemoryCostCeilingKiB(64*1024), Equals, uint32(64*1024))
+}
+
+func (s *memorySuite) TestMemoryCostCeilingKiBClampsToMinimum(c *C) {
+	limits := &MemoryLimits{MaxMemoryCostKiB: 16 * 1024}
+	c.Check(limits.MemoryCostCeilingKiB(1024*1024), Equals, uint32(MinMemoryCostKiB))
+	c.Check(limits.Insufficient(), Equals, true)
+
+	limits = &MemoryLimits{MaxMemoryCostKiB: 200 * 1024}
+	c.Check(limits.MemoryCostCeilingKiB(16*1024), Equals, uint32(MinMemoryCostKiB))
+	c.Check(limits.Insufficient(), Equals, false)
+}
@@ -20,32 +20,248 @@
 package luks2
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 
 	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
 )
 
 var (
 	systemdCryptsetupPath = "/lib/systemd/systemd-cryptsetup"
+	systemctlPath         = "systemctl"
+	dmsetupPath           = "dmsetup"
+
+	unixUname = unix.Uname
+
+	activateFeatures     ActivateFeatures
+	activateFeaturesOnce sync.Once
+)
+
+// ActivateFeatures indicates the set of optional activation features
+// supported by this package, determined by the version of the system's
+// systemd-cryptsetup binary and the version of the kernel's dm-crypt
+// target.
+type ActivateFeatures int
+
+const (
+	// ActivateFeatureSameCPUCrypt indicates that the same-cpu-crypt
+	// option is supported. This was introduced to systemd-cryptsetup in
+	// systemd v242, and to the dm-crypt target in v1.14.0 (kernel v4.0).
+	ActivateFeatureSameCPUCrypt ActivateFeatures = 1 << iota
+
+	// ActivateFeatureNoWorkqueue indicates that the no-read-workqueue and
+	// no-write-workqueue options are supported. These were introduced to
+	// systemd-cryptsetup in systemd v248, and to the dm-crypt target in
+	// v1.22.0 (kernel v5.9).
+	ActivateFeatureNoWorkqueue
 )
 
+// version is a dotted version number, used for comparing the versions
+// of the kernel and the dm-crypt target.
+type version struct {
+	major, minor int
+}
+
+func (v version) atLeast(major, minor int) bool {
+	return v.major > major || (v.major == major && v.minor >= minor)
+}
+
+// detectSystemdVersion returns the version of systemd, which is obtained
+// from systemctl. If systemctl isn't available, eg, in some initramfs
+// environments, it is obtained from systemd-cryptsetup instead. This
+// returns false if the version can't be determined.
+func detectSystemdVersion() (int, bool) {
+	for _, path := range []string{systemctlPath, systemdCryptsetupPath} {
+		out, err := exec.Command(path, "--version").CombinedOutput()
+		if err != nil {
+			continue
+		}
+
+		var v int
+		if n, _ := fmt.Sscanf(string(out), "systemd %d", &v); n != 1 {
+			continue
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+// detectDmCryptVersion returns the version of the kernel's dm-crypt target,
+// which is obtained from dmsetup. The target isn't listed if the dm-crypt
+// module isn't loaded yet, and dmsetup might not be available, so this falls
+// back to the version of the dm-crypt target that is included in the running
+// kernel. This returns false if the version can't be determined.
+func detectDmCryptVersion() (version, bool) {
+	if out, err := exec.Command(dmsetupPath, "targets").Output(); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			var v version
+			if n, _ := fmt.Sscanf(scanner.Text(), "crypt v%d.%d", &v.major, &v.minor); n == 2 {
+				return v, true
+			}
+		}
+	}
+
+	var uts unix.Utsname
+	if err := unixUname(&uts); err != nil {
+		return version{}, false
+	}
+	var kernel version
+	if n, _ := fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &kernel.major, &kernel.minor); n != 2 {
+		return version{}, false
+	}
+	switch {
+	case kernel.atLeast(5, 9):
+		return version{1, 22}, true
+	case kernel.atLeast(4, 0):
+		return version{1, 14}, true
+	default:
+		return version{1, 0}, true
+	}
+}
+
+// DetectActivateFeatures returns the optional activation features supported
+// by both the systemd-cryptsetup binary and the kernel's dm-crypt target on
+// this system. A feature is only reported as supported if it can be
+// determined that both of these support it, so that Activate fails with
+// ErrMissingCryptsetupFeature rather than silently ignoring an option.
+func DetectActivateFeatures() ActivateFeatures {
+	activateFeaturesOnce.Do(func() {
+		activateFeatures = 0
+
+		systemd, ok := detectSystemdVersion()
+		if !ok {
+			return
+		}
+		dmCrypt, ok := detectDmCryptVersion()
+		if !ok {
+			return
+		}
+
+		if systemd >= 242 && dmCrypt.atLeast(1, 14) {
+			activateFeatures |= ActivateFeatureSameCPUCrypt
+		}
+		if systemd >= 248 && dmCrypt.atLeast(1, 22) {
+			activateFeatures |= ActivateFeatureNoWorkqueue
+		}
+	})
+	return activateFeatures
+}
+
+// ActivateOptions provides options to Activate, which correspond to
+// dm-crypt options supported by systemd-cryptsetup.
+type ActivateOptions struct {
+	// Discard permits discard (TRIM) requests to be passed through
+	// to the underlying device.
+	Discard bool
+
+	// ReadOnly creates a read-only mapping.
+	ReadOnly bool
+
+	// SameCPUCrypt performs encryption using the same CPU that the IO
+	// was submitted on. This requires ActivateFeatureSameCPUCrypt.
+	SameCPUCrypt bool
+
+	// NoReadWorkqueue bypasses the dm-crypt workqueue and processes read
+	// requests synchronously. This requires ActivateFeatureNoWorkqueue.
+	NoReadWorkqueue bool
+
+	// NoWriteWorkqueue bypasses the dm-crypt workqueue and processes write
+	// requests synchronously. This requires ActivateFeatureNoWorkqueue.
+	NoWriteWorkqueue bool
+
+	// HeaderPath is the path of a detached LUKS2 header. If empty, the
+	// header is read from the source device.
+	HeaderPath string
+}
+
+// Validate checks that these options are valid and are supported by the
+// supplied set of activation features, which would normally be obtained
+// from DetectActivateFeatures. If any of the options require a feature that
+// isn't supported, ErrMissingCryptsetupFeature will be returned.
+func (o *ActivateOptions) Validate(features ActivateFeatures) error {
+	if strings.ContainsRune(o.HeaderPath, ',') {
+		return errors.New("invalid header path")
+	}
+	if o.SameCPUCrypt && features&ActivateFeatureSameCPUCrypt == 0 {
+		return ErrMissingCryptsetupFeature
+	}
+	if (o.NoReadWorkqueue || o.NoWriteWorkqueue) && features&ActivateFeatureNoWorkqueue == 0 {
+		return ErrMissingCryptsetupFeature
+	}
+	return nil
+}
+
+func (o *ActivateOptions) cryptsetupOptions(slot int) string {
+	// hardcode luks, one try and specify the keyslot to use
+	opts := []string{"luks", fmt.Sprintf("keyslot=%d", slot), "tries=1"}
+	if o.Discard {
+		opts = append(opts, "discard")
+	}
+	if o.ReadOnly {
+		opts = append(opts, "read-only")
+	}
+	if o.SameCPUCrypt {
+		opts = append(opts, "same-cpu-crypt")
+	}
+	if o.NoReadWorkqueue {
+		opts = append(opts, "no-read-workqueue")
+	}
+	if o.NoWriteWorkqueue {
+		opts = append(opts, "no-write-workqueue")
+	}
+	if o.HeaderPath != "" {
+		opts = append(opts, "header="+o.HeaderPath)
+	}
+	return strings.Join(opts, ",")
+}
+
 // Activate unlocks the LUKS device at sourceDevicePath using systemd-cryptsetup and creates a device
 // mapping with the supplied volumeName. The device is unlocked using the supplied key. The slot
 // arguments specifies which keyslot ID to use - set this to AnySlot to activate with any keyslot.
-func Activate(volumeName, sourceDevicePath string, key []byte, slot int) error {
+//
+// Additional dm-crypt options can be supplied via the options argument, which may be nil. If any
+// of the options require a feature that isn't supported by systemd-cryptsetup or the kernel's
+// dm-crypt target (see DetectActivateFeatures), ErrMissingCryptsetupFeature will be returned.
+func Activate(volumeName, sourceDevicePath string, key []byte, slot int, options *ActivateOptions) error {
+	if options == nil {
+		options = new(ActivateOptions)
+	}
+	if err := options.Validate(DetectActivateFeatures()); err != nil {
+		return err
+	}
+
 	cmd := exec.Command(systemdCryptsetupPath,
 		// attach <sourceDevicePath> to /dev/mapper/<volumeName>
 		"attach", volumeName, sourceDevicePath,
 		// read key from stdin
 		"/dev/stdin",
-		// hardcode luks, one try and specify the keyslot to use
-		fmt.Sprintf("luks,keyslot=%d,tries=1", slot))
+		options.cryptsetupOptions(slot))
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "SYSTEMD_LOG_TARGET=console")
-	cmd.Stdin = bytes.NewReader(key)
+
+	// Feed the key via a pipe rather than an io.Reader, which would be
+	// copied to the child process via an intermediate buffer on the heap
+	// that is never wiped.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return xerrors.Errorf("cannot create pipe: %w", err)
+	}
+	defer r.Close()
+	go func() {
+		w.Write(key)
+		w.Close()
+	}()
+	cmd.Stdin = r
 
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("systemd-cryptsetup failed with: %v", osutil.OutputErr(output, err))
@@ -43,6 +43,21 @@ type activateSuite struct {
 	mockSdCryptsetup *snapd_testutil.MockCmd
 }
 
+func (s *activateSuite) mockSystemdVersion(c *C, version int) {
+	systemctl := snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "systemctl"), fmt.Sprintf(`echo "systemd %d (%d-0ubuntu1)"`, version, version))
+	s.AddCleanup(systemctl.Restore)
+	s.AddCleanup(MockSystemctlPath(systemctl.Exe()))
+	ResetActivateFeatures()
+	s.AddCleanup(ResetActivateFeatures)
+}
+
+func (s *activateSuite) mockDmCryptVersion(c *C, version string) {
+	dmsetup := snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "dmsetup"), fmt.Sprintf(`echo "striped          v1.6.0"; echo "crypt            %s"; echo "linear           v1.4.0"`, version))
+	s.AddCleanup(dmsetup.Restore)
+	s.AddCleanup(MockDmsetupPath(dmsetup.Exe()))
+	ResetActivateFeatures()
+}
+
 func (s *activateSuite) SetUpTest(c *C) {
 	s.BaseTest.SetUpTest(c)
 
@@ -72,6 +87,10 @@ exit 5
 	s.mockSdCryptsetup = snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "systemd-cryptsetup"), fmt.Sprintf(sdCryptsetupBottom, s.mockKeyslotsDir))
 	s.AddCleanup(s.mockSdCryptsetup.Restore)
 	s.AddCleanup(MockSystemdCryptsetupPath(s.mockSdCryptsetup.Exe()))
+
+	s.mockSystemdVersion(c, 249)
+	s.mockDmCryptVersion(c, "v1.23.0")
+	s.AddCleanup(MockUnixUname("5.15.0-91-generic"))
 }
 
 func (s *activateSuite) addMockKeyslot(c *C, key []byte) {
@@ -85,6 +104,8 @@ type testActivateData struct {
 	volumeName       string
 	sourceDevicePath string
 	slot             int
+	options          *ActivateOptions
+	expectedOptions  string
 }
 
 func (s *activateSuite) testActivate(c *C, data *testActivateData) {
@@ -92,11 +113,16 @@ func (s *activateSuite) testActivate(c *C, data *testActivateData) {
 	rand.Read(key)
 	s.addMockKeyslot(c, key)
 
-	c.Check(Activate(data.volumeName, data.sourceDevicePath, key, data.slot), IsNil)
+	c.Check(Activate(data.volumeName, data.sourceDevicePath, key, data.slot, data.options), IsNil)
+
+	expectedOptions := data.expectedOptions
+	if expectedOptions == "" {
+		expectedOptions = fmt.Sprintf("luks,keyslot=%d,tries=1", data.slot)
+	}
 
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
 	c.Assert(s.mockSdCryptsetup.Calls()[0], HasLen, 6)
-	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", data.volumeName, data.sourceDevicePath, "/dev/stdin", fmt.Sprintf("luks,keyslot=%d,tries=1", data.slot)})
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", data.volumeName, data.sourceDevicePath, "/dev/stdin", expectedOptions})
 }
 
 func (s *activateSuite) TestActivate(c *C) {
@@ -127,18 +153,181 @@ func (s *activateSuite) TestActivateDifferentSlot(c *C) {
 		slot:             2})
 }
 
+func (s *activateSuite) TestActivateKeyLargerThanPipeBuffer(c *C) {
+	key := make([]byte, 128*1024)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	c.Check(Activate("data", "/dev/sda1", key, AnySlot, nil), IsNil)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 1)
+}
+
 func (s *activateSuite) TestActivateWrongKey(c *C) {
 	key := make([]byte, 32)
 	rand.Read(key)
 	s.addMockKeyslot(c, key)
 
-	c.Check(Activate("data", "/dev/sda1", nil, AnySlot), ErrorMatches, `systemd-cryptsetup failed with: exit status 5`)
+	c.Check(Activate("data", "/dev/sda1", nil, AnySlot, nil), ErrorMatches, `systemd-cryptsetup failed with: exit status 5`)
 
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
 	c.Assert(s.mockSdCryptsetup.Calls()[0], HasLen, 6)
 	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin", "luks,keyslot=-1,tries=1"})
 }
 
+func (s *activateSuite) TestActivateWithDiscard(c *C) {
+	s.testActivate(c, &testActivateData{
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		slot:             AnySlot,
+		options:          &ActivateOptions{Discard: true},
+		expectedOptions:  "luks,keyslot=-1,tries=1,discard"})
+}
+
+func (s *activateSuite) TestActivateReadOnly(c *C) {
+	s.testActivate(c, &testActivateData{
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		slot:             AnySlot,
+		options:          &ActivateOptions{ReadOnly: true},
+		expectedOptions:  "luks,keyslot=-1,tries=1,read-only"})
+}
+
+func (s *activateSuite) TestActivateWithHeader(c *C) {
+	s.testActivate(c, &testActivateData{
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		slot:             2,
+		options:          &ActivateOptions{HeaderPath: "/run/data.hdr"},
+		expectedOptions:  "luks,keyslot=2,tries=1,header=/run/data.hdr"})
+}
+
+func (s *activateSuite) TestActivateAllOptions(c *C) {
+	s.testActivate(c, &testActivateData{
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		slot:             AnySlot,
+		options: &ActivateOptions{
+			Discard:          true,
+			ReadOnly:         true,
+			SameCPUCrypt:     true,
+			NoReadWorkqueue:  true,
+			NoWriteWorkqueue: true,
+			HeaderPath:       "/run/data.hdr"},
+		expectedOptions: "luks,keyslot=-1,tries=1,discard,read-only,same-cpu-crypt,no-read-workqueue,no-write-workqueue,header=/run/data.hdr"})
+}
+
+func (s *activateSuite) TestActivateInvalidHeaderPath(c *C) {
+	c.Check(Activate("data", "/dev/sda1", nil, AnySlot, &ActivateOptions{HeaderPath: "/run/data.hdr,discard"}), ErrorMatches, "invalid header path")
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *activateSuite) TestActivateSameCPUCryptUnsupported(c *C) {
+	s.mockSystemdVersion(c, 241)
+
+	c.Check(Activate("data", "/dev/sda1", nil, AnySlot, &ActivateOptions{SameCPUCrypt: true}), Equals, ErrMissingCryptsetupFeature)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *activateSuite) TestActivateNoWorkqueueUnsupported(c *C) {
+	s.mockSystemdVersion(c, 245)
+
+	c.Check(Activate("data", "/dev/sda1", nil, AnySlot, &ActivateOptions{NoWriteWorkqueue: true}), Equals, ErrMissingCryptsetupFeature)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *activateSuite) TestValidateActivateOptions(c *C) {
+	opts := &ActivateOptions{SameCPUCrypt: true, NoReadWorkqueue: true}
+	c.Check(opts.Validate(ActivateFeatureSameCPUCrypt|ActivateFeatureNoWorkqueue), IsNil)
+	c.Check(opts.Validate(ActivateFeatureSameCPUCrypt), Equals, ErrMissingCryptsetupFeature)
+	c.Check(opts.Validate(ActivateFeatureNoWorkqueue), Equals, ErrMissingCryptsetupFeature)
+
+	opts = &ActivateOptions{HeaderPath: "/run/data.hdr,discard"}
+	c.Check(opts.Validate(ActivateFeatureSameCPUCrypt|ActivateFeatureNoWorkqueue), ErrorMatches, "invalid header path")
+}
+
+type testDetectActivateFeaturesData struct {
+	version  int
+	expected ActivateFeatures
+}
+
+func (s *activateSuite) testDetectActivateFeatures(c *C, data *testDetectActivateFeaturesData) {
+	s.mockSystemdVersion(c, data.version)
+	c.Check(DetectActivateFeatures(), Equals, data.expected)
+}
+
+func (s *activateSuite) TestDetectActivateFeatures237(c *C) {
+	s.testDetectActivateFeatures(c, &testDetectActivateFeaturesData{version: 237})
+}
+
+func (s *activateSuite) TestDetectActivateFeatures245(c *C) {
+	s.testDetectActivateFeatures(c, &testDetectActivateFeaturesData{
+		version:  245,
+		expected: ActivateFeatureSameCPUCrypt})
+}
+
+func (s *activateSuite) TestDetectActivateFeatures249(c *C) {
+	s.testDetectActivateFeatures(c, &testDetectActivateFeaturesData{
+		version:  249,
+		expected: ActivateFeatureSameCPUCrypt | ActivateFeatureNoWorkqueue})
+}
+
+func (s *activateSuite) TestDetectActivateFeaturesOldDmCrypt(c *C) {
+	// Test that the no-workqueue options aren't reported as supported if
+	// the kernel's dm-crypt target doesn't support them, even if
+	// systemd-cryptsetup does.
+	s.mockDmCryptVersion(c, "v1.21.0")
+	c.Check(DetectActivateFeatures(), Equals, ActivateFeatureSameCPUCrypt)
+}
+
+func (s *activateSuite) TestDetectActivateFeaturesNoCryptTarget(c *C) {
+	// Test that the version of the dm-crypt target is obtained from the
+	// kernel version if the target isn't loaded yet.
+	dmsetup := snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "dmsetup"), `echo "linear           v1.4.0"`)
+	s.AddCleanup(dmsetup.Restore)
+	s.AddCleanup(MockDmsetupPath(dmsetup.Exe()))
+	s.AddCleanup(MockUnixUname("5.4.0-150-generic"))
+	ResetActivateFeatures()
+
+	c.Check(DetectActivateFeatures(), Equals, ActivateFeatureSameCPUCrypt)
+}
+
+func (s *activateSuite) TestDetectActivateFeaturesNoDmsetup(c *C) {
+	// Test that the version of the dm-crypt target is obtained from the
+	// kernel version if dmsetup isn't available.
+	s.AddCleanup(MockDmsetupPath(filepath.Join(c.MkDir(), "dmsetup")))
+	s.AddCleanup(MockUnixUname("6.8.0-31-generic"))
+	ResetActivateFeatures()
+
+	c.Check(DetectActivateFeatures(), Equals, ActivateFeatureSameCPUCrypt|ActivateFeatureNoWorkqueue)
+}
+
+func (s *activateSuite) TestDetectActivateFeaturesNoSystemctl(c *C) {
+	// Test that the version of systemd is obtained from systemd-cryptsetup
+	// if systemctl isn't available, eg, in an initramfs.
+	s.AddCleanup(MockSystemctlPath(filepath.Join(c.MkDir(), "systemctl")))
+	sdCryptsetup := snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "systemd-cryptsetup"), `echo "systemd 245 (245.4-4ubuntu3)"`)
+	s.AddCleanup(sdCryptsetup.Restore)
+	s.AddCleanup(MockSystemdCryptsetupPath(sdCryptsetup.Exe()))
+	ResetActivateFeatures()
+
+	c.Check(DetectActivateFeatures(), Equals, ActivateFeatureSameCPUCrypt)
+	c.Check(sdCryptsetup.Calls(), DeepEquals, [][]string{{"systemd-cryptsetup", "--version"}})
+}
+
+func (s *activateSuite) TestDetectActivateFeaturesUnknownSystemdVersion(c *C) {
+	// Test that no features are reported if the version of systemd can't
+	// be determined, so that requesting them fails rather than being
+	// silently ignored.
+	s.AddCleanup(MockSystemctlPath(filepath.Join(c.MkDir(), "systemctl")))
+	sdCryptsetup := snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "systemd-cryptsetup"), `exit 1`)
+	s.AddCleanup(sdCryptsetup.Restore)
+	s.AddCleanup(MockSystemdCryptsetupPath(sdCryptsetup.Exe()))
+	ResetActivateFeatures()
+
+	c.Check(DetectActivateFeatures(), Equals, ActivateFeatures(0))
+	c.Check(Activate("data", "/dev/sda1", nil, AnySlot, &ActivateOptions{SameCPUCrypt: true}), Equals, ErrMissingCryptsetupFeature)
+}
+
 func (s *activateSuite) TestDeactivate(c *C) {
 	c.Assert(Deactivate("data"), IsNil)
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
@@ -490,6 +490,12 @@ func KillSlot(devicePath string, slot int, key []byte) error {
 	return cryptsetupCmd(bytes.NewReader(key), nil, "luksKillSlot", "--type", "luks2", "--key-file", "-", devicePath, strconv.Itoa(slot))
 }
 
+// CheckKey checks that the supplied key unlocks the keyslot with the supplied slot
+// number on the specified LUKS2 container, without activating it.
+func CheckKey(devicePath string, slot int, key []byte) error {
+	return cryptsetupCmd(bytes.NewReader(key), nil, "open", "--test-passphrase", "--type", "luks2", "--key-file", "-", "--key-slot", strconv.Itoa(slot), devicePath)
+}
+
 // SetSlotPriority sets the priority of the keyslot with the supplied slot number on
 // the specified LUKS2 container.
 func SetSlotPriority(devicePath string, slot int, priority SlotPriority) error {
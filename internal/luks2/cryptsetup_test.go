@@ -997,6 +997,41 @@ func (s *cryptsetupSuite) TestKillNonExistantSlot(c *C) {
 	luks2test.CheckLUKS2Passphrase(c, devicePath, key)
 }
 
+func (s *cryptsetupSuite) TestCheckKey(c *C) {
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	s.cryptsetup.ForgetCalls()
+
+	c.Check(CheckKey(devicePath, 1, key2), IsNil)
+	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "open", "--test-passphrase", "--type", "luks2", "--key-file", "-", "--key-slot", "1", devicePath},
+	})
+}
+
+func (s *cryptsetupSuite) TestCheckKeyWrongSlot(c *C) {
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	c.Check(CheckKey(devicePath, 0, key2), ErrorMatches, "cryptsetup failed with: No key available with this passphrase.")
+}
+
 type testSetSlotPriorityData struct {
 	slotId   int
 	priority SlotPriority
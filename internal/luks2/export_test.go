@@ -88,6 +88,38 @@ func MockStderr(w io.Writer) (restore func()) {
 	}
 }
 
+func MockSystemctlPath(path string) (restore func()) {
+	origSystemctlPath := systemctlPath
+	systemctlPath = path
+	return func() {
+		systemctlPath = origSystemctlPath
+	}
+}
+
+func MockDmsetupPath(path string) (restore func()) {
+	origDmsetupPath := dmsetupPath
+	dmsetupPath = path
+	return func() {
+		dmsetupPath = origDmsetupPath
+	}
+}
+
+func MockUnixUname(release string) (restore func()) {
+	origUname := unixUname
+	unixUname = func(uts *unix.Utsname) error {
+		*uts = unix.Utsname{}
+		copy(uts.Release[:], release)
+		return nil
+	}
+	return func() {
+		unixUname = origUname
+	}
+}
+
+func ResetActivateFeatures() {
+	activateFeaturesOnce = sync.Once{}
+}
+
 func ResetCryptsetupFeatures() {
 	featuresOnce = sync.Once{}
 }
@@ -792,6 +792,7 @@ func (m *Metadata) UnmarshalJSON(data []byte) error {
 type HeaderInfo struct {
 	HeaderSize uint64   // The total size of the binary header and JSON metadata in bytes
 	Label      string   // The label
+	UUID       string   // The UUID of the container
 	Metadata   Metadata // JSON metadata
 }
 
@@ -962,6 +963,7 @@ func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
 	return &HeaderInfo{
 		HeaderSize: hdr.HdrSize,
 		Label:      hdr.Label.String(),
+		UUID:       strings.TrimRight(string(hdr.Uuid[:]), "\x00"),
 		Metadata:   *metadata}, nil
 }
 
@@ -286,6 +286,7 @@ func (s *metadataSuite) TestMarshalGenericToken2(c *C) {
 type testReadHeaderData struct {
 	path             string
 	hdrSize          uint64
+	uuid             string
 	keyslotsSize     uint64
 	keyslot2Priority SlotPriority
 	stderr           string
@@ -300,6 +301,7 @@ func (s *metadataSuite) testReadHeader(c *C, data *testReadHeaderData) {
 
 	c.Check(hdr.HeaderSize, Equals, data.hdrSize)
 	c.Check(hdr.Label, Equals, "data")
+	c.Check(hdr.UUID, Equals, data.uuid)
 
 	c.Assert(hdr.Metadata.Keyslots, HasLen, 2)
 
@@ -372,6 +374,7 @@ func (s *metadataSuite) TestReadHeaderValid(c *C) {
 	s.testReadHeader(c, &testReadHeaderData{
 		path:             "testdata/luks2-valid-hdr.img",
 		hdrSize:          16384,
+		uuid:             "6503ce5c-c2fb-49e9-a560-71928d8ded0e",
 		keyslotsSize:     16744448,
 		keyslot2Priority: SlotPriorityNormal,
 	})
@@ -383,6 +386,7 @@ func (s *metadataSuite) TestReadHeaderInvalidPrimary(c *C) {
 	s.testReadHeader(c, &testReadHeaderData{
 		path:             "testdata/luks2-hdr-invalid-checksum0.img",
 		hdrSize:          16384,
+		uuid:             "6503ce5c-c2fb-49e9-a560-71928d8ded0e",
 		keyslotsSize:     16744448,
 		keyslot2Priority: SlotPriorityNormal,
 		stderr:           "luks2.ReadHeader: primary header for /.*/luks2-hdr-invalid-checksum0.img is invalid: invalid header checksum\n",
@@ -395,6 +399,7 @@ func (s *metadataSuite) TestReadHeaderInvalidSecondary(c *C) {
 	s.testReadHeader(c, &testReadHeaderData{
 		path:             "testdata/luks2-hdr-invalid-checksum1.img",
 		hdrSize:          16384,
+		uuid:             "6503ce5c-c2fb-49e9-a560-71928d8ded0e",
 		keyslotsSize:     16744448,
 		keyslot2Priority: SlotPriorityNormal,
 		stderr:           "luks2.ReadHeader: secondary header for /.*/luks2-hdr-invalid-checksum1.img is invalid: invalid header checksum\n",
@@ -406,6 +411,7 @@ func (s *metadataSuite) TestReadHeaderCustomMetadataSize(c *C) {
 	s.testReadHeader(c, &testReadHeaderData{
 		path:             "testdata/luks2-valid-hdr2.img",
 		hdrSize:          65536,
+		uuid:             "971ccc5f-5843-445b-9cac-65234c203543",
 		keyslotsSize:     8257536,
 		keyslot2Priority: SlotPriorityNormal,
 	})
@@ -418,6 +424,7 @@ func (s *metadataSuite) TestReadHeaderCustomMetadataSizeInvalidPrimary(c *C) {
 	s.testReadHeader(c, &testReadHeaderData{
 		path:             "testdata/luks2-hdr2-invalid-checksum0.img",
 		hdrSize:          65536,
+		uuid:             "971ccc5f-5843-445b-9cac-65234c203543",
 		keyslotsSize:     8257536,
 		keyslot2Priority: SlotPriorityNormal,
 		stderr:           "luks2.ReadHeader: primary header for /.*/luks2-hdr2-invalid-checksum0.img is invalid: invalid header checksum\n",
@@ -430,6 +437,7 @@ func (s *metadataSuite) TestReadHeaderObsoletePrimary(c *C) {
 	s.testReadHeader(c, &testReadHeaderData{
 		path:             "testdata/luks2-hdr-obsolete0.img",
 		hdrSize:          16384,
+		uuid:             "6503ce5c-c2fb-49e9-a560-71928d8ded0e",
 		keyslotsSize:     16744448,
 		keyslot2Priority: SlotPriorityIgnore,
 		stderr:           "luks2.ReadHeader: primary header for /.*/luks2-hdr-obsolete0.img is obsolete\n",
@@ -140,12 +140,25 @@ func (t *TokenBase) Name() string {
 
 type recoveryTokenRaw struct {
 	tokenBaseRaw
+	RotationKeyslot *luks2.JsonNumber `json:"ubuntu_fde_rotation_keyslot,omitempty"`
+	Replaces        string            `json:"ubuntu_fde_replaces,omitempty"`
 }
 
 // RecoveryToken represents a token with the type "ubuntu-fde-recovery",
 // associated with a recovery keyslot
 type RecoveryToken struct {
 	TokenBase
+
+	// RotationKeyslot is set whilst the recovery key associated with
+	// this token is being rotated, and it contains the ID of the keyslot
+	// that the new recovery key is being added to. It is nil if there
+	// is no rotation in progress.
+	RotationKeyslot *int
+
+	// Replaces is set on the token associated with a new recovery key
+	// whilst a rotation is in progress, and contains the name of the
+	// keyslot that it will replace.
+	Replaces string
 }
 
 func (t *RecoveryToken) Type() luks2.TokenType {
@@ -157,7 +170,12 @@ func (t *RecoveryToken) MarshalJSON() ([]byte, error) {
 		tokenBaseRaw: tokenBaseRaw{
 			Type:     RecoveryTokenType,
 			Keyslots: tokenKeyslots{t.TokenKeyslot},
-			Name:     t.TokenName}}
+			Name:     t.TokenName},
+		Replaces: t.Replaces}
+	if t.RotationKeyslot != nil {
+		slot := luks2.JsonNumber(strconv.Itoa(*t.RotationKeyslot))
+		raw.RotationKeyslot = &slot
+	}
 	return json.Marshal(raw)
 }
 
@@ -180,7 +198,15 @@ func (t *RecoveryToken) UnmarshalJSON(data []byte) error {
 	*t = RecoveryToken{
 		TokenBase: TokenBase{
 			TokenKeyslot: int(raw.Keyslots[0]),
-			TokenName:    raw.Name}}
+			TokenName:    raw.Name},
+		Replaces: raw.Replaces}
+	if raw.RotationKeyslot != nil {
+		slot, err := raw.RotationKeyslot.Int()
+		if err != nil {
+			return xerrors.Errorf("invalid rotation keyslot ID: %w", err)
+		}
+		t.RotationKeyslot = &slot
+	}
 	return nil
 }
 
@@ -108,6 +108,72 @@ func (s *tokenSuite) TestUnmarshalRecoveryToken2(c *C) {
 	c.Check(token2, DeepEquals, token)
 }
 
+func (s *tokenSuite) TestMarshalRecoveryTokenWithRotation(c *C) {
+	slot := 3
+	token := &RecoveryToken{
+		TokenBase: TokenBase{
+			TokenName:    "default-recovery",
+			TokenKeyslot: 1},
+		RotationKeyslot: &slot}
+	data, err := json.Marshal(token)
+	c.Check(err, IsNil)
+
+	s.checkRecoveryTokenJSON(c, data, token)
+
+	var j map[string]interface{}
+	c.Assert(json.Unmarshal(data, &j), IsNil)
+	c.Check(j["ubuntu_fde_rotation_keyslot"], Equals, "3")
+	_, exists := j["ubuntu_fde_replaces"]
+	c.Check(exists, testutil.IsFalse)
+}
+
+func (s *tokenSuite) TestMarshalRecoveryTokenReplaces(c *C) {
+	token := &RecoveryToken{
+		TokenBase: TokenBase{
+			TokenName:    "default-recovery-rotating",
+			TokenKeyslot: 3},
+		Replaces: "default-recovery"}
+	data, err := json.Marshal(token)
+	c.Check(err, IsNil)
+
+	s.checkRecoveryTokenJSON(c, data, token)
+
+	var j map[string]interface{}
+	c.Assert(json.Unmarshal(data, &j), IsNil)
+	c.Check(j["ubuntu_fde_replaces"], Equals, "default-recovery")
+	_, exists := j["ubuntu_fde_rotation_keyslot"]
+	c.Check(exists, testutil.IsFalse)
+}
+
+func (s *tokenSuite) TestUnmarshalRecoveryTokenWithRotation(c *C) {
+	slot := 3
+	token := &RecoveryToken{
+		TokenBase: TokenBase{
+			TokenName:    "default-recovery",
+			TokenKeyslot: 1},
+		RotationKeyslot: &slot}
+	data, err := json.Marshal(token)
+	c.Check(err, IsNil)
+
+	var token2 *RecoveryToken
+	c.Check(json.Unmarshal(data, &token2), IsNil)
+	c.Check(token2, DeepEquals, token)
+}
+
+func (s *tokenSuite) TestUnmarshalRecoveryTokenReplaces(c *C) {
+	token := &RecoveryToken{
+		TokenBase: TokenBase{
+			TokenName:    "default-recovery-rotating",
+			TokenKeyslot: 3},
+		Replaces: "default-recovery"}
+	data, err := json.Marshal(token)
+	c.Check(err, IsNil)
+
+	var token2 *RecoveryToken
+	c.Check(json.Unmarshal(data, &token2), IsNil)
+	c.Check(token2, DeepEquals, token)
+}
+
 func (s *tokenSuite) TestDecodeRecoveryToken(c *C) {
 	if luks2.DetectCryptsetupFeatures()&luks2.FeatureTokenImport == 0 {
 		c.Skip("cryptsetup doesn't support token import")
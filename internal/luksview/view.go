@@ -115,6 +115,11 @@ func (v *View) Reread() error {
 	return nil
 }
 
+// UUID returns the UUID of the container from this view.
+func (v *View) UUID() string {
+	return v.hdr.UUID
+}
+
 // TokenNames returns a sorted list of all of the keyslot names from this view.
 // This doesn't return names associated with tokens that have been orphaned
 // because their associated keyslot has been deleted.
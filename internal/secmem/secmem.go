@@ -0,0 +1,170 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package secmem provides a buffer type for holding secrets such as keys.
+package secmem
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+var (
+	unixMadvise = unix.Madvise
+	unixMlock   = unix.Mlock
+	unixMmap    = unix.Mmap
+	unixMunlock = unix.Munlock
+	unixMunmap  = unix.Munmap
+)
+
+// Wipe overwrites the contents of the supplied slice with zeroes.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
+
+// Buffer is a fixed size buffer for holding secrets. Its memory is allocated
+// outside of the Go heap, so it is never moved or copied by the runtime. It
+// is excluded from core dumps, and is locked in to memory if permitted by the
+// process's RLIMIT_MEMLOCK limit so that it is never written to swap.
+//
+// Buffers must be released with Free once they are no longer required, which
+// wipes their contents. Slices returned from Bytes must not be used once the
+// buffer is freed.
+type Buffer struct {
+	mu     sync.Mutex
+	mem    []byte // the page aligned mapping
+	size   int
+	locked bool
+}
+
+// New allocates a new Buffer of the specified size.
+func New(size int) (*Buffer, error) {
+	if size < 0 {
+		return nil, errors.New("invalid size")
+	}
+
+	pageSize := os.Getpagesize()
+	mapLen := ((size + pageSize - 1) / pageSize) * pageSize
+	if mapLen == 0 {
+		mapLen = pageSize
+	}
+
+	mem, err := unixMmap(-1, 0, mapLen, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot allocate memory: %w", err)
+	}
+
+	if err := unixMadvise(mem, unix.MADV_DONTDUMP); err != nil {
+		unixMunmap(mem)
+		return nil, xerrors.Errorf("cannot exclude memory from core dumps: %w", err)
+	}
+
+	b := &Buffer{
+		mem:  mem,
+		size: size,
+		// Locking can fail if the size exceeds RLIMIT_MEMLOCK, in which
+		// case the buffer is still usable.
+		locked: unixMlock(mem) == nil}
+	runtime.SetFinalizer(b, func(b *Buffer) { b.Free() })
+	return b, nil
+}
+
+// NewFromBytes allocates a new Buffer containing a copy of the supplied
+// data. The supplied data is not modified.
+func NewFromBytes(data []byte) (*Buffer, error) {
+	b, err := New(len(data))
+	if err != nil {
+		return nil, err
+	}
+	copy(b.Bytes(), data)
+	return b, nil
+}
+
+// Move allocates a new Buffer containing a copy of the supplied data, and
+// then wipes the supplied data. The supplied data is wiped even if this
+// function returns an error.
+func Move(data []byte) (*Buffer, error) {
+	defer Wipe(data)
+	return NewFromBytes(data)
+}
+
+// Bytes returns the contents of this buffer. It returns nil if the buffer
+// has been freed.
+func (b *Buffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.mem == nil {
+		return nil
+	}
+	return b.mem[:b.size:b.size]
+}
+
+// Len returns the size of this buffer.
+func (b *Buffer) Len() int {
+	return b.size
+}
+
+// Locked indicates whether this buffer is locked in to memory.
+func (b *Buffer) Locked() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.locked
+}
+
+// Wipe overwrites the contents of this buffer with zeroes.
+func (b *Buffer) Wipe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	Wipe(b.mem)
+}
+
+// Free wipes the contents of this buffer and releases its memory. It is safe
+// to call this more than once.
+func (b *Buffer) Free() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.mem == nil {
+		return nil
+	}
+
+	Wipe(b.mem)
+	if b.locked {
+		unixMunlock(b.mem)
+		b.locked = false
+	}
+
+	mem := b.mem
+	b.mem = nil
+	runtime.SetFinalizer(b, nil)
+
+	if err := unixMunmap(mem); err != nil {
+		return xerrors.Errorf("cannot release memory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secmem_test
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/secmem"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type secmemSuite struct{}
+
+var _ = Suite(&secmemSuite{})
+
+func (s *secmemSuite) TestWipe(c *C) {
+	b := []byte("foobarbaz")
+	Wipe(b)
+	c.Check(b, DeepEquals, make([]byte, 9))
+}
+
+func (s *secmemSuite) TestNew(c *C) {
+	var advice int
+	restore := MockUnixMadvise(func(b []byte, a int) error {
+		c.Check(len(b), Equals, os.Getpagesize())
+		advice = a
+		return unix.Madvise(b, a)
+	})
+	defer restore()
+
+	b, err := New(32)
+	c.Assert(err, IsNil)
+	defer b.Free()
+
+	c.Check(advice, Equals, unix.MADV_DONTDUMP)
+	c.Check(b.Len(), Equals, 32)
+	c.Check(b.Bytes(), DeepEquals, make([]byte, 32))
+	c.Check(cap(b.Bytes()), Equals, 32)
+
+	copy(b.Bytes(), "foo")
+	c.Check(b.Bytes()[:3], DeepEquals, []byte("foo"))
+}
+
+func (s *secmemSuite) TestNewLargerThanPage(c *C) {
+	restore := MockUnixMadvise(func(b []byte, a int) error {
+		c.Check(len(b), Equals, 2*os.Getpagesize())
+		return unix.Madvise(b, a)
+	})
+	defer restore()
+
+	b, err := New(os.Getpagesize() + 1)
+	c.Assert(err, IsNil)
+	defer b.Free()
+	c.Check(b.Len(), Equals, os.Getpagesize()+1)
+}
+
+func (s *secmemSuite) TestNewZeroSize(c *C) {
+	b, err := New(0)
+	c.Assert(err, IsNil)
+	defer b.Free()
+	c.Check(b.Bytes(), HasLen, 0)
+}
+
+func (s *secmemSuite) TestNewInvalidSize(c *C) {
+	_, err := New(-1)
+	c.Check(err, ErrorMatches, "invalid size")
+}
+
+func (s *secmemSuite) TestNewMadviseFails(c *C) {
+	restore := MockUnixMadvise(func(b []byte, a int) error {
+		return syscall.EINVAL
+	})
+	defer restore()
+
+	_, err := New(32)
+	c.Check(err, ErrorMatches, "cannot exclude memory from core dumps: invalid argument")
+}
+
+func (s *secmemSuite) TestLocked(c *C) {
+	restore := MockUnixMlock(func(b []byte) error {
+		return nil
+	})
+	defer restore()
+
+	b, err := New(32)
+	c.Assert(err, IsNil)
+	defer b.Free()
+	c.Check(b.Locked(), testutil.IsTrue)
+}
+
+func (s *secmemSuite) TestLockFails(c *C) {
+	restore := MockUnixMlock(func(b []byte) error {
+		return syscall.ENOMEM
+	})
+	defer restore()
+
+	b, err := New(32)
+	c.Assert(err, IsNil)
+	defer b.Free()
+	c.Check(b.Locked(), testutil.IsFalse)
+	c.Check(b.Bytes(), HasLen, 32)
+}
+
+func (s *secmemSuite) TestNewFromBytes(c *C) {
+	data := []byte("foobarbaz")
+
+	b, err := NewFromBytes(data)
+	c.Assert(err, IsNil)
+	defer b.Free()
+
+	c.Check(b.Bytes(), DeepEquals, []byte("foobarbaz"))
+	c.Check(data, DeepEquals, []byte("foobarbaz"))
+}
+
+func (s *secmemSuite) TestWipeBuffer(c *C) {
+	b, err := NewFromBytes([]byte("foobarbaz"))
+	c.Assert(err, IsNil)
+	defer b.Free()
+
+	b.Wipe()
+	c.Check(b.Bytes(), DeepEquals, make([]byte, 9))
+}
+
+func (s *secmemSuite) TestFreeWipes(c *C) {
+	var unmapped []byte
+	restore := MockUnixMunmap(func(b []byte) error {
+		unmapped = append([]byte(nil), b...)
+		return unix.Munmap(b)
+	})
+	defer restore()
+
+	b, err := NewFromBytes(bytes.Repeat([]byte{0xff}, 64))
+	c.Assert(err, IsNil)
+
+	c.Check(b.Free(), IsNil)
+	c.Check(unmapped, DeepEquals, make([]byte, os.Getpagesize()))
+	c.Check(b.Bytes(), IsNil)
+	c.Check(b.Locked(), testutil.IsFalse)
+}
+
+func (s *secmemSuite) TestFreeTwice(c *C) {
+	n := 0
+	restore := MockUnixMunmap(func(b []byte) error {
+		n++
+		return unix.Munmap(b)
+	})
+	defer restore()
+
+	b, err := New(32)
+	c.Assert(err, IsNil)
+
+	c.Check(b.Free(), IsNil)
+	c.Check(b.Free(), IsNil)
+	c.Check(n, Equals, 1)
+}
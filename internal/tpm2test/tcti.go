@@ -20,6 +20,7 @@
 package tpm2test
 
 import (
+	"io"
 	"os"
 
 	"github.com/canonical/go-tpm2"
@@ -33,12 +34,38 @@ type TCTI struct {
 	keepOpen     bool
 	markedClosed bool
 	closed       bool
+
+	passthrough bool // the current command bypasses tcti
+}
+
+// isPassthroughCommand indicates whether the supplied command needs to be
+// sent directly to the underlying connection because tpm2_testutil.TCTI
+// doesn't know about it. These commands must not create or modify any
+// resources that the test fixture needs to track.
+func isPassthroughCommand(data []byte) bool {
+	code, err := tpm2.CommandPacket(data).GetCommandCode()
+	if err != nil {
+		return false
+	}
+	switch code {
+	case tpm2.CommandPolicyAuthorizeNV:
+		return true
+	default:
+		return false
+	}
 }
 
 func (t *TCTI) Read(data []byte) (int, error) {
 	if t.markedClosed {
 		return 0, os.ErrClosed
 	}
+	if t.passthrough {
+		n, err := t.tcti.Unwrap().Read(data)
+		if err == io.EOF {
+			t.passthrough = false
+		}
+		return n, err
+	}
 	return t.tcti.Read(data)
 }
 
@@ -46,6 +73,10 @@ func (t *TCTI) Write(data []byte) (int, error) {
 	if t.markedClosed {
 		return 0, os.ErrClosed
 	}
+	if isPassthroughCommand(data) {
+		t.passthrough = true
+		return t.tcti.Unwrap().Write(data)
+	}
 	return t.tcti.Write(data)
 }
 
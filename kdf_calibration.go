@@ -0,0 +1,185 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const defaultKDFTargetDuration = 2 * time.Second
+
+var (
+	procCpuinfoPath = "/proc/cpuinfo"
+
+	// cpuinfoModelKeys are the keys from /proc/cpuinfo that identify
+	// the CPU model on the architectures that we support, in order of
+	// preference.
+	cpuinfoModelKeys = []string{"model name", "Model", "Hardware", "cpu"}
+)
+
+// KDFHardwareFingerprint identifies the hardware on which KDF cost parameters
+// were calibrated.
+type KDFHardwareFingerprint struct {
+	CPUModel string `json:"cpu_model"` // The CPU model, as reported in /proc/cpuinfo
+	NumCPU   int    `json:"num_cpu"`   // The number of CPUs available to this process
+}
+
+func readCPUModel() (string, error) {
+	f, err := os.Open(procCpuinfoPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(fields[0])
+		if _, exists := values[key]; exists {
+			continue
+		}
+		values[key] = strings.TrimSpace(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	for _, key := range cpuinfoModelKeys {
+		if model, ok := values[key]; ok {
+			return model, nil
+		}
+	}
+
+	return "", nil
+}
+
+// CurrentKDFHardwareFingerprint returns the fingerprint of the hardware that
+// the current process is running on.
+func CurrentKDFHardwareFingerprint() (*KDFHardwareFingerprint, error) {
+	model, err := readCPUModel()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine CPU model: %w", err)
+	}
+
+	return &KDFHardwareFingerprint{
+		CPUModel: model,
+		NumCPU:   runtimeNumCPU()}, nil
+}
+
+// KDFCalibration contains the results of benchmarking the KDF, which can be
+// supplied via KDFOptions in order to avoid benchmarking the KDF again on
+// subsequent operations. It can be serialized to JSON so that it can be
+// persisted.
+type KDFCalibration struct {
+	// Fingerprint identifies the hardware on which the KDF was
+	// benchmarked.
+	Fingerprint KDFHardwareFingerprint `json:"fingerprint"`
+
+	// TargetDuration is the target duration that the KDF was
+	// benchmarked against.
+	TargetDuration time.Duration `json:"target_duration"`
+
+	// Params are the benchmarked cost parameters.
+	Params KDFCostParams `json:"params"`
+}
+
+// Matches indicates whether this calibration was performed on the hardware
+// that the current process is running on.
+func (c *KDFCalibration) Matches() bool {
+	fingerprint, err := CurrentKDFHardwareFingerprint()
+	if err != nil {
+		return false
+	}
+	return c.Fingerprint == *fingerprint
+}
+
+// calibratedCostParams returns the calibrated cost parameters if a
+// calibration was supplied, it was performed on the current hardware and
+// it was benchmarked against the requested target duration. If these
+// conditions aren't met, it returns nil.
+func (o *KDFOptions) calibratedCostParams() *KDFCostParams {
+	if o.Calibration == nil || o.ForceIterations != 0 {
+		return nil
+	}
+
+	targetDuration := o.TargetDuration
+	if targetDuration == 0 {
+		targetDuration = defaultKDFTargetDuration
+	}
+	if o.Calibration.TargetDuration != targetDuration {
+		return nil
+	}
+	if !o.Calibration.Matches() {
+		return nil
+	}
+
+	params := o.Calibration.Params
+	return &params
+}
+
+// CalibrateKDF benchmarks the KDF once with the supplied options and returns
+// the result along with a fingerprint of the current hardware. The result can
+// be persisted and then supplied via the Calibration field of KDFOptions for
+// subsequent operations, in order to avoid running the benchmark each time.
+//
+// The kdfOptions argument must not have ForceIterations set. Its Calibration
+// field is ignored. The kdf argument provides the Argon2 KDF implementation
+// that will be benchmarked.
+func CalibrateKDF(kdfOptions *KDFOptions, kdf KDF) (*KDFCalibration, error) {
+	var options KDFOptions
+	if kdfOptions != nil {
+		options = *kdfOptions
+	}
+	if options.ForceIterations != 0 {
+		return nil, errors.New("cannot calibrate KDF with ForceIterations set")
+	}
+	options.Calibration = nil
+
+	fingerprint, err := CurrentKDFHardwareFingerprint()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain hardware fingerprint: %w", err)
+	}
+
+	params, err := options.deriveCostParams(passphraseKeyLen, kdf)
+	if err != nil {
+		return nil, err
+	}
+
+	targetDuration := options.TargetDuration
+	if targetDuration == 0 {
+		targetDuration = defaultKDFTargetDuration
+	}
+
+	return &KDFCalibration{
+		Fingerprint:    *fingerprint,
+		TargetDuration: targetDuration,
+		Params:         *params}, nil
+}
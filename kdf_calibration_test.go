@@ -0,0 +1,221 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+const (
+	x86Cpuinfo = `processor	: 0
+vendor_id	: GenuineIntel
+cpu family	: 6
+model		: 142
+model name	: Intel(R) Core(TM) i7-8650U CPU @ 1.90GHz
+stepping	: 10
+
+processor	: 1
+vendor_id	: GenuineIntel
+cpu family	: 6
+model		: 142
+model name	: Intel(R) Core(TM) i7-8650U CPU @ 1.90GHz
+stepping	: 10
+`
+
+	armCpuinfo = `processor	: 0
+BogoMIPS	: 108.00
+Features	: fp asimd evtstrm crc32 cpuid
+CPU implementer	: 0x41
+CPU part	: 0xd08
+
+Hardware	: BCM2835
+Model		: Raspberry Pi 4 Model B Rev 1.4
+`
+)
+
+type kdfCalibrationSuite struct {
+	restores []func()
+}
+
+var _ = Suite(&kdfCalibrationSuite{})
+
+func (s *kdfCalibrationSuite) SetUpTest(c *C) {
+	s.restores = []func(){
+		MockRuntimeNumCPU(2),
+		s.mockCpuinfo(c, x86Cpuinfo)}
+}
+
+func (s *kdfCalibrationSuite) TearDownTest(c *C) {
+	for i := len(s.restores) - 1; i >= 0; i-- {
+		s.restores[i]()
+	}
+	s.restores = nil
+}
+
+func (s *kdfCalibrationSuite) mockCpuinfo(c *C, content string) (restore func()) {
+	path := filepath.Join(c.MkDir(), "cpuinfo")
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+	return MockProcCpuinfoPath(path)
+}
+
+func (s *kdfCalibrationSuite) TestCurrentKDFHardwareFingerprint(c *C) {
+	fingerprint, err := CurrentKDFHardwareFingerprint()
+	c.Assert(err, IsNil)
+	c.Check(fingerprint, DeepEquals, &KDFHardwareFingerprint{
+		CPUModel: "Intel(R) Core(TM) i7-8650U CPU @ 1.90GHz",
+		NumCPU:   2})
+}
+
+func (s *kdfCalibrationSuite) TestCurrentKDFHardwareFingerprintARM(c *C) {
+	restore := s.mockCpuinfo(c, armCpuinfo)
+	defer restore()
+	restore = MockRuntimeNumCPU(4)
+	defer restore()
+
+	fingerprint, err := CurrentKDFHardwareFingerprint()
+	c.Assert(err, IsNil)
+	c.Check(fingerprint, DeepEquals, &KDFHardwareFingerprint{
+		CPUModel: "Raspberry Pi 4 Model B Rev 1.4",
+		NumCPU:   4})
+}
+
+func (s *kdfCalibrationSuite) TestCurrentKDFHardwareFingerprintNoCpuinfo(c *C) {
+	restore := MockProcCpuinfoPath(filepath.Join(c.MkDir(), "cpuinfo"))
+	defer restore()
+
+	_, err := CurrentKDFHardwareFingerprint()
+	c.Check(err, ErrorMatches, "cannot determine CPU model: open .*/cpuinfo: no such file or directory")
+}
+
+func (s *kdfCalibrationSuite) TestCalibrateKDF(c *C) {
+	var kdf testutil.MockKDF
+	calibration, err := CalibrateKDF(nil, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(kdf.BenchmarkKeyLen, Equals, uint32(48))
+
+	kdf.BenchmarkKeyLen = 0
+	expected, err := new(KDFOptions).DeriveCostParams(48, &kdf)
+	c.Assert(err, IsNil)
+
+	c.Check(calibration, DeepEquals, &KDFCalibration{
+		Fingerprint: KDFHardwareFingerprint{
+			CPUModel: "Intel(R) Core(TM) i7-8650U CPU @ 1.90GHz",
+			NumCPU:   2},
+		TargetDuration: 2 * time.Second,
+		Params:         *expected})
+}
+
+func (s *kdfCalibrationSuite) TestCalibrateKDFTargetDuration(c *C) {
+	var kdf testutil.MockKDF
+	calibration, err := CalibrateKDF(&KDFOptions{TargetDuration: 500 * time.Millisecond}, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(calibration.TargetDuration, Equals, 500*time.Millisecond)
+
+	duration, err := kdf.Time(&calibration.Params, 48)
+	c.Check(err, IsNil)
+	c.Check(duration, Equals, 500*time.Millisecond)
+}
+
+func (s *kdfCalibrationSuite) TestCalibrateKDFForceIterations(c *C) {
+	var kdf testutil.MockKDF
+	_, err := CalibrateKDF(&KDFOptions{ForceIterations: 4}, &kdf)
+	c.Check(err, ErrorMatches, "cannot calibrate KDF with ForceIterations set")
+}
+
+func (s *kdfCalibrationSuite) TestCalibrationJSON(c *C) {
+	calibration := &KDFCalibration{
+		Fingerprint: KDFHardwareFingerprint{
+			CPUModel: "Intel(R) Core(TM) i7-8650U CPU @ 1.90GHz",
+			NumCPU:   2},
+		TargetDuration: 2 * time.Second,
+		Params:         KDFCostParams{Time: 4, MemoryKiB: 512 * 1024, Threads: 2}}
+
+	b, err := json.Marshal(calibration)
+	c.Check(err, IsNil)
+	c.Check(string(b), Equals, `{"fingerprint":{"cpu_model":"Intel(R) Core(TM) i7-8650U CPU @ 1.90GHz","num_cpu":2},"target_duration":2000000000,"params":{"time":4,"memory":524288,"threads":2}}`)
+
+	var decoded *KDFCalibration
+	c.Check(json.Unmarshal(b, &decoded), IsNil)
+	c.Check(decoded, DeepEquals, calibration)
+}
+
+func (s *kdfCalibrationSuite) newCalibration() *KDFCalibration {
+	return &KDFCalibration{
+		Fingerprint: KDFHardwareFingerprint{
+			CPUModel: "Intel(R) Core(TM) i7-8650U CPU @ 1.90GHz",
+			NumCPU:   2},
+		TargetDuration: 2 * time.Second,
+		Params:         KDFCostParams{Time: 5, MemoryKiB: 300 * 1024, Threads: 2}}
+}
+
+func (s *kdfCalibrationSuite) TestDeriveCostParamsWithCalibration(c *C) {
+	var kdf testutil.MockKDF
+	params, err := (&KDFOptions{Calibration: s.newCalibration()}).DeriveCostParams(48, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(kdf.BenchmarkKeyLen, Equals, uint32(0))
+	c.Check(params, DeepEquals, &KDFCostParams{Time: 5, MemoryKiB: 300 * 1024, Threads: 2})
+}
+
+func (s *kdfCalibrationSuite) TestDeriveCostParamsWithCalibrationDifferentHardware(c *C) {
+	restore := MockRuntimeNumCPU(4)
+	defer restore()
+
+	var kdf testutil.MockKDF
+	params, err := (&KDFOptions{Calibration: s.newCalibration()}).DeriveCostParams(48, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(kdf.BenchmarkKeyLen, Equals, uint32(48))
+	c.Check(params, Not(DeepEquals), &KDFCostParams{Time: 5, MemoryKiB: 300 * 1024, Threads: 2})
+}
+
+func (s *kdfCalibrationSuite) TestDeriveCostParamsWithCalibrationDifferentTargetDuration(c *C) {
+	var kdf testutil.MockKDF
+	_, err := (&KDFOptions{TargetDuration: time.Second, Calibration: s.newCalibration()}).DeriveCostParams(48, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(kdf.BenchmarkKeyLen, Equals, uint32(48))
+}
+
+func (s *kdfCalibrationSuite) TestDeriveCostParamsWithCalibrationForceIterations(c *C) {
+	var kdf testutil.MockKDF
+	params, err := (&KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024, Calibration: s.newCalibration()}).DeriveCostParams(48, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(params, DeepEquals, &KDFCostParams{Time: 4, MemoryKiB: 32 * 1024, Threads: 2})
+}
+
+func (s *kdfCalibrationSuite) TestLUKSOptsWithCalibration(c *C) {
+	opts := &KDFOptions{Calibration: s.newCalibration()}
+	c.Check(opts.LUKSOpts(), DeepEquals, luks2.KDFOptions{ForceIterations: 5, MemoryKiB: 300 * 1024, Parallel: 2})
+}
+
+func (s *kdfCalibrationSuite) TestLUKSOptsWithCalibrationDifferentHardware(c *C) {
+	restore := s.mockCpuinfo(c, armCpuinfo)
+	defer restore()
+
+	opts := &KDFOptions{TargetDuration: 2 * time.Second, Calibration: s.newCalibration()}
+	c.Check(opts.LUKSOpts(), DeepEquals, luks2.KDFOptions{TargetDuration: 2 * time.Second})
+}
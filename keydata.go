@@ -24,6 +24,7 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
@@ -36,6 +37,8 @@ import (
 
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/secmem"
 )
 
 const (
@@ -43,10 +46,19 @@ const (
 	nilHash                    hashAlg = 0
 	passphraseEncryptionKeyLen         = 32
 	passphraseEncryption               = "aes-cfb"
+
+	// passphraseKeyLen is the length of the key derived from a passphrase,
+	// which is used for both the encryption key and the IV.
+	passphraseKeyLen = passphraseEncryptionKeyLen + aes.BlockSize
+
+	// keyDataGeneration is the generation of newly created key data.
+	// Key data with a generation of 2 or later must have a metadata MAC.
+	keyDataGeneration = 2
 )
 
 var (
 	snapModelHMACKDFLabel = []byte("SNAP-MODEL-HMAC")
+	metadataMACKDFLabel   = []byte("KEYDATA-MAC")
 )
 
 // ErrNoPlatformHandlerRegistered is returned from KeyData methods if no
@@ -58,6 +70,11 @@ var ErrNoPlatformHandlerRegistered = errors.New("no appropriate platform handler
 // knowledge of a passphrase is the supplied passphrase is incorrect.
 var ErrInvalidPassphrase = errors.New("the supplied passphrase is incorrect")
 
+// ErrNoMetadataMAC is returned from KeyData.VerifyMetadataMAC if the key
+// data was created before metadata MACs were introduced and does not have
+// one.
+var ErrNoMetadataMAC = errors.New("the key data does not have a metadata MAC")
+
 // InvalidKeyDataError is returned from KeyData methods if the key data
 // is invalid in some way.
 type InvalidKeyDataError struct {
@@ -100,6 +117,21 @@ func (e *PlatformDeviceUnavailableError) Unwrap() error {
 	return e.err
 }
 
+// PlatformLockoutError is returned from KeyData methods if the platform's
+// secure device is locked out for a KeyData because of too many incorrect
+// authorization attempts.
+type PlatformLockoutError struct {
+	err error
+}
+
+func (e *PlatformLockoutError) Error() string {
+	return fmt.Sprintf("the platform's secure device is locked out: %v", e.err)
+}
+
+func (e *PlatformLockoutError) Unwrap() error {
+	return e.err
+}
+
 // DiskUnlockKey is the key used to unlock a LUKS volume.
 type DiskUnlockKey []byte
 
@@ -283,6 +315,7 @@ type authorizedSnapModelsRaw struct {
 	KDFAlg    hashAlg           `json:"kdf_alg,omitempty"`
 	KeyDigest json.RawMessage   `json:"key_digest"`
 	Hmacs     snapModelHMACList `json:"hmacs"`
+	RuleHmacs snapModelHMACList `json:"rule_hmacs,omitempty"`
 }
 
 // authorizedSnapModels defines the Snap models that have been
@@ -292,6 +325,7 @@ type authorizedSnapModels struct {
 	kdfAlg    hashAlg           // Digest algorithm used to derive the HMAC key with HKDF. Zero for legacy (DRBG) derivation.
 	keyDigest keyDigest         // information used to validate the correctness of the HMAC key
 	hmacs     snapModelHMACList // the list of HMACs of authorized models
+	ruleHmacs snapModelHMACList // the list of HMACs of authorization rules
 
 	// legacyKeyDigest is true when keyDigest should be marshalled
 	// as a plain key rather than a keyDigest object.
@@ -316,7 +350,8 @@ func (m authorizedSnapModels) MarshalJSON() ([]byte, error) {
 		Alg:       m.alg,
 		KDFAlg:    m.kdfAlg,
 		KeyDigest: digest,
-		Hmacs:     m.hmacs})
+		Hmacs:     m.hmacs,
+		RuleHmacs: m.ruleHmacs})
 }
 
 // UnmarshalJSON implements custom unmarshalling to handle older key data
@@ -328,9 +363,10 @@ func (m *authorizedSnapModels) UnmarshalJSON(b []byte) error {
 	}
 
 	*m = authorizedSnapModels{
-		alg:    raw.Alg,
-		kdfAlg: raw.KDFAlg,
-		hmacs:  raw.Hmacs}
+		alg:       raw.Alg,
+		kdfAlg:    raw.KDFAlg,
+		hmacs:     raw.Hmacs,
+		ruleHmacs: raw.RuleHmacs}
 
 	token, err := json.NewDecoder(bytes.NewReader(raw.KeyDigest)).Token()
 	switch {
@@ -392,7 +428,21 @@ type passphraseData struct {
 	EncryptedPayload []byte `json:"encrypted_payload"`
 }
 
+// metadataMAC contains a MAC of the serialized key data, which is used to
+// detect modifications to the key data metadata by anything that doesn't
+// have access to the auxiliary key.
+type metadataMAC struct {
+	Alg hashAlg `json:"alg"` // Digest algorithm used for HKDF and the HMAC
+	MAC []byte  `json:"mac"`
+}
+
 type keyData struct {
+	// Generation is the generation of this key data. It is zero for key
+	// data created before metadata MACs were introduced. It is bound to
+	// the auxiliary key digest in AuthorizedSnapModels so that it can't
+	// be changed without the auxiliary key.
+	Generation int `json:"generation,omitempty"`
+
 	PlatformName string `json:"platform_name"` // used to identify a PlatformKeyDataHandler
 
 	// PlatformHandle is an opaque blob of data used by the associated
@@ -410,6 +460,19 @@ type keyData struct {
 	// AuthorizedSnapModels contains information about the Snap models
 	// that have been authorized to access the data protected by this key.
 	AuthorizedSnapModels authorizedSnapModels `json:"authorized_snap_models"`
+
+	// AuthorizedBootIdentities contains information about the boot
+	// identities that have been authorized to access the data protected
+	// by this key.
+	AuthorizedBootIdentities *authorizedBootIdentities `json:"authorized_boot_identities,omitempty"`
+
+	// VolumeKeyDerivation is set if the protected key is a root key
+	// from which the unlock key for each volume is derived using HKDF.
+	VolumeKeyDerivation *hkdfData `json:"volume_key_derivation,omitempty"`
+
+	// MetadataMAC is a MAC of all of the other fields in this structure,
+	// keyed from the auxiliary key.
+	MetadataMAC *metadataMAC `json:"metadata_mac,omitempty"`
 }
 
 func processPlatformHandlerError(err error) error {
@@ -424,6 +487,8 @@ func processPlatformHandlerError(err error) error {
 			return &PlatformDeviceUnavailableError{pe.Err}
 		case PlatformHandlerErrorInvalidAuthKey:
 			return ErrInvalidPassphrase
+		case PlatformHandlerErrorLockout:
+			return &PlatformLockoutError{pe.Err}
 		}
 	}
 
@@ -482,50 +547,173 @@ func (d *KeyData) snapModelAuthKey(auxKey AuxiliaryKey) ([]byte, error) {
 	return hmacKey, nil
 }
 
-func (d *KeyData) updatePassphrase(payload, oldKey []byte, passphrase string, kdfOptions *KDFOptions, kdf KDF) error {
-	handler := handlers[d.data.PlatformName]
-	if handler == nil {
-		return ErrNoPlatformHandlerRegistered
+// computeAuxKeyDigest computes the digest of the supplied snap model HMAC
+// key, which is used to verify that a supplied auxiliary key is correct.
+// For key data with a generation of 2 or later, the digest also covers the
+// generation.
+func (d *KeyData) computeAuxKeyDigest(hmacKey []byte) ([]byte, error) {
+	alg := d.data.AuthorizedSnapModels.keyDigest.Alg
+	if !alg.Available() {
+		return nil, errors.New("invalid digest algorithm")
+	}
+
+	h := alg.New()
+	h.Write(hmacKey)
+	h.Write(d.data.AuthorizedSnapModels.keyDigest.Salt)
+	if d.data.Generation >= keyDataGeneration {
+		binary.Write(h, binary.BigEndian, uint32(d.data.Generation))
+	}
+	return h.Sum(nil), nil
+}
+
+func (d *KeyData) computeMetadataMAC(alg hashAlg, auxKey AuxiliaryKey) ([]byte, error) {
+	return computeKeyDataMAC(d.data, alg, auxKey)
+}
+
+// computeKeyDataMAC computes a MAC of the supplied key data, keyed from
+// the supplied auxKey.
+func computeKeyDataMAC(data keyData, alg hashAlg, auxKey AuxiliaryKey) ([]byte, error) {
+	if !alg.Available() {
+		return nil, errors.New("invalid digest algorithm")
+	}
+
+	r := hkdf.Expand(func() hash.Hash { return alg.New() }, auxKey, metadataMACKDFLabel)
+	macKey := make([]byte, alg.Size())
+	if _, err := io.ReadFull(r, macKey); err != nil {
+		return nil, xerrors.Errorf("cannot derive key: %w", err)
+	}
+
+	data.MetadataMAC = nil
+	b, err := json.Marshal(&data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot encode keydata: %w", err)
+	}
+
+	h := hmac.New(func() hash.Hash { return alg.New() }, macKey)
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// checkAuxKey checks that the supplied auxKey is correct by using
+// it to derive the snap model HMAC key and comparing its digest
+// with the one stored in the key data.
+func (d *KeyData) checkAuxKey(auxKey AuxiliaryKey) error {
+	hmacKey, err := d.snapModelAuthKey(auxKey)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain auth key: %w", err)
+	}
+
+	digest, err := d.computeAuxKeyDigest(hmacKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, d.data.AuthorizedSnapModels.keyDigest.Digest) {
+		return errors.New("incorrect key supplied")
+	}
+
+	return nil
+}
+
+// updateMetadataMACForAuthChange computes the metadata MAC for newData, which
+// is an update of this key data where the passphrase has been changed. If auxKey
+// isn't supplied, it is recovered from newData using the supplied platform
+// protected payload and authKey. The existing metadata MAC is verified first so
+// that a passphrase change can't be used to authenticate metadata that has been
+// modified. If this key data doesn't have a metadata MAC, then this does nothing.
+func (d *KeyData) updateMetadataMACForAuthChange(handler PlatformKeyDataHandler, newData *keyData, payload, authKey []byte, auxKey AuxiliaryKey) error {
+	if d.data.MetadataMAC == nil {
+		return nil
+	}
+
+	if auxKey == nil {
+		data := &PlatformKeyData{
+			EncodedHandle:    newData.PlatformHandle,
+			EncryptedPayload: payload}
+
+		var c KeyPayload
+		var err error
+		if authKey == nil {
+			c, err = handler.RecoverKeys(data)
+		} else {
+			c, err = handler.RecoverKeysWithAuthKey(data, authKey)
+		}
+		if err != nil {
+			return xerrors.Errorf("cannot recover auxiliary key to update metadata MAC: %w", processPlatformHandlerError(err))
+		}
+		defer secmem.Wipe(c)
+
+		_, auxKey, err = c.Unmarshal()
+		if err != nil {
+			return &InvalidKeyDataError{xerrors.Errorf("cannot unmarshal cleartext key payload: %w", err)}
+		}
 	}
 
+	if err := d.VerifyMetadataMAC(auxKey); err != nil {
+		return err
+	}
+
+	mac, err := computeKeyDataMAC(*newData, d.data.MetadataMAC.Alg, auxKey)
+	if err != nil {
+		return xerrors.Errorf("cannot compute MAC: %w", err)
+	}
+	newData.MetadataMAC = &metadataMAC{Alg: d.data.MetadataMAC.Alg, MAC: mac}
+	return nil
+}
+
+func (d *KeyData) updatePassphrase(payload, oldKey []byte, passphrase string, kdfOptions *KDFOptions, kdf KDF) error {
 	if kdfOptions == nil {
 		var defaultOptions KDFOptions
 		kdfOptions = &defaultOptions
 	}
 
 	// Derive both a key and an IV from the passphrase in a single pass.
-	keyLen := passphraseEncryptionKeyLen + aes.BlockSize
-
-	params, err := kdfOptions.deriveCostParams(keyLen, kdf)
+	params, err := kdfOptions.deriveCostParams(passphraseKeyLen, kdf)
 	if err != nil {
 		return xerrors.Errorf("cannot derive KDF cost parameters: %w", err)
 	}
 
+	return d.updatePassphraseWithCostParams(payload, oldKey, passphrase, params, kdf, nil)
+}
+
+func (d *KeyData) updatePassphraseWithCostParams(payload, oldKey []byte, passphrase string, params *KDFCostParams, kdf KDF, auxKey AuxiliaryKey) error {
+	handler := handlers[d.data.PlatformName]
+	if handler == nil {
+		return ErrNoPlatformHandlerRegistered
+	}
+
 	var salt [16]byte
 	if _, err := rand.Read(salt[:]); err != nil {
 		return xerrors.Errorf("cannot read salt for new passphrase: %w", err)
 	}
 
-	key, err := kdf.Derive(passphrase, salt[:], params, uint32(keyLen))
+	k, err := kdf.Derive(passphrase, salt[:], params, passphraseKeyLen)
 	if err != nil {
 		return xerrors.Errorf("cannot derive key for new passphrase: %w", err)
 	}
-	if len(key) != keyLen {
+	if len(k) != passphraseKeyLen {
+		secmem.Wipe(k)
 		return errors.New("KDF returned unexpected key length")
 	}
+	key, err := secmem.Move(k)
+	if err != nil {
+		return xerrors.Errorf("cannot allocate buffer for key: %w", err)
+	}
+	defer key.Free()
 
-	handle, err := handler.ChangeAuthKey(d.data.PlatformHandle, oldKey, key)
+	handle, err := handler.ChangeAuthKey(d.data.PlatformHandle, oldKey, key.Bytes())
 	if err != nil {
 		return err
 	}
 
-	c, err := aes.NewCipher(key[:passphraseEncryptionKeyLen])
+	c, err := aes.NewCipher(key.Bytes()[:passphraseEncryptionKeyLen])
 	if err != nil {
 		return xerrors.Errorf("cannot create cipher: %w", err)
 	}
 
-	d.data.PlatformHandle = handle
-	d.data.PassphraseProtectedPayload = &passphraseData{
+	newData := d.data
+	newData.PlatformHandle = handle
+	newData.EncryptedPayload = nil
+	newData.PassphraseProtectedPayload = &passphraseData{
 		KDF: kdfData{
 			Type:   kdfType,
 			Salt:   salt[:],
@@ -536,13 +724,21 @@ func (d *KeyData) updatePassphrase(payload, oldKey []byte, passphrase string, kd
 		KeySize:          passphraseEncryptionKeyLen,
 		EncryptedPayload: make([]byte, len(payload))}
 
-	stream := cipher.NewCFBEncrypter(c, key[passphraseEncryptionKeyLen:])
-	stream.XORKeyStream(d.data.PassphraseProtectedPayload.EncryptedPayload, payload)
+	stream := cipher.NewCFBEncrypter(c, key.Bytes()[passphraseEncryptionKeyLen:])
+	stream.XORKeyStream(newData.PassphraseProtectedPayload.EncryptedPayload, payload)
+
+	if err := d.updateMetadataMACForAuthChange(handler, &newData, payload, key.Bytes(), auxKey); err != nil {
+		return err
+	}
 
+	d.data = newData
 	return nil
 }
 
-func (d *KeyData) openWithPassphrase(passphrase string, kdf KDF) (payload []byte, key []byte, err error) {
+// openWithPassphrase derives a key from the supplied passphrase and uses it to
+// decrypt the passphrase protected payload. The decrypted payload and the derived
+// key are returned in secure buffers which must be freed by the caller.
+func (d *KeyData) openWithPassphrase(passphrase string, kdf KDF) (payload *secmem.Buffer, key *secmem.Buffer, err error) {
 	if d.AuthMode()&AuthModePassphrase == 0 {
 		return nil, nil, errors.New("passphrase is not enabled")
 	}
@@ -568,22 +764,36 @@ func (d *KeyData) openWithPassphrase(passphrase string, kdf KDF) (payload []byte
 		Time:      uint32(data.KDF.Time),
 		MemoryKiB: uint32(data.KDF.Memory),
 		Threads:   uint8(data.KDF.CPUs)}
-	key, err = kdf.Derive(passphrase, data.KDF.Salt, params, uint32(keyLen))
+	k, err := kdf.Derive(passphrase, data.KDF.Salt, params, uint32(keyLen))
 	if err != nil {
 		return nil, nil, xerrors.Errorf("cannot derive key from passphrase: %w", err)
 	}
-	if len(key) != keyLen {
+	if len(k) != keyLen {
+		secmem.Wipe(k)
 		return nil, nil, errors.New("KDF returned unexpected key length")
 	}
+	key, err = secmem.Move(k)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot allocate buffer for key: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			key.Free()
+		}
+	}()
 
-	payload = make([]byte, len(data.EncryptedPayload))
+	payload, err = secmem.New(len(data.EncryptedPayload))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot allocate buffer for payload: %w", err)
+	}
 
-	c, err := aes.NewCipher(key[:data.KeySize])
+	c, err := aes.NewCipher(key.Bytes()[:data.KeySize])
 	if err != nil {
+		payload.Free()
 		return nil, nil, xerrors.Errorf("cannot create cipher: %w", err)
 	}
-	stream := cipher.NewCFBDecrypter(c, key[data.KeySize:])
-	stream.XORKeyStream(payload, data.EncryptedPayload)
+	stream := cipher.NewCFBDecrypter(c, key.Bytes()[data.KeySize:])
+	stream.XORKeyStream(payload.Bytes(), data.EncryptedPayload)
 
 	return payload, key, nil
 }
@@ -672,6 +882,7 @@ func (d *KeyData) RecoverKeys() (DiskUnlockKey, AuxiliaryKey, error) {
 	if err != nil {
 		return nil, nil, processPlatformHandlerError(err)
 	}
+	defer secmem.Wipe(c)
 
 	key, auxKey, err := c.Unmarshal()
 	if err != nil {
@@ -691,18 +902,21 @@ func (d *KeyData) RecoverKeysWithPassphrase(passphrase string, kdf KDF) (DiskUnl
 		return nil, nil, ErrNoPlatformHandlerRegistered
 	}
 
-	payload, key, err := d.openWithPassphrase(passphrase, kdf)
+	payload, authKey, err := d.openWithPassphrase(passphrase, kdf)
 	if err != nil {
 		return nil, nil, err
 	}
+	defer payload.Free()
+	defer authKey.Free()
 
 	data := &PlatformKeyData{
 		EncodedHandle:    d.data.PlatformHandle,
-		EncryptedPayload: payload}
-	c, err := handler.RecoverKeysWithAuthKey(data, key)
+		EncryptedPayload: payload.Bytes()}
+	c, err := handler.RecoverKeysWithAuthKey(data, authKey.Bytes())
 	if err != nil {
 		return nil, nil, processPlatformHandlerError(err)
 	}
+	defer secmem.Wipe(c)
 
 	key, auxKey, err := c.Unmarshal()
 	if err != nil {
@@ -713,7 +927,9 @@ func (d *KeyData) RecoverKeysWithPassphrase(passphrase string, kdf KDF) (DiskUnl
 }
 
 // IsSnapModelAuthorized indicates whether the supplied Snap device model is trusted to
-// access the data on the encrypted volume protected by this key data.
+// access the data on the encrypted volume protected by this key data. A model is trusted
+// if it was supplied to SetAuthorizedSnapModels, or if it matches one of the rules
+// supplied to SetSnapModelAuthRules.
 //
 // The supplied auxKey is obtained using one of the RecoverKeys* functions.
 func (d *KeyData) IsSnapModelAuthorized(auxKey AuxiliaryKey, model SnapModel) (bool, error) {
@@ -732,7 +948,25 @@ func (d *KeyData) IsSnapModelAuthorized(auxKey AuxiliaryKey, model SnapModel) (b
 		return false, xerrors.Errorf("cannot compute HMAC of model: %w", err)
 	}
 
-	return d.data.AuthorizedSnapModels.hmacs.contains(h), nil
+	if d.data.AuthorizedSnapModels.hmacs.contains(h) {
+		return true, nil
+	}
+
+	if len(d.data.AuthorizedSnapModels.ruleHmacs) == 0 {
+		return false, nil
+	}
+
+	for _, rule := range snapModelAuthRuleCandidates(model) {
+		h, err := computeSnapModelAuthRuleHMAC(crypto.Hash(alg), hmacKey, rule)
+		if err != nil {
+			return false, xerrors.Errorf("cannot compute HMAC of rule: %w", err)
+		}
+		if d.data.AuthorizedSnapModels.ruleHmacs.contains(h) {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
 // SetAuthorizedSnapModels marks the supplied Snap device models as trusted to access
@@ -745,24 +979,16 @@ func (d *KeyData) IsSnapModelAuthorized(auxKey AuxiliaryKey, model SnapModel) (b
 // The supplied auxKey is obtained using one of the RecoverKeys* functions. If the
 // supplied auxKey is incorrect, then an error will be returned.
 func (d *KeyData) SetAuthorizedSnapModels(auxKey AuxiliaryKey, models ...SnapModel) error {
+	if err := d.checkAuxKey(auxKey); err != nil {
+		return err
+	}
+
 	hmacKey, err := d.snapModelAuthKey(auxKey)
 	if err != nil {
 		return xerrors.Errorf("cannot obtain auth key: %w", err)
 	}
 
-	alg := d.data.AuthorizedSnapModels.keyDigest.Alg
-	if !alg.Available() {
-		return errors.New("invalid digest algorithm")
-	}
-
-	h := alg.New()
-	h.Write(hmacKey)
-	h.Write(d.data.AuthorizedSnapModels.keyDigest.Salt)
-	if !bytes.Equal(h.Sum(nil), d.data.AuthorizedSnapModels.keyDigest.Digest) {
-		return errors.New("incorrect key supplied")
-	}
-
-	alg = d.data.AuthorizedSnapModels.alg
+	alg := d.data.AuthorizedSnapModels.alg
 	if !alg.Available() {
 		return errors.New("invalid digest algorithm")
 	}
@@ -779,6 +1005,204 @@ func (d *KeyData) SetAuthorizedSnapModels(auxKey AuxiliaryKey, models ...SnapMod
 	}
 
 	d.data.AuthorizedSnapModels.hmacs = modelHMACs
+
+	if d.data.MetadataMAC != nil {
+		if err := d.UpdateMetadataMAC(auxKey); err != nil {
+			return xerrors.Errorf("cannot update metadata MAC: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetSnapModelAuthRules marks the Snap device models that match any of the
+// supplied rules as trusted to access the data on the encrypted volume protected
+// by this key data. This avoids having to enumerate every model from a brand
+// with SetAuthorizedSnapModels. This function replaces all previously supplied
+// rules, but does not affect models authorized with SetAuthorizedSnapModels.
+//
+// The rules are stored as HMACs keyed from the auxiliary key in the same way as
+// authorized models, so they cannot be read back or modified without it.
+//
+// This makes changes to the key data, which will need to persisted afterwards using
+// WriteAtomic.
+//
+// The supplied auxKey is obtained using one of the RecoverKeys* functions. If the
+// supplied auxKey is incorrect, then an error will be returned.
+func (d *KeyData) SetSnapModelAuthRules(auxKey AuxiliaryKey, rules ...SnapModelAuthRule) error {
+	if err := d.checkAuxKey(auxKey); err != nil {
+		return err
+	}
+
+	hmacKey, err := d.snapModelAuthKey(auxKey)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain auth key: %w", err)
+	}
+
+	alg := d.data.AuthorizedSnapModels.alg
+	if !alg.Available() {
+		return errors.New("invalid digest algorithm")
+	}
+
+	var ruleHMACs snapModelHMACList
+
+	for i := range rules {
+		h, err := computeSnapModelAuthRuleHMAC(crypto.Hash(alg), hmacKey, &rules[i])
+		if err != nil {
+			return xerrors.Errorf("cannot compute HMAC of rule %d: %w", i, err)
+		}
+
+		ruleHMACs = append(ruleHMACs, h)
+	}
+
+	d.data.AuthorizedSnapModels.ruleHmacs = ruleHMACs
+
+	if d.data.MetadataMAC != nil {
+		if err := d.UpdateMetadataMAC(auxKey); err != nil {
+			return xerrors.Errorf("cannot update metadata MAC: %w", err)
+		}
+	}
+	return nil
+}
+
+// UpdateMetadataMAC computes a MAC of this key data, keyed from the supplied
+// auxKey, and stores it in this key data. The MAC covers all of the metadata,
+// including the platform name and handle, the passphrase parameters and the
+// authorized snap models, and is checked by ActivateVolumeWithKeyData after
+// the keys have been recovered, so that modifications to the key data by
+// anything without access to the auxiliary key can be detected.
+//
+// A newly created KeyData already has a metadata MAC, and it is updated
+// automatically by the functions that modify the key data. This only needs
+// to be called to add a metadata MAC to key data that was created before
+// metadata MACs were introduced. Once added, the metadata MAC becomes
+// mandatory, and the key data can't be used without it.
+//
+// This makes changes to the key data, which will need to persisted afterwards using
+// WriteAtomic.
+//
+// The supplied auxKey is obtained using one of the RecoverKeys* functions. If the
+// supplied auxKey is incorrect, then an error will be returned.
+func (d *KeyData) UpdateMetadataMAC(auxKey AuxiliaryKey) error {
+	if err := d.checkAuxKey(auxKey); err != nil {
+		return err
+	}
+
+	if d.data.Generation < keyDataGeneration && !d.data.AuthorizedSnapModels.legacyKeyDigest {
+		// Bind the new generation to the auxiliary key digest so that
+		// the metadata MAC can't be removed. This isn't possible for
+		// key data with a legacy unsalted key digest without changing
+		// its format.
+		d.data.Generation = keyDataGeneration
+		hmacKey, err := d.snapModelAuthKey(auxKey)
+		if err != nil {
+			return xerrors.Errorf("cannot obtain auth key: %w", err)
+		}
+		digest, err := d.computeAuxKeyDigest(hmacKey)
+		if err != nil {
+			return xerrors.Errorf("cannot compute auth key digest: %w", err)
+		}
+		d.data.AuthorizedSnapModels.keyDigest.Digest = digest
+	}
+
+	alg := d.data.AuthorizedSnapModels.alg
+	if d.data.MetadataMAC != nil {
+		alg = d.data.MetadataMAC.Alg
+	}
+
+	mac, err := d.computeMetadataMAC(alg, auxKey)
+	if err != nil {
+		return xerrors.Errorf("cannot compute MAC: %w", err)
+	}
+
+	d.data.MetadataMAC = &metadataMAC{Alg: alg, MAC: mac}
+	return nil
+}
+
+// VerifyMetadataMAC verifies the MAC of this key data using the supplied
+// auxKey, in order to detect whether any of the metadata has been modified
+// by something without access to the auxiliary key.
+//
+// If the key data was created before metadata MACs were introduced and
+// does not have one, ErrNoMetadataMAC will be returned. If the MAC is
+// incorrect, or it is missing from key data that requires one, a
+// *InvalidKeyDataError error will be returned.
+//
+// The supplied auxKey is obtained using one of the RecoverKeys* functions.
+func (d *KeyData) VerifyMetadataMAC(auxKey AuxiliaryKey) error {
+	if d.data.MetadataMAC == nil {
+		if d.data.Generation >= keyDataGeneration {
+			return &InvalidKeyDataError{errors.New("missing metadata MAC")}
+		}
+		// Make sure that the generation hasn't been removed, as it
+		// is bound to the auxiliary key digest.
+		if err := d.checkAuxKey(auxKey); err != nil {
+			return &InvalidKeyDataError{xerrors.Errorf("cannot verify auxiliary key: %w", err)}
+		}
+		return ErrNoMetadataMAC
+	}
+
+	mac, err := d.computeMetadataMAC(d.data.MetadataMAC.Alg, auxKey)
+	if err != nil {
+		return &InvalidKeyDataError{xerrors.Errorf("cannot compute metadata MAC: %w", err)}
+	}
+
+	if !hmac.Equal(mac, d.data.MetadataMAC.MAC) {
+		return &InvalidKeyDataError{errors.New("metadata MAC check failed")}
+	}
+
+	return nil
+}
+
+// CopyMetadata replaces the platform independent metadata of this key data,
+// which includes the authorized snap models, snap model authorization rules,
+// authorized boot identities and volume key derivation setting, with the
+// metadata from src. This is useful when replacing a key data object with a
+// new one that protects the same keys, such as when migrating to a different
+// platform specific format.
+//
+// Both key data objects must be associated with the supplied auxKey, which is
+// obtained using one of the RecoverKeys* functions. The metadata MAC of src is
+// verified before anything is copied. If either key data uses different
+// algorithms to authenticate authorized snap models, an error will be returned.
+//
+// This makes changes to the key data, which will need to persisted afterwards
+// using WriteAtomic.
+func (d *KeyData) CopyMetadata(src *KeyData, auxKey AuxiliaryKey) error {
+	if err := d.checkAuxKey(auxKey); err != nil {
+		return err
+	}
+	if err := src.checkAuxKey(auxKey); err != nil {
+		return xerrors.Errorf("cannot verify source key data: %w", err)
+	}
+	if err := src.VerifyMetadataMAC(auxKey); err != nil && err != ErrNoMetadataMAC {
+		return xerrors.Errorf("cannot verify source key data: %w", err)
+	}
+
+	if src.data.AuthorizedSnapModels.alg != d.data.AuthorizedSnapModels.alg ||
+		src.data.AuthorizedSnapModels.kdfAlg != d.data.AuthorizedSnapModels.kdfAlg {
+		return errors.New("source key data has incompatible snap model authorization algorithms")
+	}
+
+	d.data.AuthorizedSnapModels.hmacs = append(snapModelHMACList(nil), src.data.AuthorizedSnapModels.hmacs...)
+	d.data.AuthorizedSnapModels.ruleHmacs = append(snapModelHMACList(nil), src.data.AuthorizedSnapModels.ruleHmacs...)
+
+	d.data.AuthorizedBootIdentities = nil
+	if ids := src.data.AuthorizedBootIdentities; ids != nil {
+		d.data.AuthorizedBootIdentities = &authorizedBootIdentities{
+			Alg:   ids.Alg,
+			HMACs: append(snapModelHMACList(nil), ids.HMACs...)}
+	}
+
+	d.data.VolumeKeyDerivation = nil
+	if kdf := src.data.VolumeKeyDerivation; kdf != nil {
+		d.data.VolumeKeyDerivation = &hkdfData{Alg: kdf.Alg}
+	}
+
+	if d.data.MetadataMAC != nil {
+		if err := d.UpdateMetadataMAC(auxKey); err != nil {
+			return xerrors.Errorf("cannot update metadata MAC: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -787,6 +1211,10 @@ func (d *KeyData) SetAuthorizedSnapModels(auxKey AuxiliaryKey, models ...SnapMod
 // KeyData.AuthMode returns AuthModeNone. Once a passphrase has been set, the
 // KeyData.RecoverKeys API can no longer be used.
 //
+// If the key data has a metadata MAC, the keys are recovered from the platform's
+// secure device in order to verify the existing MAC and compute a new one. If
+// they cannot be recovered, the key data is not modified and an error is returned.
+//
 // The kdfOptions argument configures the Argon2 KDF settings. The kdf argument
 // provides the Argon2 KDF implementation that will be used - this should ultimately
 // execute the implementation returned by the Argon2iKDF function, but the caller
@@ -796,12 +1224,7 @@ func (d *KeyData) SetPassphrase(passphrase string, kdfOptions *KDFOptions, kdf K
 		return errors.New("cannot set passphrase without authorization")
 	}
 
-	if err := d.updatePassphrase(d.data.EncryptedPayload, nil, passphrase, kdfOptions, kdf); err != nil {
-		return err
-	}
-
-	d.data.EncryptedPayload = nil
-	return nil
+	return d.updatePassphrase(d.data.EncryptedPayload, nil, passphrase, kdfOptions, kdf)
 }
 
 // ChangePassphrase updates the passphrase used to recover the keys from this key data
@@ -810,6 +1233,10 @@ func (d *KeyData) SetPassphrase(passphrase string, kdfOptions *KDFOptions, kdf K
 //
 // The current passphrase must be supplied via the oldPassphrase argument.
 //
+// If the key data has a metadata MAC, the keys are recovered from the platform's
+// secure device in order to verify the existing MAC and compute a new one. If
+// they cannot be recovered, the key data is not modified and an error is returned.
+//
 // The kdfOptions argument configures the Argon2 KDF settings. The kdf argument
 // provides the Argon2 KDF implementation that will be used - this should ultimately
 // execute the implementation returned by the Argon2iKDF function, but the caller
@@ -823,20 +1250,82 @@ func (d *KeyData) ChangePassphrase(oldPassphrase, newPassphrase string, kdfOptio
 	if err != nil {
 		return err
 	}
+	defer payload.Free()
+	defer oldKey.Free()
 
-	if err := d.updatePassphrase(payload, oldKey, newPassphrase, kdfOptions, kdf); err != nil {
+	if err := d.updatePassphrase(payload.Bytes(), oldKey.Bytes(), newPassphrase, kdfOptions, kdf); err != nil {
 		return processPlatformHandlerError(err)
 	}
 
 	return nil
 }
 
+// UpgradeKDFCostParams benchmarks the KDF using the supplied kdfOptions and
+// compares the result with the cost parameters used to derive the key from the
+// current passphrase. If the current cost is less than half of the benchmarked
+// cost, the keys are protected again using a key derived from the same passphrase
+// with the benchmarked cost parameters, and true is returned. If the current cost
+// is sufficient, no changes are made and false is returned. This can only be
+// called if a passphrase has been set (KeyData.AuthMode returns AuthModePassphrase).
+//
+// Like ChangePassphrase, this updates the metadata MAC if it is successful, and
+// the key data will need to be persisted afterwards using WriteAtomic.
+//
+// The kdfOptions argument configures the Argon2 KDF settings. The kdf argument
+// provides the Argon2 KDF implementation that will be used - this should ultimately
+// execute the implementation returned by the Argon2iKDF function, but the caller
+// can choose to execute this in a short-lived utility process.
+func (d *KeyData) UpgradeKDFCostParams(passphrase string, kdfOptions *KDFOptions, kdf KDF) (upgraded bool, err error) {
+	return d.upgradeKDFCostParams(passphrase, kdfOptions, kdf, nil)
+}
+
+// upgradeKDFCostParams is the implementation of UpgradeKDFCostParams. The
+// auxKey argument is optional, and avoids having to recover it from the
+// platform's secure device in order to update the metadata MAC.
+func (d *KeyData) upgradeKDFCostParams(passphrase string, kdfOptions *KDFOptions, kdf KDF, auxKey AuxiliaryKey) (upgraded bool, err error) {
+	if d.AuthMode()&AuthModePassphrase == 0 {
+		return false, errors.New("cannot upgrade KDF cost parameters without a passphrase")
+	}
+
+	if kdfOptions == nil {
+		var defaultOptions KDFOptions
+		kdfOptions = &defaultOptions
+	}
+
+	params, err := kdfOptions.deriveCostParams(passphraseKeyLen, kdf)
+	if err != nil {
+		return false, xerrors.Errorf("cannot derive KDF cost parameters: %w", err)
+	}
+
+	current := d.data.PassphraseProtectedPayload.KDF
+	if uint64(current.Time)*uint64(current.Memory) >= (uint64(params.Time)*uint64(params.MemoryKiB))/2 {
+		return false, nil
+	}
+
+	payload, oldKey, err := d.openWithPassphrase(passphrase, kdf)
+	if err != nil {
+		return false, err
+	}
+	defer payload.Free()
+	defer oldKey.Free()
+
+	if err := d.updatePassphraseWithCostParams(payload.Bytes(), oldKey.Bytes(), passphrase, params, kdf, auxKey); err != nil {
+		return false, processPlatformHandlerError(err)
+	}
+
+	return true, nil
+}
+
 // ClearPassphraseWithPassphrase clears the passphrase from this key data so that the
 // keys can be recovered via the KeyData.RecoverKeys API. This can only be called if a
 // passhphrase has been set previously (KeyData.AuthMode returns AuthModePassphrase).
 //
 // The current passphrase must be supplied.
 //
+// If the key data has a metadata MAC, the keys are recovered from the platform's
+// secure device in order to verify the existing MAC and compute a new one. If
+// they cannot be recovered, the key data is not modified and an error is returned.
+//
 // The kdf argument provides the Argon2 KDF implementation that will be used - this
 // should ultimately execute the implementation returned by the Argon2iKDF function,
 // but the caller can choose to execute this in a short-lived utility process.
@@ -854,15 +1343,24 @@ func (d *KeyData) ClearPassphraseWithPassphrase(passphrase string, kdf KDF) erro
 	if err != nil {
 		return err
 	}
+	defer payload.Free()
+	defer key.Free()
 
-	handle, err := handler.ChangeAuthKey(d.data.PlatformHandle, key, nil)
+	handle, err := handler.ChangeAuthKey(d.data.PlatformHandle, key.Bytes(), nil)
 	if err != nil {
 		return processPlatformHandlerError(err)
 	}
 
-	d.data.PlatformHandle = handle
-	d.data.EncryptedPayload = payload
-	d.data.PassphraseProtectedPayload = nil
+	newData := d.data
+	newData.PlatformHandle = handle
+	newData.EncryptedPayload = append([]byte(nil), payload.Bytes()...)
+	newData.PassphraseProtectedPayload = nil
+
+	if err := d.updateMetadataMACForAuthChange(handler, &newData, newData.EncryptedPayload, nil, nil); err != nil {
+		return err
+	}
+
+	d.data = newData
 	return nil
 }
 
@@ -909,6 +1407,7 @@ func NewKeyData(params *KeyParams) (*KeyData, error) {
 
 	kd := &KeyData{
 		data: keyData{
+			Generation:       keyDataGeneration,
 			PlatformName:     params.PlatformName,
 			PlatformHandle:   json.RawMessage(encodedHandle),
 			EncryptedPayload: params.EncryptedPayload,
@@ -924,21 +1423,30 @@ func NewKeyData(params *KeyParams) (*KeyData, error) {
 		return nil, xerrors.Errorf("cannot compute snap model auth key: %w", err)
 	}
 
-	h := kd.data.AuthorizedSnapModels.keyDigest.Alg.New()
-	h.Write(authKey)
-	h.Write(kd.data.AuthorizedSnapModels.keyDigest.Salt)
-	kd.data.AuthorizedSnapModels.keyDigest.Digest = h.Sum(nil)
+	kd.data.AuthorizedSnapModels.keyDigest.Digest, err = kd.computeAuxKeyDigest(authKey)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute snap model auth key digest: %w", err)
+	}
+
+	if err := kd.UpdateMetadataMAC(params.AuxiliaryKey); err != nil {
+		return nil, xerrors.Errorf("cannot compute metadata MAC: %w", err)
+	}
 
 	return kd, nil
 }
 
 // MarshalKeys serializes the supplied disk unlock key and auxiliary key in
 // to a format that is ready to be encrypted by a platform's secure device.
+//
+// The payload is serialized directly in to a correctly sized slice rather than
+// a growable buffer so that no partial copies of the keys are left on the heap.
+// The caller is responsible for wiping the returned payload once it is no
+// longer required.
 func MarshalKeys(key DiskUnlockKey, auxKey AuxiliaryKey) KeyPayload {
-	w := new(bytes.Buffer)
-	binary.Write(w, binary.BigEndian, uint16(len(key)))
-	w.Write(key)
-	binary.Write(w, binary.BigEndian, uint16(len(auxKey)))
-	w.Write(auxKey)
-	return w.Bytes()
+	out := make(KeyPayload, 2+len(key)+2+len(auxKey))
+	binary.BigEndian.PutUint16(out, uint16(len(key)))
+	copy(out[2:], key)
+	binary.BigEndian.PutUint16(out[2+len(key):], uint16(len(auxKey)))
+	copy(out[4+len(key):], auxKey)
+	return out
 }
@@ -0,0 +1,162 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto"
+)
+
+const (
+	// KeyDataVersionUnsaltedKeyDigest is the version of key data where
+	// the digest of the snap model authorization key is not salted.
+	KeyDataVersionUnsaltedKeyDigest = 1
+
+	// KeyDataVersionLegacySnapModelAuthKey is the version of key data
+	// where the snap model authorization key is derived from the auxiliary
+	// key using a DRBG.
+	KeyDataVersionLegacySnapModelAuthKey = 2
+
+	// KeyDataVersionCurrent is the version of key data where the snap
+	// model authorization key is derived from the auxiliary key using
+	// HKDF. This is the version of newly created key data.
+	KeyDataVersionCurrent = 3
+)
+
+// KDFInfo describes the parameters of the key derivation function used
+// to derive keys from a passphrase.
+type KDFInfo struct {
+	Type   string `json:"type"`   // The KDF algorithm, eg "argon2i"
+	Time   int    `json:"time"`   // The time cost parameter
+	Memory int    `json:"memory"` // The memory cost parameter in KiB
+	CPUs   int    `json:"cpus"`   // The number of threads
+}
+
+// PassphraseInfo describes how the payload of a KeyData object is protected
+// by a passphrase.
+type PassphraseInfo struct {
+	KDF        KDFInfo `json:"kdf"`
+	Encryption string  `json:"encryption"` // The encryption algorithm, eg "aes-cfb"
+	KeySize    int     `json:"key_size"`   // The size of the passphrase derived encryption key
+}
+
+// KeyDataInfo provides a structured description of a KeyData object, for
+// the purposes of auditing. It doesn't contain any secret material.
+type KeyDataInfo struct {
+	// Version is the version of the platform agnostic key data format,
+	// which describes how the auxiliary key digest and snap model
+	// authorization key are computed.
+	Version int `json:"version"`
+
+	// Generation is the generation of this key data. Key data with a
+	// generation of 2 or later has its generation bound to the auxiliary
+	// key digest and must have a metadata MAC. It is zero for key data
+	// created before metadata MACs were introduced.
+	Generation int `json:"generation"`
+
+	PlatformName string   `json:"platform_name"`
+	AuthMode     AuthMode `json:"auth_mode"`
+
+	// Passphrase describes the passphrase protection for this key data.
+	// It is nil if AuthMode does not include AuthModePassphrase.
+	Passphrase *PassphraseInfo `json:"passphrase,omitempty"`
+
+	// SnapModelAuthHash is the digest algorithm used for HMACs of
+	// authorized snap models.
+	SnapModelAuthHash crypto.Hash `json:"snap_model_auth_hash"`
+
+	// NumAuthorizedSnapModels is the number of snap models that are
+	// authorized to access the data protected by this key data.
+	NumAuthorizedSnapModels int `json:"num_authorized_snap_models"`
+
+	// NumSnapModelAuthRules is the number of rules that authorize
+	// snap models to access the data protected by this key data.
+	NumSnapModelAuthRules int `json:"num_snap_model_auth_rules,omitempty"`
+
+	// NumAuthorizedBootIdentities is the number of boot identities that
+	// are authorized to access the data protected by this key data.
+	NumAuthorizedBootIdentities int `json:"num_authorized_boot_identities,omitempty"`
+
+	// DerivesVolumeKeys indicates whether the protected key is a root
+	// key from which the unlock key for each volume is derived.
+	DerivesVolumeKeys bool `json:"derives_volume_keys,omitempty"`
+
+	// HasMetadataMAC indicates whether this key data has a metadata MAC.
+	HasMetadataMAC bool `json:"has_metadata_mac"`
+
+	// Platform contains platform specific properties. It is only set
+	// if the handler registered for PlatformName implements
+	// PlatformKeyDataInspector.
+	Platform map[string]interface{} `json:"platform,omitempty"`
+}
+
+func (d *KeyData) version() int {
+	switch {
+	case d.data.AuthorizedSnapModels.legacyKeyDigest:
+		return KeyDataVersionUnsaltedKeyDigest
+	case d.data.AuthorizedSnapModels.kdfAlg == nilHash:
+		return KeyDataVersionLegacySnapModelAuthKey
+	default:
+		return KeyDataVersionCurrent
+	}
+}
+
+// Inspect returns a structured description of this key data, without
+// recovering any keys. If a handler is registered for the platform that
+// this key data was created for and it implements PlatformKeyDataInspector,
+// it will be used to populate the Platform field of the returned description.
+// If there is no handler registered, the Platform field is left unset.
+func (d *KeyData) Inspect() (*KeyDataInfo, error) {
+	info := &KeyDataInfo{
+		Version:                 d.version(),
+		Generation:              d.data.Generation,
+		PlatformName:            d.data.PlatformName,
+		AuthMode:                d.AuthMode(),
+		SnapModelAuthHash:       crypto.Hash(d.data.AuthorizedSnapModels.alg),
+		NumAuthorizedSnapModels: len(d.data.AuthorizedSnapModels.hmacs),
+		NumSnapModelAuthRules:   len(d.data.AuthorizedSnapModels.ruleHmacs),
+		HasMetadataMAC:          d.data.MetadataMAC != nil}
+
+	info.DerivesVolumeKeys = d.DerivesVolumeKeys()
+	if d.data.AuthorizedBootIdentities != nil {
+		info.NumAuthorizedBootIdentities = len(d.data.AuthorizedBootIdentities.HMACs)
+	}
+
+	if p := d.data.PassphraseProtectedPayload; p != nil {
+		info.Passphrase = &PassphraseInfo{
+			KDF: KDFInfo{
+				Type:   p.KDF.Type,
+				Time:   p.KDF.Time,
+				Memory: p.KDF.Memory,
+				CPUs:   p.KDF.CPUs},
+			Encryption: p.Encryption,
+			KeySize:    p.KeySize}
+	}
+
+	handler := handlers[d.data.PlatformName]
+	if inspector, ok := handler.(PlatformKeyDataInspector); ok {
+		platform, err := inspector.InspectHandle(d.data.PlatformHandle)
+		if err != nil {
+			return nil, processPlatformHandlerError(err)
+		}
+		info.Platform = platform
+	}
+
+	return info, nil
+}
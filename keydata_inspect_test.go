@@ -0,0 +1,212 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type keyDataInspectSuite struct {
+	keyDataTestBase
+}
+
+var _ = Suite(&keyDataInspectSuite{})
+
+func (s *keyDataInspectSuite) TestInspectAuthModeNone(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, &KeyDataInfo{
+		Version:           KeyDataVersionCurrent,
+		Generation:        2,
+		PlatformName:      mockPlatformName,
+		AuthMode:          AuthModeNone,
+		SnapModelAuthHash: crypto.SHA256,
+		HasMetadataMAC:    true,
+		Platform: map[string]interface{}{
+			"iv": protected.Handle.(*mockPlatformKeyDataHandle).IV}})
+}
+
+func (s *keyDataInspectSuite) TestInspectAuthModePassphrase(c *C) {
+	s.handler.passphraseSupport = true
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA384)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.SetPassphrase("passphrase", &KDFOptions{ForceIterations: 3, MemoryKiB: 32 * 1024}, new(testutil.MockKDF)), IsNil)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.Version, Equals, KeyDataVersionCurrent)
+	c.Check(info.Generation, Equals, 2)
+	c.Check(info.AuthMode, Equals, AuthModePassphrase)
+	c.Check(info.SnapModelAuthHash, Equals, crypto.SHA384)
+	c.Check(info.HasMetadataMAC, Equals, true)
+	c.Assert(info.Passphrase, NotNil)
+	c.Check(info.Passphrase.KDF.Type, Equals, "argon2i")
+	c.Check(info.Passphrase.KDF.Time, Equals, 3)
+	c.Check(info.Passphrase.KDF.Memory, Equals, 32*1024)
+	c.Check(info.Passphrase.KDF.CPUs > 0, testutil.IsTrue)
+	c.Check(info.Passphrase.Encryption, Equals, "aes-cfb")
+	c.Check(info.Passphrase.KeySize, Equals, 32)
+}
+
+func (s *keyDataInspectSuite) TestInspectAuthorizedSnapModels(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "other-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, models...), IsNil)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.NumAuthorizedSnapModels, Equals, 2)
+}
+
+func (s *keyDataInspectSuite) TestInspectPassphraseOnly(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+
+	keyData, err := NewKeyDataWithPassphrase(&PassphraseKeyParams{
+		Key:          key,
+		AuxiliaryKey: auxKey}, "passphrase", nil, new(testutil.MockKDF))
+	c.Assert(err, IsNil)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.PlatformName, Equals, PassphrasePlatformName)
+	c.Check(info.AuthMode, Equals, AuthModePassphrase)
+	c.Check(info.Passphrase, NotNil)
+	c.Check(info.HasMetadataMAC, Equals, true)
+	c.Check(info.Platform, IsNil)
+}
+
+func (s *keyDataInspectSuite) TestInspectUnsaltedKeyDigest(c *C) {
+	j := []byte(
+		`{` +
+			`"platform_name":"other",` +
+			`"platform_handle":"iTnGw6iFTfDgGS+KMtDHx2yF0bpNaTWyzeLtsbaC9YaspcssRrHzcRsNrubyEVT9",` +
+			`"encrypted_payload":"fYM/SYjIRZj7JOJA710c9hSsxp5NpEchEVXgozd1KgxqZ/TOzIvWF9WYSrRcXiy1vsyjhkF0Svh3ihfApzvje7tTQRI=",` +
+			`"authorized_snap_models":{` +
+			`"alg":"sha256",` +
+			`"key_digest":"ECpFZzxG8XWUKGylGggA2HR+8pERsmA891SmDvs3NiE=",` +
+			`"hmacs":["pcYGJdlrxgn6M5Q4gq23cykD1D6X68XBZV+Ikzoyxo0="]}}
+`)
+
+	keyData, err := ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(j)})
+	c.Assert(err, IsNil)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, &KeyDataInfo{
+		Version:                 KeyDataVersionUnsaltedKeyDigest,
+		PlatformName:            "other",
+		AuthMode:                AuthModeNone,
+		SnapModelAuthHash:       crypto.SHA256,
+		NumAuthorizedSnapModels: 1})
+}
+
+func (s *keyDataInspectSuite) TestInspectLegacySnapModelAuthKey(c *C) {
+	j := []byte(
+		`{` +
+			`"platform_name":"other",` +
+			`"platform_handle":{` +
+			`"key":"u2wBdkkDL0c5ovbM9z/3VoRVy6cHMs3YdwiUL+mNl/Q=",` +
+			`"iv":"sXJZ9DUc26Qz5x4/FwjFzA==",` +
+			`"auth-key-hmac":"JVayPium5JZZrEkqb7bsiQXPWJHEhX3r0aHjByulHXs="},` +
+			`"encrypted_payload":"eDTWEozwRLFh1td/i+eufBDIFHiYJoQqhw51jPuWAy0hfJaw22ywTau+UdqRXQTh4bTl8LZhaDpBGk3wBMjLO8Y3l4Q=",` +
+			`"authorized_snap_models":{` +
+			`"alg":"sha256",` +
+			`"key_digest":{` +
+			`"alg":"sha256",` +
+			`"salt":"TLiHg00TtO6R8EKYavCxtxAwvivNncKn7z0F3ZvVZOU=",` +
+			`"digest":"yRQPnWba/JE4uKB9oxVuhOcB/Ue0cW6H+X3epl1ldSQ="},` +
+			`"hmacs":["mpjxUcFTqGpX+zDyFzDBwT77tZCqaktY9QQXswVNXKk="]}}
+`)
+
+	keyData, err := ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(j)})
+	c.Assert(err, IsNil)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.Version, Equals, KeyDataVersionLegacySnapModelAuthKey)
+	c.Check(info.Generation, Equals, 0)
+	c.Check(info.HasMetadataMAC, Equals, false)
+	c.Check(info.Platform, IsNil)
+
+	// Adding a metadata MAC bumps the generation, but doesn't change the
+	// version.
+	c.Check(keyData.UpdateMetadataMAC(AuxiliaryKey(testutil.DecodeHexString(c, "67bb324dd1b40a41c5db84e6248fdacea2505e19fa954b96580b77fadff1a257"))), IsNil)
+
+	info, err = keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.Version, Equals, KeyDataVersionLegacySnapModelAuthKey)
+	c.Check(info.Generation, Equals, 2)
+	c.Check(info.HasMetadataMAC, Equals, true)
+}
+
+func (s *keyDataInspectSuite) TestInspectInvalidPlatformHandle(c *C) {
+	j := []byte(
+		`{` +
+			`"platform_name":"mock",` +
+			`"platform_handle":"iTnGw6iFTfDgGS+KMtDHx2yF0bpNaTWyzeLtsbaC9YaspcssRrHzcRsNrubyEVT9",` +
+			`"encrypted_payload":"fYM/SYjIRZj7JOJA710c9hSsxp5NpEchEVXgozd1KgxqZ/TOzIvWF9WYSrRcXiy1vsyjhkF0Svh3ihfApzvje7tTQRI=",` +
+			`"authorized_snap_models":{` +
+			`"alg":"sha256",` +
+			`"key_digest":"ECpFZzxG8XWUKGylGggA2HR+8pERsmA891SmDvs3NiE=",` +
+			`"hmacs":null}}
+`)
+
+	keyData, err := ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(j)})
+	c.Assert(err, IsNil)
+
+	_, err = keyData.Inspect()
+	c.Check(err, ErrorMatches, "invalid key data: JSON decode error: .*")
+	c.Check(err, testutil.ConvertibleTo, &InvalidKeyDataError{})
+}
@@ -38,9 +38,16 @@ type LUKS2KeyDataReader struct {
 }
 
 // NewLUKS2KeyDataReader is used to read a LUKS2 token containing key data with
-// the specified name on the specified LUKS2 container.
+// the specified name on the specified LUKS2 container. The devicePath argument
+// may be a device path or any other volume locator accepted by
+// ParseVolumeLocator.
 func NewLUKS2KeyDataReader(devicePath, name string) (*LUKS2KeyDataReader, error) {
-	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	path, err := resolveDevicePath(devicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot resolve device path: %w", err)
+	}
+
+	view, err := newLUKSView(path, luks2.LockModeBlocking)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot obtain LUKS2 header view: %w", err)
 	}
@@ -0,0 +1,198 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	_ "crypto/sha256"
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/secmem"
+)
+
+// PassphrasePlatformName is the platform name used for KeyData objects that
+// are protected only by a passphrase, without the involvement of a platform's
+// secure device.
+const PassphrasePlatformName = "passphrase"
+
+// passphraseKeyDataHandle is the platform handle for key data that is protected
+// only by a passphrase.
+type passphraseKeyDataHandle struct {
+	// AuthKeyDigest is used to verify the passphrase derived key.
+	AuthKeyDigest keyDigest `json:"auth_key_digest"`
+}
+
+func newPassphraseKeyDataHandle(authKey []byte) (*passphraseKeyDataHandle, error) {
+	var salt [32]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return nil, xerrors.Errorf("cannot read salt: %w", err)
+	}
+
+	handle := &passphraseKeyDataHandle{
+		AuthKeyDigest: keyDigest{
+			Alg:  hashAlg(crypto.SHA256),
+			Salt: salt[:]}}
+
+	h := handle.AuthKeyDigest.Alg.New()
+	h.Write(authKey)
+	h.Write(handle.AuthKeyDigest.Salt)
+	handle.AuthKeyDigest.Digest = h.Sum(nil)
+
+	return handle, nil
+}
+
+func (h *passphraseKeyDataHandle) checkAuthKey(authKey []byte) error {
+	alg := h.AuthKeyDigest.Alg
+	if !alg.Available() {
+		return &PlatformHandlerError{Type: PlatformHandlerErrorInvalidData, Err: errors.New("invalid digest algorithm")}
+	}
+
+	d := alg.New()
+	d.Write(authKey)
+	d.Write(h.AuthKeyDigest.Salt)
+	if !hmac.Equal(d.Sum(nil), h.AuthKeyDigest.Digest) {
+		return &PlatformHandlerError{Type: PlatformHandlerErrorInvalidAuthKey, Err: errors.New("the supplied key is incorrect")}
+	}
+
+	return nil
+}
+
+// passphraseKeyDataHandler is the PlatformKeyDataHandler for key data that is
+// protected only by a passphrase. The payload is protected entirely by the
+// passphrase derived key in the platform agnostic code, so this just verifies
+// that the passphrase derived key is correct.
+type passphraseKeyDataHandler struct{}
+
+func (_ passphraseKeyDataHandler) unmarshalHandle(data []byte) (*passphraseKeyDataHandle, error) {
+	var handle *passphraseKeyDataHandle
+	if err := json.Unmarshal(data, &handle); err != nil {
+		return nil, &PlatformHandlerError{Type: PlatformHandlerErrorInvalidData, Err: xerrors.Errorf("cannot decode handle: %w", err)}
+	}
+	if handle == nil {
+		return nil, &PlatformHandlerError{Type: PlatformHandlerErrorInvalidData, Err: errors.New("no handle")}
+	}
+	return handle, nil
+}
+
+func (_ passphraseKeyDataHandler) RecoverKeys(data *PlatformKeyData) (KeyPayload, error) {
+	return nil, &PlatformHandlerError{Type: PlatformHandlerErrorInvalidData, Err: errors.New("key data is not protected by a passphrase")}
+}
+
+func (h passphraseKeyDataHandler) RecoverKeysWithAuthKey(data *PlatformKeyData, key []byte) (KeyPayload, error) {
+	handle, err := h.unmarshalHandle(data.EncodedHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := handle.checkAuthKey(key); err != nil {
+		return nil, err
+	}
+
+	return data.EncryptedPayload, nil
+}
+
+func (h passphraseKeyDataHandler) ChangeAuthKey(data, old, new []byte) ([]byte, error) {
+	if new == nil {
+		return nil, errors.New("cannot remove the passphrase from key data that is only protected by a passphrase")
+	}
+
+	if old != nil {
+		handle, err := h.unmarshalHandle(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := handle.checkAuthKey(old); err != nil {
+			return nil, err
+		}
+	}
+
+	handle, err := newPassphraseKeyDataHandle(new)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(handle)
+}
+
+func init() {
+	RegisterPlatformKeyDataHandler(PassphrasePlatformName, passphraseKeyDataHandler{})
+}
+
+// PassphraseKeyParams provides parameters required to create a new KeyData
+// object that is protected only by a passphrase.
+type PassphraseKeyParams struct {
+	Key          DiskUnlockKey // The disk unlock key to protect
+	AuxiliaryKey AuxiliaryKey  // The auxiliary key to protect
+
+	// SnapModelAuthHash is the digest algorithm used for HMACs of Snap
+	// device models, and also the digest algorithm used to produce the
+	// key digest. If this is zero, then SHA-256 is used.
+	SnapModelAuthHash crypto.Hash
+}
+
+// NewKeyDataWithPassphrase creates a new KeyData object that protects the
+// supplied keys with the supplied passphrase only, without the involvement of
+// a platform's secure device. The payload is encrypted with a key derived from
+// the passphrase using the KDF. The returned KeyData uses PassphrasePlatformName
+// as its platform name, and AuthMode will return AuthModePassphrase.
+//
+// The returned KeyData can be used in the same way as KeyData objects that are
+// protected by a platform's secure device, including with
+// ActivateVolumeWithKeyData and the snap model authorization APIs. The
+// passphrase can be changed with KeyData.ChangePassphrase, but cannot be
+// removed.
+//
+// The kdfOptions argument configures the Argon2 KDF settings. The kdf argument
+// provides the Argon2 KDF implementation that will be used - this should ultimately
+// execute the implementation returned by the Argon2iKDF function, but the caller
+// can choose to execute this in a short-lived utility process.
+func NewKeyDataWithPassphrase(params *PassphraseKeyParams, passphrase string, kdfOptions *KDFOptions, kdf KDF) (*KeyData, error) {
+	alg := params.SnapModelAuthHash
+	if alg == crypto.Hash(0) {
+		alg = crypto.SHA256
+	}
+
+	// The cleartext payload is only retained until it is protected by the
+	// passphrase.
+	payload := MarshalKeys(params.Key, params.AuxiliaryKey)
+	defer secmem.Wipe(payload)
+
+	kd, err := NewKeyData(&KeyParams{
+		Handle:            json.RawMessage("null"),
+		EncryptedPayload:  payload,
+		PlatformName:      PassphrasePlatformName,
+		AuxiliaryKey:      params.AuxiliaryKey,
+		SnapModelAuthHash: alg})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := kd.SetPassphrase(passphrase, kdfOptions, kdf); err != nil {
+		return nil, xerrors.Errorf("cannot set passphrase: %w", err)
+	}
+
+	return kd, nil
+}
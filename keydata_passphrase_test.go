@@ -0,0 +1,190 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type keyDataPassphraseSuite struct {
+	keyDataTestBase
+}
+
+var _ = Suite(&keyDataPassphraseSuite{})
+
+func (s *keyDataPassphraseSuite) newKeyData(c *C, passphrase string) (*KeyData, DiskUnlockKey, AuxiliaryKey) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+
+	keyData, err := NewKeyDataWithPassphrase(&PassphraseKeyParams{
+		Key:          key,
+		AuxiliaryKey: auxKey}, passphrase, nil, new(testutil.MockKDF))
+	c.Assert(err, IsNil)
+
+	return keyData, key, auxKey
+}
+
+func (s *keyDataPassphraseSuite) TestNewKeyDataWithPassphrase(c *C) {
+	keyData, _, _ := s.newKeyData(c, "passphrase")
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+
+	c.Check(j["platform_name"], Equals, PassphrasePlatformName)
+	c.Check(j, Not(testutil.HasKey), "encrypted_payload")
+	c.Check(j, testutil.HasKey, "passphrase_protected_payload")
+
+	m, ok := j["authorized_snap_models"].(map[string]interface{})
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(toHash(c, m["alg"]), Equals, crypto.SHA256)
+}
+
+func (s *keyDataPassphraseSuite) TestNewKeyDataWithPassphraseDifferentAuthHash(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+
+	keyData, err := NewKeyDataWithPassphrase(&PassphraseKeyParams{
+		Key:               key,
+		AuxiliaryKey:      auxKey,
+		SnapModelAuthHash: crypto.SHA384}, "passphrase", nil, new(testutil.MockKDF))
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+
+	m, ok := j["authorized_snap_models"].(map[string]interface{})
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(toHash(c, m["alg"]), Equals, crypto.SHA384)
+}
+
+func (s *keyDataPassphraseSuite) testRecoverKeysWithPassphrase(c *C, passphrase string) {
+	keyData, key, auxKey := s.newKeyData(c, passphrase)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err := ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase(passphrase, new(testutil.MockKDF))
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataPassphraseSuite) TestRecoverKeysWithPassphrase1(c *C) {
+	s.testRecoverKeysWithPassphrase(c, "passphrase")
+}
+
+func (s *keyDataPassphraseSuite) TestRecoverKeysWithPassphrase2(c *C) {
+	s.testRecoverKeysWithPassphrase(c, "1234")
+}
+
+func (s *keyDataPassphraseSuite) TestRecoverKeysWithInvalidPassphrase(c *C) {
+	keyData, _, _ := s.newKeyData(c, "passphrase")
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("1234", new(testutil.MockKDF))
+	c.Check(err, Equals, ErrInvalidPassphrase)
+	c.Check(recoveredKey, IsNil)
+	c.Check(recoveredAuxKey, IsNil)
+}
+
+func (s *keyDataPassphraseSuite) TestRecoverKeys(c *C) {
+	keyData, _, _ := s.newKeyData(c, "passphrase")
+
+	_, _, err := keyData.RecoverKeys()
+	c.Check(err, ErrorMatches, "cannot recover key without authorization")
+}
+
+func (s *keyDataPassphraseSuite) TestChangePassphrase(c *C) {
+	keyData, key, auxKey := s.newKeyData(c, "passphrase")
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.ChangePassphrase("passphrase", "1234", nil, &kdf), IsNil)
+
+	_, _, err := keyData.RecoverKeysWithPassphrase("passphrase", &kdf)
+	c.Check(err, Equals, ErrInvalidPassphrase)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataPassphraseSuite) TestChangePassphraseWithInvalidPassphrase(c *C) {
+	keyData, key, auxKey := s.newKeyData(c, "passphrase")
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.ChangePassphrase("1234", "foo", nil, &kdf), Equals, ErrInvalidPassphrase)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("passphrase", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataPassphraseSuite) TestClearPassphrase(c *C) {
+	keyData, _, _ := s.newKeyData(c, "passphrase")
+
+	c.Check(keyData.ClearPassphraseWithPassphrase("passphrase", new(testutil.MockKDF)), ErrorMatches,
+		"cannot perform action because of an unexpected error: cannot remove the passphrase from key data that is only protected by a passphrase")
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+}
+
+func (s *keyDataPassphraseSuite) TestSnapModelAuthorization(c *C) {
+	keyData, _, auxKey := s.newKeyData(c, "passphrase")
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "other-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, models[0]), IsNil)
+
+	authorized, err := keyData.IsSnapModelAuthorized(auxKey, models[0])
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsTrue)
+
+	authorized, err = keyData.IsSnapModelAuthorized(auxKey, models[1])
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsFalse)
+}
@@ -56,11 +56,17 @@ const (
 	mockPlatformDeviceStateOK = iota
 	mockPlatformDeviceStateUnavailable
 	mockPlatformDeviceStateUninitialized
+	mockPlatformDeviceStateLockout
 )
 
 type mockPlatformKeyDataHandler struct {
 	state             int
 	passphraseSupport bool
+
+	// recoveredPayloads records the cleartext payloads returned
+	// from this handler, so that tests can check that they are
+	// wiped after use.
+	recoveredPayloads []KeyPayload
 }
 
 func (h *mockPlatformKeyDataHandler) checkState() error {
@@ -69,6 +75,8 @@ func (h *mockPlatformKeyDataHandler) checkState() error {
 		return &PlatformHandlerError{Type: PlatformHandlerErrorUnavailable, Err: errors.New("the platform device is unavailable")}
 	case mockPlatformDeviceStateUninitialized:
 		return &PlatformHandlerError{Type: PlatformHandlerErrorUninitialized, Err: errors.New("the platform device is uninitialized")}
+	case mockPlatformDeviceStateLockout:
+		return &PlatformHandlerError{Type: PlatformHandlerErrorLockout, Err: errors.New("the platform device is locked out")}
 	default:
 		return nil
 	}
@@ -101,6 +109,7 @@ func (h *mockPlatformKeyDataHandler) recoverKeys(handle *mockPlatformKeyDataHand
 	s := cipher.NewCFBDecrypter(b, handle.IV)
 	out := make(KeyPayload, len(payload))
 	s.XORKeyStream(out, payload)
+	h.recoveredPayloads = append(h.recoveredPayloads, out)
 	return out, nil
 }
 
@@ -163,6 +172,15 @@ func (h *mockPlatformKeyDataHandler) ChangeAuthKey(data, old, new []byte) ([]byt
 	return json.Marshal(&handle)
 }
 
+func (h *mockPlatformKeyDataHandler) InspectHandle(data []byte) (map[string]interface{}, error) {
+	handle, err := h.unmarshalHandle(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"iv": handle.IV}, nil
+}
+
 type mockKeyDataWriter struct {
 	tmp   *bytes.Buffer
 	final *bytes.Buffer
@@ -238,6 +256,7 @@ func (s *keyDataTestBase) SetUpSuite(c *C) {
 func (s *keyDataTestBase) SetUpTest(c *C) {
 	s.handler.state = mockPlatformDeviceStateOK
 	s.handler.passphraseSupport = false
+	s.handler.recoveredPayloads = nil
 }
 
 func (s *keyDataTestBase) TearDownSuite(c *C) {
@@ -586,6 +605,27 @@ func (s *keyDataSuite) TestRecoverKeys(c *C) {
 	c.Check(recoveredAuxKey, DeepEquals, auxKey)
 }
 
+func (s *keyDataSuite) checkRecoveredPayloadsWiped(c *C) {
+	c.Assert(s.handler.recoveredPayloads, Not(HasLen), 0)
+	for _, payload := range s.handler.recoveredPayloads {
+		c.Check(payload, DeepEquals, make(KeyPayload, len(payload)))
+	}
+}
+
+func (s *keyDataSuite) TestRecoverKeysWipesPayload(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+
+	s.checkRecoveredPayloadsWiped(c)
+}
+
 func (s *keyDataSuite) TestRecoverKeysUnrecognizedPlatform(c *C) {
 	key, auxKey := s.newKeyDataKeys(c, 32, 32)
 	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
@@ -670,6 +710,125 @@ func (s *keyDataSuite) TestRecoverKeysWithPassphrase2(c *C) {
 	s.testRecoverKeysWithPassphrase(c, "1234")
 }
 
+func (s *keyDataSuite) TestRecoverKeysWithPassphraseLockout(c *C) {
+	s.handler.passphraseSupport = true
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.SetPassphrase("1234", nil, &kdf), IsNil)
+
+	s.handler.state = mockPlatformDeviceStateLockout
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, ErrorMatches, "the platform's secure device is locked out: the platform device is locked out")
+	c.Check(err, testutil.ConvertibleTo, &PlatformLockoutError{})
+	c.Check(recoveredKey, IsNil)
+	c.Check(recoveredAuxKey, IsNil)
+}
+
+// recordingKDF is a KDF that records the keys that it returns, so that
+// tests can check that they are wiped after use.
+type recordingKDF struct {
+	testutil.MockKDF
+	keys [][]byte
+}
+
+func (k *recordingKDF) Derive(passphrase string, salt []byte, params *KDFCostParams, keyLen uint32) ([]byte, error) {
+	key, err := k.MockKDF.Derive(passphrase, salt, params, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	k.keys = append(k.keys, key)
+	return key, nil
+}
+
+func (k *recordingKDF) checkKeysWiped(c *C) {
+	c.Assert(k.keys, Not(HasLen), 0)
+	for _, key := range k.keys {
+		c.Check(key, DeepEquals, make([]byte, len(key)))
+	}
+}
+
+func (s *keyDataSuite) TestRecoverKeysWithPassphraseWipesSecrets(c *C) {
+	s.handler.passphraseSupport = true
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	var kdf recordingKDF
+	c.Check(keyData.SetPassphrase("passphrase", nil, &kdf), IsNil)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("passphrase", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+
+	c.Check(kdf.keys, HasLen, 2)
+	kdf.checkKeysWiped(c)
+	s.checkRecoveredPayloadsWiped(c)
+}
+
+func (s *keyDataSuite) TestChangePassphraseWipesSecrets(c *C) {
+	s.handler.passphraseSupport = true
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	var kdf recordingKDF
+	c.Check(keyData.SetPassphrase("passphrase", nil, &kdf), IsNil)
+	c.Check(keyData.ChangePassphrase("passphrase", "1234", nil, &kdf), IsNil)
+
+	c.Check(kdf.keys, HasLen, 3)
+	kdf.checkKeysWiped(c)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataSuite) TestClearPassphraseWithPassphraseWipesSecrets(c *C) {
+	s.handler.passphraseSupport = true
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	var kdf recordingKDF
+	c.Check(keyData.SetPassphrase("passphrase", nil, &kdf), IsNil)
+	c.Check(keyData.ClearPassphraseWithPassphrase("passphrase", &kdf), IsNil)
+	kdf.checkKeysWiped(c)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataSuite) TestMarshalKeys(c *C) {
+	payload := MarshalKeys(DiskUnlockKey{1, 2, 3}, AuxiliaryKey{4, 5})
+	c.Check(payload, DeepEquals, KeyPayload{0, 3, 1, 2, 3, 0, 2, 4, 5})
+	c.Check(cap(payload), Equals, len(payload))
+
+	key, auxKey, err := payload.Unmarshal()
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, DiskUnlockKey{1, 2, 3})
+	c.Check(auxKey, DeepEquals, AuxiliaryKey{4, 5})
+}
+
 func (s *keyDataSuite) TestSetPassphraseNotSupported(c *C) {
 	key, auxKey := s.newKeyDataKeys(c, 32, 32)
 	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
@@ -831,6 +990,98 @@ func (s *keyDataSuite) TestChangePassphraseWrongPassphrase(c *C) {
 	s.checkKeyDataJSONAuthModePassphrase(c, keyData, protected, 0, "12345678", nil)
 }
 
+type testUpgradeKDFCostParamsData struct {
+	initialOptions *KDFOptions
+	upgradeOptions *KDFOptions
+	upgraded       bool
+}
+
+func (s *keyDataSuite) testUpgradeKDFCostParams(c *C, data *testUpgradeKDFCostParamsData) {
+	s.handler.passphraseSupport = true
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.SetPassphrase("passphrase", data.initialOptions, &kdf), IsNil)
+
+	upgraded, err := keyData.UpgradeKDFCostParams("passphrase", data.upgradeOptions, &kdf)
+	c.Check(err, IsNil)
+	c.Check(upgraded, Equals, data.upgraded)
+
+	expectedOptions := data.initialOptions
+	if data.upgraded {
+		expectedOptions = data.upgradeOptions
+	}
+	s.checkKeyDataJSONAuthModePassphrase(c, keyData, protected, 0, "passphrase", expectedOptions)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("passphrase", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataSuite) TestUpgradeKDFCostParams(c *C) {
+	s.testUpgradeKDFCostParams(c, &testUpgradeKDFCostParamsData{
+		initialOptions: &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024},
+		upgradeOptions: &KDFOptions{ForceIterations: 10, MemoryKiB: 32 * 1024},
+		upgraded:       true})
+}
+
+func (s *keyDataSuite) TestUpgradeKDFCostParamsMemory(c *C) {
+	s.testUpgradeKDFCostParams(c, &testUpgradeKDFCostParamsData{
+		initialOptions: &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024},
+		upgradeOptions: &KDFOptions{ForceIterations: 4, MemoryKiB: 128 * 1024},
+		upgraded:       true})
+}
+
+func (s *keyDataSuite) TestUpgradeKDFCostParamsNotRequired(c *C) {
+	s.testUpgradeKDFCostParams(c, &testUpgradeKDFCostParamsData{
+		initialOptions: &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024},
+		upgradeOptions: &KDFOptions{ForceIterations: 6, MemoryKiB: 32 * 1024},
+		upgraded:       false})
+}
+
+func (s *keyDataSuite) TestUpgradeKDFCostParamsNotRequiredLower(c *C) {
+	s.testUpgradeKDFCostParams(c, &testUpgradeKDFCostParamsData{
+		initialOptions: &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024},
+		upgradeOptions: &KDFOptions{ForceIterations: 2, MemoryKiB: 32 * 1024},
+		upgraded:       false})
+}
+
+func (s *keyDataSuite) TestUpgradeKDFCostParamsAuthModeNone(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	_, err = keyData.UpgradeKDFCostParams("passphrase", nil, new(testutil.MockKDF))
+	c.Check(err, ErrorMatches, "cannot upgrade KDF cost parameters without a passphrase")
+}
+
+func (s *keyDataSuite) TestUpgradeKDFCostParamsWrongPassphrase(c *C) {
+	s.handler.passphraseSupport = true
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.SetPassphrase("passphrase", &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024}, &kdf), IsNil)
+
+	upgraded, err := keyData.UpgradeKDFCostParams("1234", &KDFOptions{ForceIterations: 10, MemoryKiB: 32 * 1024}, &kdf)
+	c.Check(err, Equals, ErrInvalidPassphrase)
+	c.Check(upgraded, Equals, false)
+
+	s.checkKeyDataJSONAuthModePassphrase(c, keyData, protected, 0, "passphrase", &KDFOptions{ForceIterations: 4, MemoryKiB: 32 * 1024})
+}
+
 func (s *keyDataSuite) TestClearPassphraseWithPassphraseAuthModeNone(c *C) {
 	key, auxKey := s.newKeyDataKeys(c, 32, 32)
 	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
@@ -1047,6 +1298,374 @@ func (s *keyDataSuite) TestSetAuthorizedSnapModelsWithWrongKey(c *C) {
 	c.Check(keyData.SetAuthorizedSnapModels(make(AuxiliaryKey, 32), models...), ErrorMatches, "incorrect key supplied")
 }
 
+func (s *keyDataSuite) TestNewKeyDataHasMetadataMAC(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+}
+
+func (s *keyDataSuite) TestVerifyMetadataMACWithWrongKey(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	err = keyData.VerifyMetadataMAC(make(AuxiliaryKey, 32))
+	c.Check(err, ErrorMatches, "invalid key data: metadata MAC check failed")
+	c.Check(err, FitsTypeOf, &InvalidKeyDataError{})
+}
+
+func (s *keyDataSuite) testVerifyMetadataMACDetectsModification(c *C, modify func(j map[string]interface{})) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Check(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	modify(j)
+
+	b, err := json.Marshal(j)
+	c.Check(err, IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(b)})
+	c.Assert(err, IsNil)
+
+	err = keyData.VerifyMetadataMAC(auxKey)
+	c.Check(err, ErrorMatches, "invalid key data: metadata MAC check failed")
+	c.Check(err, FitsTypeOf, &InvalidKeyDataError{})
+}
+
+func (s *keyDataSuite) TestVerifyMetadataMACDetectsModifiedModels(c *C) {
+	s.testVerifyMetadataMACDetectsModification(c, func(j map[string]interface{}) {
+		m := j["authorized_snap_models"].(map[string]interface{})
+		m["hmacs"] = []interface{}{base64.StdEncoding.EncodeToString(make([]byte, 32))}
+	})
+}
+
+func (s *keyDataSuite) TestVerifyMetadataMACDetectsModifiedHandle(c *C) {
+	s.testVerifyMetadataMACDetectsModification(c, func(j map[string]interface{}) {
+		m := j["platform_handle"].(map[string]interface{})
+		m["iv"] = base64.StdEncoding.EncodeToString(make([]byte, aes.BlockSize))
+	})
+}
+
+func (s *keyDataSuite) TestVerifyMetadataMACDetectsModifiedPlatformName(c *C) {
+	s.testVerifyMetadataMACDetectsModification(c, func(j map[string]interface{}) {
+		j["platform_name"] = "other"
+	})
+}
+
+func (s *keyDataSuite) TestPassphraseChangesUpdateMetadataMAC(c *C) {
+	s.handler.passphraseSupport = true
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.SetPassphrase("passphrase", nil, &kdf), IsNil)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+
+	c.Check(keyData.ChangePassphrase("passphrase", "1234", nil, &kdf), IsNil)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+
+	c.Check(keyData.ClearPassphraseWithPassphrase("1234", &kdf), IsNil)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+}
+
+func (s *keyDataSuite) TestChangePassphraseDetectsModifiedMetadata(c *C) {
+	// Test that changing the passphrase doesn't compute a new MAC for
+	// key data that has been modified.
+	s.handler.passphraseSupport = true
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	var kdf testutil.MockKDF
+	c.Check(keyData.SetPassphrase("passphrase", nil, &kdf), IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Check(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	m := j["authorized_snap_models"].(map[string]interface{})
+	m["hmacs"] = []interface{}{base64.StdEncoding.EncodeToString(make([]byte, 32))}
+
+	b, err := json.Marshal(j)
+	c.Check(err, IsNil)
+	keyData, err = ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(b)})
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.ChangePassphrase("passphrase", "1234", nil, &kdf), ErrorMatches,
+		"cannot perform action because of an unexpected error: invalid key data: metadata MAC check failed")
+
+	// The key data should not have been modified.
+	_, _, err = keyData.RecoverKeysWithPassphrase("passphrase", &kdf)
+	c.Check(err, IsNil)
+}
+
+func (s *keyDataSuite) TestVerifyMetadataMACMissing(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Check(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	c.Check(j["generation"], Equals, float64(2))
+	delete(j, "metadata_mac")
+
+	b, err := json.Marshal(j)
+	c.Check(err, IsNil)
+	keyData, err = ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(b)})
+	c.Assert(err, IsNil)
+
+	err = keyData.VerifyMetadataMAC(auxKey)
+	c.Check(err, ErrorMatches, "invalid key data: missing metadata MAC")
+	c.Check(err, FitsTypeOf, &InvalidKeyDataError{})
+}
+
+func (s *keyDataSuite) TestVerifyMetadataMACDetectsRemovedGeneration(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Check(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	delete(j, "metadata_mac")
+	delete(j, "generation")
+
+	b, err := json.Marshal(j)
+	c.Check(err, IsNil)
+	keyData, err = ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(b)})
+	c.Assert(err, IsNil)
+
+	err = keyData.VerifyMetadataMAC(auxKey)
+	c.Check(err, ErrorMatches, "invalid key data: cannot verify auxiliary key: incorrect key supplied")
+	c.Check(err, FitsTypeOf, &InvalidKeyDataError{})
+}
+
+func (s *keyDataSuite) TestSetAuthorizedSnapModelsUpdatesMetadataMAC(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, models...), IsNil)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+}
+
+type testSnapModelAuthRulesData struct {
+	rules      []SnapModelAuthRule
+	model      SnapModel
+	authorized bool
+}
+
+func (s *keyDataSuite) testSnapModelAuthRules(c *C, data *testSnapModelAuthRulesData) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.SetSnapModelAuthRules(auxKey, data.rules...), IsNil)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+
+	authorized, err := keyData.IsSnapModelAuthorized(auxKey, data.model)
+	c.Check(err, IsNil)
+	c.Check(authorized, Equals, data.authorized)
+
+	for _, rule := range data.rules {
+		if rule.Matches(data.model) {
+			c.Check(data.authorized, testutil.IsTrue)
+		}
+	}
+}
+
+func (s *keyDataSuite) TestSnapModelAuthRulesBrandAndGrade(c *C) {
+	s.testSnapModelAuthRules(c, &testSnapModelAuthRulesData{
+		rules: []SnapModelAuthRule{{BrandID: "fake-brand", Grade: "secured"}},
+		model: testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		authorized: true})
+}
+
+func (s *keyDataSuite) TestSnapModelAuthRulesBrandAndSignKey(c *C) {
+	s.testSnapModelAuthRules(c, &testSnapModelAuthRulesData{
+		rules: []SnapModelAuthRule{{BrandID: "fake-brand", SignKeyID: "GQ2ARdxYdcEATk3THxMZTuolBDz5_8QFUMyjD9yuIPjX7tBfPJQFiyBjKdvo0jEu"}},
+		model: testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "dangerous",
+		}, "GQ2ARdxYdcEATk3THxMZTuolBDz5_8QFUMyjD9yuIPjX7tBfPJQFiyBjKdvo0jEu"),
+		authorized: true})
+}
+
+func (s *keyDataSuite) TestSnapModelAuthRulesModelPrefix(c *C) {
+	s.testSnapModelAuthRules(c, &testSnapModelAuthRulesData{
+		rules: []SnapModelAuthRule{
+			{BrandID: "other-brand", Grade: "secured"},
+			{BrandID: "fake-brand", Grade: "secured", ModelPrefix: "fake-"}},
+		model: testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		authorized: true})
+}
+
+func (s *keyDataSuite) TestSnapModelAuthRulesModelPrefixNoMatch(c *C) {
+	s.testSnapModelAuthRules(c, &testSnapModelAuthRulesData{
+		rules: []SnapModelAuthRule{{BrandID: "fake-brand", Grade: "secured", ModelPrefix: "other-"}},
+		model: testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		authorized: false})
+}
+
+func (s *keyDataSuite) TestSnapModelAuthRulesGradeNoMatch(c *C) {
+	s.testSnapModelAuthRules(c, &testSnapModelAuthRulesData{
+		rules: []SnapModelAuthRule{{BrandID: "fake-brand", Grade: "secured"}},
+		model: testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "dangerous",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		authorized: false})
+}
+
+func (s *keyDataSuite) TestSnapModelAuthRulesBrandNoMatch(c *C) {
+	s.testSnapModelAuthRules(c, &testSnapModelAuthRulesData{
+		rules: []SnapModelAuthRule{{BrandID: "other-brand", SignKeyID: "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"}},
+		model: testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		authorized: false})
+}
+
+func (s *keyDataSuite) TestSetSnapModelAuthRulesInvalidRule(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.SetSnapModelAuthRules(auxKey, SnapModelAuthRule{Grade: "secured"}), ErrorMatches,
+		"cannot compute HMAC of rule 0: no brand ID")
+	c.Check(keyData.SetSnapModelAuthRules(auxKey, SnapModelAuthRule{BrandID: "fake-brand", Grade: "secured"}, SnapModelAuthRule{BrandID: "fake-brand"}), ErrorMatches,
+		"cannot compute HMAC of rule 1: exactly one of grade or signing key ID must be specified")
+	c.Check(keyData.SetSnapModelAuthRules(auxKey, SnapModelAuthRule{BrandID: "fake-brand", Grade: "secured", SignKeyID: "foo"}), ErrorMatches,
+		"cannot compute HMAC of rule 0: exactly one of grade or signing key ID must be specified")
+}
+
+func (s *keyDataSuite) TestSetSnapModelAuthRulesWithWrongKey(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.SetSnapModelAuthRules(make(AuxiliaryKey, 32), SnapModelAuthRule{BrandID: "fake-brand", Grade: "secured"}), ErrorMatches, "incorrect key supplied")
+}
+
+func (s *keyDataSuite) TestSetSnapModelAuthRulesPreservesModels(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "dangerous",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, model), IsNil)
+	c.Check(keyData.SetSnapModelAuthRules(auxKey, SnapModelAuthRule{BrandID: "other-brand", Grade: "secured"}), IsNil)
+
+	authorized, err := keyData.IsSnapModelAuthorized(auxKey, model)
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsTrue)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.NumAuthorizedSnapModels, Equals, 1)
+	c.Check(info.NumSnapModelAuthRules, Equals, 1)
+}
+
+func (s *keyDataSuite) TestUpdateMetadataMACWithWrongKey(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.UpdateMetadataMAC(make(AuxiliaryKey, 32)), ErrorMatches, "incorrect key supplied")
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+}
+
 type testWriteAtomicData struct {
 	keyData *KeyData
 	params  *KeyParams
@@ -1426,4 +2045,84 @@ func (s *keyDataSuite) TestReadAndWriteWithLegacySnapModelAuthKey(c *C) {
 	ok, err = keyData.IsSnapModelAuthorized(auxKey, model2)
 	c.Check(err, IsNil)
 	c.Check(ok, testutil.IsTrue)
+
+	c.Check(keyData.VerifyMetadataMAC(auxKey), Equals, ErrNoMetadataMAC)
+	c.Check(keyData.UpdateMetadataMAC(auxKey), IsNil)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+}
+
+func (s *keyDataSuite) TestCopyMetadata(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+
+	src, err := NewKeyData(s.mockProtectKeys(c, key, auxKey, crypto.SHA256))
+	c.Assert(err, IsNil)
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+	c.Check(src.SetAuthorizedSnapModels(auxKey, model), IsNil)
+	rule := SnapModelAuthRule{BrandID: "other-brand", Grade: "secured"}
+	c.Check(src.SetSnapModelAuthRules(auxKey, rule), IsNil)
+	id := BootIdentityClaims{"os-release:ID": "ubuntu"}
+	c.Check(src.SetAuthorizedBootIdentities(auxKey, id), IsNil)
+	c.Check(src.EnableVolumeKeyDerivation(auxKey, crypto.SHA256), IsNil)
+
+	dst, err := NewKeyData(s.mockProtectKeys(c, key, auxKey, crypto.SHA256))
+	c.Assert(err, IsNil)
+	c.Check(dst.CopyMetadata(src, auxKey), IsNil)
+	c.Check(dst.VerifyMetadataMAC(auxKey), IsNil)
+
+	ok, err := dst.IsSnapModelAuthorized(auxKey, model)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsTrue)
+
+	ok, err = dst.IsBootIdentityAuthorized(auxKey, id)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsTrue)
+
+	c.Check(dst.DerivesVolumeKeys(), testutil.IsTrue)
+
+	// The copy is independent of the source.
+	c.Check(src.SetAuthorizedSnapModels(auxKey), IsNil)
+	ok, err = dst.IsSnapModelAuthorized(auxKey, model)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsTrue)
+}
+
+func (s *keyDataSuite) TestCopyMetadataWithWrongKey(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+
+	src, err := NewKeyData(s.mockProtectKeys(c, key, auxKey, crypto.SHA256))
+	c.Assert(err, IsNil)
+	dst, err := NewKeyData(s.mockProtectKeys(c, key, auxKey, crypto.SHA256))
+	c.Assert(err, IsNil)
+
+	c.Check(dst.CopyMetadata(src, make(AuxiliaryKey, 32)), ErrorMatches, "incorrect key supplied")
+}
+
+func (s *keyDataSuite) TestCopyMetadataUnrelatedSource(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	_, otherAuxKey := s.newKeyDataKeys(c, 32, 32)
+
+	src, err := NewKeyData(s.mockProtectKeys(c, key, otherAuxKey, crypto.SHA256))
+	c.Assert(err, IsNil)
+	dst, err := NewKeyData(s.mockProtectKeys(c, key, auxKey, crypto.SHA256))
+	c.Assert(err, IsNil)
+
+	c.Check(dst.CopyMetadata(src, auxKey), ErrorMatches, "cannot verify source key data: incorrect key supplied")
+}
+
+func (s *keyDataSuite) TestCopyMetadataIncompatibleAlgorithms(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+
+	src, err := NewKeyData(s.mockProtectKeys(c, key, auxKey, crypto.SHA384))
+	c.Assert(err, IsNil)
+	dst, err := NewKeyData(s.mockProtectKeys(c, key, auxKey, crypto.SHA256))
+	c.Assert(err, IsNil)
+
+	c.Check(dst.CopyMetadata(src, auxKey), ErrorMatches, "source key data has incompatible snap model authorization algorithms")
 }
@@ -26,6 +26,7 @@ import (
 	"syscall"
 
 	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/luks2"
 
 	"golang.org/x/xerrors"
 )
@@ -44,59 +45,104 @@ func keyringPrefixOrDefault(prefix string) string {
 	return prefix
 }
 
-// GetDiskUnlockKeyFromKernel retrieves the key that was used to unlock the
-// encrypted container at the specified path. The value of prefix must match
-// the prefix that was supplied via ActivateVolumeOptions during unlocking.
-//
-// If remove is true, the key will be removed from the kernel keyring prior
-// to returning.
-//
-// If no key is found, a ErrKernelKeyNotFound error will be returned.
-func GetDiskUnlockKeyFromKernel(prefix, devicePath string, remove bool) (DiskUnlockKey, error) {
-	key, err := keyring.GetKeyFromUserKeyring(devicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(prefix))
+// readVolumeUUID returns the UUID of the LUKS2 container with the header at
+// the specified path, or an empty string if it can't be determined.
+func readVolumeUUID(headerPath string, lockMode luks2.LockMode) string {
+	hdr, err := luks2ReadHeader(headerPath, lockMode)
+	if err != nil {
+		return ""
+	}
+	return hdr.UUID
+}
+
+// keyringVolumeIDs returns the identifiers used for the volume at the specified
+// path in the description of kernel keys. Keys are associated with the supplied
+// UUID of the LUKS2 container if it is known, so that they can be retrieved even
+// if the container is subsequently accessed via a different path. They are also
+// associated with the path for compatibility with consumers that look up keys by
+// path.
+func keyringVolumeIDs(devicePath, uuid string) []string {
+	if uuid == "" {
+		return []string{devicePath}
+	}
+	return []string{"UUID=" + uuid, devicePath}
+}
+
+func isKeyNotFoundError(err error) bool {
+	var e syscall.Errno
+	return xerrors.As(err, &e) && e == syscall.ENOKEY
+}
+
+func getKeyFromKernel(prefix, devicePath, purpose string, remove bool) ([]byte, error) {
+	path, err := resolveDevicePath(devicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot resolve device path: %w", err)
+	}
+
+	// Try the UUID of the container first, falling back to the path
+	// for keys that were added when the UUID couldn't be determined. The
+	// header is read without blocking so that this doesn't stall behind
+	// another process that is modifying it. If it is locked, only the path
+	// is tried.
+	ids := keyringVolumeIDs(path, readVolumeUUID(path, luks2.LockModeNonBlocking))
+
+	var key []byte
+	for _, id := range ids {
+		key, err = keyring.GetKeyFromUserKeyring(id, purpose, keyringPrefixOrDefault(prefix))
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
-		var e syscall.Errno
-		if xerrors.As(err, &e) && e == syscall.ENOKEY {
+		if isKeyNotFoundError(err) {
 			return nil, ErrKernelKeyNotFound
 		}
 		return nil, err
-
 	}
 
 	if remove {
-		if err := keyring.RemoveKeyFromUserKeyring(devicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(prefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
+		// Remove the key under every description it was added with.
+		for _, id := range ids {
+			if err := keyring.RemoveKeyFromUserKeyring(id, purpose, keyringPrefixOrDefault(prefix)); err != nil && !isKeyNotFoundError(err) {
+				fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
+			}
 		}
 	}
 
 	return key, nil
 }
 
+// GetDiskUnlockKeyFromKernel retrieves the key that was used to unlock the
+// encrypted container at the specified path. The value of prefix must match
+// the prefix that was supplied via ActivateVolumeOptions during unlocking.
+//
+// The devicePath argument may be a device path or any other volume locator
+// accepted by ParseVolumeLocator. Keys are associated with the UUID of the
+// container where possible as well as the path used to unlock it, so the
+// path doesn't need to match the one used during unlocking.
+//
+// If remove is true, the key will be removed from the kernel keyring prior
+// to returning. This removes it for both the UUID and the path.
+//
+// If no key is found, a ErrKernelKeyNotFound error will be returned.
+func GetDiskUnlockKeyFromKernel(prefix, devicePath string, remove bool) (DiskUnlockKey, error) {
+	return getKeyFromKernel(prefix, devicePath, keyringPurposeDiskUnlock, remove)
+}
+
 // GetAuxiliaryKeyFromKernel retrieves the auxiliary key associated with the
 // KeyData that was used to unlock the encrypted container at the specified path.
 // The value of prefix must match the prefix that was supplied via
 // ActivateVolumeOptions during unlocking.
 //
+// The devicePath argument may be a device path or any other volume locator
+// accepted by ParseVolumeLocator. Keys are associated with the UUID of the
+// container where possible as well as the path used to unlock it, so the
+// path doesn't need to match the one used during unlocking.
+//
 // If remove is true, the key will be removed from the kernel keyring prior
-// to returning.
+// to returning. This removes it for both the UUID and the path.
 //
 // If no key is found, a ErrKernelKeyNotFound error will be returned.
 func GetAuxiliaryKeyFromKernel(prefix, devicePath string, remove bool) (AuxiliaryKey, error) {
-	key, err := keyring.GetKeyFromUserKeyring(devicePath, keyringPurposeAuxiliary, keyringPrefixOrDefault(prefix))
-	if err != nil {
-		var e syscall.Errno
-		if xerrors.As(err, &e) && e == syscall.ENOKEY {
-			return nil, ErrKernelKeyNotFound
-		}
-		return nil, err
-
-	}
-
-	if remove {
-		if err := keyring.RemoveKeyFromUserKeyring(devicePath, keyringPurposeAuxiliary, keyringPrefixOrDefault(prefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
-		}
-	}
-
-	return key, nil
+	return getKeyFromKernel(prefix, devicePath, keyringPurposeAuxiliary, remove)
 }
@@ -20,10 +20,14 @@
 package secboot_test
 
 import (
+	"errors"
 	"math/rand"
+	"os"
+	"syscall"
 
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/testutil"
 
 	. "gopkg.in/check.v1"
@@ -35,6 +39,13 @@ type keyringSuite struct {
 
 var _ = Suite(&keyringSuite{})
 
+func (s *keyringSuite) SetUpTest(c *C) {
+	s.KeyringTestBase.SetUpTest(c)
+	s.AddCleanup(MockLUKS2ReadHeader(func(string, luks2.LockMode) (*luks2.HeaderInfo, error) {
+		return nil, errors.New("no container")
+	}))
+}
+
 func (s *keyringSuite) SetUpSuite(c *C) {
 	s.KeyringTestBase.SetUpSuite(c)
 
@@ -111,6 +122,50 @@ func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelAndRemove(c *C) {
 	c.Check(err, ErrorMatches, "cannot find key: required key not available")
 }
 
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelAndRemoveByUUID(c *C) {
+	// Test that the key is removed under both the UUID and path descriptions.
+	restore := MockLUKS2ReadHeader(func(path string, lockMode luks2.LockMode) (*luks2.HeaderInfo, error) {
+		c.Check(path, Equals, "/dev/sda1")
+		c.Check(lockMode, Equals, luks2.LockModeNonBlocking)
+		return &luks2.HeaderInfo{UUID: "6503ce5c-c2fb-49e9-a560-71928d8ded0e"}, nil
+	})
+	defer restore()
+
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e", "unlock", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "ubuntu-fde"), IsNil)
+
+	key2, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", true)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	_, err = keyring.GetKeyFromUserKeyring("UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e", "unlock", "ubuntu-fde")
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+	_, err = keyring.GetKeyFromUserKeyring("/dev/sda1", "unlock", "ubuntu-fde")
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelHeaderLocked(c *C) {
+	// Test that the key is retrieved by path without blocking if another
+	// process has the header locked.
+	restore := MockLUKS2ReadHeader(func(path string, lockMode luks2.LockMode) (*luks2.HeaderInfo, error) {
+		c.Check(lockMode, Equals, luks2.LockModeNonBlocking)
+		return nil, &os.PathError{Op: "flock", Path: path, Err: syscall.EWOULDBLOCK}
+	})
+	defer restore()
+
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "ubuntu-fde"), IsNil)
+
+	key2, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+}
+
 type testGetAuxiliaryKeyFromKernelData struct {
 	key        AuxiliaryKey
 	prefix     string
@@ -43,6 +43,12 @@ const (
 	// be performed by PlatformKeyDataHandler because the supplied
 	// authorization key was incorrect.
 	PlatformHandlerErrorInvalidAuthKey
+
+	// PlatformHandlerErrorLockout indicates that an action could not be
+	// performed by PlatformKeyDataHandler because the platform's secure
+	// device is locked out for the supplied key data because of too many
+	// incorrect authorization attempts.
+	PlatformHandlerErrorLockout
 )
 
 // PlatformHandlerError is returned from a PlatformKeyDataHandler implementation when
@@ -70,6 +76,12 @@ type PlatformKeyData struct {
 
 // PlatormKeyDataHandler is the interface that this go package uses to
 // interact with a platform's secure device for the purpose of recovering keys.
+//
+// The caller takes ownership of the cleartext payloads returned from RecoverKeys
+// and RecoverKeysWithAuthKey and wipes them once the keys have been unmarshalled,
+// so implementations must not return a payload that shares memory with any data
+// that they retain. The passphrase derived keys supplied to RecoverKeysWithAuthKey
+// and ChangeAuthKey are only valid for the duration of the call.
 type PlatformKeyDataHandler interface {
 	// RecoverKeys attempts to recover the cleartext keys from the supplied key
 	// data using this platform's secure device.
@@ -97,6 +109,17 @@ type PlatformKeyDataHandler interface {
 
 var handlers = make(map[string]PlatformKeyDataHandler)
 
+// PlatformKeyDataInspector is an optional interface that can be implemented
+// by a PlatformKeyDataHandler in order to provide information about platform
+// handles to KeyData.Inspect.
+type PlatformKeyDataInspector interface {
+	// InspectHandle returns a set of platform specific properties decoded
+	// from the supplied JSON encoded platform handle. The returned values
+	// should be JSON encodable. Implementations should not require access
+	// to the platform's secure device.
+	InspectHandle(handle []byte) (map[string]interface{}, error)
+}
+
 // RegisterPlatformKeyDataHandler registers a handler for the specified platform name.
 func RegisterPlatformKeyDataHandler(name string, handler PlatformKeyDataHandler) {
 	handlers[name] = handler
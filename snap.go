@@ -26,7 +26,10 @@ import (
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"hash"
+	"io"
+	"strings"
 
 	"github.com/snapcore/snapd/asserts"
 
@@ -87,3 +90,93 @@ func computeSnapModelHMAC(alg crypto.Hash, key []byte, model SnapModel) (snapMod
 
 	return h.Sum(nil), nil
 }
+
+const (
+	snapModelAuthRuleGrade     uint8 = 1
+	snapModelAuthRuleSignKeyID uint8 = 2
+)
+
+// SnapModelAuthRule describes a set of snap device models that are
+// authorized to access the data protected by a key without having to
+// enumerate each of them. A rule matches models with the specified
+// brand ID and either the specified grade or the specified signing key,
+// and optionally a model name that starts with the specified prefix.
+type SnapModelAuthRule struct {
+	// BrandID is the brand ID of matching models. It must be set.
+	BrandID string
+
+	// Grade is the grade of matching models. Exactly one of Grade
+	// and SignKeyID must be set.
+	Grade asserts.ModelGrade
+
+	// SignKeyID is the ID of the key used to sign matching models.
+	// Exactly one of Grade and SignKeyID must be set.
+	SignKeyID string
+
+	// ModelPrefix is an optional prefix of the name of matching
+	// models. If empty, models with any name match.
+	ModelPrefix string
+}
+
+func (r *SnapModelAuthRule) validate() error {
+	if r.BrandID == "" {
+		return errors.New("no brand ID")
+	}
+	if (r.Grade == "") == (r.SignKeyID == "") {
+		return errors.New("exactly one of grade or signing key ID must be specified")
+	}
+	return nil
+}
+
+// Matches indicates whether the supplied model is matched by this rule.
+func (r *SnapModelAuthRule) Matches(model SnapModel) bool {
+	if r.validate() != nil {
+		return false
+	}
+	if model.BrandID() != r.BrandID || !strings.HasPrefix(model.Model(), r.ModelPrefix) {
+		return false
+	}
+	if r.Grade != "" {
+		return model.Grade() == r.Grade
+	}
+	return model.SignKeyID() == r.SignKeyID
+}
+
+func computeSnapModelAuthRuleHMAC(alg crypto.Hash, key []byte, rule *SnapModelAuthRule) (snapModelHMAC, error) {
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
+
+	kind := snapModelAuthRuleGrade
+	value := string(rule.Grade)
+	if rule.SignKeyID != "" {
+		kind = snapModelAuthRuleSignKeyID
+		value = rule.SignKeyID
+	}
+
+	h := hmac.New(func() hash.Hash { return alg.New() }, key)
+	binary.Write(h, binary.LittleEndian, kind)
+	for _, s := range []string{rule.BrandID, value, rule.ModelPrefix} {
+		binary.Write(h, binary.LittleEndian, uint32(len(s)))
+		io.WriteString(h, s)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// snapModelAuthRuleCandidates returns every rule that could match the
+// supplied model. Rules are only stored as HMACs, so checking a model
+// against them requires computing the HMAC of each candidate.
+func snapModelAuthRuleCandidates(model SnapModel) (out []*SnapModelAuthRule) {
+	name := model.Model()
+	for i := 0; i <= len(name); i++ {
+		prefix := name[:i]
+		if model.Grade() != "" {
+			out = append(out, &SnapModelAuthRule{BrandID: model.BrandID(), Grade: model.Grade(), ModelPrefix: prefix})
+		}
+		if model.SignKeyID() != "" {
+			out = append(out, &SnapModelAuthRule{BrandID: model.BrandID(), SignKeyID: model.SignKeyID(), ModelPrefix: prefix})
+		}
+	}
+	return out
+}
@@ -0,0 +1,273 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// PCRMismatch describes a PCR with a value that differs from the
+// expected value.
+type PCRMismatch struct {
+	Alg      tpm2.HashAlgorithmId
+	PCR      int
+	Expected tpm2.Digest
+	Current  tpm2.Digest
+
+	// DivergentEvents contains the events from the TCG event log that
+	// are responsible for the difference, if an event log was supplied.
+	// If a prefix of the events measured to this PCR produces the
+	// expected value, then this only contains the events that follow
+	// that prefix. Otherwise, it contains every event measured to this
+	// PCR.
+	DivergentEvents []*tcglog.Event
+}
+
+// PCRPolicyBranchDiagnosis describes how the current PCR values differ from
+// the values associated with a single branch of a PCR policy.
+type PCRPolicyBranchDiagnosis struct {
+	Values     tpm2.PCRValues // The PCR values associated with this branch
+	Mismatches []*PCRMismatch // The PCRs that differ from this branch
+}
+
+// PCRPolicyDiagnosis explains why the PCR policy of a sealed key object does
+// or doesn't accept the current PCR values.
+type PCRPolicyDiagnosis struct {
+	// CurrentValues contains the current values of the PCRs included
+	// in the PCR policy.
+	CurrentValues tpm2.PCRValues
+
+	// CurrentValuesAccepted indicates whether the current PCR values
+	// are accepted by the PCR policy.
+	CurrentValuesAccepted bool
+
+	// Branches contains an entry for each branch of the supplied PCR
+	// protection profile that is included in the PCR policy.
+	Branches []*PCRPolicyBranchDiagnosis
+
+	// ClosestBranch is the entry in Branches with the fewest
+	// mismatched PCRs.
+	ClosestBranch *PCRPolicyBranchDiagnosis
+
+	// EventLogMismatches describes the PCRs for which a replay of the
+	// supplied event log doesn't produce the current value, in which
+	// case the event log can't be trusted for these PCRs. The Expected
+	// field of each entry contains the replayed value.
+	EventLogMismatches []*PCRMismatch
+}
+
+// eventLogReplay contains the events measured to each PCR for a single
+// algorithm, and the initial value of each PCR.
+type eventLogReplay struct {
+	alg     tpm2.HashAlgorithmId
+	initial map[int]tpm2.Digest
+	events  map[int][]*tcglog.Event
+}
+
+func newEventLogReplay(log *tcglog.Log, alg tpm2.HashAlgorithmId) *eventLogReplay {
+	r := &eventLogReplay{
+		alg:     alg,
+		initial: make(map[int]tpm2.Digest),
+		events:  make(map[int][]*tcglog.Event)}
+
+	for _, ev := range log.Events {
+		pcr := int(ev.PCRIndex)
+		if ev.EventType == tcglog.EventTypeNoAction {
+			if d, ok := ev.Data.(*tcglog.StartupLocalityEventData); ok && pcr == 0 {
+				initial := make(tpm2.Digest, alg.Size())
+				initial[len(initial)-1] = d.StartupLocality
+				r.initial[0] = initial
+			}
+			continue
+		}
+		if _, ok := ev.Digests[alg]; !ok {
+			continue
+		}
+		r.events[pcr] = append(r.events[pcr], ev)
+	}
+
+	return r
+}
+
+func (r *eventLogReplay) initialValue(pcr int) tpm2.Digest {
+	if initial, ok := r.initial[pcr]; ok {
+		return initial
+	}
+	initial := make(tpm2.Digest, r.alg.Size())
+	if pcr >= 17 && pcr <= 22 {
+		// The DRTM PCRs are reset to all ones.
+		for i := range initial {
+			initial[i] = 0xff
+		}
+	}
+	return initial
+}
+
+func (r *eventLogReplay) extend(value tpm2.Digest, ev *tcglog.Event) tpm2.Digest {
+	h := r.alg.NewHash()
+	h.Write(value)
+	h.Write(ev.Digests[r.alg])
+	return h.Sum(nil)
+}
+
+// value returns the value of the specified PCR obtained by replaying all of
+// the events measured to it.
+func (r *eventLogReplay) value(pcr int) tpm2.Digest {
+	value := r.initialValue(pcr)
+	for _, ev := range r.events[pcr] {
+		value = r.extend(value, ev)
+	}
+	return value
+}
+
+// divergentEvents returns the events measured to the specified PCR that
+// follow the shortest prefix of events that produces the expected value, or
+// all events if no prefix produces the expected value.
+func (r *eventLogReplay) divergentEvents(pcr int, expected tpm2.Digest) []*tcglog.Event {
+	events := r.events[pcr]
+
+	value := r.initialValue(pcr)
+	for i := 0; i <= len(events); i++ {
+		if bytes.Equal(value, expected) {
+			return events[i:]
+		}
+		if i < len(events) {
+			value = r.extend(value, events[i])
+		}
+	}
+	return events
+}
+
+// diagnosePCRPolicy compares the supplied current PCR values with each of the
+// supplied branches of the specified policy, optionally using the supplied
+// event log to identify the events responsible for any differences.
+func diagnosePCRPolicy(policy keyDataPolicy, alg tpm2.HashAlgorithmId, current tpm2.PCRValues, branches []tpm2.PCRValues, log *tcglog.Log) (*PCRPolicyDiagnosis, error) {
+	pcrs := policy.PCRSelection()
+
+	diagnosis := &PCRPolicyDiagnosis{CurrentValues: current}
+
+	accepted, err := policy.AcceptsPCRValues(alg, current)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot check current PCR values against policy: %w", err)
+	}
+	diagnosis.CurrentValuesAccepted = accepted
+
+	replays := make(map[tpm2.HashAlgorithmId]*eventLogReplay)
+	if log != nil {
+		for _, s := range pcrs {
+			replay := newEventLogReplay(log, s.Hash)
+			replays[s.Hash] = replay
+
+			for _, pcr := range s.Select {
+				value := replay.value(pcr)
+				if bytes.Equal(value, current[s.Hash][pcr]) {
+					continue
+				}
+				diagnosis.EventLogMismatches = append(diagnosis.EventLogMismatches, &PCRMismatch{
+					Alg:      s.Hash,
+					PCR:      pcr,
+					Expected: value,
+					Current:  current[s.Hash][pcr]})
+			}
+		}
+	}
+
+	for _, values := range branches {
+		ok, err := policy.AcceptsPCRValues(alg, values)
+		if err != nil || !ok {
+			// This branch isn't part of the policy.
+			continue
+		}
+
+		branch := &PCRPolicyBranchDiagnosis{Values: values}
+		for _, s := range pcrs {
+			for _, pcr := range s.Select {
+				expected := values[s.Hash][pcr]
+				if bytes.Equal(expected, current[s.Hash][pcr]) {
+					continue
+				}
+
+				mismatch := &PCRMismatch{
+					Alg:      s.Hash,
+					PCR:      pcr,
+					Expected: expected,
+					Current:  current[s.Hash][pcr]}
+				if replay, ok := replays[s.Hash]; ok {
+					mismatch.DivergentEvents = replay.divergentEvents(pcr, expected)
+				}
+				branch.Mismatches = append(branch.Mismatches, mismatch)
+			}
+		}
+
+		diagnosis.Branches = append(diagnosis.Branches, branch)
+		if diagnosis.ClosestBranch == nil || len(branch.Mismatches) < len(diagnosis.ClosestBranch.Mismatches) {
+			diagnosis.ClosestBranch = branch
+		}
+	}
+
+	return diagnosis, nil
+}
+
+// DiagnosePCRPolicy explains why the PCR policy of this sealed key object
+// does or doesn't accept the current PCR values, which is useful when
+// unsealing fails with an InvalidKeyDataError because the authorization
+// policy check failed.
+//
+// The key data only contains a digest for each branch of the PCR policy, so
+// the caller must supply the PCR protection profile that the current PCR
+// policy was computed from in order to identify which PCRs differ. Each
+// branch of the profile that is part of the PCR policy is compared against
+// the current PCR values read from the TPM, and the closest branch is
+// identified. If profile is nil, this only reports whether the current PCR
+// values are accepted.
+//
+// If log is not nil, it is replayed in order to identify the events that
+// caused each PCR to diverge from the expected value, and to check that the
+// event log is consistent with the current PCR values.
+func (k *SealedKeyData) DiagnosePCRPolicy(tpm *Connection, profile *PCRProtectionProfile, log *tcglog.Log) (*PCRPolicyDiagnosis, error) {
+	policy := k.data.Policy()
+
+	_, current, err := tpm.PCRRead(policy.PCRSelection())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read current PCR values: %w", err)
+	}
+
+	var branches []tpm2.PCRValues
+	if profile != nil {
+		branches, err = profile.ComputePCRValues(tpm.TPMContext)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+		}
+	}
+
+	diagnosis, err := diagnosePCRPolicy(policy, k.data.Public().NameAlg, current, branches, log)
+	if err != nil {
+		if isPolicyDataError(err) {
+			return nil, InvalidKeyDataError{err.Error()}
+		}
+		return nil, err
+	}
+	return diagnosis, nil
+}
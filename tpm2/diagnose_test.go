@@ -0,0 +1,285 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto"
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+	"github.com/canonical/tcglog-parser"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type diagnoseSuiteNoTPM struct {
+	policyV3Mixin
+}
+
+var _ = Suite(&diagnoseSuiteNoTPM{})
+
+func (s *diagnoseSuiteNoTPM) newPolicy(c *C, pcrs tpm2.PCRSelectionList, values ...tpm2.PCRValues) KeyDataPolicy {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+
+	var pcrDigests tpm2.DigestList
+	for _, v := range values {
+		digest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, v)
+		c.Assert(err, IsNil)
+		pcrDigests = append(pcrDigests, digest)
+	}
+
+	policy := &KeyDataPolicy_v3{
+		StaticData: &StaticPolicyData_v3{
+			AuthPublicKey: s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)},
+		PCRData: &PcrPolicyData_v3{}}
+	c.Assert(policy.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, NewPcrPolicyParams(key, pcrs, pcrDigests, nil)), IsNil)
+	return policy
+}
+
+func (s *diagnoseSuiteNoTPM) newEvent(pcr int, data string) *tcglog.Event {
+	return &tcglog.Event{
+		PCRIndex:  tcglog.PCRIndex(pcr),
+		EventType: tcglog.EventTypeEFIBootServicesApplication,
+		Digests:   tcglog.DigestMap{tpm2.HashAlgorithmSHA256: tcglog.Digest(hash(crypto.SHA256, data))}}
+}
+
+func (s *diagnoseSuiteNoTPM) replay(initial tpm2.Digest, events ...*tcglog.Event) tpm2.Digest {
+	value := initial
+	for _, ev := range events {
+		h := crypto.SHA256.New()
+		h.Write(value)
+		h.Write(ev.Digests[tpm2.HashAlgorithmSHA256])
+		value = h.Sum(nil)
+	}
+	return value
+}
+
+func (s *diagnoseSuiteNoTPM) TestDiagnosePCRPolicyAccepted(c *C) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}}
+	values := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo"), 7: hash(crypto.SHA256, "bar")}}
+	policy := s.newPolicy(c, pcrs, values)
+
+	diagnosis, err := DiagnosePCRPolicy(policy, tpm2.HashAlgorithmSHA256, values, []tpm2.PCRValues{values}, nil)
+	c.Assert(err, IsNil)
+	c.Check(diagnosis.CurrentValuesAccepted, testutil.IsTrue)
+	c.Check(diagnosis.CurrentValues, DeepEquals, values)
+	c.Assert(diagnosis.Branches, HasLen, 1)
+	c.Check(diagnosis.Branches[0].Values, DeepEquals, values)
+	c.Check(diagnosis.Branches[0].Mismatches, HasLen, 0)
+	c.Check(diagnosis.ClosestBranch, Equals, diagnosis.Branches[0])
+	c.Check(diagnosis.EventLogMismatches, HasLen, 0)
+}
+
+func (s *diagnoseSuiteNoTPM) TestDiagnosePCRPolicyNoBranches(c *C) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}}
+	values := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo"), 7: hash(crypto.SHA256, "bar")}}
+	policy := s.newPolicy(c, pcrs, values)
+
+	current := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo2"), 7: hash(crypto.SHA256, "bar")}}
+
+	diagnosis, err := DiagnosePCRPolicy(policy, tpm2.HashAlgorithmSHA256, current, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(diagnosis.CurrentValuesAccepted, testutil.IsFalse)
+	c.Check(diagnosis.Branches, HasLen, 0)
+	c.Check(diagnosis.ClosestBranch, IsNil)
+}
+
+func (s *diagnoseSuiteNoTPM) TestDiagnosePCRPolicyClosestBranch(c *C) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}}
+	branch1 := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4:  hash(crypto.SHA256, "foo1"),
+		7:  hash(crypto.SHA256, "bar1"),
+		12: hash(crypto.SHA256, "baz")}}
+	branch2 := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4:  hash(crypto.SHA256, "foo2"),
+		7:  hash(crypto.SHA256, "bar"),
+		12: hash(crypto.SHA256, "baz")}}
+	notInPolicy := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4:  hash(crypto.SHA256, "foo3"),
+		7:  hash(crypto.SHA256, "bar"),
+		12: hash(crypto.SHA256, "baz")}}
+	policy := s.newPolicy(c, pcrs, branch1, branch2)
+
+	current := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4:  hash(crypto.SHA256, "foo3"),
+		7:  hash(crypto.SHA256, "bar"),
+		12: hash(crypto.SHA256, "baz")}}
+
+	diagnosis, err := DiagnosePCRPolicy(policy, tpm2.HashAlgorithmSHA256, current, []tpm2.PCRValues{branch1, branch2, notInPolicy}, nil)
+	c.Assert(err, IsNil)
+	c.Check(diagnosis.CurrentValuesAccepted, testutil.IsFalse)
+	c.Assert(diagnosis.Branches, HasLen, 2)
+	c.Check(diagnosis.Branches[0].Values, DeepEquals, branch1)
+	c.Check(diagnosis.Branches[0].Mismatches, HasLen, 2)
+	c.Check(diagnosis.Branches[1].Values, DeepEquals, branch2)
+	c.Check(diagnosis.ClosestBranch, Equals, diagnosis.Branches[1])
+	c.Check(diagnosis.ClosestBranch.Mismatches, DeepEquals, []*PCRMismatch{
+		{
+			Alg:      tpm2.HashAlgorithmSHA256,
+			PCR:      4,
+			Expected: hash(crypto.SHA256, "foo2"),
+			Current:  hash(crypto.SHA256, "foo3")}})
+}
+
+func (s *diagnoseSuiteNoTPM) TestDiagnosePCRPolicyWithEventLogExtraEvents(c *C) {
+	events := []*tcglog.Event{
+		s.newEvent(4, "shim"),
+		s.newEvent(7, "db"),
+		s.newEvent(4, "grub"),
+		s.newEvent(4, "kernel"),
+		s.newEvent(4, "unexpected"),
+	}
+	log := &tcglog.Log{Events: events}
+
+	zero := make(tpm2.Digest, 32)
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}}
+	expected := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4: s.replay(zero, events[0], events[2], events[3]),
+		7: s.replay(zero, events[1])}}
+	policy := s.newPolicy(c, pcrs, expected)
+
+	current := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4: s.replay(zero, events[0], events[2], events[3], events[4]),
+		7: s.replay(zero, events[1])}}
+
+	diagnosis, err := DiagnosePCRPolicy(policy, tpm2.HashAlgorithmSHA256, current, []tpm2.PCRValues{expected}, log)
+	c.Assert(err, IsNil)
+	c.Check(diagnosis.CurrentValuesAccepted, testutil.IsFalse)
+	c.Check(diagnosis.EventLogMismatches, HasLen, 0)
+	c.Assert(diagnosis.ClosestBranch, NotNil)
+	c.Assert(diagnosis.ClosestBranch.Mismatches, HasLen, 1)
+	c.Check(diagnosis.ClosestBranch.Mismatches[0].PCR, Equals, 4)
+	c.Check(diagnosis.ClosestBranch.Mismatches[0].DivergentEvents, DeepEquals, []*tcglog.Event{events[4]})
+}
+
+func (s *diagnoseSuiteNoTPM) TestDiagnosePCRPolicyWithEventLogDifferentEvent(c *C) {
+	events := []*tcglog.Event{
+		s.newEvent(4, "shim"),
+		s.newEvent(4, "grub"),
+		s.newEvent(4, "kernel2"),
+	}
+	log := &tcglog.Log{Events: events}
+
+	zero := make(tpm2.Digest, 32)
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4}}}
+	expected := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4: s.replay(zero, events[0], events[1], s.newEvent(4, "kernel1"))}}
+	policy := s.newPolicy(c, pcrs, expected)
+
+	current := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: s.replay(zero, events...)}}
+
+	diagnosis, err := DiagnosePCRPolicy(policy, tpm2.HashAlgorithmSHA256, current, []tpm2.PCRValues{expected}, log)
+	c.Assert(err, IsNil)
+	c.Assert(diagnosis.ClosestBranch, NotNil)
+	c.Assert(diagnosis.ClosestBranch.Mismatches, HasLen, 1)
+	c.Check(diagnosis.ClosestBranch.Mismatches[0].DivergentEvents, DeepEquals, events)
+}
+
+func (s *diagnoseSuiteNoTPM) TestDiagnosePCRPolicyWithInconsistentEventLog(c *C) {
+	events := []*tcglog.Event{
+		{PCRIndex: 0, EventType: tcglog.EventTypeNoAction, Data: &tcglog.StartupLocalityEventData{StartupLocality: 3}},
+		s.newEvent(0, "firmware"),
+		s.newEvent(7, "db"),
+	}
+	log := &tcglog.Log{Events: events}
+
+	zero := make(tpm2.Digest, 32)
+	locality3 := make(tpm2.Digest, 32)
+	locality3[31] = 3
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{0, 7}}}
+	current := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		0: s.replay(locality3, events[1]),
+		7: s.replay(zero, events[2], s.newEvent(7, "missing"))}}
+	policy := s.newPolicy(c, pcrs, current)
+
+	diagnosis, err := DiagnosePCRPolicy(policy, tpm2.HashAlgorithmSHA256, current, nil, log)
+	c.Assert(err, IsNil)
+	c.Check(diagnosis.CurrentValuesAccepted, testutil.IsTrue)
+	c.Check(diagnosis.EventLogMismatches, DeepEquals, []*PCRMismatch{
+		{
+			Alg:      tpm2.HashAlgorithmSHA256,
+			PCR:      7,
+			Expected: s.replay(zero, events[2]),
+			Current:  current[tpm2.HashAlgorithmSHA256][7]}})
+}
+
+type diagnoseSuite struct {
+	tpm2test.TPMTest
+	primaryKeyMixin
+}
+
+func (s *diagnoseSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *diagnoseSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	s.primaryKeyMixin.tpmTest = &s.TPMTest.TPMTest
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&diagnoseSuite{})
+
+func (s *diagnoseSuite) TestDiagnosePCRPolicy(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	profile := tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23})
+	params := &ProtectKeyParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+	k, _, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	_, expected, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{23}}})
+	c.Assert(err, IsNil)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+
+	diagnosis, err := skd.DiagnosePCRPolicy(s.TPM(), profile, nil)
+	c.Assert(err, IsNil)
+	c.Check(diagnosis.CurrentValuesAccepted, testutil.IsFalse)
+	c.Assert(diagnosis.ClosestBranch, NotNil)
+	c.Assert(diagnosis.ClosestBranch.Mismatches, HasLen, 1)
+	c.Check(diagnosis.ClosestBranch.Mismatches[0].PCR, Equals, 23)
+	c.Check(diagnosis.ClosestBranch.Mismatches[0].Expected, DeepEquals, expected[tpm2.HashAlgorithmSHA256][23])
+}
@@ -50,6 +50,10 @@ var (
 
 	// ErrNoTPM2Device is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if no TPM2 device is avaiable.
 	ErrNoTPM2Device = errors.New("no TPM2 device is available")
+
+	// ErrNoSuitablePCRBank is returned from Connection.SelectPCRBank or ProtectKeyWithTPM if there
+	// is no PCR bank that is active on the TPM, present in the TCG event log and supported.
+	ErrNoSuitablePCRBank = errors.New("no suitable PCR bank is available")
 )
 
 // TPMResourceExistsError is returned from any function that creates a persistent TPM resource if a resource already exists
@@ -76,6 +80,20 @@ func (e AuthFailError) Error() string {
 	return fmt.Sprintf("cannot access resource at handle %v because an authorization check failed", e.Handle)
 }
 
+// PINLockoutError is returned from the platform handler when recovering a key that is
+// protected by a PIN if the retry limit of the PIN NV index associated with the key, at the
+// provided handle, has been reached. This is independent of the TPM's dictionary attack
+// protection. Until the retry counter is reset with SealedKeyData.ResetPINLockout, which
+// requires the authorization value of the storage hierarchy, the key will need to be
+// recovered via a mechanism that is independent of the TPM (eg, a recovery key).
+type PINLockoutError struct {
+	Handle tpm2.Handle
+}
+
+func (e PINLockoutError) Error() string {
+	return fmt.Sprintf("the PIN associated with the NV index at handle %v is locked out because of too many incorrect attempts", e.Handle)
+}
+
 // EKCertVerificationError is returned from SecureConnectToDefaultTPM if verification of the EK certificate against the built-in
 // root CA certificates fails, or the EK certificate does not have the correct properties, or the supplied certificate data cannot
 // be unmarshalled correctly because it is invalid.
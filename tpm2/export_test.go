@@ -33,14 +33,23 @@ const (
 
 // Export variables and unexported functions for testing
 var (
+	ClassifyNVIndex                         = classifyNVIndex
 	ComputeV0PinNVIndexPostInitAuthPolicies = computeV0PinNVIndexPostInitAuthPolicies
 	CreatePcrPolicyCounter                  = createPcrPolicyCounter
 	ComputeV1PcrPolicyRefFromCounterName    = computeV1PcrPolicyRefFromCounterName
 	ComputeV3PcrPolicyCounterAuthPolicies   = computeV3PcrPolicyCounterAuthPolicies
 	ComputeV3PcrPolicyRefFromCounterName    = computeV3PcrPolicyRefFromCounterName
+	ComputePolicyAuthorizeNVDigest          = computePolicyAuthorizeNVDigest
 	ComputeSnapModelDigest                  = computeSnapModelDigest
+	ComputeV4PcrPolicyIndexAuthPolicy       = computeV4PcrPolicyIndexAuthPolicy
+	ComputeV5PinIndexAuthPolicies           = computeV5PinIndexAuthPolicies
+	CreatePcrPolicyIndex                    = createPcrPolicyIndex
+	AuthorizePCRPolicyWithNVIndex           = authorizePCRPolicyWithNVIndex
+	CreatePinIndex                          = createPinIndex
+	DefaultPINRetryLimit                    = defaultPINRetryLimit
 	DeriveAuthValue                         = deriveAuthValue
 	DeriveV3PolicyAuthKey                   = deriveV3PolicyAuthKey
+	DiagnosePCRPolicy                       = diagnosePCRPolicy
 	ErrSessionDigestNotFound                = errSessionDigestNotFound
 	IsPolicyDataError                       = isPolicyDataError
 	MakeKeyData                             = makeKeyData
@@ -49,13 +58,19 @@ var (
 	NewKeyData                              = newKeyData
 	NewKeyDataPolicy                        = newKeyDataPolicy
 	NewKeyDataPolicyLegacy                  = newKeyDataPolicyLegacy
+	NewKeyDataPolicyV4                      = newKeyDataPolicyV4
+	NewKeyDataPolicyV5                      = newKeyDataPolicyV5
 	NewPolicyAuthPublicKey                  = newPolicyAuthPublicKey
 	NewPolicyOrDataV0                       = newPolicyOrDataV0
 	NewPolicyOrTree                         = newPolicyOrTree
+	PolicyOrTreeDepth                       = policyOrTreeDepth
 	ReadKeyDataV0                           = readKeyDataV0
 	ReadKeyDataV1                           = readKeyDataV1
 	ReadKeyDataV2                           = readKeyDataV2
 	ReadKeyDataV3                           = readKeyDataV3
+	ReadKeyDataV4                           = readKeyDataV4
+	ReadKeyDataV5                           = readKeyDataV5
+	RestrictPCRProtectionProfileToBank      = restrictPCRProtectionProfileToBank
 )
 
 // Alias some unexported types for testing. These are required in order to pass these between functions in tests, or to access
@@ -66,6 +81,8 @@ type KeyData_v0 = keyData_v0
 type KeyData_v1 = keyData_v1
 type KeyData_v2 = keyData_v2
 type KeyData_v3 = keyData_v3
+type KeyData_v4 = keyData_v4
+type KeyData_v5 = keyData_v5
 type KeyDataError = keyDataError
 type KeyDataParams = keyDataParams
 type KeyDataPolicy = keyDataPolicy
@@ -74,13 +91,15 @@ type KeyDataPolicy_v0 = keyDataPolicy_v0
 type KeyDataPolicy_v1 = keyDataPolicy_v1
 type KeyDataPolicy_v2 = keyDataPolicy_v2
 type KeyDataPolicy_v3 = keyDataPolicy_v3
+type KeyDataPolicy_v4 = keyDataPolicy_v4
+type KeyDataPolicy_v5 = keyDataPolicy_v5
 
 func NewImportableObjectKeySealer(key *tpm2.Public) keySealer {
 	return &importableObjectKeySealer{key}
 }
 
 func NewSealedObjectKeySealer(tpm *Connection) keySealer {
-	return &sealedObjectKeySealer{tpm}
+	return &sealedObjectKeySealer{tpm: tpm}
 }
 
 type PolicyDataError = policyDataError
@@ -120,6 +139,8 @@ type PcrPolicyData_v0 = pcrPolicyData_v0
 type PcrPolicyData_v1 = pcrPolicyData_v1
 type PcrPolicyData_v2 = pcrPolicyData_v2
 type PcrPolicyData_v3 = pcrPolicyData_v3
+type PcrPolicyData_v4 = pcrPolicyData_v4
+type PcrPolicyData_v5 = pcrPolicyData_v5
 
 type PcrPolicyParams = pcrPolicyParams
 
@@ -137,6 +158,8 @@ type SnapModelHasher = snapModelHasher
 type StaticPolicyData_v0 = staticPolicyData_v0
 type StaticPolicyData_v1 = staticPolicyData_v1
 type StaticPolicyData_v3 = staticPolicyData_v3
+type StaticPolicyData_v4 = staticPolicyData_v4
+type StaticPolicyData_v5 = staticPolicyData_v5
 
 // Export some helpers for testing.
 type MockPolicyPCRParam struct {
@@ -188,6 +211,14 @@ func MockCreatePcrPolicyCounter(fn func(*tpm2.TPMContext, tpm2.Handle, *tpm2.Pub
 	}
 }
 
+func MockEventLogPath(path string) (restore func()) {
+	orig := eventLogPath
+	eventLogPath = path
+	return func() {
+		eventLogPath = orig
+	}
+}
+
 func MockNewKeyDataPolicy(fn func(tpm2.HashAlgorithmId, *tpm2.Public, *tpm2.NVPublic, uint64) (KeyDataPolicy, tpm2.Digest, error)) (restore func()) {
 	orig := newKeyDataPolicy
 	newKeyDataPolicy = fn
@@ -25,6 +25,8 @@ import (
 	"github.com/canonical/go-tpm2/util"
 
 	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcg"
 )
 
 // keySealer is an abstraction for creating a sealed key object
@@ -40,6 +42,10 @@ type keySealer interface {
 // to the storage primary key of the associated TPM.
 type sealedObjectKeySealer struct {
 	tpm *Connection
+
+	// noDA indicates that the sealed object should be exempt from the
+	// TPM's dictionary attack protection.
+	noDA bool
 }
 
 func (s *sealedObjectKeySealer) CreateSealedObject(data []byte, nameAlg tpm2.HashAlgorithmId, policy tpm2.Digest) (tpm2.Private, *tpm2.Public, tpm2.EncryptedSecret, error) {
@@ -52,7 +58,7 @@ func (s *sealedObjectKeySealer) CreateSealedObject(data []byte, nameAlg tpm2.Has
 	srk := s.tpm.provisionedSrk
 	if srk == nil {
 		var err error
-		srk, err = provisionStoragePrimaryKey(s.tpm.TPMContext, s.tpm.HmacSession())
+		srk, err = provisionStoragePrimaryKey(s.tpm.TPMContext, tcg.SRKHandle, s.tpm.HmacSession())
 		switch {
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
 			return nil, nil, nil, AuthFailError{tpm2.HandleOwner}
@@ -67,6 +73,9 @@ func (s *sealedObjectKeySealer) CreateSealedObject(data []byte, nameAlg tpm2.Has
 	// Define the template
 	template := templates.NewSealedObject(nameAlg)
 	template.Attrs &^= tpm2.AttrUserWithAuth
+	if s.noDA {
+		template.Attrs |= tpm2.AttrNoDA
+	}
 	template.AuthPolicy = policy
 
 	// Now create the sealed key object. The command is integrity protected so if the object
@@ -95,6 +95,10 @@ func readKeyData(r io.Reader, version uint32) (keyData, error) {
 		return readKeyDataV2(r)
 	case 3:
 		return readKeyDataV3(r)
+	case 4:
+		return readKeyDataV4(r)
+	case 5:
+		return readKeyDataV5(r)
 	default:
 		return nil, fmt.Errorf("unexpected version number (%d)", version)
 	}
@@ -102,6 +106,18 @@ func readKeyData(r io.Reader, version uint32) (keyData, error) {
 
 func newKeyData(keyPrivate tpm2.Private, keyPublic *tpm2.Public, importSymSeed tpm2.EncryptedSecret, policy keyDataPolicy) (keyData, error) {
 	switch p := policy.(type) {
+	case *keyDataPolicy_v5:
+		return &keyData_v5{
+			KeyPrivate:       keyPrivate,
+			KeyPublic:        keyPublic,
+			KeyImportSymSeed: importSymSeed,
+			PolicyData:       p}, nil
+	case *keyDataPolicy_v4:
+		return &keyData_v4{
+			KeyPrivate:       keyPrivate,
+			KeyPublic:        keyPublic,
+			KeyImportSymSeed: importSymSeed,
+			PolicyData:       p}, nil
 	case *keyDataPolicy_v3:
 		return &keyData_v3{
 			KeyPrivate:       keyPrivate,
@@ -124,6 +140,21 @@ func newKeyData(keyPrivate tpm2.Private, keyPublic *tpm2.Public, importSymSeed t
 	}
 }
 
+// inspectKeyData returns the properties of the supplied key data that are
+// reported by secboot.KeyData.Inspect.
+func inspectKeyData(data keyData) map[string]interface{} {
+	policy := data.Policy()
+	props := map[string]interface{}{
+		"version":                   data.Version(),
+		"pcr_policy_counter_handle": policy.PCRPolicyCounterHandle(),
+		"pcr_policy_sequence":       policy.PCRPolicySequence(),
+		"pcr_selection":             policy.PCRSelection()}
+	if p, ok := policy.(pinKeyDataPolicy); ok {
+		props["pin_index_handle"] = p.PINIndexHandle()
+	}
+	return props
+}
+
 type sealedKeyDataBase struct {
 	data keyData
 }
@@ -165,7 +196,13 @@ func (k *sealedKeyDataBase) validateData(tpm *tpm2.TPMContext, session tpm2.Sess
 	if k.data.Public().Type != sealedKeyTemplate.Type {
 		return nil, keyDataError{errors.New("sealed key object has the wrong type")}
 	}
-	if k.data.Public().Attrs&^(tpm2.AttrFixedTPM|tpm2.AttrFixedParent) != sealedKeyTemplate.Attrs {
+	ignoreAttrs := tpm2.AttrFixedTPM | tpm2.AttrFixedParent
+	if _, ok := k.data.Policy().(pinKeyDataPolicy); ok {
+		// Objects protected by a PIN NV index are exempt from dictionary
+		// attack protection.
+		ignoreAttrs |= tpm2.AttrNoDA
+	}
+	if k.data.Public().Attrs&^ignoreAttrs != sealedKeyTemplate.Attrs {
 		return nil, keyDataError{errors.New("sealed key object has the wrong attributes")}
 	}
 
@@ -232,7 +269,8 @@ func (k *SealedKeyData) Version() uint32 {
 }
 
 // PCRPolicyCounterHandle indicates the handle of the NV counter used for PCR policy revocation for this sealed key object (and for
-// PIN integration for version 0 key files).
+// PIN integration for version 0 key files). For version 4 key files, this is the handle of the NV index that contains the digest
+// of the authorized PCR policy.
 func (k *SealedKeyData) PCRPolicyCounterHandle() tpm2.Handle {
 	return k.data.Policy().PCRPolicyCounterHandle()
 }
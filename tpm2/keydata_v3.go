@@ -75,13 +75,9 @@ func (d *keyData_v3) Imported(priv tpm2.Private) {
 	d.KeyImportSymSeed = nil
 }
 
-func (d *keyData_v3) ValidateData(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
-	if d.KeyImportSymSeed != nil {
-		return nil, errors.New("cannot validate importable key data")
-	}
-
-	// Validate the type and scheme of the dynamic authorization policy signing key.
-	authPublicKey := d.PolicyData.StaticData.AuthPublicKey
+// validateV3PolicyAuthPublicKey validates the type and scheme of the supplied
+// dynamic authorization policy signing key, returning its name.
+func validateV3PolicyAuthPublicKey(authPublicKey *tpm2.Public) (tpm2.Name, error) {
 	authKeyName, err := authPublicKey.ComputeName()
 	if err != nil {
 		return nil, keyDataError{xerrors.Errorf("cannot compute name of dynamic authorization policy key: %w", err)}
@@ -98,6 +94,19 @@ func (d *keyData_v3) ValidateData(tpm *tpm2.TPMContext, session tpm2.SessionCont
 			return nil, keyDataError{errors.New("dynamic authorization policy signing key algorithm must match name algorithm")}
 		}
 	}
+	return authKeyName, nil
+}
+
+func (d *keyData_v3) ValidateData(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	if d.KeyImportSymSeed != nil {
+		return nil, errors.New("cannot validate importable key data")
+	}
+
+	// Validate the type and scheme of the dynamic authorization policy signing key.
+	authKeyName, err := validateV3PolicyAuthPublicKey(d.PolicyData.StaticData.AuthPublicKey)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create a context for the PCR policy counter.
 	pcrPolicyCounterHandle := d.PolicyData.StaticData.PCRPolicyCounterHandle
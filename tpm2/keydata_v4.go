@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+)
+
+// keyData_v4 represents version 4 of keyData.
+type keyData_v4 struct {
+	KeyPrivate       tpm2.Private
+	KeyPublic        *tpm2.Public
+	KeyImportSymSeed tpm2.EncryptedSecret
+	PolicyData       *keyDataPolicy_v4
+}
+
+func readKeyDataV4(r io.Reader) (keyData, error) {
+	var d *keyData_v4
+	if _, err := mu.UnmarshalFromReader(r, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *keyData_v4) Version() uint32 {
+	return 4
+}
+
+func (d *keyData_v4) Private() tpm2.Private {
+	return d.KeyPrivate
+}
+
+func (d *keyData_v4) SetPrivate(priv tpm2.Private) {
+	d.KeyPrivate = priv
+}
+
+func (d *keyData_v4) Public() *tpm2.Public {
+	return d.KeyPublic
+}
+
+func (d *keyData_v4) ImportSymSeed() tpm2.EncryptedSecret {
+	return d.KeyImportSymSeed
+}
+
+func (d *keyData_v4) Imported(priv tpm2.Private) {
+	if d.KeyImportSymSeed == nil {
+		panic("does not need to be imported")
+	}
+	d.KeyPrivate = priv
+	d.KeyImportSymSeed = nil
+}
+
+func (d *keyData_v4) ValidateData(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	if d.KeyImportSymSeed != nil {
+		return nil, errors.New("cannot validate importable key data")
+	}
+
+	// Validate the type and scheme of the dynamic authorization policy signing key.
+	authKeyName, err := validateV3PolicyAuthPublicKey(d.PolicyData.StaticData.AuthPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a context for the PCR policy NV index.
+	pcrPolicyIndexHandle := d.PolicyData.StaticData.PCRPolicyIndexHandle
+	if pcrPolicyIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, keyDataError{errors.New("PCR policy NV index handle is invalid")}
+	}
+	pcrPolicyIndex, err := tpm.CreateResourceContextFromTPM(pcrPolicyIndexHandle, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		if tpm2.IsResourceUnavailableError(err, pcrPolicyIndexHandle) {
+			return nil, keyDataError{errors.New("PCR policy NV index is unavailable")}
+		}
+		return nil, xerrors.Errorf("cannot create context for PCR policy NV index: %w", err)
+	}
+
+	// Make sure that the NV index can only be written with a signed authorization from
+	// the dynamic authorization policy signing key.
+	pcrPolicyIndexPub, _, err := tpm.NVReadPublic(pcrPolicyIndex, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of PCR policy NV index: %w", err)
+	}
+	if !pcrPolicyIndexPub.NameAlg.Available() {
+		return nil, keyDataError{errors.New("cannot determine if PCR policy NV index has the expected authorization policy: algorithm unavailable")}
+	}
+	if !bytes.Equal(pcrPolicyIndexPub.AuthPolicy, computeV4PcrPolicyIndexAuthPolicy(pcrPolicyIndexPub.NameAlg, authKeyName)) {
+		return nil, keyDataError{errors.New("PCR policy NV index has an authorization policy that is inconsistent with the associated metadata")}
+	}
+	if pcrPolicyIndexPub.Attrs != pcrPolicyIndexAttrs|tpm2.AttrNVWritten {
+		return nil, keyDataError{errors.New("PCR policy NV index has unexpected attributes")}
+	}
+
+	// Make sure that the static authorization policy data is consistent with the sealed key object's policy.
+	if !d.KeyPublic.NameAlg.Available() {
+		return nil, keyDataError{errors.New("cannot determine if static authorization policy matches sealed key object: algorithm unavailable")}
+	}
+	trial := util.ComputeAuthPolicy(d.KeyPublic.NameAlg)
+	trial.SetDigest(computePolicyAuthorizeNVDigest(d.KeyPublic.NameAlg, pcrPolicyIndex.Name()))
+	trial.PolicyAuthValue()
+
+	if !bytes.Equal(trial.GetDigest(), d.KeyPublic.AuthPolicy) {
+		return nil, keyDataError{errors.New("the sealed key object's authorization policy is inconsistent with the associated metadata or persistent TPM resources")}
+	}
+
+	return pcrPolicyIndex, nil
+}
+
+func (d *keyData_v4) Write(w io.Writer) error {
+	_, err := mu.MarshalToWriter(w, d)
+	return err
+}
+
+func (d *keyData_v4) Policy() keyDataPolicy {
+	return d.PolicyData
+}
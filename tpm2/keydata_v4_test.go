@@ -0,0 +1,239 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/templates"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type keyDataV4Suite struct {
+	tpm2test.TPMTest
+	policyV3Mixin
+
+	primary tpm2.ResourceContext
+}
+
+func (s *keyDataV4Suite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeatureNV
+}
+
+func (s *keyDataV4Suite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	primary := s.CreateStoragePrimaryKeyRSA(c)
+	s.primary = s.EvictControl(c, tpm2.HandleOwner, primary, tcg.SRKHandle)
+}
+
+func (s *keyDataV4Suite) newMockKeyData(c *C, pcrPolicyIndexHandle tpm2.Handle) (KeyData, tpm2.Name) {
+	// Create the auth key
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	// Create the PCR policy NV index
+	pcrPolicyIndexPub, err := CreatePcrPolicyIndex(s.TPM().TPMContext, pcrPolicyIndexHandle, authKeyPublic, authKey, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+
+	// Create sealed object
+	secret := []byte("secret data")
+
+	template := tpm2_testutil.NewSealedObjectTemplate()
+
+	policyData, policy, err := NewKeyDataPolicyV4(template.NameAlg, authKeyPublic, pcrPolicyIndexPub)
+	c.Assert(err, IsNil)
+	c.Assert(policyData, testutil.ConvertibleTo, &KeyDataPolicy_v4{})
+
+	template.AuthPolicy = policy
+
+	policyData.(*KeyDataPolicy_v4).PCRData = &PcrPolicyData_v4{
+		Selection:                 tpm2.PCRSelectionList{},
+		OrData:                    PolicyOrData_v0{},
+		PolicySequence:            policyData.PCRPolicySequence(),
+		AuthorizedPolicy:          make(tpm2.Digest, 32),
+		AuthorizedPolicySignature: &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}}
+
+	sensitive := tpm2.SensitiveCreate{Data: secret}
+
+	priv, pub, _, _, _, err := s.TPM().Create(s.primary, &sensitive, template, nil, nil, nil)
+	c.Assert(err, IsNil)
+
+	return &KeyData_v4{
+		KeyPrivate: priv,
+		KeyPublic:  pub,
+		PolicyData: policyData.(*KeyDataPolicy_v4)}, pcrPolicyIndexPub.Name()
+}
+
+var _ = Suite(&keyDataV4Suite{})
+
+func (s *keyDataV4Suite) TestVersion(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+	c.Check(data.Version(), Equals, uint32(4))
+}
+
+func (s *keyDataV4Suite) TestSealedObjectData(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+	c.Check(data.Private(), DeepEquals, data.(*KeyData_v4).KeyPrivate)
+	c.Check(data.Public(), DeepEquals, data.(*KeyData_v4).KeyPublic)
+}
+
+func (s *keyDataV4Suite) TestImportNotImportable(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+	private := data.Private()
+
+	c.Check(data.ImportSymSeed(), IsNil)
+	c.Check(func() { data.Imported(nil) }, PanicMatches, "does not need to be imported")
+	c.Check(data.Private(), DeepEquals, private)
+}
+
+func (s *keyDataV4Suite) TestValidateOK1(c *C) {
+	data, pcrPolicyIndexName := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	pcrPolicyIndex, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, IsNil)
+	c.Check(pcrPolicyIndex.Name(), DeepEquals, pcrPolicyIndexName)
+}
+
+func (s *keyDataV4Suite) TestValidateOK2(c *C) {
+	data, pcrPolicyIndexName := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x0180ff00))
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	pcrPolicyIndex, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, IsNil)
+	c.Check(pcrPolicyIndex.Name(), DeepEquals, pcrPolicyIndexName)
+}
+
+func (s *keyDataV4Suite) TestValidateInvalidAuthPublicKeyType(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+
+	data.(*KeyData_v4).PolicyData.StaticData.AuthPublicKey.Type = tpm2.ObjectTypeRSA
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "public area of dynamic authorization policy signing key has the wrong type")
+}
+
+func (s *keyDataV4Suite) TestValidateInvalidPolicyIndexHandle(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+
+	data.(*KeyData_v4).PolicyData.StaticData.PCRPolicyIndexHandle = tpm2.HandleNull
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PCR policy NV index handle is invalid")
+}
+
+func (s *keyDataV4Suite) TestValidateNoPolicyIndex(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+
+	index, err := s.TPM().CreateResourceContextFromTPM(data.Policy().PCRPolicyCounterHandle())
+	c.Assert(err, IsNil)
+	c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err = data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PCR policy NV index is unavailable")
+}
+
+func (s *keyDataV4Suite) TestValidateWrongAuthKey(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+
+	authKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	c.Assert(err, IsNil)
+	data.(*KeyData_v4).PolicyData.StaticData.AuthPublicKey = util.NewExternalECCPublicKeyWithDefaults(templates.KeyUsageSign, &authKey.PublicKey)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err = data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PCR policy NV index has an authorization policy that is inconsistent with the associated metadata")
+}
+
+func (s *keyDataV4Suite) TestValidateWrongPolicyIndex(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+
+	index, err := s.TPM().CreateResourceContextFromTPM(data.Policy().PCRPolicyCounterHandle())
+	handle := index.Handle()
+	c.Assert(err, IsNil)
+	c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+
+	nvPub := tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    34}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &nvPub)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err = data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PCR policy NV index has an authorization policy that is inconsistent with the associated metadata")
+}
+
+func (s *keyDataV4Suite) TestValidateWrongPolicyIndexAttrs(c *C) {
+	// Test that a PCR policy NV index that has the expected authorization
+	// policy, but which can also be written by the owner, is rejected.
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+
+	index, err := s.TPM().CreateResourceContextFromTPM(data.Policy().PCRPolicyCounterHandle())
+	c.Assert(err, IsNil)
+	pub, _, err := s.TPM().NVReadPublic(index)
+	c.Assert(err, IsNil)
+	c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+
+	pub.Attrs = (pub.Attrs &^ tpm2.AttrNVWritten) | tpm2.AttrNVOwnerWrite
+	index = s.NVDefineSpace(c, tpm2.HandleOwner, nil, pub)
+	c.Check(s.TPM().NVWrite(s.TPM().OwnerHandleContext(), index, make([]byte, pub.Size), 0, nil), IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err = data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PCR policy NV index has unexpected attributes")
+}
+
+func (s *keyDataV4Suite) TestSerialization(c *C) {
+	data1, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000))
+
+	buf := new(bytes.Buffer)
+	c.Check(data1.Write(buf), IsNil)
+
+	data2, err := ReadKeyDataV4(buf)
+	c.Assert(err, IsNil)
+	c.Check(data2, tpm2_testutil.TPMValueDeepEquals, data1)
+}
@@ -0,0 +1,163 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023-2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+)
+
+// keyData_v5 represents version 5 of keyData.
+type keyData_v5 struct {
+	KeyPrivate       tpm2.Private
+	KeyPublic        *tpm2.Public
+	KeyImportSymSeed tpm2.EncryptedSecret
+	PolicyData       *keyDataPolicy_v5
+}
+
+func readKeyDataV5(r io.Reader) (keyData, error) {
+	var d *keyData_v5
+	if _, err := mu.UnmarshalFromReader(r, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *keyData_v5) Version() uint32 {
+	return 5
+}
+
+func (d *keyData_v5) Private() tpm2.Private {
+	return d.KeyPrivate
+}
+
+func (d *keyData_v5) SetPrivate(priv tpm2.Private) {
+	d.KeyPrivate = priv
+}
+
+func (d *keyData_v5) Public() *tpm2.Public {
+	return d.KeyPublic
+}
+
+func (d *keyData_v5) ImportSymSeed() tpm2.EncryptedSecret {
+	return d.KeyImportSymSeed
+}
+
+func (d *keyData_v5) Imported(priv tpm2.Private) {
+	if d.KeyImportSymSeed == nil {
+		panic("does not need to be imported")
+	}
+	d.KeyPrivate = priv
+	d.KeyImportSymSeed = nil
+}
+
+func (d *keyData_v5) ValidateData(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	if d.KeyImportSymSeed != nil {
+		return nil, errors.New("cannot validate importable key data")
+	}
+
+	// Validate the type and scheme of the dynamic authorization policy signing key.
+	authKeyName, err := validateV3PolicyAuthPublicKey(d.PolicyData.StaticData.AuthPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a context for the PCR policy counter.
+	pcrPolicyCounterHandle := d.PolicyData.StaticData.PCRPolicyCounterHandle
+	var pcrPolicyCounter tpm2.ResourceContext
+	switch {
+	case pcrPolicyCounterHandle != tpm2.HandleNull && pcrPolicyCounterHandle.Type() != tpm2.HandleTypeNVIndex:
+		return nil, keyDataError{errors.New("PCR policy counter handle is invalid")}
+	case pcrPolicyCounterHandle != tpm2.HandleNull:
+		pcrPolicyCounter, err = tpm.CreateResourceContextFromTPM(pcrPolicyCounterHandle, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			if tpm2.IsResourceUnavailableError(err, pcrPolicyCounterHandle) {
+				return nil, keyDataError{errors.New("PCR policy counter is unavailable")}
+			}
+			return nil, xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+		}
+	}
+
+	// Create a context for the PIN NV index.
+	pinIndexHandle := d.PolicyData.StaticData.PINIndexHandle
+	if pinIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, keyDataError{errors.New("PIN NV index handle is invalid")}
+	}
+	pinIndex, err := tpm.CreateResourceContextFromTPM(pinIndexHandle, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		if tpm2.IsResourceUnavailableError(err, pinIndexHandle) {
+			return nil, keyDataError{errors.New("PIN NV index is unavailable")}
+		}
+		return nil, xerrors.Errorf("cannot create context for PIN NV index: %w", err)
+	}
+	pinIndexPub, _, err := tpm.NVReadPublic(pinIndex, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of PIN NV index: %w", err)
+	}
+	if pinIndexPub.Attrs != pinIndexAttrs|tpm2.AttrNVWritten {
+		return nil, keyDataError{errors.New("PIN NV index has unexpected attributes")}
+	}
+	if !pinIndexPub.NameAlg.Available() {
+		return nil, keyDataError{errors.New("cannot determine if PIN NV index has a valid authorization policy: algorithm unavailable")}
+	}
+	pinIndexTrial := util.ComputeAuthPolicy(pinIndexPub.NameAlg)
+	pinIndexTrial.PolicyOR(computeV5PinIndexAuthPolicies(pinIndexPub.NameAlg, authKeyName))
+	if !bytes.Equal(pinIndexTrial.GetDigest(), pinIndexPub.AuthPolicy) {
+		return nil, keyDataError{errors.New("PIN NV index has unexpected authorization policy")}
+	}
+	if d.PolicyData.StaticData.PINRetryLimit == 0 {
+		return nil, keyDataError{errors.New("invalid PIN retry limit")}
+	}
+
+	// The PIN is only subject to the retry limit of the PIN NV index.
+	if d.KeyPublic.Attrs&tpm2.AttrNoDA == 0 {
+		return nil, keyDataError{errors.New("sealed key object is not exempt from dictionary attack protection")}
+	}
+
+	// Make sure that the static authorization policy data is consistent with the sealed key object's policy.
+	if !d.KeyPublic.NameAlg.Available() {
+		return nil, keyDataError{errors.New("cannot determine if static authorization policy matches sealed key object: algorithm unavailable")}
+	}
+	trial := util.ComputeAuthPolicy(d.KeyPublic.NameAlg)
+	trial.PolicyAuthorize(computeV3PcrPolicyRefFromCounterContext(pcrPolicyCounter), authKeyName)
+	trial.PolicySecret(pinIndex.Name(), nil)
+
+	if !bytes.Equal(trial.GetDigest(), d.KeyPublic.AuthPolicy) {
+		return nil, keyDataError{errors.New("the sealed key object's authorization policy is inconsistent with the associated metadata or persistent TPM resources")}
+	}
+
+	return pcrPolicyCounter, nil
+}
+
+func (d *keyData_v5) Write(w io.Writer) error {
+	_, err := mu.MarshalToWriter(w, d)
+	return err
+}
+
+func (d *keyData_v5) Policy() keyDataPolicy {
+	return d.PolicyData
+}
@@ -0,0 +1,309 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/templates"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type keyDataV5Suite struct {
+	tpm2test.TPMTest
+	policyV3Mixin
+
+	primary tpm2.ResourceContext
+}
+
+func (s *keyDataV5Suite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeatureNV
+}
+
+func (s *keyDataV5Suite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	primary := s.CreateStoragePrimaryKeyRSA(c)
+	s.primary = s.EvictControl(c, tpm2.HandleOwner, primary, tcg.SRKHandle)
+}
+
+func (s *keyDataV5Suite) newMockKeyData(c *C, pcrPolicyCounterHandle, pinIndexHandle tpm2.Handle) (KeyData, tpm2.Name) {
+	// Create the auth key
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	// Create the PCR policy counter
+	var pcrPolicyCounterPub *tpm2.NVPublic
+	var pcrPolicyCount uint64
+	if pcrPolicyCounterHandle != tpm2.HandleNull {
+		var err error
+		pcrPolicyCounterPub, pcrPolicyCount, err = CreatePcrPolicyCounter(s.TPM().TPMContext, pcrPolicyCounterHandle, authKeyPublic, s.TPM().HmacSession())
+		c.Assert(err, IsNil)
+	}
+
+	// Create the PIN NV index
+	pinIndexPub, err := CreatePinIndex(s.TPM().TPMContext, pinIndexHandle, authKeyPublic, authKey, 3, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+
+	// Create sealed object
+	secret := []byte("secret data")
+
+	template := tpm2_testutil.NewSealedObjectTemplate()
+	template.Attrs |= tpm2.AttrNoDA
+
+	policyData, policy, err := NewKeyDataPolicyV5(template.NameAlg, authKeyPublic, pcrPolicyCounterPub, pcrPolicyCount, pinIndexPub, 3)
+	c.Assert(err, IsNil)
+	c.Assert(policyData, testutil.ConvertibleTo, &KeyDataPolicy_v5{})
+
+	template.AuthPolicy = policy
+
+	policyData.(*KeyDataPolicy_v5).PCRData = &PcrPolicyData_v5{
+		Selection:                 tpm2.PCRSelectionList{},
+		OrData:                    PolicyOrData_v0{},
+		PolicySequence:            policyData.PCRPolicySequence(),
+		AuthorizedPolicy:          make(tpm2.Digest, 32),
+		AuthorizedPolicySignature: &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}}
+
+	sensitive := tpm2.SensitiveCreate{Data: secret}
+
+	priv, pub, _, _, _, err := s.TPM().Create(s.primary, &sensitive, template, nil, nil, nil)
+	c.Assert(err, IsNil)
+
+	var pcrPolicyCounterName tpm2.Name
+	if pcrPolicyCounterPub != nil {
+		pcrPolicyCounterName = pcrPolicyCounterPub.Name()
+	}
+
+	return &KeyData_v5{
+		KeyPrivate: priv,
+		KeyPublic:  pub,
+		PolicyData: policyData.(*KeyDataPolicy_v5)}, pcrPolicyCounterName
+}
+
+var _ = Suite(&keyDataV5Suite{})
+
+func (s *keyDataV5Suite) TestVersion(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+	c.Check(data.Version(), Equals, uint32(5))
+}
+
+func (s *keyDataV5Suite) TestSealedObjectData(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+	c.Check(data.Private(), DeepEquals, data.(*KeyData_v5).KeyPrivate)
+	c.Check(data.Public(), DeepEquals, data.(*KeyData_v5).KeyPublic)
+}
+
+func (s *keyDataV5Suite) TestImportNotImportable(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+	private := data.Private()
+
+	c.Check(data.ImportSymSeed(), IsNil)
+	c.Check(func() { data.Imported(nil) }, PanicMatches, "does not need to be imported")
+	c.Check(data.Private(), DeepEquals, private)
+}
+
+func (s *keyDataV5Suite) TestValidateOK1(c *C) {
+	data, pcrPolicyCounterName := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	pcrPolicyCounter, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, IsNil)
+	c.Check(pcrPolicyCounter.Name(), DeepEquals, pcrPolicyCounterName)
+}
+
+func (s *keyDataV5Suite) TestValidateOK2(c *C) {
+	data, _ := s.newMockKeyData(c, tpm2.HandleNull, s.NextAvailableHandle(c, 0x01810000))
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	pcrPolicyCounter, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, IsNil)
+	c.Check(pcrPolicyCounter, IsNil)
+}
+
+func (s *keyDataV5Suite) TestValidateInvalidAuthPublicKeyType(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	data.(*KeyData_v5).PolicyData.StaticData.AuthPublicKey.Type = tpm2.ObjectTypeRSA
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "public area of dynamic authorization policy signing key has the wrong type")
+}
+
+func (s *keyDataV5Suite) TestValidateInvalidPolicyCounterHandle(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	data.(*KeyData_v5).PolicyData.StaticData.PCRPolicyCounterHandle = 0x81000000
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PCR policy counter handle is invalid")
+}
+
+func (s *keyDataV5Suite) TestValidateNoPolicyCounter(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	index, err := s.TPM().CreateResourceContextFromTPM(data.Policy().PCRPolicyCounterHandle())
+	c.Assert(err, IsNil)
+	c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err = data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PCR policy counter is unavailable")
+}
+
+func (s *keyDataV5Suite) TestValidateWrongAuthKey(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	authKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	c.Assert(err, IsNil)
+	data.(*KeyData_v5).PolicyData.StaticData.AuthPublicKey = util.NewExternalECCPublicKeyWithDefaults(templates.KeyUsageSign, &authKey.PublicKey)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err = data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PIN NV index has unexpected authorization policy")
+}
+
+func (s *keyDataV5Suite) TestValidateInvalidPINIndexHandle(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	data.(*KeyData_v5).PolicyData.StaticData.PINIndexHandle = tpm2.HandleNull
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PIN NV index handle is invalid")
+}
+
+func (s *keyDataV5Suite) TestValidateNoPINIndex(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	index, err := s.TPM().CreateResourceContextFromTPM(data.Policy().(*KeyDataPolicy_v5).PINIndexHandle())
+	c.Assert(err, IsNil)
+	c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err = data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PIN NV index is unavailable")
+}
+
+func (s *keyDataV5Suite) TestValidateWrongPINIndex(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	index, err := s.TPM().CreateResourceContextFromTPM(data.Policy().(*KeyDataPolicy_v5).PINIndexHandle())
+	c.Assert(err, IsNil)
+	handle := index.Handle()
+	c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+
+	nvPub := tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &nvPub)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err = data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PIN NV index has unexpected attributes")
+}
+
+func (s *keyDataV5Suite) TestValidatePINIndexWrongPolicy(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	index, err := s.TPM().CreateResourceContextFromTPM(data.Policy().(*KeyDataPolicy_v5).PINIndexHandle())
+	c.Assert(err, IsNil)
+	handle := index.Handle()
+	c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+
+	// Redefine the index with the same attributes but an authorization
+	// policy that permits the retry counter to be reset by anyone.
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+
+	nvPub := tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypePinFail.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVOwnerRead | tpm2.AttrNVNoDA),
+		AuthPolicy: trial.GetDigest(),
+		Size:       8}
+	index = s.NVDefineSpace(c, tpm2.HandleOwner, nil, &nvPub)
+	policySession := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	c.Check(s.TPM().PolicyCommandCode(policySession, tpm2.CommandNVWrite), IsNil)
+	c.Check(s.TPM().NVSetPinCounterParams(index, index, &tpm2.NVPinCounterParams{Limit: 3}, policySession), IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err = data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "PIN NV index has unexpected authorization policy")
+}
+
+func (s *keyDataV5Suite) TestValidateNotNoDA(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	data.(*KeyData_v5).KeyPublic.Attrs &^= tpm2.AttrNoDA
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "sealed key object is not exempt from dictionary attack protection")
+}
+
+func (s *keyDataV5Suite) TestValidateInvalidPINRetryLimit(c *C) {
+	data, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	data.(*KeyData_v5).PolicyData.StaticData.PINRetryLimit = 0
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256).WithAttrs(tpm2.AttrContinueSession)
+	_, err := data.ValidateData(s.TPM().TPMContext, session)
+	c.Check(err, testutil.ConvertibleTo, KeyDataError{})
+	c.Check(err, ErrorMatches, "invalid PIN retry limit")
+}
+
+func (s *keyDataV5Suite) TestSerialization(c *C) {
+	data1, _ := s.newMockKeyData(c, s.NextAvailableHandle(c, 0x01800000), s.NextAvailableHandle(c, 0x01810000))
+
+	buf := new(bytes.Buffer)
+	c.Check(data1.Write(buf), IsNil)
+
+	data2, err := ReadKeyDataV5(buf)
+	c.Assert(err, IsNil)
+	c.Check(data2, tpm2_testutil.TPMValueDeepEquals, data1)
+}
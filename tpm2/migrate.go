@@ -0,0 +1,270 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// MigrateKeyDataToNVAuthorizedPCRPolicy creates new version 4 key data objects that protect
+// the same keys as the supplied version 3 key data objects, but with a PCR policy that is
+// authorized by a NV index using TPM2_PolicyAuthorizeNV instead of a signed PCR policy and
+// PCR policy counter. The supplied keys must all be related (ie, they were created using
+// ProtectKeysWithTPM), they must not have a passphrase, and they must be recoverable with
+// the current PCR values. Key data objects with a passphrase can be migrated with
+// MigrateKeyDataWithPassphraseToNVAuthorizedPCRPolicy, and keys that have already been
+// recovered can be migrated with MigrateRecoveredKeyDataToNVAuthorizedPCRPolicy.
+//
+// As the authorization policy of a sealed object can't be changed, this creates new sealed
+// objects in the same way as ProtectKeysWithTPM, using the auth key recovered from the
+// supplied key data objects. The NV index is created at the handle specified by the
+// PCRPolicyCounterHandle field of params, and the new keys are protected with a PCR policy
+// computed from the PCRProfile field. The AuthKey, NVAuthorizedPCRPolicy and
+// AuthorizedSnapModels fields of params are ignored. The authorized snap models and other
+// platform independent metadata are copied from the supplied key data objects.
+//
+// On success, the caller must persist the returned key data objects in place of the supplied
+// ones. The PCR policy counter associated with the supplied key data objects can then be
+// undefined with UndefineMigratedPCRPolicyCounter.
+func MigrateKeyDataToNVAuthorizedPCRPolicy(tpm *Connection, params *ProtectKeyParams, keys ...*secboot.KeyData) ([]*secboot.KeyData, error) {
+	if err := checkMigrateParams(params, keys); err != nil {
+		return nil, err
+	}
+
+	authKey, unlockKeys, err := recoverKeysForMigration(keys, func(kd *secboot.KeyData) (secboot.DiskUnlockKey, secboot.AuxiliaryKey, error) {
+		return kd.RecoverKeys()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return migrateKeyDataToNVAuthorizedPCRPolicy(tpm, params, authKey, unlockKeys, keys)
+}
+
+// MigrateKeyDataWithPassphraseToNVAuthorizedPCRPolicy is a variant of
+// MigrateKeyDataToNVAuthorizedPCRPolicy for key data objects that have a passphrase. The
+// keys are recovered from each of the supplied key data objects with the supplied
+// passphrase, and the same passphrase is set on each of the returned key data objects
+// using the supplied kdfOptions. The kdf argument provides the Argon2 KDF implementation.
+func MigrateKeyDataWithPassphraseToNVAuthorizedPCRPolicy(tpm *Connection, params *ProtectKeyParams, passphrase string, kdfOptions *secboot.KDFOptions, kdf secboot.KDF, keys ...*secboot.KeyData) ([]*secboot.KeyData, error) {
+	if err := checkMigrateParams(params, keys); err != nil {
+		return nil, err
+	}
+
+	authKey, unlockKeys, err := recoverKeysForMigration(keys, func(kd *secboot.KeyData) (secboot.DiskUnlockKey, secboot.AuxiliaryKey, error) {
+		return kd.RecoverKeysWithPassphrase(passphrase, kdf)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	migrated, err := migrateKeyDataToNVAuthorizedPCRPolicy(tpm, params, authKey, unlockKeys, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, kd := range migrated {
+		if err := kd.SetPassphrase(passphrase, kdfOptions, kdf); err != nil {
+			undefineMigratedPCRPolicyIndex(tpm, migrated[0])
+			return nil, xerrors.Errorf("cannot set passphrase on migrated key data at index %d: %w", i, err)
+		}
+	}
+
+	return migrated, nil
+}
+
+// MigrateRecoveredKeyDataToNVAuthorizedPCRPolicy is a variant of
+// MigrateKeyDataToNVAuthorizedPCRPolicy for when the keys have already been recovered
+// from the supplied key data objects, eg, as a result of unlocking a volume. The
+// recovered auxiliary key must be supplied via the authKey argument, and the recovered
+// unlock keys must be supplied via the unlockKeys argument in the same order as the
+// associated key data objects. The auxiliary key is checked against each of the
+// supplied key data objects, but the unlock keys can't be checked without recovering
+// them again, so the caller is responsible for making sure that they are correct.
+//
+// The returned key data objects don't have a passphrase, regardless of whether the
+// supplied ones do.
+func MigrateRecoveredKeyDataToNVAuthorizedPCRPolicy(tpm *Connection, params *ProtectKeyParams, authKey secboot.AuxiliaryKey, unlockKeys []secboot.DiskUnlockKey, keys ...*secboot.KeyData) ([]*secboot.KeyData, error) {
+	if err := checkMigrateParams(params, keys); err != nil {
+		return nil, err
+	}
+	if len(unlockKeys) != len(keys) {
+		return nil, errors.New("the number of unlock keys doesn't match the number of key data objects")
+	}
+
+	for i, kd := range keys {
+		skd, err := NewSealedKeyData(kd)
+		if err != nil {
+			return nil, err
+		}
+		if err := skd.data.Policy().ValidateAuthKey(authKey); err != nil {
+			return nil, xerrors.Errorf("invalid auth key for key data at index %d: %w", i, err)
+		}
+	}
+
+	return migrateKeyDataToNVAuthorizedPCRPolicy(tpm, params, authKey, unlockKeys, keys)
+}
+
+// UndefineMigratedPCRPolicyCounter undefines the PCR policy counter associated with the
+// supplied version 3 key data objects, once they have been migrated with one of the
+// Migrate*ToNVAuthorizedPCRPolicy functions and the migrated key data objects have been
+// persisted. This revokes the supplied key data objects, which can no longer be used to
+// recover their keys. The supplied keys must all be related and share the same PCR policy
+// counter, and the supplied authKey must be the one associated with them.
+//
+// This requires knowledge of the authorization value for the storage hierarchy, which
+// must be set with tpm.OwnerHandleContext().SetAuthValue beforehand if it isn't empty.
+func UndefineMigratedPCRPolicyCounter(tpm *Connection, authKey secboot.AuxiliaryKey, keys ...*secboot.KeyData) error {
+	if len(keys) == 0 {
+		return errors.New("no keys provided")
+	}
+
+	var pub *tpm2.NVPublic
+
+	for i, kd := range keys {
+		skd, err := NewSealedKeyData(kd)
+		if err != nil {
+			return err
+		}
+		if skd.Version() != 3 {
+			return fmt.Errorf("key data at index %d has unsupported metadata version %d", i, skd.Version())
+		}
+		if err := skd.data.Policy().ValidateAuthKey(authKey); err != nil {
+			return xerrors.Errorf("invalid auth key for key data at index %d: %w", i, err)
+		}
+
+		p, err := skd.validateData(tpm.TPMContext, tpm.HmacSession())
+		switch {
+		case isKeyDataError(err):
+			return InvalidKeyDataError{err.Error()}
+		case err != nil:
+			return xerrors.Errorf("cannot validate key data at index %d: %w", i, err)
+		case p == nil:
+			return fmt.Errorf("key data at index %d has no PCR policy counter", i)
+		case pub != nil && p.Index != pub.Index:
+			return fmt.Errorf("key data at index %d has a different PCR policy counter to the primary key data", i)
+		}
+		pub = p
+	}
+
+	index, err := tpm2.CreateNVIndexResourceContextFromPublic(pub)
+	if err != nil {
+		return xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+	}
+	if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, tpm.HmacSession()); err != nil {
+		if isAuthFailError(err, tpm2.CommandNVUndefineSpace, 1) {
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot undefine PCR policy counter: %w", err)
+	}
+
+	return nil
+}
+
+func checkMigrateParams(params *ProtectKeyParams, keys []*secboot.KeyData) error {
+	// params is mandatory.
+	if params == nil {
+		return errors.New("no ProtectKeyParams provided")
+	}
+	if len(keys) == 0 {
+		return errors.New("no keys provided")
+	}
+
+	for i, kd := range keys {
+		skd, err := NewSealedKeyData(kd)
+		if err != nil {
+			return err
+		}
+		if skd.Version() != 3 {
+			return fmt.Errorf("key data at index %d has unsupported metadata version %d", i, skd.Version())
+		}
+	}
+
+	return nil
+}
+
+func recoverKeysForMigration(keys []*secboot.KeyData, recoverFn func(*secboot.KeyData) (secboot.DiskUnlockKey, secboot.AuxiliaryKey, error)) (authKey secboot.AuxiliaryKey, unlockKeys []secboot.DiskUnlockKey, err error) {
+	for i, kd := range keys {
+		key, auxKey, err := recoverFn(kd)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot recover keys from key data at index %d: %w", i, err)
+		}
+
+		if i == 0 {
+			authKey = auxKey
+		} else if !bytes.Equal(auxKey, authKey) {
+			return nil, nil, fmt.Errorf("key data at index %d is not related to the primary key data", i)
+		}
+		unlockKeys = append(unlockKeys, key)
+	}
+
+	return authKey, unlockKeys, nil
+}
+
+func migrateKeyDataToNVAuthorizedPCRPolicy(tpm *Connection, params *ProtectKeyParams, authKey secboot.AuxiliaryKey, unlockKeys []secboot.DiskUnlockKey, keys []*secboot.KeyData) ([]*secboot.KeyData, error) {
+	// Make sure that the metadata of the existing keys hasn't been
+	// modified before creating any new TPM resources.
+	for i, kd := range keys {
+		if err := kd.VerifyMetadataMAC(authKey); err != nil && err != secboot.ErrNoMetadataMAC {
+			return nil, xerrors.Errorf("cannot verify metadata of key data at index %d: %w", i, err)
+		}
+	}
+
+	p := *params
+	p.AuthKey = authKey
+	p.NVAuthorizedPCRPolicy = true
+	p.AuthorizedSnapModels = nil
+
+	migrated, _, err := ProtectKeysWithTPM(tpm, unlockKeys, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, kd := range migrated {
+		if err := kd.CopyMetadata(keys[i], authKey); err != nil {
+			undefineMigratedPCRPolicyIndex(tpm, migrated[0])
+			return nil, xerrors.Errorf("cannot copy metadata from key data at index %d: %w", i, err)
+		}
+	}
+
+	return migrated, nil
+}
+
+// undefineMigratedPCRPolicyIndex undefines the PCR policy NV index created
+// for the supplied migrated key data when migration fails.
+func undefineMigratedPCRPolicyIndex(tpm *Connection, kd *secboot.KeyData) {
+	skd, err := NewSealedKeyData(kd)
+	if err != nil {
+		return
+	}
+	index, err := tpm.CreateResourceContextFromTPM(skd.PCRPolicyCounterHandle())
+	if err != nil {
+		return
+	}
+	tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, tpm.HmacSession())
+}
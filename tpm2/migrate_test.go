@@ -0,0 +1,329 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type migrateSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *migrateSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *migrateSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&migrateSuite{})
+
+func (s *migrateSuite) makeKeysForMigration(c *C, n int) (keys []secboot.DiskUnlockKey, protectedKeys []*secboot.KeyData, authKey secboot.AuxiliaryKey) {
+	for i := 0; i < n; i++ {
+		key := make(secboot.DiskUnlockKey, 32)
+		rand.Read(key)
+
+		keys = append(keys, key)
+	}
+
+	protectedKeys, authKey, err := ProtectKeysWithTPM(s.TPM(), keys, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+	c.Assert(err, IsNil)
+
+	for _, k := range protectedKeys {
+		c.Check(k.SetAuthorizedSnapModels(authKey, s.model(c)), IsNil)
+		c.Check(k.SetAuthorizedBootIdentities(authKey, secboot.BootIdentityClaims{"os-release:ID": "ubuntu"}), IsNil)
+	}
+
+	return keys, protectedKeys, authKey
+}
+
+func (s *migrateSuite) model(c *C) secboot.SnapModel {
+	return testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+}
+
+func (s *migrateSuite) checkMigrated(c *C, params *ProtectKeyParams, keys []secboot.DiskUnlockKey, authKey secboot.AuxiliaryKey, migrated []*secboot.KeyData, recoverFn func(*secboot.KeyData) (secboot.DiskUnlockKey, secboot.AuxiliaryKey, error)) {
+	c.Check(migrated, HasLen, len(keys))
+
+	for i, k := range migrated {
+		skd, err := NewSealedKeyData(k)
+		c.Assert(err, IsNil)
+		c.Check(skd.Version(), Equals, uint32(4))
+		c.Check(skd.PCRPolicyCounterHandle(), Equals, params.PCRPolicyCounterHandle)
+		c.Check(skd.Validate(s.TPM().TPMContext, authKey, s.TPM().HmacSession()), IsNil)
+
+		keyUnsealed, authKeyUnsealed, err := recoverFn(k)
+		c.Check(err, IsNil)
+		c.Check(keyUnsealed, DeepEquals, keys[i])
+		c.Check(authKeyUnsealed, DeepEquals, authKey)
+
+		// The platform independent metadata is carried over.
+		c.Check(k.VerifyMetadataMAC(authKey), IsNil)
+		ok, err := k.IsSnapModelAuthorized(authKey, s.model(c))
+		c.Check(err, IsNil)
+		c.Check(ok, testutil.IsTrue)
+		ok, err = k.IsBootIdentityAuthorized(authKey, secboot.BootIdentityClaims{"os-release:ID": "ubuntu"})
+		c.Check(err, IsNil)
+		c.Check(ok, testutil.IsTrue)
+	}
+}
+
+func (s *migrateSuite) testMigrateKeyDataToNVAuthorizedPCRPolicy(c *C, n int) {
+	keys, protectedKeys, authKey := s.makeKeysForMigration(c, n)
+	skd, err := NewSealedKeyData(protectedKeys[0])
+	c.Assert(err, IsNil)
+	oldHandle := skd.PCRPolicyCounterHandle()
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810001)}
+
+	migrated, err := MigrateKeyDataToNVAuthorizedPCRPolicy(s.TPM(), params, protectedKeys...)
+	c.Assert(err, IsNil)
+	s.checkMigrated(c, params, keys, authKey, migrated, func(k *secboot.KeyData) (secboot.DiskUnlockKey, secboot.AuxiliaryKey, error) {
+		return k.RecoverKeys()
+	})
+
+	// The old keys still work until the old PCR policy counter is undefined.
+	for _, k := range protectedKeys {
+		_, _, err := k.RecoverKeys()
+		c.Check(err, IsNil)
+	}
+	c.Check(UndefineMigratedPCRPolicyCounter(s.TPM(), authKey, protectedKeys...), IsNil)
+	c.Check(s.TPM().DoesHandleExist(oldHandle), testutil.IsFalse)
+	for _, k := range protectedKeys {
+		_, _, err := k.RecoverKeys()
+		c.Check(err, NotNil)
+	}
+
+	// The migrated keys share a PCR policy, so they can be updated together
+	// with the same auxiliary key.
+	c.Check(UpdateKeyDataPCRProtectionPolicy(s.TPM(), authKey, tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}), migrated...), IsNil)
+	skd, err = NewSealedKeyData(migrated[0])
+	c.Assert(err, IsNil)
+	c.Check(skd.RevokeOldPCRProtectionPolicies(s.TPM(), authKey), IsNil)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	for i, k := range migrated {
+		keyUnsealed, _, err := k.RecoverKeys()
+		c.Check(err, IsNil)
+		c.Check(keyUnsealed, DeepEquals, keys[i])
+	}
+}
+
+func (s *migrateSuite) TestMigrateKeyDataToNVAuthorizedPCRPolicy1(c *C) {
+	s.testMigrateKeyDataToNVAuthorizedPCRPolicy(c, 1)
+}
+
+func (s *migrateSuite) TestMigrateKeyDataToNVAuthorizedPCRPolicy2(c *C) {
+	s.testMigrateKeyDataToNVAuthorizedPCRPolicy(c, 2)
+}
+
+func (s *migrateSuite) TestMigrateKeyDataWithPassphraseToNVAuthorizedPCRPolicy(c *C) {
+	keys, protectedKeys, authKey := s.makeKeysForMigration(c, 2)
+
+	var kdf testutil.MockKDF
+	for _, k := range protectedKeys {
+		c.Check(k.SetPassphrase("passphrase", nil, &kdf), IsNil)
+	}
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810001)}
+
+	migrated, err := MigrateKeyDataWithPassphraseToNVAuthorizedPCRPolicy(s.TPM(), params, "passphrase", nil, &kdf, protectedKeys...)
+	c.Assert(err, IsNil)
+	s.checkMigrated(c, params, keys, authKey, migrated, func(k *secboot.KeyData) (secboot.DiskUnlockKey, secboot.AuxiliaryKey, error) {
+		c.Check(k.AuthMode(), Equals, secboot.AuthModePassphrase)
+		return k.RecoverKeysWithPassphrase("passphrase", &kdf)
+	})
+}
+
+func (s *migrateSuite) TestMigrateKeyDataWithPassphraseToNVAuthorizedPCRPolicyWrongPassphrase(c *C) {
+	_, protectedKeys, _ := s.makeKeysForMigration(c, 1)
+
+	var kdf testutil.MockKDF
+	c.Check(protectedKeys[0].SetPassphrase("passphrase", nil, &kdf), IsNil)
+
+	handle := s.NextAvailableHandle(c, 0x01810001)
+	_, err := MigrateKeyDataWithPassphraseToNVAuthorizedPCRPolicy(s.TPM(), &ProtectKeyParams{PCRPolicyCounterHandle: handle}, "1234", nil, &kdf, protectedKeys...)
+	c.Check(err, ErrorMatches, "cannot recover keys from key data at index 0: the supplied passphrase is incorrect")
+	c.Check(s.TPM().DoesHandleExist(handle), testutil.IsFalse)
+}
+
+func (s *migrateSuite) TestMigrateRecoveredKeyDataToNVAuthorizedPCRPolicy(c *C) {
+	keys, protectedKeys, authKey := s.makeKeysForMigration(c, 2)
+
+	// The old keys can't be recovered with the current PCR values,
+	// but they were recovered previously.
+	_, err := s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810001)}
+
+	migrated, err := MigrateRecoveredKeyDataToNVAuthorizedPCRPolicy(s.TPM(), params, authKey, keys, protectedKeys...)
+	c.Assert(err, IsNil)
+	s.checkMigrated(c, params, keys, authKey, migrated, func(k *secboot.KeyData) (secboot.DiskUnlockKey, secboot.AuxiliaryKey, error) {
+		return k.RecoverKeys()
+	})
+}
+
+func (s *migrateSuite) TestMigrateRecoveredKeyDataToNVAuthorizedPCRPolicyWrongAuthKey(c *C) {
+	keys, protectedKeys, _ := s.makeKeysForMigration(c, 1)
+
+	handle := s.NextAvailableHandle(c, 0x01810001)
+	_, err := MigrateRecoveredKeyDataToNVAuthorizedPCRPolicy(s.TPM(), &ProtectKeyParams{PCRPolicyCounterHandle: handle}, make(secboot.AuxiliaryKey, 32), keys, protectedKeys...)
+	c.Check(err, ErrorMatches, "invalid auth key for key data at index 0: dynamic authorization policy signing private key doesn't match public key")
+	c.Check(s.TPM().DoesHandleExist(handle), testutil.IsFalse)
+}
+
+func (s *migrateSuite) TestMigrateRecoveredKeyDataToNVAuthorizedPCRPolicyWrongNumberOfKeys(c *C) {
+	keys, protectedKeys, authKey := s.makeKeysForMigration(c, 2)
+
+	_, err := MigrateRecoveredKeyDataToNVAuthorizedPCRPolicy(s.TPM(), &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810001)}, authKey, keys[:1], protectedKeys...)
+	c.Check(err, ErrorMatches, "the number of unlock keys doesn't match the number of key data objects")
+}
+
+func (s *migrateSuite) TestUndefineMigratedPCRPolicyCounterWrongAuthKey(c *C) {
+	_, protectedKeys, _ := s.makeKeysForMigration(c, 1)
+	skd, err := NewSealedKeyData(protectedKeys[0])
+	c.Assert(err, IsNil)
+	handle := skd.PCRPolicyCounterHandle()
+
+	err = UndefineMigratedPCRPolicyCounter(s.TPM(), make(secboot.AuxiliaryKey, 32), protectedKeys...)
+	c.Check(err, ErrorMatches, "invalid auth key for key data at index 0: dynamic authorization policy signing private key doesn't match public key")
+	c.Check(s.TPM().DoesHandleExist(handle), testutil.IsTrue)
+}
+
+func (s *migrateSuite) TestUndefineMigratedPCRPolicyCounterDifferentCounters(c *C) {
+	_, protectedKeys1, authKey := s.makeKeysForMigration(c, 1)
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+	k, _, err := ProtectKeyWithTPM(s.TPM(), key, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		AuthKey:                authKey})
+	c.Assert(err, IsNil)
+
+	err = UndefineMigratedPCRPolicyCounter(s.TPM(), authKey, protectedKeys1[0], k)
+	c.Check(err, ErrorMatches, "key data at index 1 has a different PCR policy counter to the primary key data")
+}
+
+func (s *migrateSuite) TestUndefineMigratedPCRPolicyCounterNoCounter(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+	k, authKey, err := ProtectKeyWithTPM(s.TPM(), key, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	err = UndefineMigratedPCRPolicyCounter(s.TPM(), authKey, k)
+	c.Check(err, ErrorMatches, "key data at index 0 has no PCR policy counter")
+}
+
+func (s *migrateSuite) TestMigrateKeyDataToNVAuthorizedPCRPolicyNilParams(c *C) {
+	_, err := MigrateKeyDataToNVAuthorizedPCRPolicy(s.TPM(), nil)
+	c.Check(err, ErrorMatches, "no ProtectKeyParams provided")
+}
+
+func (s *migrateSuite) TestMigrateKeyDataToNVAuthorizedPCRPolicyNoKeys(c *C) {
+	_, err := MigrateKeyDataToNVAuthorizedPCRPolicy(s.TPM(), &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+	c.Check(err, ErrorMatches, "no keys provided")
+}
+
+func (s *migrateSuite) TestMigrateKeyDataToNVAuthorizedPCRPolicyAlreadyMigrated(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	k, _, err := ProtectKeyWithTPM(s.TPM(), key, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		NVAuthorizedPCRPolicy:  true})
+	c.Assert(err, IsNil)
+
+	_, err = MigrateKeyDataToNVAuthorizedPCRPolicy(s.TPM(), &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810001)}, k)
+	c.Check(err, ErrorMatches, "key data at index 0 has unsupported metadata version 4")
+}
+
+func (s *migrateSuite) TestMigrateKeyDataToNVAuthorizedPCRPolicyUnrelated(c *C) {
+	var protectedKeys []*secboot.KeyData
+	for i := 0; i < 2; i++ {
+		key := make(secboot.DiskUnlockKey, 32)
+		rand.Read(key)
+
+		k, _, err := ProtectKeyWithTPM(s.TPM(), key, &ProtectKeyParams{
+			PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+			PCRPolicyCounterHandle: tpm2.HandleNull})
+		c.Assert(err, IsNil)
+		protectedKeys = append(protectedKeys, k)
+	}
+
+	_, err := MigrateKeyDataToNVAuthorizedPCRPolicy(s.TPM(), &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}, protectedKeys...)
+	c.Check(err, ErrorMatches, "key data at index 1 is not related to the primary key data")
+}
+
+func (s *migrateSuite) TestMigrateKeyDataToNVAuthorizedPCRPolicyCannotRecover(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	k, _, err := ProtectKeyWithTPM(s.TPM(), key, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	handle := s.NextAvailableHandle(c, 0x01810000)
+	_, err = MigrateKeyDataToNVAuthorizedPCRPolicy(s.TPM(), &ProtectKeyParams{PCRPolicyCounterHandle: handle}, k)
+	c.Check(err, ErrorMatches, "cannot recover keys from key data at index 0: invalid key data: cannot complete authorization policy assertions: "+
+		"cannot execute PCR assertions: cannot execute PolicyOR assertions: current session digest not found in policy data")
+	c.Check(s.TPM().DoesHandleExist(handle), testutil.IsFalse)
+}
@@ -0,0 +1,219 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// eventLogPath is the path of the TCG event log for the default TPM, in binary form.
+var eventLogPath = "/sys/kernel/security/tpm0/binary_bios_measurements"
+
+// pcrBankPreference is the list of supported PCR banks, from strongest to weakest.
+var pcrBankPreference = []tpm2.HashAlgorithmId{
+	tpm2.HashAlgorithmSHA512,
+	tpm2.HashAlgorithmSHA384,
+	tpm2.HashAlgorithmSHA256,
+	tpm2.HashAlgorithmSHA1,
+}
+
+func containsAlg(algs []tpm2.HashAlgorithmId, alg tpm2.HashAlgorithmId) bool {
+	for _, a := range algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// StrongestPCRBank returns the strongest supported PCR bank that is present
+// in all of the supplied lists of digest algorithms, eg, the active PCR banks
+// and the algorithms supported by the TCG event log. If there isn't one,
+// ErrNoSuitablePCRBank is returned.
+func StrongestPCRBank(algLists ...[]tpm2.HashAlgorithmId) (tpm2.HashAlgorithmId, error) {
+	for _, alg := range pcrBankPreference {
+		if !alg.Available() {
+			continue
+		}
+
+		found := true
+		for _, algs := range algLists {
+			if !containsAlg(algs, alg) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return alg, nil
+		}
+	}
+
+	return tpm2.HashAlgorithmNull, ErrNoSuitablePCRBank
+}
+
+func activePCRBanks(tpm *tpm2.TPMContext, session tpm2.SessionContext) ([]tpm2.HashAlgorithmId, error) {
+	pcrs, err := tpm.GetCapabilityPCRs(session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, err
+	}
+
+	var algs []tpm2.HashAlgorithmId
+	for _, s := range pcrs {
+		if len(s.Select) == 0 {
+			// This bank is implemented but not allocated.
+			continue
+		}
+		algs = append(algs, s.Hash)
+	}
+	return algs, nil
+}
+
+func eventLogAlgorithms() ([]tpm2.HashAlgorithmId, error) {
+	f, err := os.Open(eventLogPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	log, err := tcglog.ReadLog(f, &tcglog.LogOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return log.Algorithms, nil
+}
+
+// ActivePCRBanks returns the digest algorithms of the PCR banks that are
+// currently active (allocated) on the TPM.
+func (t *Connection) ActivePCRBanks() ([]tpm2.HashAlgorithmId, error) {
+	algs, err := activePCRBanks(t.TPMContext, t.HmacSession())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain PCR banks: %w", err)
+	}
+	return algs, nil
+}
+
+// EventLogAlgorithms returns the digest algorithms that are supported by the
+// TCG event log for the TPM, which indicates the PCR banks that the platform
+// firmware measured to during boot.
+func (t *Connection) EventLogAlgorithms() ([]tpm2.HashAlgorithmId, error) {
+	algs, err := eventLogAlgorithms()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read TCG event log: %w", err)
+	}
+	return algs, nil
+}
+
+// SelectPCRBank returns the strongest supported PCR bank that is both active
+// on the TPM and present in the TCG event log, which is suitable for use when
+// creating a PCRProtectionProfile. If there isn't a suitable PCR bank,
+// ErrNoSuitablePCRBank will be returned.
+func (t *Connection) SelectPCRBank() (tpm2.HashAlgorithmId, error) {
+	active, err := t.ActivePCRBanks()
+	if err != nil {
+		return tpm2.HashAlgorithmNull, err
+	}
+	logAlgs, err := t.EventLogAlgorithms()
+	if err != nil {
+		return tpm2.HashAlgorithmNull, err
+	}
+	return StrongestPCRBank(active, logAlgs)
+}
+
+// restrictPCRProtectionProfileToBank returns a new PCRProtectionProfile that
+// only contains the values for the specified PCR bank from the supplied
+// profile, with a branch for each set of PCR values that the supplied
+// profile produces.
+func restrictPCRProtectionProfileToBank(tpm *tpm2.TPMContext, profile *PCRProtectionProfile, alg tpm2.HashAlgorithmId) (*PCRProtectionProfile, error) {
+	values, err := profile.ComputePCRValues(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+	}
+
+	out := NewPCRProtectionProfile()
+	bp := out.RootBranch().AddBranchPoint()
+	for _, v := range values {
+		b := bp.AddBranch()
+		pcrs, err := tpm2.PCRValues{alg: v[alg]}.SelectionList()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute selection list: %w", err)
+		}
+		for _, s := range pcrs {
+			for _, pcr := range s.Select {
+				b.AddPCRValue(alg, pcr, v[alg][pcr])
+			}
+		}
+		b.EndBranch()
+	}
+	bp.EndBranchPoint()
+
+	if out.err != nil {
+		return nil, out.err
+	}
+	return out, nil
+}
+
+// selectStrongestPCRBankForProfile returns a PCRProtectionProfile that only
+// contains values for the strongest PCR bank that is included in the supplied
+// profile, active on the TPM and present in the TCG event log. If the
+// supplied profile only contains values for a single suitable bank, it is
+// returned unmodified.
+func selectStrongestPCRBankForProfile(tpm *tpm2.TPMContext, profile *PCRProtectionProfile, session tpm2.SessionContext) (*PCRProtectionProfile, error) {
+	values, err := profile.ComputePCRValues(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+	}
+
+	var profileAlgs []tpm2.HashAlgorithmId
+	for _, v := range values {
+		for alg := range v {
+			if !containsAlg(profileAlgs, alg) {
+				profileAlgs = append(profileAlgs, alg)
+			}
+		}
+	}
+	if len(profileAlgs) == 0 {
+		// Nothing to select.
+		return profile, nil
+	}
+
+	active, err := activePCRBanks(tpm, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain PCR banks: %w", err)
+	}
+	logAlgs, err := eventLogAlgorithms()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read TCG event log: %w", err)
+	}
+
+	alg, err := StrongestPCRBank(profileAlgs, active, logAlgs)
+	if err != nil {
+		return nil, err
+	}
+	if len(profileAlgs) == 1 {
+		return profile, nil
+	}
+
+	return restrictPCRProtectionProfileToBank(tpm, profile, alg)
+}
@@ -0,0 +1,151 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type pcrBanksSuiteNoTPM struct{}
+
+var _ = Suite(&pcrBanksSuiteNoTPM{})
+
+func (s *pcrBanksSuiteNoTPM) TestStrongestPCRBank(c *C) {
+	alg, err := StrongestPCRBank(
+		[]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA384},
+		[]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA384, tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA1})
+	c.Check(err, IsNil)
+	c.Check(alg, Equals, tpm2.HashAlgorithmSHA384)
+}
+
+func (s *pcrBanksSuiteNoTPM) TestStrongestPCRBankIntersection(c *C) {
+	alg, err := StrongestPCRBank(
+		[]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA384},
+		[]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256})
+	c.Check(err, IsNil)
+	c.Check(alg, Equals, tpm2.HashAlgorithmSHA256)
+}
+
+func (s *pcrBanksSuiteNoTPM) TestStrongestPCRBankSHA1(c *C) {
+	alg, err := StrongestPCRBank(
+		[]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1},
+		[]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256})
+	c.Check(err, IsNil)
+	c.Check(alg, Equals, tpm2.HashAlgorithmSHA1)
+}
+
+func (s *pcrBanksSuiteNoTPM) TestStrongestPCRBankNoneSuitable(c *C) {
+	_, err := StrongestPCRBank(
+		[]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1},
+		[]tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256})
+	c.Check(err, Equals, ErrNoSuitablePCRBank)
+}
+
+func (s *pcrBanksSuiteNoTPM) TestRestrictPCRProtectionProfileToBank(c *C) {
+	profile := NewPCRProtectionProfile()
+	profile.RootBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA1, 7, hash(crypto.SHA1, "foo")).
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, hash(crypto.SHA256, "foo"))
+	bp := profile.RootBranch().AddBranchPoint()
+	bp.AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA1, 4, hash(crypto.SHA1, "bar1")).
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "bar1"))
+	bp.AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA1, 4, hash(crypto.SHA1, "bar2")).
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "bar2"))
+	bp.EndBranchPoint()
+
+	restricted, err := RestrictPCRProtectionProfileToBank(nil, profile, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+
+	values, err := restricted.ComputePCRValues(nil)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA256: {
+				4: hash(crypto.SHA256, "bar1"),
+				7: hash(crypto.SHA256, "foo")}},
+		{
+			tpm2.HashAlgorithmSHA256: {
+				4: hash(crypto.SHA256, "bar2"),
+				7: hash(crypto.SHA256, "foo")}}})
+}
+
+func (s *pcrBanksSuiteNoTPM) TestRestrictPCRProtectionProfileToBankNoTPM(c *C) {
+	profile := NewPCRProtectionProfile()
+	profile.AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7)
+
+	_, err := RestrictPCRProtectionProfileToBank(nil, profile, tpm2.HashAlgorithmSHA256)
+	c.Check(err, ErrorMatches, "cannot compute PCR values from protection profile: .*")
+}
+
+type pcrBanksSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *pcrBanksSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeaturePCR
+}
+
+var _ = Suite(&pcrBanksSuite{})
+
+func (s *pcrBanksSuite) TestActivePCRBanks(c *C) {
+	algs, err := s.TPM().ActivePCRBanks()
+	c.Check(err, IsNil)
+	c.Check(algs, Not(HasLen), 0)
+
+	for _, alg := range algs {
+		_, _, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: alg, Select: []int{7}}})
+		c.Check(err, IsNil)
+	}
+}
+
+func (s *pcrBanksSuite) TestEventLogAlgorithms(c *C) {
+	restore := MockEventLogPath("../efi/testdata/eventlog_sb.bin")
+	defer restore()
+
+	algs, err := s.TPM().EventLogAlgorithms()
+	c.Check(err, IsNil)
+	c.Check(algs, DeepEquals, []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256})
+}
+
+func (s *pcrBanksSuite) TestSelectPCRBank(c *C) {
+	restore := MockEventLogPath("../efi/testdata/eventlog_sb.bin")
+	defer restore()
+
+	alg, err := s.TPM().SelectPCRBank()
+	c.Check(err, IsNil)
+	c.Check(alg, Equals, tpm2.HashAlgorithmSHA256)
+}
+
+func (s *pcrBanksSuite) TestSelectPCRBankNoEventLog(c *C) {
+	restore := MockEventLogPath("/nonexistent")
+	defer restore()
+
+	_, err := s.TPM().SelectPCRBank()
+	c.Check(err, ErrorMatches, "cannot read TCG event log: .*")
+}
@@ -22,6 +22,8 @@ package tpm2
 import (
 	"bytes"
 	"crypto"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -586,11 +588,13 @@ func (b *PCRProtectionProfileBranch) EndBranch() *PCRProtectionProfileBranchPoin
 // PCR policy upon completion of the sub-branches.
 //
 // A PCRProtectionProfile can be serialized to and unserialized from the TPM
-// wire format.
+// wire format, or from a human-readable JSON encoding that is suitable for
+// review and for storing alongside release artifacts.
 type PCRProtectionProfile struct {
-	root              *PCRProtectionProfileBranch
-	pcrsToReadFromTPM tpm2.PCRSelectionList
-	err               error
+	root                *PCRProtectionProfileBranch
+	pcrsToReadFromTPM   tpm2.PCRSelectionList
+	selectStrongestBank bool
+	err                 error
 }
 
 // NewPCRProtectionProfile creates an empty PCR profile.
@@ -667,6 +671,21 @@ func (p *PCRProtectionProfile) ExtendPCR(alg tpm2.HashAlgorithmId, pcr int, valu
 	return p
 }
 
+// SelectStrongestPCRBank indicates that a PCR policy created or updated from
+// this profile should only be computed from the values for the strongest PCR
+// bank that is included in this profile, active on the TPM and present in the
+// TCG event log. This makes it possible to supply a profile that covers several
+// PCR banks to ProtectKeyWithTPM, ProtectKeysWithTPM,
+// SealedKeyData.UpdatePCRProtectionPolicy, UpdateKeyDataPCRProtectionPolicy and
+// UpdateKeyPCRProtectionPolicyMultiple. If there isn't a suitable bank, these
+// will return ErrNoSuitablePCRBank. This isn't preserved when the profile is
+// serialized. The function returns the same PCRProtectionProfile so that calls
+// may be chained.
+func (p *PCRProtectionProfile) SelectStrongestPCRBank() *PCRProtectionProfile {
+	p.selectStrongestBank = true
+	return p
+}
+
 // AddProfileOR adds a branch point to this branch containing the supplied
 // root branches associated with the supplied sub-profiles as branches, in order
 // to define PCR policies for multiple conditions.
@@ -1025,6 +1044,272 @@ func (p *PCRProtectionProfile) Unmarshal(r io.Reader) error {
 	return errors.New("missing EndBranch for root branch")
 }
 
+// pcrProtectionProfileJSONAlg is a digest algorithm in a JSON encoded PCR
+// profile, represented by its name.
+type pcrProtectionProfileJSONAlg tpm2.HashAlgorithmId
+
+func (a pcrProtectionProfileJSONAlg) MarshalJSON() ([]byte, error) {
+	var s string
+
+	switch tpm2.HashAlgorithmId(a) {
+	case tpm2.HashAlgorithmSHA1:
+		s = "sha1"
+	case tpm2.HashAlgorithmSHA256:
+		s = "sha256"
+	case tpm2.HashAlgorithmSHA384:
+		s = "sha384"
+	case tpm2.HashAlgorithmSHA512:
+		s = "sha512"
+	default:
+		return nil, fmt.Errorf("unknown digest algorithm: %v", tpm2.HashAlgorithmId(a))
+	}
+
+	return json.Marshal(s)
+}
+
+func (a *pcrProtectionProfileJSONAlg) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	switch s {
+	case "sha1":
+		*a = pcrProtectionProfileJSONAlg(tpm2.HashAlgorithmSHA1)
+	case "sha256":
+		*a = pcrProtectionProfileJSONAlg(tpm2.HashAlgorithmSHA256)
+	case "sha384":
+		*a = pcrProtectionProfileJSONAlg(tpm2.HashAlgorithmSHA384)
+	case "sha512":
+		*a = pcrProtectionProfileJSONAlg(tpm2.HashAlgorithmSHA512)
+	default:
+		return fmt.Errorf("unknown digest algorithm: %q", s)
+	}
+
+	return nil
+}
+
+// pcrProtectionProfileJSONDigest is a digest in a JSON encoded PCR profile,
+// represented as a hex string.
+type pcrProtectionProfileJSONDigest tpm2.Digest
+
+func (d pcrProtectionProfileJSONDigest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(d))
+}
+
+func (d *pcrProtectionProfileJSONDigest) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return xerrors.Errorf("cannot decode digest: %w", err)
+	}
+	*d = b
+	return nil
+}
+
+// pcrProtectionProfileJSONPCR is the argument of an AddPCRValueFromTPM
+// instruction in a JSON encoded PCR profile.
+type pcrProtectionProfileJSONPCR struct {
+	Alg pcrProtectionProfileJSONAlg `json:"alg"`
+	PCR int                         `json:"pcr"`
+}
+
+func (a *pcrProtectionProfileJSONPCR) check() error {
+	if a.PCR < 0 || a.PCR > maxPCR {
+		return fmt.Errorf("invalid PCR index %d", a.PCR)
+	}
+	return nil
+}
+
+// pcrProtectionProfileJSONPCRValue is the argument of an AddPCRValue or
+// ExtendPCR instruction in a JSON encoded PCR profile.
+type pcrProtectionProfileJSONPCRValue struct {
+	Alg   pcrProtectionProfileJSONAlg    `json:"alg"`
+	PCR   int                            `json:"pcr"`
+	Value pcrProtectionProfileJSONDigest `json:"value"`
+}
+
+func (a *pcrProtectionProfileJSONPCRValue) check() error {
+	if a.PCR < 0 || a.PCR > maxPCR {
+		return fmt.Errorf("invalid PCR index %d", a.PCR)
+	}
+	if len(a.Value) != tpm2.HashAlgorithmId(a.Alg).Size() {
+		return fmt.Errorf("invalid digest length %d for PCR %d", len(a.Value), a.PCR)
+	}
+	return nil
+}
+
+// pcrProtectionProfileJSONInstr represents a single instruction in a JSON
+// encoded PCR profile. Exactly one field is set.
+type pcrProtectionProfileJSONInstr struct {
+	AddPCRValue        *pcrProtectionProfileJSONPCRValue  `json:"add-pcr-value,omitempty"`
+	AddPCRValueFromTPM *pcrProtectionProfileJSONPCR       `json:"add-pcr-value-from-tpm,omitempty"`
+	ExtendPCR          *pcrProtectionProfileJSONPCRValue  `json:"extend-pcr,omitempty"`
+	BranchPoint        *[]*pcrProtectionProfileJSONBranch `json:"branch-point,omitempty"`
+}
+
+// pcrProtectionProfileJSONBranch represents a branch in a JSON encoded PCR
+// profile.
+type pcrProtectionProfileJSONBranch struct {
+	Instrs []*pcrProtectionProfileJSONInstr `json:"instrs"`
+}
+
+// build adds the instructions from this JSON encoded branch to the supplied
+// profile branch.
+func (j *pcrProtectionProfileJSONBranch) build(b *PCRProtectionProfileBranch) error {
+	for i, instr := range j.Instrs {
+		if instr == nil {
+			return fmt.Errorf("invalid instruction %d: no operation", i)
+		}
+
+		n := 0
+		for _, set := range []bool{instr.AddPCRValue != nil, instr.AddPCRValueFromTPM != nil, instr.ExtendPCR != nil, instr.BranchPoint != nil} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("invalid instruction %d: expected exactly one operation", i)
+		}
+
+		switch {
+		case instr.AddPCRValue != nil:
+			if err := instr.AddPCRValue.check(); err != nil {
+				return xerrors.Errorf("invalid instruction %d: %w", i, err)
+			}
+			b.AddPCRValue(tpm2.HashAlgorithmId(instr.AddPCRValue.Alg), instr.AddPCRValue.PCR, tpm2.Digest(instr.AddPCRValue.Value))
+		case instr.AddPCRValueFromTPM != nil:
+			if err := instr.AddPCRValueFromTPM.check(); err != nil {
+				return xerrors.Errorf("invalid instruction %d: %w", i, err)
+			}
+			b.AddPCRValueFromTPM(tpm2.HashAlgorithmId(instr.AddPCRValueFromTPM.Alg), instr.AddPCRValueFromTPM.PCR)
+		case instr.ExtendPCR != nil:
+			if err := instr.ExtendPCR.check(); err != nil {
+				return xerrors.Errorf("invalid instruction %d: %w", i, err)
+			}
+			b.ExtendPCR(tpm2.HashAlgorithmId(instr.ExtendPCR.Alg), instr.ExtendPCR.PCR, tpm2.Digest(instr.ExtendPCR.Value))
+		case instr.BranchPoint != nil:
+			bp := b.AddBranchPoint()
+			for k, branch := range *instr.BranchPoint {
+				if branch == nil {
+					return fmt.Errorf("invalid instruction %d: missing branch %d", i, k)
+				}
+				sub := bp.AddBranch()
+				if err := branch.build(sub); err != nil {
+					return xerrors.Errorf("invalid instruction %d: branch %d: %w", i, k, err)
+				}
+				sub.EndBranch()
+			}
+			bp.EndBranchPoint()
+		}
+	}
+
+	return nil
+}
+
+type pcrProtectionProfileJSONSerializer struct {
+	root         *pcrProtectionProfileJSONBranch
+	branches     []*pcrProtectionProfileJSONBranch
+	branchPoints []*[]*pcrProtectionProfileJSONBranch
+}
+
+func (c *pcrProtectionProfileJSONSerializer) currentBranch() *pcrProtectionProfileJSONBranch {
+	return c.branches[len(c.branches)-1]
+}
+
+func (c *pcrProtectionProfileJSONSerializer) beginBranch(_ int) {
+	branch := &pcrProtectionProfileJSONBranch{Instrs: []*pcrProtectionProfileJSONInstr{}}
+	if len(c.branches) == 0 {
+		c.root = branch
+	} else {
+		bp := c.branchPoints[len(c.branchPoints)-1]
+		*bp = append(*bp, branch)
+	}
+	c.branches = append(c.branches, branch)
+}
+
+func (c *pcrProtectionProfileJSONSerializer) addPCRValue(alg tpm2.HashAlgorithmId, pcr int, value tpm2.Digest) {
+	branch := c.currentBranch()
+	branch.Instrs = append(branch.Instrs, &pcrProtectionProfileJSONInstr{
+		AddPCRValue: &pcrProtectionProfileJSONPCRValue{
+			Alg:   pcrProtectionProfileJSONAlg(alg),
+			PCR:   pcr,
+			Value: pcrProtectionProfileJSONDigest(value)}})
+}
+
+func (c *pcrProtectionProfileJSONSerializer) addPCRValueFromTPM(alg tpm2.HashAlgorithmId, pcr int) {
+	branch := c.currentBranch()
+	branch.Instrs = append(branch.Instrs, &pcrProtectionProfileJSONInstr{
+		AddPCRValueFromTPM: &pcrProtectionProfileJSONPCR{
+			Alg: pcrProtectionProfileJSONAlg(alg),
+			PCR: pcr}})
+}
+
+func (c *pcrProtectionProfileJSONSerializer) extendPCR(alg tpm2.HashAlgorithmId, pcr int, value tpm2.Digest) {
+	branch := c.currentBranch()
+	branch.Instrs = append(branch.Instrs, &pcrProtectionProfileJSONInstr{
+		ExtendPCR: &pcrProtectionProfileJSONPCRValue{
+			Alg:   pcrProtectionProfileJSONAlg(alg),
+			PCR:   pcr,
+			Value: pcrProtectionProfileJSONDigest(value)}})
+}
+
+func (c *pcrProtectionProfileJSONSerializer) beginBranchPoint() {
+	bp := new([]*pcrProtectionProfileJSONBranch)
+	*bp = []*pcrProtectionProfileJSONBranch{}
+
+	branch := c.currentBranch()
+	branch.Instrs = append(branch.Instrs, &pcrProtectionProfileJSONInstr{BranchPoint: bp})
+	c.branchPoints = append(c.branchPoints, bp)
+}
+
+func (c *pcrProtectionProfileJSONSerializer) endBranchPoint() {
+	c.branchPoints = c.branchPoints[:len(c.branchPoints)-1]
+}
+
+func (c *pcrProtectionProfileJSONSerializer) endBranch() {
+	c.branches = c.branches[:len(c.branches)-1]
+}
+
+// MarshalJSON implements json.Marshaler. It encodes this profile as a
+// human-readable tree of instructions, with digest algorithms represented
+// by name and digests represented as hex strings. A profile that has
+// already failed can't be encoded.
+func (p *PCRProtectionProfile) MarshalJSON() ([]byte, error) {
+	if p.err != nil {
+		return nil, xerrors.Errorf("cannot encode failed profile: %w", p.err)
+	}
+
+	c := new(pcrProtectionProfileJSONSerializer)
+	p.run(c)
+	return json.Marshal(c.root)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, and decodes a profile that was
+// encoded with MarshalJSON.
+func (p *PCRProtectionProfile) UnmarshalJSON(data []byte) error {
+	var root *pcrProtectionProfileJSONBranch
+	if err := json.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if root == nil {
+		return errors.New("missing root branch")
+	}
+
+	p.root = newPCRProtectionProfileBranch(p, nil)
+	p.pcrsToReadFromTPM = nil
+	p.err = nil
+
+	if err := root.build(p.root); err != nil {
+		return err
+	}
+	return p.err
+}
+
 type pcrProtectionProfileComputerBranchContext struct {
 	values          pcrValuesList
 	subBranchValues pcrValuesList
@@ -1159,3 +1444,167 @@ func (p *PCRProtectionProfile) ComputePCRDigests(tpm *tpm2.TPMContext, alg tpm2.
 
 	return pcrs, uniquePcrDigests, nil
 }
+
+// PCRProtectionProfileStats describes the PCR policy that will be computed
+// from a PCRProtectionProfile.
+type PCRProtectionProfileStats struct {
+	// ComputedBranches is the number of branches computed from the
+	// original profile, before de-duplication.
+	ComputedBranches int
+
+	// Branches is the number of unique branches, which is the number of
+	// digests in the PolicyOR tree of the computed PCR policy.
+	Branches int
+
+	// Depth is the depth of the PolicyOR tree of the computed PCR policy,
+	// which is the number of PolicyOR assertions required to satisfy it.
+	Depth int
+
+	// ConstantPCRs are the PCRs that have the same value in every branch.
+	ConstantPCRs tpm2.PCRSelectionList
+}
+
+// TooManyBranches indicates that the computed PCR policy has more branches
+// than are supported, in which case sealing a key with it will fail.
+func (s *PCRProtectionProfileStats) TooManyBranches() bool {
+	return s.Branches > policyOrMaxDigests
+}
+
+// pcrValuesKey returns a key that uniquely identifies the supplied PCR values
+// for the specified selection.
+func pcrValuesKey(pcrs tpm2.PCRSelectionList, values tpm2.PCRValues) string {
+	key := new(bytes.Buffer)
+	for _, s := range pcrs {
+		for _, pcr := range s.Select {
+			fmt.Fprintf(key, "%v:%d:%x,", s.Hash, pcr, values[s.Hash][pcr])
+		}
+	}
+	return key.String()
+}
+
+// computeStats computes the PCR values for this profile and returns the
+// statistics about the PCR policy that will be computed from it, along with
+// the PCR selection and the unique sets of PCR values.
+func (p *PCRProtectionProfile) computeStats(tpm *tpm2.TPMContext) (*PCRProtectionProfileStats, tpm2.PCRSelectionList, []tpm2.PCRValues, error) {
+	values, err := p.ComputePCRValues(tpm)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	pcrs, err := values[0].SelectionList()
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot compute selection list: %w", err)
+	}
+
+	// De-duplicate the computed branches, making sure that they all
+	// contain values for the same sets of PCRs.
+	var unique []tpm2.PCRValues
+	seen := make(map[string]struct{})
+	for _, v := range values {
+		p, err := v.SelectionList()
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot compute selection list: %w", err)
+		}
+		if !mu.DeepEqual(p, pcrs) {
+			return nil, nil, nil, errors.New("not all branches contain values for the same sets of PCRs")
+		}
+
+		key := pcrValuesKey(pcrs, v)
+		if _, exists := seen[key]; exists {
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, v)
+	}
+
+	stats := &PCRProtectionProfileStats{
+		ComputedBranches: len(values),
+		Branches:         len(unique),
+		Depth:            policyOrTreeDepth(len(unique))}
+
+	for _, s := range pcrs {
+		for _, pcr := range s.Select {
+			constant := true
+			for _, v := range unique[1:] {
+				if !bytes.Equal(v[s.Hash][pcr], unique[0][s.Hash][pcr]) {
+					constant = false
+					break
+				}
+			}
+			if constant {
+				stats.ConstantPCRs = stats.ConstantPCRs.MustMerge(tpm2.PCRSelectionList{{Hash: s.Hash, Select: []int{pcr}}})
+			}
+		}
+	}
+
+	return stats, pcrs, unique, nil
+}
+
+// Stats computes the PCR values for this profile and returns statistics about
+// the PCR policy that will be computed from it, which can be checked before
+// sealing a key. This doesn't modify the profile - see Minimize for obtaining
+// an equivalent profile with fewer branches.
+//
+// Any values that this profile reads from the TPM with AddPCRValueFromTPM are
+// read using the supplied TPM context.
+func (p *PCRProtectionProfile) Stats(tpm *tpm2.TPMContext) (*PCRProtectionProfileStats, error) {
+	stats, _, _, err := p.computeStats(tpm)
+	return stats, err
+}
+
+// Minimize computes the PCR values for this profile and returns an equivalent
+// profile that produces the same PCR policy with the minimum number of
+// branches, along with statistics about the computed PCR policy which can be
+// checked before sealing a key.
+//
+// Profiles that combine several load sequences, signature database updates
+// and other states can produce many duplicate sets of PCR values, each of
+// which has to be computed every time the PCR policy is updated. The returned
+// profile contains a single branch for each unique set of PCR values. PCRs
+// that have the same value in every branch are added once to the root branch
+// of the returned profile rather than to each branch. Note that these PCRs
+// are still included in the PCR policy - removing them would weaken it.
+//
+// Any values that this profile reads from the TPM with AddPCRValueFromTPM are
+// read using the supplied TPM context, and are recorded as concrete values in
+// the returned profile.
+func (p *PCRProtectionProfile) Minimize(tpm *tpm2.TPMContext) (*PCRProtectionProfile, *PCRProtectionProfileStats, error) {
+	stats, pcrs, unique, err := p.computeStats(tpm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Add the PCRs that are constant across all branches to the root branch.
+	out := NewPCRProtectionProfile()
+	for _, s := range stats.ConstantPCRs {
+		for _, pcr := range s.Select {
+			out.RootBranch().AddPCRValue(s.Hash, pcr, unique[0][s.Hash][pcr])
+		}
+	}
+
+	varying, err := pcrs.Remove(stats.ConstantPCRs)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute varying PCRs: %w", err)
+	}
+
+	// Add a branch for each unique set of values for the remaining PCRs.
+	if !varying.IsEmpty() {
+		bp := out.RootBranch().AddBranchPoint()
+		for _, v := range unique {
+			b := bp.AddBranch()
+			for _, s := range varying {
+				for _, pcr := range s.Select {
+					b.AddPCRValue(s.Hash, pcr, v[s.Hash][pcr])
+				}
+			}
+			b.EndBranch()
+		}
+		bp.EndBranchPoint()
+	}
+
+	if out.err != nil {
+		return nil, nil, out.err
+	}
+
+	return out, stats, nil
+}
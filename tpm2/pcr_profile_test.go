@@ -20,6 +20,8 @@
 package tpm2_test
 
 import (
+	"crypto"
+	"encoding/json"
 	"fmt"
 
 	"github.com/canonical/go-tpm2"
@@ -1053,6 +1055,336 @@ func (s *pcrProfileSuite) TestUnmarshalUnexpctedEndBranch2(c *C) {
 		"tpm2.PCRProtectionProfile: unexpected EndBranch at instruction 2")
 }
 
+func (s *pcrProfileSuite) TestMarshalAndUnmarshalJSON(c *C) {
+	p := NewPCRProtectionProfile()
+	p.RootBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 0, make([]byte, 32)).
+		AddBranchPoint(). // Begin (A1 || A2)
+		AddBranch().      // Begin A1
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+		EndBranch(). // End A1
+		AddBranch(). // Begin A2
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
+		EndBranch().      // End A2
+		EndBranchPoint(). // End (A1 || A2)
+		ExtendPCR(tpm2.HashAlgorithmSHA1, 8, make([]byte, 20))
+
+	b, err := json.Marshal(p)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, `{"instrs":[`+
+		`{"add-pcr-value":{"alg":"sha256","pcr":0,"value":"0000000000000000000000000000000000000000000000000000000000000000"}},`+
+		`{"branch-point":[`+
+		`{"instrs":[{"add-pcr-value":{"alg":"sha256","pcr":7,"value":"424816d020cf3d793ac021da47379bdf608080a83eb9364a7fbe0bdfa87111d7"}}]},`+
+		`{"instrs":[{"add-pcr-value-from-tpm":{"alg":"sha256","pcr":7}}]}]},`+
+		`{"extend-pcr":{"alg":"sha1","pcr":8,"value":"0000000000000000000000000000000000000000"}}]}`)
+
+	var p2 *PCRProtectionProfile
+	c.Assert(json.Unmarshal(b, &p2), IsNil)
+	c.Check(p2.String(), Equals, p.String())
+
+	b2, err := json.Marshal(p2)
+	c.Check(err, IsNil)
+	c.Check(b2, DeepEquals, b)
+}
+
+func (s *pcrProfileSuite) TestUnmarshalJSONComputesSameDigests(c *C) {
+	p := NewPCRProtectionProfile()
+	p.RootBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+		AddBranchPoint().
+		AddBranch().
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 12, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar")).
+		EndBranch().
+		AddBranch().
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 12, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "baz")).
+		EndBranch().
+		EndBranchPoint()
+
+	b, err := json.Marshal(p)
+	c.Assert(err, IsNil)
+
+	var p2 *PCRProtectionProfile
+	c.Assert(json.Unmarshal(b, &p2), IsNil)
+
+	expectedPcrs, expectedDigests, err := p.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	pcrs, digests, err := p2.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Check(err, IsNil)
+	c.Check(pcrs, tpm2_testutil.TPMValueDeepEquals, expectedPcrs)
+	c.Check(digests, DeepEquals, expectedDigests)
+}
+
+func (s *pcrProfileSuite) TestMarshalJSONFailedProfile(c *C) {
+	p := NewPCRProtectionProfile()
+	p.RootBranch().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, nil)
+
+	_, err := json.Marshal(p)
+	c.Check(err, ErrorMatches, "json: error calling MarshalJSON for type \\*tpm2.PCRProtectionProfile: cannot encode failed profile: "+
+		"digest length is inconsistent with specified algorithm .*")
+}
+
+func (s *pcrProfileSuite) testUnmarshalJSONError(c *C, data string, expected string) {
+	var p *PCRProtectionProfile
+	c.Check(json.Unmarshal([]byte(data), &p), ErrorMatches, expected)
+}
+
+func (s *pcrProfileSuite) TestUnmarshalJSONUnknownAlg(c *C) {
+	s.testUnmarshalJSONError(c, `{"instrs":[{"add-pcr-value-from-tpm":{"alg":"md5","pcr":7}}]}`,
+		`unknown digest algorithm: "md5"`)
+}
+
+func (s *pcrProfileSuite) TestUnmarshalJSONInvalidDigest(c *C) {
+	s.testUnmarshalJSONError(c, `{"instrs":[{"add-pcr-value":{"alg":"sha256","pcr":7,"value":"zz"}}]}`,
+		`cannot decode digest: encoding/hex: invalid byte: U\+007A 'z'`)
+}
+
+func (s *pcrProfileSuite) TestUnmarshalJSONInvalidDigestLength(c *C) {
+	s.testUnmarshalJSONError(c, `{"instrs":[{"branch-point":[{"instrs":[{"extend-pcr":{"alg":"sha256","pcr":7,"value":"0000"}}]}]}]}`,
+		`invalid instruction 0: branch 0: invalid instruction 0: invalid digest length 2 for PCR 7`)
+}
+
+func (s *pcrProfileSuite) TestUnmarshalJSONInvalidPCR(c *C) {
+	s.testUnmarshalJSONError(c, `{"instrs":[{"add-pcr-value-from-tpm":{"alg":"sha256","pcr":-1}}]}`,
+		`invalid instruction 0: invalid PCR index -1`)
+}
+
+func (s *pcrProfileSuite) TestUnmarshalJSONMultipleOperations(c *C) {
+	s.testUnmarshalJSONError(c, `{"instrs":[{"add-pcr-value-from-tpm":{"alg":"sha256","pcr":7},"branch-point":[]}]}`,
+		`invalid instruction 0: expected exactly one operation`)
+}
+
+func (s *pcrProfileSuite) TestUnmarshalJSONNoOperation(c *C) {
+	s.testUnmarshalJSONError(c, `{"instrs":[{}]}`,
+		`invalid instruction 0: expected exactly one operation`)
+}
+
+func (s *pcrProfileSuite) TestStats(c *C) {
+	// Create a profile with 2 load sequences that produce the same values
+	// for PCR 4, and 2 states for PCR 7 where one is duplicated.
+	p := NewPCRProtectionProfile()
+	p.RootBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 0, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "fw")).
+		AddBranchPoint().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "db1")).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "db2")).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "db1")).
+		EndBranch().
+		EndBranchPoint().
+		AddBranchPoint().
+		AddBranch().
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "shim")).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "kernel")).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 4, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "shim", "kernel")).
+		EndBranch().
+		EndBranchPoint()
+
+	stats, err := p.Stats(nil)
+	c.Assert(err, IsNil)
+	c.Check(stats, DeepEquals, &PCRProtectionProfileStats{
+		ComputedBranches: 6,
+		Branches:         2,
+		Depth:            1,
+		ConstantPCRs:     tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{0, 4}}}})
+	c.Check(stats.TooManyBranches(), testutil.IsFalse)
+
+	// The number of branches should match the number of digests in the
+	// computed PCR policy.
+	_, digests, err := p.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(digests, HasLen, stats.Branches)
+}
+
+func (s *pcrProfileSuite) TestStatsSingleBranch(c *C) {
+	p := NewPCRProtectionProfile()
+	p.RootBranch().
+		AddBranchPoint().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+		EndBranch().
+		EndBranchPoint()
+
+	stats, err := p.Stats(nil)
+	c.Assert(err, IsNil)
+	c.Check(stats, DeepEquals, &PCRProtectionProfileStats{
+		ComputedBranches: 2,
+		Branches:         1,
+		Depth:            1,
+		ConstantPCRs:     tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}})
+}
+
+func (s *pcrProfileSuite) TestStatsDepth2(c *C) {
+	p := NewPCRProtectionProfile()
+	bp := p.RootBranch().AddBranchPoint()
+	for i := 0; i < 20; i++ {
+		bp.AddBranch().
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 7, hash(crypto.SHA256, fmt.Sprintf("%d", i))).
+			EndBranch()
+	}
+	bp.EndBranchPoint()
+
+	stats, err := p.Stats(nil)
+	c.Assert(err, IsNil)
+	c.Check(stats.ComputedBranches, Equals, 20)
+	c.Check(stats.Branches, Equals, 20)
+	c.Check(stats.Depth, Equals, 2)
+	c.Check(stats.ConstantPCRs, HasLen, 0)
+}
+
+func (s *pcrProfileSuite) TestStatsInconsistentPCRs(c *C) {
+	p := NewPCRProtectionProfile()
+	p.RootBranch().
+		AddBranchPoint().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make([]byte, 32)).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 8, make([]byte, 32)).
+		EndBranch().
+		EndBranchPoint()
+
+	_, err := p.Stats(nil)
+	c.Check(err, ErrorMatches, "not all branches contain values for the same sets of PCRs")
+}
+
+func (s *pcrProfileSuite) TestStatsFailedProfile(c *C) {
+	p := NewPCRProtectionProfile()
+	p.RootBranch().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, nil)
+
+	_, err := p.Stats(nil)
+	c.Check(err, ErrorMatches, "cannot compute PCR values because an error occurred when constructing the profile: .*")
+}
+
+func (s *pcrProfileSuite) TestMinimize(c *C) {
+	// Create a profile with 2 load sequences that produce the same values
+	// for PCR 4, and 3 states for PCR 7 where one is duplicated.
+	p := NewPCRProtectionProfile()
+	p.RootBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 0, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "fw")).
+		AddBranchPoint().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "db1")).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "db2")).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "db1")).
+		EndBranch().
+		EndBranchPoint().
+		AddBranchPoint().
+		AddBranch().
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "shim")).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "kernel")).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 4, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "shim", "kernel")).
+		EndBranch().
+		EndBranchPoint()
+
+	minimized, stats, err := p.Minimize(nil)
+	c.Assert(err, IsNil)
+	c.Check(stats, DeepEquals, &PCRProtectionProfileStats{
+		ComputedBranches: 6,
+		Branches:         2,
+		Depth:            1,
+		ConstantPCRs:     tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{0, 4}}}})
+
+	c.Check(minimized.String(), Equals, fmt.Sprintf(`
+ AddPCRValue(TPM_ALG_SHA256, 0, %[1]x)
+ AddPCRValue(TPM_ALG_SHA256, 4, %[2]x)
+ BranchPoint(
+   Branch 0 {
+    AddPCRValue(TPM_ALG_SHA256, 7, %[3]x)
+   }
+   Branch 1 {
+    AddPCRValue(TPM_ALG_SHA256, 7, %[4]x)
+   }
+ )
+`,
+		tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "fw"),
+		tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "shim", "kernel"),
+		tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "db1"),
+		tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "db2")))
+
+	// The minimized profile has fewer branches.
+	values, err := p.ComputePCRValues(nil)
+	c.Assert(err, IsNil)
+	c.Check(values, HasLen, 6)
+	values, err = minimized.ComputePCRValues(nil)
+	c.Assert(err, IsNil)
+	c.Check(values, HasLen, 2)
+
+	// ... but produces the same policy.
+	expectedPcrs, expectedDigests, err := p.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	pcrs, digests, err := minimized.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Check(err, IsNil)
+	c.Check(pcrs, tpm2_testutil.TPMValueDeepEquals, expectedPcrs)
+	c.Check(digests, DeepEquals, expectedDigests)
+
+	minimizedStats, err := minimized.Stats(nil)
+	c.Check(err, IsNil)
+	c.Check(minimizedStats.ComputedBranches, Equals, 2)
+	c.Check(minimizedStats.Branches, Equals, 2)
+}
+
+func (s *pcrProfileSuite) TestMinimizeSingleBranch(c *C) {
+	p := NewPCRProtectionProfile()
+	p.RootBranch().
+		AddBranchPoint().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+		EndBranch().
+		EndBranchPoint()
+
+	minimized, stats, err := p.Minimize(nil)
+	c.Assert(err, IsNil)
+	c.Check(stats, DeepEquals, &PCRProtectionProfileStats{
+		ComputedBranches: 2,
+		Branches:         1,
+		Depth:            1,
+		ConstantPCRs:     tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}})
+	c.Check(minimized.String(), Equals, fmt.Sprintf(`
+ AddPCRValue(TPM_ALG_SHA256, 7, %x)
+`, tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")))
+
+	expectedPcrs, expectedDigests, err := p.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	pcrs, digests, err := minimized.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Check(err, IsNil)
+	c.Check(pcrs, tpm2_testutil.TPMValueDeepEquals, expectedPcrs)
+	c.Check(digests, DeepEquals, expectedDigests)
+}
+
+func (s *pcrProfileSuite) TestMinimizeInconsistentPCRs(c *C) {
+	p := NewPCRProtectionProfile()
+	p.RootBranch().
+		AddBranchPoint().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make([]byte, 32)).
+		EndBranch().
+		AddBranch().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 8, make([]byte, 32)).
+		EndBranch().
+		EndBranchPoint()
+
+	_, _, err := p.Minimize(nil)
+	c.Check(err, ErrorMatches, "not all branches contain values for the same sets of PCRs")
+}
+
 func (s *pcrProfileSuite) TestAddPCRValueFromTPMFailsWithoutTPM(c *C) {
 	profile := NewPCRProtectionProfile()
 	c.Check(profile.RootBranch().
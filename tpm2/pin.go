@@ -0,0 +1,117 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/secmem"
+)
+
+func (k *sealedKeyDataBase) resetPINLockoutImpl(tpm *tpm2.TPMContext, session tpm2.SessionContext) error {
+	policy, ok := k.data.Policy().(pinKeyDataPolicy)
+	if !ok {
+		return errors.New("key data is not protected by a PIN")
+	}
+
+	if _, err := k.validateData(tpm, session); err != nil {
+		if isKeyDataError(err) {
+			return InvalidKeyDataError{err.Error()}
+		}
+		return xerrors.Errorf("cannot validate key data: %w", err)
+	}
+
+	context, err := policy.PINIndexContext(tpm, session)
+	if err != nil {
+		return xerrors.Errorf("cannot create context for PIN NV index: %w", err)
+	}
+
+	if err := context.ResetWithOwnerAuth(); err != nil {
+		if isAuthFailError(err, tpm2.CommandPolicySecret, 1) {
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot reset PIN retry counter: %w", err)
+	}
+	return nil
+}
+
+// changePIN changes the PIN of the PIN NV index associated with the supplied
+// policy from the PIN derived from oldAuthKey to the one derived from newAuthKey.
+// If the retry limit of the index has already been reached, a PINLockoutError
+// error is returned.
+func changePIN(tpm *tpm2.TPMContext, policy pinKeyDataPolicy, oldAuthKey, newAuthKey []byte, session tpm2.SessionContext) error {
+	context, err := policy.PINIndexContext(tpm, session)
+	if err != nil {
+		return xerrors.Errorf("cannot create context for PIN NV index: %w", err)
+	}
+
+	var oldPIN, newPIN []byte
+	if len(oldAuthKey) > 0 {
+		oldPIN, err = deriveAuthValue(oldAuthKey, context.index.Name().Algorithm().Size())
+		if err != nil {
+			return xerrors.Errorf("cannot derive old PIN: %w", err)
+		}
+		defer secmem.Wipe(oldPIN)
+	}
+	if len(newAuthKey) > 0 {
+		newPIN, err = deriveAuthValue(newAuthKey, context.index.Name().Algorithm().Size())
+		if err != nil {
+			return xerrors.Errorf("cannot derive new PIN: %w", err)
+		}
+		defer secmem.Wipe(newPIN)
+	}
+
+	if err := context.ChangeAuth(oldPIN, newPIN); err != nil {
+		if tpm2.IsTPMError(err, tpm2.ErrorAuthUnavailable, tpm2.CommandNVChangeAuth) {
+			return PINLockoutError{policy.PINIndexHandle()}
+		}
+		return err
+	}
+	return nil
+}
+
+// PINIndexHandle returns the handle of the NV index that implements the PIN for
+// this sealed key, or zero if it was not created with one.
+func (k *SealedKeyData) PINIndexHandle() tpm2.Handle {
+	policy, ok := k.data.Policy().(pinKeyDataPolicy)
+	if !ok {
+		return 0
+	}
+	return policy.PINIndexHandle()
+}
+
+// ResetPINLockout resets the retry counter of the PIN NV index associated with this
+// sealed key, which permits the key to be recovered with its PIN again after
+// PINLockoutError has been returned because of too many incorrect attempts. The PIN
+// and retry limit are not changed.
+//
+// This requires knowledge of the authorization value of the storage hierarchy, which
+// must be set on the owner hierarchy context of the supplied connection. If this is
+// incorrect, a AuthFailError error will be returned.
+//
+// If the sealed key was not created with a PIN NV index, an error will be returned. If
+// validation of the key data fails, a InvalidKeyDataError error will be returned.
+func (k *SealedKeyData) ResetPINLockout(tpm *Connection) error {
+	return k.resetPINLockoutImpl(tpm.TPMContext, tpm.HmacSession())
+}
@@ -0,0 +1,239 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type pinSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *pinSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy |
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *pinSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil), Equals, ErrTPMProvisioningRequiresLockout)
+}
+
+var _ = Suite(&pinSuite{})
+
+// newPINKey creates a key protected by a PIN NV index with the supplied retry limit
+// and sets its PIN.
+func (s *pinSuite) newPINKey(c *C, limit uint32, pin string) (k *secboot.KeyData, key secboot.DiskUnlockKey, authKey secboot.AuxiliaryKey) {
+	key = make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0),
+		PINIndexHandle:         s.NextAvailableHandle(c, 0x0181ff00),
+		PINRetryLimit:          limit}
+
+	k, authKey, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	var kdf testutil.MockKDF
+	c.Assert(k.SetPassphrase(pin, nil, &kdf), IsNil)
+
+	return k, key, authKey
+}
+
+func (s *pinSuite) pinCounterParams(c *C, k *secboot.KeyData) *tpm2.NVPinCounterParams {
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	index, err := s.TPM().CreateResourceContextFromTPM(skd.PINIndexHandle())
+	c.Assert(err, IsNil)
+
+	params, err := s.TPM().NVReadPinCounterParams(s.TPM().OwnerHandleContext(), index, nil)
+	c.Assert(err, IsNil)
+	return params
+}
+
+func (s *pinSuite) TestRecoverKeysWithPIN(c *C) {
+	k, key, authKey := s.newPINKey(c, 3, "1234")
+
+	var kdf testutil.MockKDF
+	keyUnsealed, authKeyUnsealed, err := k.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, authKey)
+
+	c.Check(s.pinCounterParams(c, k), DeepEquals, &tpm2.NVPinCounterParams{Count: 0, Limit: 3})
+}
+
+func (s *pinSuite) TestRecoverKeysWithBadPIN(c *C) {
+	k, key, authKey := s.newPINKey(c, 3, "1234")
+
+	var kdf testutil.MockKDF
+	_, _, err := k.RecoverKeysWithPassphrase("4321", &kdf)
+	c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+	c.Check(s.pinCounterParams(c, k), DeepEquals, &tpm2.NVPinCounterParams{Count: 1, Limit: 3})
+
+	// A successful attempt resets the retry counter.
+	keyUnsealed, authKeyUnsealed, err := k.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, authKey)
+	c.Check(s.pinCounterParams(c, k), DeepEquals, &tpm2.NVPinCounterParams{Count: 0, Limit: 3})
+}
+
+func (s *pinSuite) lockoutCounter(c *C) uint32 {
+	props, err := s.TPM().GetCapabilityTPMProperties(tpm2.PropertyLockoutCounter, 1)
+	c.Assert(err, IsNil)
+	c.Assert(props, HasLen, 1)
+	return props[0].Value
+}
+
+func (s *pinSuite) TestRecoverKeysWithBadPINDoesNotAffectDALockout(c *C) {
+	k, key, authKey := s.newPINKey(c, 5, "1234")
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.Data().Public().Attrs&tpm2.AttrNoDA, Equals, tpm2.AttrNoDA)
+
+	lockoutCounter := s.lockoutCounter(c)
+
+	var kdf testutil.MockKDF
+	for i := 0; i < 4; i++ {
+		_, _, err := k.RecoverKeysWithPassphrase("4321", &kdf)
+		c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+	}
+	c.Check(k.ChangePassphrase("4321", "5678", nil, &kdf), Equals, secboot.ErrInvalidPassphrase)
+	c.Check(s.pinCounterParams(c, k), DeepEquals, &tpm2.NVPinCounterParams{Count: 5, Limit: 5})
+
+	// Incorrect PINs are only counted by the PIN NV index.
+	c.Check(s.lockoutCounter(c), Equals, lockoutCounter)
+
+	c.Check(skd.ResetPINLockout(s.TPM()), IsNil)
+	keyUnsealed, authKeyUnsealed, err := k.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, authKey)
+}
+
+func (s *pinSuite) TestRecoverKeysWithPINLockout(c *C) {
+	k, _, _ := s.newPINKey(c, 2, "1234")
+
+	var kdf testutil.MockKDF
+	for i := 0; i < 2; i++ {
+		_, _, err := k.RecoverKeysWithPassphrase("4321", &kdf)
+		c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+	}
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	_, _, err = k.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Assert(err, testutil.ConvertibleTo, &secboot.PlatformLockoutError{})
+	c.Check(err, testutil.ErrorIs, PINLockoutError{skd.PINIndexHandle()})
+	c.Check(err, ErrorMatches, "the platform's secure device is locked out: the PIN associated with the NV index at handle 0x[[:xdigit:]]{8} "+
+		"is locked out because of too many incorrect attempts")
+}
+
+func (s *pinSuite) TestResetPINLockout(c *C) {
+	k, key, authKey := s.newPINKey(c, 1, "1234")
+
+	var kdf testutil.MockKDF
+	_, _, err := k.RecoverKeysWithPassphrase("4321", &kdf)
+	c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+	_, _, err = k.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, testutil.ConvertibleTo, &secboot.PlatformLockoutError{})
+
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("foo"))
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.ResetPINLockout(s.TPM()), IsNil)
+	c.Check(s.pinCounterParams(c, k), DeepEquals, &tpm2.NVPinCounterParams{Count: 0, Limit: 1})
+
+	// The storage hierarchy can reset the retry counter, but the PIN is still
+	// required to recover the key.
+	_, _, err = k.RecoverKeysWithPassphrase("4321", &kdf)
+	c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+	c.Check(skd.ResetPINLockout(s.TPM()), IsNil)
+
+	keyUnsealed, authKeyUnsealed, err := k.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, authKey)
+}
+
+func (s *pinSuite) TestResetPINLockoutWrongOwnerAuth(c *C) {
+	k, _, _ := s.newPINKey(c, 1, "1234")
+
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("foo"))
+	s.TPM().OwnerHandleContext().SetAuthValue([]byte("bar"))
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	err = skd.ResetPINLockout(s.TPM())
+	c.Check(err, Equals, AuthFailError{tpm2.HandleOwner})
+}
+
+func (s *pinSuite) TestResetPINLockoutNoPIN(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0)}
+
+	k, _, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.PINIndexHandle(), Equals, tpm2.Handle(0))
+	c.Check(skd.ResetPINLockout(s.TPM()), ErrorMatches, "key data is not protected by a PIN")
+}
+
+func (s *pinSuite) TestChangePIN(c *C) {
+	k, key, authKey := s.newPINKey(c, 3, "1234")
+
+	var kdf testutil.MockKDF
+	c.Check(k.ChangePassphrase("1234", "5678", nil, &kdf), IsNil)
+
+	_, _, err := k.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, Equals, secboot.ErrInvalidPassphrase)
+
+	keyUnsealed, authKeyUnsealed, err := k.RecoverKeysWithPassphrase("5678", &kdf)
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, authKey)
+}
@@ -36,6 +36,7 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/secmem"
 	"github.com/snapcore/secboot/internal/tcg"
 )
 
@@ -95,16 +96,22 @@ func (h *platformKeyDataHandler) recoverKeysCommon(data *secboot.PlatformKeyData
 		if err != nil {
 			return nil, xerrors.Errorf("cannot derive auth value: %w", err)
 		}
+		defer secmem.Wipe(authValue)
 	}
 
 	symKey, err := k.unsealDataFromTPM(tpm.TPMContext, authValue, tpm.HmacSession())
 	if err != nil {
 		var e InvalidKeyDataError
+		var pinErr PINLockoutError
 		switch {
 		case xerrors.As(err, &e):
 			return nil, &secboot.PlatformHandlerError{
 				Type: secboot.PlatformHandlerErrorInvalidData,
 				Err:  errors.New(e.msg)}
+		case xerrors.As(err, &pinErr):
+			return nil, &secboot.PlatformHandlerError{
+				Type: secboot.PlatformHandlerErrorLockout,
+				Err:  pinErr}
 		case err == ErrTPMProvisioning:
 			return nil, &secboot.PlatformHandlerError{
 				Type: secboot.PlatformHandlerErrorUninitialized,
@@ -113,13 +120,15 @@ func (h *platformKeyDataHandler) recoverKeysCommon(data *secboot.PlatformKeyData
 			return nil, &secboot.PlatformHandlerError{
 				Type: secboot.PlatformHandlerErrorUnavailable,
 				Err:  err}
-		case tpm2.IsTPMSessionError(err, tpm2.ErrorAuthFail, tpm2.CommandUnseal, 1):
+		case tpm2.IsTPMSessionError(err, tpm2.ErrorAuthFail, tpm2.CommandUnseal, 1),
+			tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, tpm2.CommandPolicySecret, 1):
 			return nil, &secboot.PlatformHandlerError{
 				Type: secboot.PlatformHandlerErrorInvalidAuthKey,
 				Err:  err}
 		}
 		return nil, xerrors.Errorf("cannot unseal key: %w", err)
 	}
+	defer secmem.Wipe(symKey)
 
 	if len(symKey) != 32+aes.BlockSize {
 		return nil, &secboot.PlatformHandlerError{
@@ -185,6 +194,26 @@ func (h *platformKeyDataHandler) ChangeAuthKey(handle, old, new []byte) ([]byte,
 		return nil, xerrors.Errorf("cannot validate key data: %w", err)
 	}
 
+	if policy, ok := k.data.Policy().(pinKeyDataPolicy); ok {
+		// The PIN is the authorization value of the PIN NV index rather
+		// than the sealed object, so the key data doesn't change.
+		if err := changePIN(tpm.TPMContext, policy, old, new, tpm.HmacSession()); err != nil {
+			var pinErr PINLockoutError
+			switch {
+			case xerrors.As(err, &pinErr):
+				return nil, &secboot.PlatformHandlerError{
+					Type: secboot.PlatformHandlerErrorLockout,
+					Err:  pinErr}
+			case tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, tpm2.CommandNVChangeAuth, 1):
+				return nil, &secboot.PlatformHandlerError{
+					Type: secboot.PlatformHandlerErrorInvalidAuthKey,
+					Err:  err}
+			}
+			return nil, xerrors.Errorf("cannot change PIN: %w", err)
+		}
+		return json.Marshal(k)
+	}
+
 	srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
 	switch {
 	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
@@ -255,6 +284,22 @@ func (h *platformKeyDataHandler) ChangeAuthKey(handle, old, new []byte) ([]byte,
 	return newHandle, nil
 }
 
+func (h *platformKeyDataHandler) InspectHandle(handle []byte) (map[string]interface{}, error) {
+	var k *SealedKeyData
+	if err := json.Unmarshal(handle, &k); err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err}
+	}
+	if k == nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  errors.New("no handle")}
+	}
+
+	return inspectKeyData(k.data), nil
+}
+
 func init() {
 	secboot.RegisterPlatformKeyDataHandler(platformName, &platformKeyDataHandler{})
 }
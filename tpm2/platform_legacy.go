@@ -30,6 +30,7 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/secmem"
 )
 
 const legacyPlatformName = "tpm2-legacy"
@@ -85,6 +86,8 @@ func (h *legacyPlatformKeyDataHandler) RecoverKeys(data *secboot.PlatformKeyData
 		}
 		return nil, xerrors.Errorf("cannot unseal key: %w", err)
 	}
+	defer secmem.Wipe(key)
+	defer secmem.Wipe(authKey)
 
 	return secboot.MarshalKeys(key, authKey), nil
 }
@@ -97,6 +100,28 @@ func (h *legacyPlatformKeyDataHandler) ChangeAuthKey(handle, old, new []byte) ([
 	return nil, fmt.Errorf("passphrase authentication is not supported for the %s platform", legacyPlatformName)
 }
 
+func (h *legacyPlatformKeyDataHandler) InspectHandle(handle []byte) (map[string]interface{}, error) {
+	var b []byte
+	if err := json.Unmarshal(handle, &b); err != nil {
+		return nil, &secboot.PlatformHandlerError{
+			Type: secboot.PlatformHandlerErrorInvalidData,
+			Err:  err}
+	}
+
+	k, err := ReadSealedKeyObject(bytes.NewReader(b))
+	if err != nil {
+		var e InvalidKeyDataError
+		if xerrors.As(err, &e) {
+			return nil, &secboot.PlatformHandlerError{
+				Type: secboot.PlatformHandlerErrorInvalidData,
+				Err:  err}
+		}
+		return nil, xerrors.Errorf("cannot read key object: %w", err)
+	}
+
+	return inspectKeyData(k.data), nil
+}
+
 // NewKeyDataFromSealedKeyObjectFile creates a secboot.KeyData for the TPM
 // sealed key object at the supplied path, in order to enable keys to be
 // recovered from the TPM sealed key object using the secboot.KeyData API.
@@ -26,6 +26,7 @@ import (
 	"syscall"
 
 	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
 
 	. "gopkg.in/check.v1"
 
@@ -74,6 +75,27 @@ func (s *platformLegacySuite) TestRecoverKeys(c *C) {
 	c.Check(recoveredAuthPrivateKey, DeepEquals, secboot.AuxiliaryKey(authPrivateKey))
 }
 
+func (s *platformLegacySuite) TestInspect(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+	keyFile := filepath.Join(c.MkDir(), "keydata")
+
+	_, err := SealKeyToTPM(s.TPM(), key, keyFile, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Check(err, IsNil)
+
+	k, err := NewKeyDataFromSealedKeyObjectFile(keyFile)
+	c.Assert(err, IsNil)
+
+	info, err := k.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.PlatformName, Equals, "tpm2-legacy")
+	c.Check(info.Platform["version"], Equals, uint32(1))
+	c.Check(info.Platform["pcr_policy_counter_handle"], Equals, tpm2.HandleNull)
+	c.Check(info.Platform["pcr_selection"], tpm2_testutil.TPMValueDeepEquals, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}})
+}
+
 func (s *platformLegacySuite) TestRecoverKeysNoTPMConnection(c *C) {
 	key := make(secboot.DiskUnlockKey, 32)
 	rand.Read(key)
@@ -26,6 +26,7 @@ import (
 	"syscall"
 
 	"github.com/canonical/go-tpm2"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
 
 	. "gopkg.in/check.v1"
 
@@ -510,3 +511,36 @@ func (s *platformSuite) TestChangeAuthKeyWithIncorrectAuthKey(c *C) {
 	c.Check(err, ErrorMatches, "TPM returned an error for session 1 whilst executing command TPM_CC_ObjectChangeAuth: "+
 		"TPM_RC_AUTH_FAIL \\(the authorization HMAC check failed and DA counter incremented\\)")
 }
+
+func (s *platformSuite) TestInspect(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	handle := s.NextAvailableHandle(c, 0x0181fff0)
+	k, _, err := ProtectKeyWithTPM(s.TPM(), key, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 12}),
+		PCRPolicyCounterHandle: handle})
+	c.Assert(err, IsNil)
+
+	info, err := k.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.PlatformName, Equals, "tpm2")
+	c.Check(info.Platform["version"], Equals, uint32(3))
+	c.Check(info.Platform["pcr_policy_counter_handle"], Equals, handle)
+	c.Check(info.Platform, testutil.HasKey, "pcr_policy_sequence")
+	c.Check(info.Platform["pcr_selection"], tpm2_testutil.TPMValueDeepEquals, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 12}}})
+}
+
+func (s *platformSuite) TestInspectNoPCRPolicyCounter(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	k, _, err := ProtectKeyWithTPM(s.TPM(), key, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	info, err := k.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.Platform["pcr_policy_counter_handle"], Equals, tpm2.HandleNull)
+}
@@ -102,6 +102,12 @@ type keyDataPolicy interface {
 
 	PCRPolicySequence() uint64 // Current sequence of PCR policy for revocation
 
+	PCRSelection() tpm2.PCRSelectionList // PCRs included in the current PCR policy
+
+	// AcceptsPCRValues indicates whether the supplied PCR values satisfy the
+	// PCR assertions of the current PCR policy, without the use of a TPM.
+	AcceptsPCRValues(alg tpm2.HashAlgorithmId, values tpm2.PCRValues) (bool, error)
+
 	// UpdatePCRPolicy updates the PCR policy associated with this keyDataPolicy.
 	UpdatePCRPolicy(alg tpm2.HashAlgorithmId, params *pcrPolicyParams) error
 
@@ -126,6 +132,43 @@ type keyDataPolicy interface {
 	ValidateAuthKey(key secboot.AuxiliaryKey) error
 }
 
+// pcrPolicyIndexContext corresponds to a NV index that stores the digest of
+// the authorized PCR policy.
+type pcrPolicyIndexContext interface {
+	Get() (tpm2.Digest, error)                                // Return the digest of the authorized PCR policy
+	Write(digest tpm2.Digest, key secboot.AuxiliaryKey) error // Authorize the supplied PCR policy digest using the supplied key for authorization
+}
+
+// nvAuthorizedKeyDataPolicy is implemented by keyDataPolicy implementations
+// that authorize PCR policies by storing their digest in a NV index.
+type nvAuthorizedKeyDataPolicy interface {
+	keyDataPolicy
+
+	PCRPolicyDigest() tpm2.Digest // Digest of the current PCR policy
+
+	// PCRPolicyIndexContext returns a context for the PCR policy NV index
+	// associated with this keyDataPolicy. The supplied public area must match
+	// the public area of the NV index associated with this policy.
+	PCRPolicyIndexContext(tpm *tpm2.TPMContext, pub *tpm2.NVPublic, session tpm2.SessionContext) (pcrPolicyIndexContext, error)
+}
+
+// pinKeyDataPolicy is implemented by keyDataPolicy implementations that
+// require knowledge of a PIN, with a retry limit that is enforced by a PIN
+// NV index and is independent of the TPM's dictionary attack protection.
+type pinKeyDataPolicy interface {
+	keyDataPolicy
+
+	PINIndexHandle() tpm2.Handle // Handle of the PIN NV index
+
+	// PINIndexContext returns a context for the PIN NV index associated
+	// with this keyDataPolicy.
+	PINIndexContext(tpm *tpm2.TPMContext, session tpm2.SessionContext) (*pinIndexContext, error)
+
+	// ExecutePINPolicy verifies the supplied PIN with the PIN NV index
+	// and records this in the supplied authorization policy session.
+	ExecutePINPolicy(tpm *tpm2.TPMContext, pin tpm2.Auth, policySession, hmacSession tpm2.SessionContext) error
+}
+
 func createPcrPolicyCounterImpl(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKey *tpm2.Public, computeAuthPolicies func(tpm2.HashAlgorithmId, tpm2.Name) tpm2.DigestList, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, uint64, error) {
 	nameAlg := tpm2.HashAlgorithmSHA256
 
@@ -302,6 +345,18 @@ func newKeyDataPolicyLegacy(alg tpm2.HashAlgorithmId, key *tpm2.Public, pcrPolic
 			PolicySequence: pcrPolicySequence}}, trial.GetDigest(), nil
 }
 
+// policyOrTreeDepth returns the depth of the tree that newPolicyOrTree will
+// create for the specified number of digests, which is the number of PolicyOR
+// assertions executed in order to satisfy the policy.
+func policyOrTreeDepth(numDigests int) int {
+	depth := 1
+	for numDigests > 8 {
+		numDigests = (numDigests + 7) / 8
+		depth++
+	}
+	return depth
+}
+
 // newPolicyOrTree creates a new policyOrTree from the supplied digests
 // for creating a policy that can be satisified by multiple conditions. It also
 // extends the supplied trial policy.
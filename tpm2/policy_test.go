@@ -124,6 +124,7 @@ func (s *policySuiteNoTPM) testNewPolicyOrTree(c *C, data *testNewPolicyOrTreeDa
 	policy, depth := s.checkPolicyOrTree(c, data.alg, data.digests, tree)
 	c.Check(policy, DeepEquals, data.expected)
 	c.Check(depth, Equals, data.depth)
+	c.Check(PolicyOrTreeDepth(len(data.digests)), Equals, data.depth)
 }
 
 func (s *policySuiteNoTPM) TestNewPolicyOrTreeSingleDigest(c *C) {
@@ -323,6 +323,31 @@ func (d *pcrPolicyData_v0) executePcrAssertions(tpm *tpm2.TPMContext, session tp
 	return nil
 }
 
+// acceptsPCRValues computes the session digest that would result from the
+// PolicyPCR assertion executed with the supplied PCR values, and indicates
+// whether it appears in one of the leaf nodes of the PolicyOR tree.
+func (d *pcrPolicyData_v0) acceptsPCRValues(alg tpm2.HashAlgorithmId, values tpm2.PCRValues) (bool, error) {
+	pcrDigest, err := util.ComputePCRDigest(alg, d.Selection, values)
+	if err != nil {
+		return false, xerrors.Errorf("cannot compute PCR digest: %w", err)
+	}
+
+	trial := util.ComputeAuthPolicy(alg)
+	trial.PolicyPCR(pcrDigest, d.Selection)
+	digest := trial.GetDigest()
+
+	tree, err := d.OrData.resolve()
+	if err != nil {
+		return false, policyDataError{xerrors.Errorf("cannot resolve PolicyOR tree: %w", err)}
+	}
+	for _, n := range tree.leafNodes {
+		if n.contains(digest) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (d *pcrPolicyData_v0) executeRevocationCheck(tpm *tpm2.TPMContext, counter tpm2.ResourceContext, policySession, revocationCheckSession tpm2.SessionContext) error {
 	operandB := make([]byte, 8)
 	binary.BigEndian.PutUint64(operandB, d.PolicySequence)
@@ -356,6 +381,14 @@ func (p *keyDataPolicy_v0) PCRPolicySequence() uint64 {
 	return p.PCRData.PolicySequence
 }
 
+func (p *keyDataPolicy_v0) PCRSelection() tpm2.PCRSelectionList {
+	return p.PCRData.Selection
+}
+
+func (p *keyDataPolicy_v0) AcceptsPCRValues(alg tpm2.HashAlgorithmId, values tpm2.PCRValues) (bool, error) {
+	return p.PCRData.acceptsPCRValues(alg, values)
+}
+
 // UpdatePCRPolicy updates the PCR policy associated with this keyDataPolicy. The PCR policy asserts
 // that the following are true:
 //   - The selected PCRs contain expected values - ie, one of the sets of permitted values specified by
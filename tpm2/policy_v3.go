@@ -85,6 +85,14 @@ func (p *keyDataPolicy_v3) PCRPolicySequence() uint64 {
 	return p.PCRData.PolicySequence
 }
 
+func (p *keyDataPolicy_v3) PCRSelection() tpm2.PCRSelectionList {
+	return p.PCRData.Selection
+}
+
+func (p *keyDataPolicy_v3) AcceptsPCRValues(alg tpm2.HashAlgorithmId, values tpm2.PCRValues) (bool, error) {
+	return p.PCRData.acceptsPCRValues(alg, values)
+}
+
 // UpdatePCRPolicy updates the PCR policy associated with this keyDataPolicy. The PCR policy asserts
 // that the following are true:
 //   - The selected PCRs contain expected values - ie, one of the sets of permitted values specified by
@@ -132,6 +140,25 @@ func (p *keyDataPolicy_v3) SetPCRPolicyFrom(src keyDataPolicy) {
 }
 
 func (p *keyDataPolicy_v3) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession, hmacSession tpm2.SessionContext) error {
+	if err := p.executeAuthorizedPcrPolicy(tpm, policySession); err != nil {
+		return err
+	}
+
+	// For metadata versions > 0, PIN support was implemented by requiring knowlege of the authorization value for
+	// the sealed key object when this policy session is used to unseal it, although this support was never
+	// used and has been removed.
+	// XXX: This mechanism will be re-used as part of the passphrase integration in the future, although the
+	//  authorization value will be a passphrase derived key.
+	if err := tpm.PolicyAuthValue(policySession); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// executeAuthorizedPcrPolicy executes the PCR policy and the revocation check, and
+// then the PolicyAuthorize assertion that authorizes it.
+func (p *keyDataPolicy_v3) executeAuthorizedPcrPolicy(tpm *tpm2.TPMContext, policySession tpm2.SessionContext) error {
 	if err := p.PCRData.executePcrAssertions(tpm, policySession); err != nil {
 		return xerrors.Errorf("cannot execute PCR assertions: %w", err)
 	}
@@ -194,15 +221,6 @@ func (p *keyDataPolicy_v3) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession,
 		return err
 	}
 
-	// For metadata versions > 0, PIN support was implemented by requiring knowlege of the authorization value for
-	// the sealed key object when this policy session is used to unseal it, although this support was never
-	// used and has been removed.
-	// XXX: This mechanism will be re-used as part of the passphrase integration in the future, although the
-	//  authorization value will be a passphrase derived key.
-	if err := tpm.PolicyAuthValue(policySession); err != nil {
-		return err
-	}
-
 	return nil
 }
 
@@ -280,12 +298,19 @@ func (p *keyDataPolicy_v3) PCRPolicyCounterContext(tpm *tpm2.TPMContext, pub *tp
 }
 
 func (p *keyDataPolicy_v3) ValidateAuthKey(key secboot.AuxiliaryKey) error {
-	priv, err := deriveV3PolicyAuthKey(p.StaticData.AuthPublicKey.NameAlg.GetHash(), key)
+	return validateV3PolicyAuthKey(p.StaticData.AuthPublicKey, key)
+}
+
+// validateV3PolicyAuthKey verifies that the supplied key is the one that the
+// supplied public key for verifying dynamic authorization policies was
+// derived from.
+func validateV3PolicyAuthKey(authPublicKey *tpm2.Public, key secboot.AuxiliaryKey) error {
+	priv, err := deriveV3PolicyAuthKey(authPublicKey.NameAlg.GetHash(), key)
 	if err != nil {
 		return xerrors.Errorf("cannot derive private key: %w", err)
 	}
 
-	pub, ok := p.StaticData.AuthPublicKey.Public().(*ecdsa.PublicKey)
+	pub, ok := authPublicKey.Public().(*ecdsa.PublicKey)
 	if !ok {
 		return policyDataError{errors.New("unexpected dynamic authorization policy public key type")}
 	}
@@ -312,6 +312,111 @@ func (s *policyV3SuiteNoTPM) TestSetPCRPolicyFrom(c *C) {
 	c.Check(policyData2.(*KeyDataPolicy_v3).PCRData, DeepEquals, policyData1.PCRData)
 }
 
+type testV3AcceptsPCRValuesData struct {
+	alg       tpm2.HashAlgorithmId
+	pcrs      tpm2.PCRSelectionList
+	pcrValues []tpm2.PCRValues
+
+	values   tpm2.PCRValues
+	expected bool
+}
+
+func (s *policyV3SuiteNoTPM) testAcceptsPCRValues(c *C, data *testV3AcceptsPCRValuesData) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+
+	var pcrDigests tpm2.DigestList
+	for _, v := range data.pcrValues {
+		digest, err := util.ComputePCRDigest(data.alg, data.pcrs, v)
+		c.Assert(err, IsNil)
+		pcrDigests = append(pcrDigests, digest)
+	}
+
+	var policyData KeyDataPolicy = &KeyDataPolicy_v3{
+		StaticData: &StaticPolicyData_v3{
+			AuthPublicKey: s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)},
+		PCRData: &PcrPolicyData_v3{}}
+	c.Check(policyData.UpdatePCRPolicy(data.alg, NewPcrPolicyParams(key, data.pcrs, pcrDigests, nil)), IsNil)
+
+	ok, err := policyData.AcceptsPCRValues(data.alg, data.values)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, data.expected)
+}
+
+func (s *policyV3SuiteNoTPM) TestAcceptsPCRValues(c *C) {
+	values := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: hash(crypto.SHA256, "foo"), 12: hash(crypto.SHA256, "bar")}}
+	s.testAcceptsPCRValues(c, &testV3AcceptsPCRValuesData{
+		alg:       tpm2.HashAlgorithmSHA256,
+		pcrs:      tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 12}}},
+		pcrValues: []tpm2.PCRValues{values},
+		values:    values,
+		expected:  true})
+}
+
+func (s *policyV3SuiteNoTPM) TestAcceptsPCRValuesRejected(c *C) {
+	s.testAcceptsPCRValues(c, &testV3AcceptsPCRValuesData{
+		alg:  tpm2.HashAlgorithmSHA256,
+		pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 12}}},
+		pcrValues: []tpm2.PCRValues{
+			{tpm2.HashAlgorithmSHA256: {7: hash(crypto.SHA256, "foo"), 12: hash(crypto.SHA256, "bar")}}},
+		values:   tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: hash(crypto.SHA256, "foo"), 12: hash(crypto.SHA256, "baz")}},
+		expected: false})
+}
+
+func (s *policyV3SuiteNoTPM) TestAcceptsPCRValuesIgnoresUnselectedPCRs(c *C) {
+	s.testAcceptsPCRValues(c, &testV3AcceptsPCRValuesData{
+		alg:  tpm2.HashAlgorithmSHA256,
+		pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 12}}},
+		pcrValues: []tpm2.PCRValues{
+			{tpm2.HashAlgorithmSHA256: {7: hash(crypto.SHA256, "foo"), 12: hash(crypto.SHA256, "bar")}}},
+		values: tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+			4:  hash(crypto.SHA256, "xyz"),
+			7:  hash(crypto.SHA256, "foo"),
+			12: hash(crypto.SHA256, "bar")}},
+		expected: true})
+}
+
+func (s *policyV3SuiteNoTPM) TestAcceptsPCRValuesDepth1(c *C) {
+	var pcrValues []tpm2.PCRValues
+	for i := 0; i < 20; i++ {
+		pcrValues = append(pcrValues, tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+			7:  hash(crypto.SHA256, "foo"),
+			12: hash(crypto.SHA256, strconv.Itoa(i))}})
+	}
+	s.testAcceptsPCRValues(c, &testV3AcceptsPCRValuesData{
+		alg:       tpm2.HashAlgorithmSHA256,
+		pcrs:      tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 12}}},
+		pcrValues: pcrValues,
+		values:    pcrValues[17],
+		expected:  true})
+}
+
+func (s *policyV3SuiteNoTPM) TestAcceptsPCRValuesSHA1(c *C) {
+	values := tpm2.PCRValues{tpm2.HashAlgorithmSHA1: {7: hash(crypto.SHA1, "foo"), 12: hash(crypto.SHA1, "bar")}}
+	s.testAcceptsPCRValues(c, &testV3AcceptsPCRValuesData{
+		alg:       tpm2.HashAlgorithmSHA1,
+		pcrs:      tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA1, Select: []int{7, 12}}},
+		pcrValues: []tpm2.PCRValues{values},
+		values:    values,
+		expected:  true})
+}
+
+func (s *policyV3SuiteNoTPM) TestAcceptsPCRValuesMissingPCR(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 12}}}
+
+	var policyData KeyDataPolicy = &KeyDataPolicy_v3{
+		StaticData: &StaticPolicyData_v3{
+			AuthPublicKey: s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)},
+		PCRData: &PcrPolicyData_v3{}}
+	c.Check(policyData.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, NewPcrPolicyParams(key, pcrs, tpm2.DigestList{hash(crypto.SHA256, "1")}, nil)), IsNil)
+
+	_, err := policyData.AcceptsPCRValues(tpm2.HashAlgorithmSHA256, tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: hash(crypto.SHA256, "foo")}})
+	c.Check(err, ErrorMatches, "cannot compute PCR digest: .*")
+}
+
 type testV3ExecutePCRPolicyData struct {
 	authKeyNameAlg      tpm2.HashAlgorithmId
 	policyCounterHandle tpm2.Handle
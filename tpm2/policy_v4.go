@@ -0,0 +1,402 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// computeV4PcrPolicyIndexAuthPolicy computes the authorization policy digest for a PCR
+// policy NV index that can be updated with the key associated with updateKeyName. This
+// has a single branch that permits TPM2_NV_Write with a signed authorization, which is
+// bound to the command parameters with a cpHash. Unlike a PCR policy counter, there is
+// no branch for initializing the index without a signed authorization.
+func computeV4PcrPolicyIndexAuthPolicy(alg tpm2.HashAlgorithmId, updateKeyName tpm2.Name) tpm2.Digest {
+	trial := util.ComputeAuthPolicy(alg)
+	trial.PolicySigned(updateKeyName, nil)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	return trial.GetDigest()
+}
+
+// pcrPolicyIndexAttrs are the attributes of a PCR policy NV index, excluding
+// AttrNVWritten.
+const pcrPolicyIndexAttrs = tpm2.NVAttributes(tpm2.NVTypeOrdinary) | tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA
+
+// pcrPolicyIndexSize is the size of a PCR policy NV index, which contains a
+// SHA-256 TPMT_HA.
+var pcrPolicyIndexSize = len(mu.MustMarshalToBytes(tpm2.MakeTaggedHash(tpm2.HashAlgorithmSHA256, initialPcrPolicyIndexDigest)))
+
+// computePolicyAuthorizeNVDigest computes the policy digest that results from
+// a TPM2_PolicyAuthorizeNV assertion for the NV index with the supplied name.
+// The assertion resets the session digest, so this doesn't depend on any
+// previous assertions.
+func computePolicyAuthorizeNVDigest(alg tpm2.HashAlgorithmId, nvIndexName tpm2.Name) tpm2.Digest {
+	h := alg.NewHash()
+	h.Write(make([]byte, alg.Size()))
+	binary.Write(h, binary.BigEndian, tpm2.CommandPolicyAuthorizeNV)
+	h.Write(nvIndexName)
+	return h.Sum(nil)
+}
+
+// policyAuthorizeNV executes a TPM2_PolicyAuthorizeNV assertion, which isn't
+// provided by go-tpm2. This asserts that the current digest of policySession
+// matches the TPMT_HA stored in the NV index associated with nvIndex, and then
+// resets the session digest to one that depends only on the name of the NV
+// index.
+func policyAuthorizeNV(tpm *tpm2.TPMContext, authContext, nvIndex tpm2.ResourceContext, policySession, authContextAuthSession tpm2.SessionContext, sessions ...tpm2.SessionContext) error {
+	return tpm.StartCommand(tpm2.CommandPolicyAuthorizeNV).
+		AddHandles(tpm2.UseResourceContextWithAuth(authContext, authContextAuthSession), tpm2.UseHandleContext(nvIndex), tpm2.UseHandleContext(policySession)).
+		AddExtraSessions(sessions...).
+		Run(nil)
+}
+
+// initialPcrPolicyIndexDigest is the value that a PCR policy NV index is
+// initialized with before the first PCR policy is written to it. It isn't
+// the output of any policy session.
+var initialPcrPolicyIndexDigest = bytes.Repeat([]byte{0xff}, 32)
+
+// createPcrPolicyIndexImpl creates and initializes a NV index that is associated with a sealed key
+// object and stores the digest of the authorized PCR policy.
+func createPcrPolicyIndexImpl(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKey *tpm2.Public, key secboot.AuxiliaryKey, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	nameAlg := tpm2.HashAlgorithmSHA256
+
+	// Define the NV index
+	public := &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    nameAlg,
+		Attrs:      pcrPolicyIndexAttrs,
+		AuthPolicy: computeV4PcrPolicyIndexAuthPolicy(nameAlg, updateKey.Name()),
+		Size:       uint16(pcrPolicyIndexSize)}
+
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, hmacSession)
+	if err != nil {
+		return nil, err
+	}
+
+	// NVDefineSpace was integrity protected, so we know that we have an index with the expected public area at the handle we specified
+	// at this point.
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, hmacSession)
+	}()
+
+	// Initialize the index with a signed authorization, so that its name is
+	// the one that PCR policies are authorized with.
+	context := &pcrPolicyIndexContext_v4{
+		tpm:       tpm,
+		index:     index,
+		size:      public.Size,
+		session:   hmacSession,
+		updateKey: updateKey}
+	if err := context.Write(initialPcrPolicyIndexDigest, key); err != nil {
+		return nil, err
+	}
+
+	// The index has a different name now that it has been written, so update the public area we return so that it can be used
+	// to construct an authorization policy.
+	public.Attrs |= tpm2.AttrNVWritten
+
+	succeeded = true
+	return public, nil
+}
+
+// createPcrPolicyIndex creates and initializes a NV index that is associated with a sealed key object
+// and stores the digest of its authorized PCR policy, for use with TPM2_PolicyAuthorizeNV.
+//
+// The NV index will be created with attributes that allow anyone to read the index, and an authorization
+// policy that only permits TPM2_NV_Write with a signed authorization that is bound to the data being
+// written. The index is initialized using the supplied key, which must correspond to updateKey. The caller
+// must ensure that the updateKey argument is a valid public key.
+var createPcrPolicyIndex = createPcrPolicyIndexImpl
+
+// newKeyDataPolicyV4 creates a keyDataPolicy containing a static authorization policy that asserts:
+//   - The PCR policy has been satisfied and its digest matches the digest stored in the supplied NV
+//     index (by way of a PolicyAuthorizeNV assertion, which allows the PCR policy to be updated
+//     without creating a new sealed key object).
+//   - Knowledge of the the authorization value for the entity on which the policy session is used has been
+//     demonstrated by the caller.
+//
+// Updating the PCR policy automatically revokes the previous one, so no PCR policy counter is used. The
+// caller must ensure that the pcrPolicyIndexPub argument is valid.
+//
+// The key argument must be created with newPolicyAuthPublicKey.
+//
+// This returns some policy metadata and a policy digest which is used as the auth policy field of the
+// protected object.
+func newKeyDataPolicyV4(alg tpm2.HashAlgorithmId, key *tpm2.Public, pcrPolicyIndexPub *tpm2.NVPublic) (keyDataPolicy, tpm2.Digest, error) {
+	if pcrPolicyIndexPub == nil {
+		return nil, nil, errors.New("no PCR policy NV index supplied")
+	}
+
+	trial := util.ComputeAuthPolicy(alg)
+	trial.SetDigest(computePolicyAuthorizeNVDigest(alg, pcrPolicyIndexPub.Name()))
+	trial.PolicyAuthValue()
+
+	return &keyDataPolicy_v4{
+		StaticData: &staticPolicyData_v4{
+			AuthPublicKey:        key,
+			PCRPolicyIndexHandle: pcrPolicyIndexPub.Index},
+		PCRData: &pcrPolicyData_v4{
+			// Set AuthorizedPolicySignature here because this object needs to be
+			// serializable. It isn't used by v4.
+			AuthorizedPolicySignature: &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}}}, trial.GetDigest(), nil
+}
+
+// staticPolicyData_v4 represents version 4 of the metadata for executing a
+// policy session that never changes for the life of a key.
+type staticPolicyData_v4 struct {
+	AuthPublicKey        *tpm2.Public
+	PCRPolicyIndexHandle tpm2.Handle
+}
+
+// pcrPolicyData_v4 represents version 4 of the PCR policy metadata for
+// executing a policy session, and can be updated. It has the same format
+// as version 3, although the AuthorizedPolicySignature field is unused.
+type pcrPolicyData_v4 = pcrPolicyData_v3
+
+// keyDataPolicy_v4 represents version 4 of the metadata for executing a
+// policy session.
+type keyDataPolicy_v4 struct {
+	StaticData *staticPolicyData_v4
+	PCRData    *pcrPolicyData_v4
+}
+
+// PCRPolicyCounterHandle returns the handle of the NV index that stores the
+// digest of the authorized PCR policy.
+func (p *keyDataPolicy_v4) PCRPolicyCounterHandle() tpm2.Handle {
+	return p.StaticData.PCRPolicyIndexHandle
+}
+
+func (p *keyDataPolicy_v4) PCRPolicySequence() uint64 {
+	return p.PCRData.PolicySequence
+}
+
+func (p *keyDataPolicy_v4) PCRSelection() tpm2.PCRSelectionList {
+	return p.PCRData.Selection
+}
+
+func (p *keyDataPolicy_v4) AcceptsPCRValues(alg tpm2.HashAlgorithmId, values tpm2.PCRValues) (bool, error) {
+	return p.PCRData.acceptsPCRValues(alg, values)
+}
+
+// UpdatePCRPolicy updates the PCR policy associated with this keyDataPolicy. The PCR policy asserts
+// that the selected PCRs contain expected values - ie, one of the sets of permitted values specified
+// by the caller to this function, indicating that the device is in an expected state. This is done by
+// a single PolicyPCR assertion and then one or more PolicyOR assertions (depending on how many sets of
+// permitted PCR values there are).
+//
+// This only updates the metadata. The computed PCR policy digest only becomes authorized once it is
+// written to the PCR policy NV index with the context returned from PCRPolicyIndexContext, which also
+// revokes the previous PCR policy.
+func (p *keyDataPolicy_v4) UpdatePCRPolicy(alg tpm2.HashAlgorithmId, params *pcrPolicyParams) error {
+	pcrData := p.PCRData.new(params)
+
+	trial := util.ComputeAuthPolicy(alg)
+	if err := pcrData.addPcrAssertions(alg, trial, params.pcrDigests); err != nil {
+		return xerrors.Errorf("cannot compute base PCR policy: %w", err)
+	}
+
+	pcrData.AuthorizedPolicy = trial.GetDigest()
+	pcrData.AuthorizedPolicySignature = &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}
+
+	p.PCRData = pcrData
+	return nil
+}
+
+// PCRPolicyDigest returns the digest of the current PCR policy, which is
+// authorized when it is written to the PCR policy NV index.
+func (p *keyDataPolicy_v4) PCRPolicyDigest() tpm2.Digest {
+	return p.PCRData.AuthorizedPolicy
+}
+
+func (p *keyDataPolicy_v4) SetPCRPolicyFrom(src keyDataPolicy) {
+	p.PCRData = src.(*keyDataPolicy_v4).PCRData
+}
+
+func (p *keyDataPolicy_v4) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession, hmacSession tpm2.SessionContext) error {
+	if err := p.PCRData.executePcrAssertions(tpm, policySession); err != nil {
+		return xerrors.Errorf("cannot execute PCR assertions: %w", err)
+	}
+
+	pcrPolicyIndexHandle := p.StaticData.PCRPolicyIndexHandle
+	if pcrPolicyIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+		return policyDataError{fmt.Errorf("invalid handle %v for PCR policy NV index", pcrPolicyIndexHandle)}
+	}
+
+	pcrPolicyIndex, err := tpm.CreateResourceContextFromTPM(pcrPolicyIndexHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, pcrPolicyIndexHandle):
+		// If there is no NV index at the expected handle then the key file is invalid and must be recreated.
+		return policyDataError{errors.New("no PCR policy NV index found")}
+	case err != nil:
+		return err
+	}
+
+	if err := policyAuthorizeNV(tpm, pcrPolicyIndex, pcrPolicyIndex, policySession, nil); err != nil {
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorValue, tpm2.CommandPolicyAuthorizeNV),
+			tpm2.IsTPMError(err, tpm2.ErrorHash, tpm2.CommandPolicyAuthorizeNV):
+			// The PCR policy doesn't match the one stored in the NV index,
+			// either because it has been revoked or it was never authorized.
+			return policyDataError{errors.New("the PCR policy is not authorized")}
+		case tpm2.IsTPMHandleError(err, tpm2.AnyErrorCode, tpm2.CommandPolicyAuthorizeNV, 2):
+			// The NV index has the wrong type or attributes.
+			return policyDataError{xerrors.Errorf("invalid PCR policy NV index: %w", err)}
+		default:
+			return err
+		}
+	}
+
+	// Require knowledge of the authorization value for the sealed key object when this policy session is
+	// used to unseal it, as in previous versions.
+	if err := tpm.PolicyAuthValue(policySession); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// pcrPolicyIndexContext_v4 provides a pcrPolicyIndexContext for the NV
+// index that stores the authorized PCR policy digest for a v4 key.
+type pcrPolicyIndexContext_v4 struct {
+	tpm       *tpm2.TPMContext
+	index     tpm2.ResourceContext
+	size      uint16
+	session   tpm2.SessionContext
+	updateKey *tpm2.Public
+}
+
+// Get returns the digest of the PCR policy that is currently authorized.
+func (c *pcrPolicyIndexContext_v4) Get() (tpm2.Digest, error) {
+	data, err := c.tpm.NVRead(c.index, c.index, c.size, 0, c.session)
+	if err != nil {
+		return nil, err
+	}
+
+	var digest tpm2.TaggedHash
+	if _, err := mu.UnmarshalFromBytes(data, &digest); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal digest: %w", err)
+	}
+	return digest.Digest(), nil
+}
+
+// Write writes the supplied PCR policy digest to the NV index, authorizing
+// it and revoking any previous PCR policy. The signed authorization is bound
+// to the data being written.
+func (c *pcrPolicyIndexContext_v4) Write(digest tpm2.Digest, key secboot.AuxiliaryKey) error {
+	ecdsaKey, err := deriveV3PolicyAuthKey(c.updateKey.NameAlg.GetHash(), key)
+	if err != nil {
+		return xerrors.Errorf("cannot derive auth key: %w", err)
+	}
+
+	alg := c.index.Name().Algorithm()
+	if len(digest) != alg.Size() {
+		return errors.New("invalid PCR policy digest")
+	}
+	data := mu.MustMarshalToBytes(tpm2.MakeTaggedHash(alg, digest))
+	if len(data) != int(c.size) {
+		return errors.New("PCR policy digest has the wrong size for the NV index")
+	}
+
+	cpHash, err := util.ComputeCpHash(alg, tpm2.CommandNVWrite, []util.Entity{c.index, c.index}, tpm2.MaxNVBuffer(data), uint16(0))
+	if err != nil {
+		return xerrors.Errorf("cannot compute command parameter digest: %w", err)
+	}
+
+	// Begin a policy session to write the index.
+	policySession, err := c.tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, alg)
+	if err != nil {
+		return err
+	}
+	defer c.tpm.FlushContext(policySession)
+
+	// Load the public part of the key in to the TPM. There's no integrity protection for this command as if it's altered in
+	// transit then either the signature verification fails or the policy digest will not match the one associated with the NV
+	// index.
+	keyLoaded, err := c.tpm.LoadExternal(nil, c.updateKey, tpm2.HandleEndorsement)
+	if err != nil {
+		return err
+	}
+	defer c.tpm.FlushContext(keyLoaded)
+
+	// Create a signed authorization for this write. keyData.validate checks that this scheme is compatible with the key
+	scheme := tpm2.SigScheme{
+		Scheme: tpm2.SigSchemeAlgECDSA,
+		Details: &tpm2.SigSchemeU{
+			ECDSA: &tpm2.SigSchemeECDSA{
+				HashAlg: c.updateKey.NameAlg}}}
+	signature, err := util.SignPolicyAuthorization(ecdsaKey, &scheme, policySession.NonceTPM(), cpHash, nil, 0)
+	if err != nil {
+		return xerrors.Errorf("cannot sign authorization: %w", err)
+	}
+
+	if _, _, err := c.tpm.PolicySigned(keyLoaded, policySession, true, cpHash, nil, 0, signature); err != nil {
+		return err
+	}
+	if err := c.tpm.PolicyCommandCode(policySession, tpm2.CommandNVWrite); err != nil {
+		return err
+	}
+
+	// Write the index.
+	return c.tpm.NVWrite(c.index, c.index, data, 0, policySession, c.session.IncludeAttrs(tpm2.AttrAudit))
+}
+
+// PCRPolicyCounterContext returns an error because a v4 key doesn't have a
+// PCR policy counter. Use PCRPolicyIndexContext instead.
+func (p *keyDataPolicy_v4) PCRPolicyCounterContext(tpm *tpm2.TPMContext, pub *tpm2.NVPublic, session tpm2.SessionContext) (pcrPolicyCounterContext, error) {
+	return nil, errors.New("PCR policies are authorized by a NV index rather than a counter")
+}
+
+func (p *keyDataPolicy_v4) PCRPolicyIndexContext(tpm *tpm2.TPMContext, pub *tpm2.NVPublic, session tpm2.SessionContext) (pcrPolicyIndexContext, error) {
+	if pub.Index != p.StaticData.PCRPolicyIndexHandle {
+		return nil, errors.New("NV index public area is inconsistent with metadata")
+	}
+
+	index, err := tpm2.CreateNVIndexResourceContextFromPublic(pub)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+
+	return &pcrPolicyIndexContext_v4{
+		tpm:       tpm,
+		index:     index,
+		size:      pub.Size,
+		session:   session,
+		updateKey: p.StaticData.AuthPublicKey}, nil
+}
+
+func (p *keyDataPolicy_v4) ValidateAuthKey(key secboot.AuxiliaryKey) error {
+	return validateV3PolicyAuthKey(p.StaticData.AuthPublicKey, key)
+}
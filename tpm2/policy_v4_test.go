@@ -0,0 +1,689 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto"
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type policyV4SuiteNoTPM struct {
+	policyOrTreeMixin
+	policyV3Mixin
+}
+
+type policyV4Suite struct {
+	tpm2test.TPMTest
+	policyV3Mixin
+}
+
+func (s *policyV4Suite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeaturePCR | tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&policyV4Suite{})
+var _ = Suite(&policyV4SuiteNoTPM{})
+
+func (s *policyV4SuiteNoTPM) mockPcrPolicyIndexPub(handle tpm2.Handle) *tpm2.NVPublic {
+	return &tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		Size:    34}
+}
+
+func (s *policyV4SuiteNoTPM) TestComputePolicyAuthorizeNVDigest(c *C) {
+	name := s.mockPcrPolicyIndexPub(0x01800000).Name()
+
+	h := crypto.SHA256.New()
+	h.Write(make([]byte, 32))
+	h.Write(mu.MustMarshalToBytes(tpm2.CommandPolicyAuthorizeNV))
+	h.Write(name)
+
+	c.Check(ComputePolicyAuthorizeNVDigest(tpm2.HashAlgorithmSHA256, name), DeepEquals, tpm2.Digest(h.Sum(nil)))
+}
+
+func (s *policyV4SuiteNoTPM) TestComputePolicyAuthorizeNVDigestDifferentIndex(c *C) {
+	c.Check(ComputePolicyAuthorizeNVDigest(tpm2.HashAlgorithmSHA256, s.mockPcrPolicyIndexPub(0x01800000).Name()), Not(DeepEquals),
+		ComputePolicyAuthorizeNVDigest(tpm2.HashAlgorithmSHA256, s.mockPcrPolicyIndexPub(0x01800001).Name()))
+}
+
+func (s *policyV4SuiteNoTPM) TestNewKeyDataPolicy(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)
+
+	pub := s.mockPcrPolicyIndexPub(0x01800000)
+
+	policyData, digest, err := NewKeyDataPolicyV4(tpm2.HashAlgorithmSHA256, authKeyPublic, pub)
+	c.Assert(err, IsNil)
+	c.Assert(policyData, testutil.ConvertibleTo, &KeyDataPolicy_v4{})
+	c.Check(policyData.(*KeyDataPolicy_v4).StaticData.AuthPublicKey, DeepEquals, authKeyPublic)
+	c.Check(policyData.PCRPolicyCounterHandle(), Equals, pub.Index)
+	c.Check(policyData.PCRPolicySequence(), Equals, uint64(0))
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.SetDigest(ComputePolicyAuthorizeNVDigest(tpm2.HashAlgorithmSHA256, pub.Name()))
+	trial.PolicyAuthValue()
+	c.Check(digest, DeepEquals, trial.GetDigest())
+}
+
+func (s *policyV4SuiteNoTPM) TestNewKeyDataPolicyNoIndex(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)
+
+	_, _, err := NewKeyDataPolicyV4(tpm2.HashAlgorithmSHA256, authKeyPublic, nil)
+	c.Check(err, ErrorMatches, "no PCR policy NV index supplied")
+}
+
+func (s *policyV4SuiteNoTPM) TestPCRPolicyCounterHandle(c *C) {
+	var data KeyDataPolicy = &KeyDataPolicy_v4{
+		StaticData: &StaticPolicyData_v4{
+			PCRPolicyIndexHandle: 0x01800000}}
+	c.Check(data.PCRPolicyCounterHandle(), Equals, tpm2.Handle(0x01800000))
+
+	data = &KeyDataPolicy_v4{
+		StaticData: &StaticPolicyData_v4{
+			PCRPolicyIndexHandle: 0x0180ff00}}
+	c.Check(data.PCRPolicyCounterHandle(), Equals, tpm2.Handle(0x0180ff00))
+}
+
+func (s *policyV4SuiteNoTPM) TestPCRPolicySequence(c *C) {
+	var data KeyDataPolicy = &KeyDataPolicy_v4{
+		PCRData: &PcrPolicyData_v4{
+			PolicySequence: 10}}
+	c.Check(data.PCRPolicySequence(), Equals, uint64(10))
+
+	data = &KeyDataPolicy_v4{
+		PCRData: &PcrPolicyData_v4{
+			PolicySequence: 500}}
+	c.Check(data.PCRPolicySequence(), Equals, uint64(500))
+}
+
+type testV4UpdatePCRPolicyData struct {
+	initialSeq uint64
+
+	alg        tpm2.HashAlgorithmId
+	pcrs       tpm2.PCRSelectionList
+	pcrDigests tpm2.DigestList
+
+	expectedPolicy tpm2.Digest
+}
+
+func (s *policyV4SuiteNoTPM) testUpdatePCRPolicy(c *C, data *testV4UpdatePCRPolicyData) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+
+	var policyData KeyDataPolicy = &KeyDataPolicy_v4{
+		StaticData: &StaticPolicyData_v4{
+			AuthPublicKey:        s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key),
+			PCRPolicyIndexHandle: 0x01800000},
+		PCRData: &PcrPolicyData_v4{
+			PolicySequence: data.initialSeq}}
+
+	params := NewPcrPolicyParams(key, data.pcrs, data.pcrDigests, s.mockPcrPolicyIndexPub(0x01800000).Name())
+	c.Check(policyData.UpdatePCRPolicy(data.alg, params), IsNil)
+
+	c.Check(policyData.(*KeyDataPolicy_v4).PCRData.Selection, tpm2_testutil.TPMValueDeepEquals, data.pcrs)
+
+	orTree, err := policyData.(*KeyDataPolicy_v4).PCRData.OrData.Resolve()
+	c.Assert(err, IsNil)
+	var digests tpm2.DigestList
+	for _, digest := range data.pcrDigests {
+		trial := util.ComputeAuthPolicy(data.alg)
+		trial.PolicyPCR(digest, data.pcrs)
+		digests = append(digests, trial.GetDigest())
+	}
+	s.checkPolicyOrTree(c, data.alg, digests, orTree)
+
+	c.Check(policyData.(*KeyDataPolicy_v4).PCRData.PolicySequence, Equals, data.initialSeq+1)
+
+	c.Check(policyData.(*KeyDataPolicy_v4).PCRData.AuthorizedPolicy, DeepEquals, data.expectedPolicy)
+	c.Check(policyData.(*KeyDataPolicy_v4).PCRData.AuthorizedPolicySignature.SigAlg, Equals, tpm2.SigSchemeAlgNull)
+}
+
+func (s *policyV4SuiteNoTPM) TestUpdatePCRPolicy(c *C) {
+	s.testUpdatePCRPolicy(c, &testV4UpdatePCRPolicyData{
+		initialSeq:     1000,
+		alg:            tpm2.HashAlgorithmSHA256,
+		pcrs:           tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}},
+		pcrDigests:     tpm2.DigestList{hash(crypto.SHA256, "1")},
+		expectedPolicy: testutil.DecodeHexString(c, "830c1432cbdc2f3dc2c1c83430df4fe0f5c2c6b1437b01071ddfd6f70fe33a90")})
+}
+
+func (s *policyV4SuiteNoTPM) TestUpdatePCRPolicyDepth1(c *C) {
+	s.testUpdatePCRPolicy(c, &testV4UpdatePCRPolicyData{
+		initialSeq: 1000,
+		alg:        tpm2.HashAlgorithmSHA256,
+		pcrs:       tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}},
+		pcrDigests: tpm2.DigestList{
+			hash(crypto.SHA256, "1"),
+			hash(crypto.SHA256, "2"),
+			hash(crypto.SHA256, "3"),
+			hash(crypto.SHA256, "4"),
+			hash(crypto.SHA256, "5")},
+		expectedPolicy: testutil.DecodeHexString(c, "a59dbb4a535959a60822bd8d01933c4fa89dfdb686b55ae6ea8dc744b68726c4")})
+}
+
+func (s *policyV4SuiteNoTPM) TestUpdatePCRPolicyDifferentSequence(c *C) {
+	s.testUpdatePCRPolicy(c, &testV4UpdatePCRPolicyData{
+		initialSeq:     9999,
+		alg:            tpm2.HashAlgorithmSHA256,
+		pcrs:           tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}},
+		pcrDigests:     tpm2.DigestList{hash(crypto.SHA256, "1")},
+		expectedPolicy: testutil.DecodeHexString(c, "830c1432cbdc2f3dc2c1c83430df4fe0f5c2c6b1437b01071ddfd6f70fe33a90")})
+}
+
+func (s *policyV4SuiteNoTPM) TestUpdatePCRPolicyDifferentPCRs(c *C) {
+	s.testUpdatePCRPolicy(c, &testV4UpdatePCRPolicyData{
+		initialSeq:     1000,
+		alg:            tpm2.HashAlgorithmSHA256,
+		pcrs:           tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA1, Select: []int{4, 7, 12}}},
+		pcrDigests:     tpm2.DigestList{hash(crypto.SHA256, "1")},
+		expectedPolicy: testutil.DecodeHexString(c, "a9af42ecaa59bdc7838b09731a625e27f750de556763c45f50e78771afd39f11")})
+}
+
+func (s *policyV4SuiteNoTPM) TestSetPCRPolicyFrom(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+
+	policyData1 := &KeyDataPolicy_v4{
+		StaticData: &StaticPolicyData_v4{
+			AuthPublicKey:        s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key),
+			PCRPolicyIndexHandle: 0x01800000},
+		PCRData: &PcrPolicyData_v4{
+			PolicySequence: 5000}}
+
+	params := NewPcrPolicyParams(key,
+		tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}},
+		tpm2.DigestList{hash(crypto.SHA256, "1"), hash(crypto.SHA256, "2")},
+		s.mockPcrPolicyIndexPub(0x01800000).Name())
+	c.Check(policyData1.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+
+	var policyData2 KeyDataPolicy = &KeyDataPolicy_v4{
+		StaticData: &StaticPolicyData_v4{
+			AuthPublicKey:        s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key),
+			PCRPolicyIndexHandle: 0x01800000}}
+	policyData2.SetPCRPolicyFrom(policyData1)
+
+	c.Check(policyData2.(*KeyDataPolicy_v4).PCRData, DeepEquals, policyData1.PCRData)
+}
+
+func (s *policyV4SuiteNoTPM) TestValidateAuthKey(c *C) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	data := &KeyDataPolicy_v4{
+		StaticData: &StaticPolicyData_v4{
+			AuthPublicKey: authKeyPublic}}
+	c.Check(data.ValidateAuthKey(authKey), IsNil)
+}
+
+func (s *policyV4SuiteNoTPM) TestValidateAuthKeyWrongKey(c *C) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	data := &KeyDataPolicy_v4{
+		StaticData: &StaticPolicyData_v4{
+			AuthPublicKey: authKeyPublic}}
+
+	rand.Read(authKey)
+
+	err := data.ValidateAuthKey(authKey)
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, "dynamic authorization policy signing private key doesn't match public key")
+}
+
+func (s *policyV4Suite) TestCreatePcrPolicyIndex(c *C) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	handle := s.NextAvailableHandle(c, 0x01800000)
+
+	pub, err := CreatePcrPolicyIndex(s.TPM().TPMContext, handle, authKeyPublic, authKey, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+	c.Check(pub.Index, Equals, handle)
+	c.Check(pub.Attrs, Equals, tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA|tpm2.AttrNVWritten))
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicySigned(authKeyPublic.Name(), nil)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	c.Check(pub.AuthPolicy, DeepEquals, trial.GetDigest())
+	c.Check(ComputeV4PcrPolicyIndexAuthPolicy(tpm2.HashAlgorithmSHA256, authKeyPublic.Name()), DeepEquals, trial.GetDigest())
+
+	index, err := s.TPM().CreateResourceContextFromTPM(handle)
+	c.Assert(err, IsNil)
+	c.Check(index.Name(), DeepEquals, pub.Name())
+
+	b, err := s.TPM().NVRead(index, index, pub.Size, 0, nil)
+	c.Check(err, IsNil)
+	c.Check(b, DeepEquals, mu.MustMarshalToBytes(tpm2.MakeTaggedHash(tpm2.HashAlgorithmSHA256, bytes.Repeat([]byte{0xff}, 32))))
+}
+
+func (s *policyV4Suite) TestCreatePcrPolicyIndexWrongKey(c *C) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	handle := s.NextAvailableHandle(c, 0x01800000)
+
+	rand.Read(authKey)
+	_, err := CreatePcrPolicyIndex(s.TPM().TPMContext, handle, authKeyPublic, authKey, s.TPM().HmacSession())
+	c.Check(tpm2.IsTPMParameterError(err, tpm2.ErrorSignature, tpm2.CommandPolicySigned, 5), testutil.IsTrue)
+
+	// The index should have been undefined.
+	_, err = s.TPM().CreateResourceContextFromTPM(handle)
+	c.Check(tpm2.IsResourceUnavailableError(err, handle), testutil.IsTrue)
+}
+
+type testV4ExecutePCRPolicyData struct {
+	alg tpm2.HashAlgorithmId
+
+	pcrs      tpm2.PCRSelectionList
+	pcrValues []tpm2.PCRValues
+
+	pcrEvents []pcrEvent
+
+	fn func(data *KeyDataPolicy_v4, authKey secboot.AuxiliaryKey, pub *tpm2.NVPublic)
+}
+
+func (s *policyV4Suite) testExecutePCRPolicy(c *C, data *testV4ExecutePCRPolicyData) (tpm2.Digest, tpm2.Digest, error) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	pub, err := CreatePcrPolicyIndex(s.TPM().TPMContext, s.NextAvailableHandle(c, 0x01800000), authKeyPublic, authKey, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+
+	policyData, expectedDigest, err := NewKeyDataPolicyV4(data.alg, authKeyPublic, pub)
+	c.Assert(err, IsNil)
+	c.Assert(policyData, testutil.ConvertibleTo, &KeyDataPolicy_v4{})
+
+	var digests tpm2.DigestList
+	for _, v := range data.pcrValues {
+		d, _ := util.ComputePCRDigest(data.alg, data.pcrs, v)
+		digests = append(digests, d)
+	}
+
+	params := NewPcrPolicyParams(authKey, data.pcrs, digests, pub.Name())
+	c.Check(policyData.UpdatePCRPolicy(data.alg, params), IsNil)
+	c.Check(AuthorizePCRPolicyWithNVIndex(s.TPM().TPMContext, policyData.(*KeyDataPolicy_v4), pub, authKey, s.TPM().HmacSession()), IsNil)
+
+	for _, selection := range data.pcrs {
+		for _, pcr := range selection.Select {
+			c.Check(s.TPM().PCRReset(s.TPM().PCRHandleContext(pcr), nil), IsNil)
+		}
+	}
+
+	for _, e := range data.pcrEvents {
+		_, err := s.TPM().PCREvent(s.TPM().PCRHandleContext(e.index), []byte(e.data), nil)
+		c.Check(err, IsNil)
+	}
+
+	if data.fn != nil {
+		data.fn(policyData.(*KeyDataPolicy_v4), authKey, pub)
+	}
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, data.alg)
+	executeErr := policyData.ExecutePCRPolicy(s.TPM().TPMContext, session, s.TPM().HmacSession())
+
+	digest, err := s.TPM().PolicyGetDigest(session)
+	c.Check(err, IsNil)
+
+	return expectedDigest, digest, executeErr
+}
+
+func (s *policyV4Suite) TestExecutePCRPolicy(c *C) {
+	expected, digest, err := s.testExecutePCRPolicy(c, &testV4ExecutePCRPolicyData{
+		alg:  tpm2.HashAlgorithmSHA256,
+		pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{16, 23}}},
+		pcrValues: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					16: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo", "bar"),
+					23: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar", "foo"),
+				},
+			},
+		},
+		pcrEvents: []pcrEvent{
+			{
+				index: 16,
+				data:  "foo",
+			},
+			{
+				index: 16,
+				data:  "bar",
+			},
+			{
+				index: 23,
+				data:  "bar",
+			},
+			{
+				index: 23,
+				data:  "foo",
+			},
+		},
+	})
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+}
+
+func (s *policyV4Suite) TestExecutePCRPolicyNoPCRs(c *C) {
+	expected, digest, err := s.testExecutePCRPolicy(c, &testV4ExecutePCRPolicyData{
+		alg:       tpm2.HashAlgorithmSHA256,
+		pcrValues: []tpm2.PCRValues{{}},
+	})
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+}
+
+func (s *policyV4Suite) TestExecutePCRPolicyMultiple(c *C) {
+	expected, digest, err := s.testExecutePCRPolicy(c, &testV4ExecutePCRPolicyData{
+		alg:  tpm2.HashAlgorithmSHA256,
+		pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{16}}},
+		pcrValues: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					16: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					16: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar"),
+				},
+			},
+		},
+		pcrEvents: []pcrEvent{
+			{
+				index: 16,
+				data:  "bar",
+			},
+		},
+	})
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+}
+
+func (s *policyV4Suite) TestExecutePCRPolicyErrorHandlingPCRMismatch(c *C) {
+	expected, digest, err := s.testExecutePCRPolicy(c, &testV4ExecutePCRPolicyData{
+		alg:  tpm2.HashAlgorithmSHA256,
+		pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{16}}},
+		pcrValues: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					16: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+				},
+			},
+		},
+		pcrEvents: []pcrEvent{
+			{
+				index: 16,
+				data:  "bar",
+			},
+		},
+	})
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, "cannot execute PCR assertions: cannot execute PolicyOR assertions: current session digest not found in policy data")
+	c.Check(digest, Not(DeepEquals), expected)
+}
+
+func (s *policyV4Suite) TestExecutePCRPolicyErrorHandlingRevoked(c *C) {
+	// Test with a PCR policy that has been superseded by another one.
+	expected, digest, err := s.testExecutePCRPolicy(c, &testV4ExecutePCRPolicyData{
+		alg:  tpm2.HashAlgorithmSHA256,
+		pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{16}}},
+		pcrValues: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					16: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+				},
+			},
+		},
+		pcrEvents: []pcrEvent{
+			{
+				index: 16,
+				data:  "foo",
+			},
+		},
+		fn: func(data *KeyDataPolicy_v4, authKey secboot.AuxiliaryKey, pub *tpm2.NVPublic) {
+			newData := &KeyDataPolicy_v4{
+				StaticData: data.StaticData,
+				PCRData:    data.PCRData}
+			params := NewPcrPolicyParams(authKey,
+				tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{16}}},
+				tpm2.DigestList{hash(crypto.SHA256, "1")}, pub.Name())
+			c.Check(newData.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+			c.Check(AuthorizePCRPolicyWithNVIndex(s.TPM().TPMContext, newData, pub, authKey, s.TPM().HmacSession()), IsNil)
+		},
+	})
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, "the PCR policy is not authorized")
+	c.Check(digest, Not(DeepEquals), expected)
+}
+
+func (s *policyV4Suite) TestExecutePCRPolicyErrorHandlingNotAuthorized(c *C) {
+	// Test with a PCR policy that was never written to the NV index.
+	expected, digest, err := s.testExecutePCRPolicy(c, &testV4ExecutePCRPolicyData{
+		alg:  tpm2.HashAlgorithmSHA256,
+		pcrs: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{16}}},
+		pcrValues: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					16: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+				},
+			},
+		},
+		pcrEvents: []pcrEvent{
+			{
+				index: 16,
+				data:  "foo",
+			},
+			{
+				index: 16,
+				data:  "bar",
+			},
+		},
+		fn: func(data *KeyDataPolicy_v4, authKey secboot.AuxiliaryKey, pub *tpm2.NVPublic) {
+			pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{16}}}
+			digest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, tpm2.PCRValues{
+				tpm2.HashAlgorithmSHA256: {
+					16: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo", "bar")}})
+			c.Assert(err, IsNil)
+			params := NewPcrPolicyParams(authKey, pcrs, tpm2.DigestList{digest}, pub.Name())
+			c.Check(data.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+		},
+	})
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, "the PCR policy is not authorized")
+	c.Check(digest, Not(DeepEquals), expected)
+}
+
+func (s *policyV4Suite) TestExecutePCRPolicyErrorHandlingNoIndex(c *C) {
+	expected, digest, err := s.testExecutePCRPolicy(c, &testV4ExecutePCRPolicyData{
+		alg:       tpm2.HashAlgorithmSHA256,
+		pcrValues: []tpm2.PCRValues{{}},
+		fn: func(data *KeyDataPolicy_v4, authKey secboot.AuxiliaryKey, pub *tpm2.NVPublic) {
+			index, err := tpm2.CreateNVIndexResourceContextFromPublic(pub)
+			c.Assert(err, IsNil)
+			c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+		},
+	})
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, "no PCR policy NV index found")
+	c.Check(digest, Not(DeepEquals), expected)
+}
+
+func (s *policyV4Suite) TestExecutePCRPolicyErrorHandlingInvalidIndexHandle(c *C) {
+	expected, digest, err := s.testExecutePCRPolicy(c, &testV4ExecutePCRPolicyData{
+		alg:       tpm2.HashAlgorithmSHA256,
+		pcrValues: []tpm2.PCRValues{{}},
+		fn: func(data *KeyDataPolicy_v4, authKey secboot.AuxiliaryKey, pub *tpm2.NVPublic) {
+			data.StaticData.PCRPolicyIndexHandle = 0x81000000
+		},
+	})
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, "invalid handle 0x81000000 for PCR policy NV index")
+	c.Check(digest, Not(DeepEquals), expected)
+}
+
+func (s *policyV4Suite) newPcrPolicyIndexForTest(c *C) (*KeyDataPolicy_v4, *tpm2.NVPublic, secboot.AuxiliaryKey) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	pub, err := CreatePcrPolicyIndex(s.TPM().TPMContext, s.NextAvailableHandle(c, 0x01800000), authKeyPublic, authKey, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+
+	data := &KeyDataPolicy_v4{
+		StaticData: &StaticPolicyData_v4{
+			AuthPublicKey:        authKeyPublic,
+			PCRPolicyIndexHandle: pub.Index},
+		PCRData: &PcrPolicyData_v4{
+			PolicySequence:   10,
+			AuthorizedPolicy: hash(crypto.SHA256, "foo")}}
+	return data, pub, authKey
+}
+
+func (s *policyV4Suite) TestPCRPolicyCounterContext(c *C) {
+	data, pub, _ := s.newPcrPolicyIndexForTest(c)
+
+	_, err := data.PCRPolicyCounterContext(s.TPM().TPMContext, pub, s.TPM().HmacSession())
+	c.Check(err, ErrorMatches, "PCR policies are authorized by a NV index rather than a counter")
+}
+
+func (s *policyV4Suite) TestPolicyIndexContextGet(c *C) {
+	data, pub, _ := s.newPcrPolicyIndexForTest(c)
+
+	context, err := data.PCRPolicyIndexContext(s.TPM().TPMContext, pub, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+
+	// The index doesn't contain the current PCR policy yet.
+	digest, err := context.Get()
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, tpm2.Digest(bytes.Repeat([]byte{0xff}, 32)))
+}
+
+func (s *policyV4Suite) TestPolicyIndexContextInconsistentPub(c *C) {
+	data, pub, _ := s.newPcrPolicyIndexForTest(c)
+	data.StaticData.PCRPolicyIndexHandle++
+
+	_, err := data.PCRPolicyIndexContext(s.TPM().TPMContext, pub, s.TPM().HmacSession())
+	c.Check(err, ErrorMatches, "NV index public area is inconsistent with metadata")
+}
+
+func (s *policyV4Suite) TestPolicyIndexContextWrite(c *C) {
+	data, pub, authKey := s.newPcrPolicyIndexForTest(c)
+
+	context, err := data.PCRPolicyIndexContext(s.TPM().TPMContext, pub, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+
+	c.Check(context.Write(data.PCRPolicyDigest(), authKey), IsNil)
+
+	digest, err := context.Get()
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, tpm2.Digest(hash(crypto.SHA256, "foo")))
+
+	index, err := tpm2.CreateNVIndexResourceContextFromPublic(pub)
+	c.Assert(err, IsNil)
+	b, err := s.TPM().NVRead(index, index, pub.Size, 0, nil)
+	c.Check(err, IsNil)
+	c.Check(b, DeepEquals, mu.MustMarshalToBytes(tpm2.MakeTaggedHash(tpm2.HashAlgorithmSHA256, hash(crypto.SHA256, "foo"))))
+}
+
+func (s *policyV4Suite) TestPolicyIndexContextWriteWrongKey(c *C) {
+	data, pub, authKey := s.newPcrPolicyIndexForTest(c)
+
+	context, err := data.PCRPolicyIndexContext(s.TPM().TPMContext, pub, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+
+	rand.Read(authKey)
+	err = context.Write(data.PCRPolicyDigest(), authKey)
+	c.Check(tpm2.IsTPMParameterError(err, tpm2.ErrorSignature, tpm2.CommandPolicySigned, 5), testutil.IsTrue)
+
+	digest, err := context.Get()
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, tpm2.Digest(bytes.Repeat([]byte{0xff}, 32)))
+}
+
+func (s *policyV4Suite) TestPolicyIndexAuthorizationIsBoundToData(c *C) {
+	// Test that a signed authorization for writing one digest to the PCR
+	// policy NV index can't be used to write a different digest.
+	_, pub, authKey := s.newPcrPolicyIndexForTest(c)
+
+	index, err := tpm2.CreateNVIndexResourceContextFromPublic(pub)
+	c.Assert(err, IsNil)
+
+	authorized := mu.MustMarshalToBytes(tpm2.MakeTaggedHash(tpm2.HashAlgorithmSHA256, hash(crypto.SHA256, "foo")))
+	cpHash, err := util.ComputeCpHash(tpm2.HashAlgorithmSHA256, tpm2.CommandNVWrite, []util.Entity{index, index}, tpm2.MaxNVBuffer(authorized), uint16(0))
+	c.Assert(err, IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+
+	key, err := DeriveV3PolicyAuthKey(crypto.SHA256, authKey)
+	c.Assert(err, IsNil)
+	keyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+	keyLoaded, err := s.TPM().LoadExternal(nil, keyPublic, tpm2.HandleEndorsement)
+	c.Assert(err, IsNil)
+	defer s.TPM().FlushContext(keyLoaded)
+
+	scheme := tpm2.SigScheme{
+		Scheme: tpm2.SigSchemeAlgECDSA,
+		Details: &tpm2.SigSchemeU{
+			ECDSA: &tpm2.SigSchemeECDSA{
+				HashAlg: tpm2.HashAlgorithmSHA256}}}
+	signature, err := util.SignPolicyAuthorization(key, &scheme, session.NonceTPM(), cpHash, nil, 0)
+	c.Assert(err, IsNil)
+
+	_, _, err = s.TPM().PolicySigned(keyLoaded, session, true, cpHash, nil, 0, signature)
+	c.Check(err, IsNil)
+	c.Check(s.TPM().PolicyCommandCode(session, tpm2.CommandNVWrite), IsNil)
+
+	data := mu.MustMarshalToBytes(tpm2.MakeTaggedHash(tpm2.HashAlgorithmSHA256, hash(crypto.SHA256, "bar")))
+	err = s.TPM().NVWrite(index, index, data, 0, session)
+	c.Check(tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandNVWrite, 1), testutil.IsTrue, Commentf("%v", err))
+}
+
+func (s *policyV4Suite) TestPolicyIndexNotWritableByOwner(c *C) {
+	_, pub, _ := s.newPcrPolicyIndexForTest(c)
+
+	index, err := tpm2.CreateNVIndexResourceContextFromPublic(pub)
+	c.Assert(err, IsNil)
+
+	err = s.TPM().NVWrite(s.TPM().OwnerHandleContext(), index, make([]byte, pub.Size), 0, nil)
+	c.Check(tpm2.IsTPMError(err, tpm2.ErrorNVAuthorization, tpm2.CommandNVWrite), testutil.IsTrue, Commentf("%v", err))
+}
@@ -0,0 +1,463 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// defaultPINRetryLimit is the number of incorrect PIN attempts that are
+// permitted for a key before it is locked out, if the caller doesn't
+// specify one.
+const defaultPINRetryLimit = 5
+
+// computeV5PinIndexAuthPolicies computes the authorization policy digests passed to
+// TPM2_PolicyOR for a PIN NV index that can be initialized with the key associated with
+// updateKeyName, reset with the authorization value of the storage hierarchy, and have
+// its PIN changed with knowledge of the current PIN.
+func computeV5PinIndexAuthPolicies(alg tpm2.HashAlgorithmId, updateKeyName tpm2.Name) tpm2.DigestList {
+	// The NV index requires 3 policies:
+	// - A policy for initializing the index using a signed assertion, which is
+	//   bound to the data being written.
+	// - A policy for resetting the retry counter after a lockout using the
+	//   authorization value of the storage hierarchy, as the key that the signed
+	//   assertion is made with can't be recovered during a lockout.
+	// - A policy for changing the authorization value of the index (the PIN),
+	//   which requires knowledge of the current PIN.
+	// The index is read using the authorization value of the storage hierarchy,
+	// and its own authorization value is the PIN.
+	var authPolicies tpm2.DigestList
+
+	if !updateKeyName.IsValid() {
+		// avoid a panic if updateKeyName is invalid. Note that this will
+		// produce invalid policies - callers should take steps to ensure that
+		// updateKeyName is valid.
+		updateKeyName = tpm2.Name(mu.MustMarshalToBytes(tpm2.HandleUnassigned))
+	}
+
+	trial := util.ComputeAuthPolicy(alg)
+	trial.PolicySigned(updateKeyName, nil)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	authPolicies = append(authPolicies, trial.GetDigest())
+
+	trial = util.ComputeAuthPolicy(alg)
+	trial.PolicySecret(tpm2.Name(mu.MustMarshalToBytes(tpm2.HandleOwner)), nil)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	authPolicies = append(authPolicies, trial.GetDigest())
+
+	trial = util.ComputeAuthPolicy(alg)
+	trial.PolicyAuthValue()
+	trial.PolicyCommandCode(tpm2.CommandNVChangeAuth)
+	authPolicies = append(authPolicies, trial.GetDigest())
+
+	return authPolicies
+}
+
+// pinIndexAttrs are the attributes of a PIN NV index, excluding AttrNVWritten.
+// It is a TPM_NT_PIN_FAIL index with the PIN as its authorization value, so that
+// each failed authorization increments its retry counter rather than the TPM's
+// dictionary attack counter, each successful authorization clears its retry
+// counter, and its authorization value can't be used once the retry counter
+// reaches its limit.
+var pinIndexAttrs = tpm2.NVTypePinFail.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVOwnerRead | tpm2.AttrNVNoDA)
+
+// createPinIndexImpl creates and initializes a NV index that is associated with a sealed key
+// object and implements the retry limit for its PIN.
+func createPinIndexImpl(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKey *tpm2.Public, key secboot.AuxiliaryKey, retryLimit uint32, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	nameAlg := tpm2.HashAlgorithmSHA256
+
+	authPolicies := computeV5PinIndexAuthPolicies(nameAlg, updateKey.Name())
+
+	trial := util.ComputeAuthPolicy(nameAlg)
+	trial.PolicyOR(authPolicies)
+
+	// Define the NV index.
+	public := &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    nameAlg,
+		Attrs:      pinIndexAttrs,
+		AuthPolicy: trial.GetDigest(),
+		Size:       8}
+
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, hmacSession)
+	if err != nil {
+		return nil, err
+	}
+
+	// NVDefineSpace was integrity protected, so we know that we have an index with the expected public area at the handle we specified
+	// at this point.
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, hmacSession)
+	}()
+
+	// Initialize the index with a signed authorization.
+	context := &pinIndexContext{
+		tpm:        tpm,
+		index:      index,
+		session:    hmacSession,
+		updateKey:  updateKey,
+		retryLimit: retryLimit}
+	if err := context.Reset(key); err != nil {
+		return nil, err
+	}
+
+	// The index has a different name now that it has been written, so update the public area we return so that it can be used
+	// to construct an authorization policy.
+	public.Attrs |= tpm2.AttrNVWritten
+
+	succeeded = true
+	return public, nil
+}
+
+// createPinIndex creates and initializes a NV index that is associated with a sealed key object
+// and verifies its PIN with a retry limit that is independent of the TPM's dictionary attack
+// protection. The PIN is the authorization value of the NV index.
+//
+// The NV index will be created with an empty authorization value (PIN), attributes that allow the
+// retry counter to be read with the authorization value of the storage hierarchy, and an
+// authorization policy that permits the retry counter to be initialized with a signed
+// authorization, reset with the authorization value of the storage hierarchy, and the PIN to be
+// changed with knowledge of the current PIN. The index is initialized using the supplied key,
+// which must correspond to updateKey. The caller must ensure that the updateKey argument is a
+// valid public key.
+var createPinIndex = createPinIndexImpl
+
+// pinIndexContext corresponds to the PIN NV index associated with a v5 key.
+type pinIndexContext struct {
+	tpm        *tpm2.TPMContext
+	index      tpm2.ResourceContext
+	session    tpm2.SessionContext
+	updateKey  *tpm2.Public
+	retryLimit uint32
+}
+
+// resetParams returns the command parameters for resetting the retry counter,
+// along with the command parameter digest used to bind an authorization to them.
+func (c *pinIndexContext) resetParams() (*tpm2.NVPinCounterParams, tpm2.Digest, error) {
+	params := &tpm2.NVPinCounterParams{Limit: c.retryLimit}
+	cpHash, err := util.ComputeCpHash(c.index.Name().Algorithm(), tpm2.CommandNVWrite, []util.Entity{c.index, c.index},
+		tpm2.MaxNVBuffer(mu.MustMarshalToBytes(params)), uint16(0))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute command parameter digest: %w", err)
+	}
+	return params, cpHash, nil
+}
+
+// beginPolicySession begins a policy session for the PIN NV index and executes
+// the supplied assertions followed by the TPM2_PolicyOR assertion.
+func (c *pinIndexContext) beginPolicySession(assertions func(tpm2.SessionContext) error) (tpm2.SessionContext, error) {
+	policySession, err := c.tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, c.index.Name().Algorithm())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := assertions(policySession); err != nil {
+		c.tpm.FlushContext(policySession)
+		return nil, err
+	}
+	authPolicies := computeV5PinIndexAuthPolicies(c.index.Name().Algorithm(), c.updateKey.Name())
+	if err := c.tpm.PolicyOR(policySession, authPolicies); err != nil {
+		c.tpm.FlushContext(policySession)
+		return nil, err
+	}
+
+	return policySession, nil
+}
+
+// Get returns the current retry counter and retry limit. This requires the
+// authorization value of the storage hierarchy, but doesn't affect the retry
+// counter.
+func (c *pinIndexContext) Get() (*tpm2.NVPinCounterParams, error) {
+	return c.tpm.NVReadPinCounterParams(c.tpm.OwnerHandleContext(), c.index, c.session)
+}
+
+// Reset resets the retry counter, using the supplied key for authorization.
+func (c *pinIndexContext) Reset(key secboot.AuxiliaryKey) error {
+	ecdsaKey, err := deriveV3PolicyAuthKey(c.updateKey.NameAlg.GetHash(), key)
+	if err != nil {
+		return xerrors.Errorf("cannot derive auth key: %w", err)
+	}
+
+	params, cpHash, err := c.resetParams()
+	if err != nil {
+		return err
+	}
+
+	// Load the public part of the key in to the TPM. There's no integrity protection for this command as if it's altered in
+	// transit then either the signature verification fails or the policy digest will not match the one associated with the NV
+	// index.
+	keyLoaded, err := c.tpm.LoadExternal(nil, c.updateKey, tpm2.HandleEndorsement)
+	if err != nil {
+		return err
+	}
+	defer c.tpm.FlushContext(keyLoaded)
+
+	policySession, err := c.beginPolicySession(func(policySession tpm2.SessionContext) error {
+		// Create a signed authorization for this write. keyData.validate checks that this scheme is compatible with the key
+		scheme := tpm2.SigScheme{
+			Scheme: tpm2.SigSchemeAlgECDSA,
+			Details: &tpm2.SigSchemeU{
+				ECDSA: &tpm2.SigSchemeECDSA{
+					HashAlg: c.updateKey.NameAlg}}}
+		signature, err := util.SignPolicyAuthorization(ecdsaKey, &scheme, policySession.NonceTPM(), cpHash, nil, 0)
+		if err != nil {
+			return xerrors.Errorf("cannot sign authorization: %w", err)
+		}
+
+		if _, _, err := c.tpm.PolicySigned(keyLoaded, policySession, true, cpHash, nil, 0, signature); err != nil {
+			return err
+		}
+		return c.tpm.PolicyCommandCode(policySession, tpm2.CommandNVWrite)
+	})
+	if err != nil {
+		return err
+	}
+	defer c.tpm.FlushContext(policySession)
+
+	return c.tpm.NVSetPinCounterParams(c.index, c.index, params, policySession, c.session.IncludeAttrs(tpm2.AttrAudit))
+}
+
+// ChangeAuth changes the authorization value of the index (the PIN), which
+// requires knowledge of the current authorization value. A failed attempt
+// increments the retry counter.
+func (c *pinIndexContext) ChangeAuth(oldAuth, newAuth tpm2.Auth) error {
+	c.index.SetAuthValue(oldAuth)
+
+	policySession, err := c.beginPolicySession(func(policySession tpm2.SessionContext) error {
+		if err := c.tpm.PolicyAuthValue(policySession); err != nil {
+			return err
+		}
+		return c.tpm.PolicyCommandCode(policySession, tpm2.CommandNVChangeAuth)
+	})
+	if err != nil {
+		return err
+	}
+	defer c.tpm.FlushContext(policySession)
+
+	return c.tpm.NVChangeAuth(c.index, newAuth, policySession, c.session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+}
+
+// ResetWithOwnerAuth resets the retry counter, using the authorization value
+// of the storage hierarchy for authorization.
+func (c *pinIndexContext) ResetWithOwnerAuth() error {
+	params, cpHash, err := c.resetParams()
+	if err != nil {
+		return err
+	}
+
+	policySession, err := c.beginPolicySession(func(policySession tpm2.SessionContext) error {
+		if _, _, err := c.tpm.PolicySecret(c.tpm.OwnerHandleContext(), policySession, cpHash, nil, 0, c.session); err != nil {
+			return err
+		}
+		return c.tpm.PolicyCommandCode(policySession, tpm2.CommandNVWrite)
+	})
+	if err != nil {
+		return err
+	}
+	defer c.tpm.FlushContext(policySession)
+
+	return c.tpm.NVSetPinCounterParams(c.index, c.index, params, policySession, c.session.IncludeAttrs(tpm2.AttrAudit))
+}
+
+// newKeyDataPolicyV5 creates a keyDataPolicy containing a static authorization policy that asserts:
+//   - The PCR policy created by updatePcrPolicy and authorized by key is valid and has been satisfied (by way
+//     of a PolicyAuthorize assertion, which allows the PCR policy to be updated without creating a new sealed
+//     key object), as in version 3.
+//   - Knowledge of the authorization value of the supplied PIN NV index (the PIN) has been demonstrated
+//     by the caller (by way of a PolicySecret assertion). Each failed attempt increments the retry
+//     counter of the index, and the PIN can no longer be used once its retry limit is reached.
+//
+// The sealed key object has an empty authorization value and is exempt from the TPM's dictionary attack
+// protection, so the PIN is only subject to the retry limit of the NV index. Note that the PIN NV index
+// can be redefined by anyone with knowledge of the authorization value of the storage hierarchy.
+//
+// PCR policies support revocation by way of a NV counter in the same way as version 3. The caller must ensure
+// that the pcrPolicyCounterPub and pinIndexPub arguments are valid.
+//
+// The key argument must be created with newPolicyAuthPublicKey.
+//
+// This returns some policy metadata and a policy digest which is used as the auth policy field of the
+// protected object.
+func newKeyDataPolicyV5(alg tpm2.HashAlgorithmId, key *tpm2.Public, pcrPolicyCounterPub *tpm2.NVPublic, pcrPolicySequence uint64, pinIndexPub *tpm2.NVPublic, pinRetryLimit uint32) (keyDataPolicy, tpm2.Digest, error) {
+	if pinIndexPub == nil {
+		return nil, nil, errors.New("no PIN NV index supplied")
+	}
+
+	pcrPolicyCounterHandle := tpm2.HandleNull
+	var pcrPolicyCounterName tpm2.Name
+	if pcrPolicyCounterPub != nil {
+		pcrPolicyCounterHandle = pcrPolicyCounterPub.Index
+		pcrPolicyCounterName = pcrPolicyCounterPub.Name()
+	}
+
+	trial := util.ComputeAuthPolicy(alg)
+	trial.PolicyAuthorize(computeV3PcrPolicyRefFromCounterName(pcrPolicyCounterName), key.Name())
+	trial.PolicySecret(pinIndexPub.Name(), nil)
+
+	return &keyDataPolicy_v5{
+		StaticData: &staticPolicyData_v5{
+			AuthPublicKey:          key,
+			PCRPolicyCounterHandle: pcrPolicyCounterHandle,
+			PINIndexHandle:         pinIndexPub.Index,
+			PINRetryLimit:          pinRetryLimit},
+		PCRData: &pcrPolicyData_v5{
+			PolicySequence: pcrPolicySequence,
+			// Set AuthorizedPolicySignature here because this object needs to be
+			// serializable before the initial signature is created.
+			AuthorizedPolicySignature: &tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}}}, trial.GetDigest(), nil
+}
+
+// staticPolicyData_v5 represents version 5 of the metadata for executing a
+// policy session that never changes for the life of a key.
+type staticPolicyData_v5 struct {
+	AuthPublicKey          *tpm2.Public
+	PCRPolicyCounterHandle tpm2.Handle
+	PINIndexHandle         tpm2.Handle
+	PINRetryLimit          uint32
+}
+
+// pcrPolicyData_v5 represents version 5 of the PCR policy metadata for
+// executing a policy session, and can be updated. It has the same format
+// as version 3.
+type pcrPolicyData_v5 = pcrPolicyData_v3
+
+// keyDataPolicy_v5 represents version 5 of the metadata for executing a
+// policy session.
+type keyDataPolicy_v5 struct {
+	StaticData *staticPolicyData_v5
+	PCRData    *pcrPolicyData_v5
+}
+
+// v3 returns a version 3 view of this policy, which shares the same PCR policy
+// data. The PCR policy of version 5 is identical to that of version 3.
+func (p *keyDataPolicy_v5) v3() *keyDataPolicy_v3 {
+	return &keyDataPolicy_v3{
+		StaticData: &staticPolicyData_v3{
+			AuthPublicKey:          p.StaticData.AuthPublicKey,
+			PCRPolicyCounterHandle: p.StaticData.PCRPolicyCounterHandle},
+		PCRData: p.PCRData}
+}
+
+func (p *keyDataPolicy_v5) PCRPolicyCounterHandle() tpm2.Handle {
+	return p.StaticData.PCRPolicyCounterHandle
+}
+
+func (p *keyDataPolicy_v5) PCRPolicySequence() uint64 {
+	return p.PCRData.PolicySequence
+}
+
+func (p *keyDataPolicy_v5) PCRSelection() tpm2.PCRSelectionList {
+	return p.PCRData.Selection
+}
+
+func (p *keyDataPolicy_v5) AcceptsPCRValues(alg tpm2.HashAlgorithmId, values tpm2.PCRValues) (bool, error) {
+	return p.PCRData.acceptsPCRValues(alg, values)
+}
+
+// UpdatePCRPolicy updates the PCR policy associated with this keyDataPolicy in
+// the same way as version 3.
+func (p *keyDataPolicy_v5) UpdatePCRPolicy(alg tpm2.HashAlgorithmId, params *pcrPolicyParams) error {
+	v3 := p.v3()
+	if err := v3.UpdatePCRPolicy(alg, params); err != nil {
+		return err
+	}
+	p.PCRData = v3.PCRData
+	return nil
+}
+
+func (p *keyDataPolicy_v5) SetPCRPolicyFrom(src keyDataPolicy) {
+	p.PCRData = src.(*keyDataPolicy_v5).PCRData
+}
+
+// ExecutePCRPolicy executes the authorized PCR policy. The PIN is asserted
+// separately with ExecutePINPolicy.
+func (p *keyDataPolicy_v5) ExecutePCRPolicy(tpm *tpm2.TPMContext, policySession, hmacSession tpm2.SessionContext) error {
+	return p.v3().executeAuthorizedPcrPolicy(tpm, policySession)
+}
+
+func (p *keyDataPolicy_v5) PCRPolicyCounterContext(tpm *tpm2.TPMContext, pub *tpm2.NVPublic, session tpm2.SessionContext) (pcrPolicyCounterContext, error) {
+	return p.v3().PCRPolicyCounterContext(tpm, pub, session)
+}
+
+func (p *keyDataPolicy_v5) ValidateAuthKey(key secboot.AuxiliaryKey) error {
+	return validateV3PolicyAuthKey(p.StaticData.AuthPublicKey, key)
+}
+
+func (p *keyDataPolicy_v5) PINIndexHandle() tpm2.Handle {
+	return p.StaticData.PINIndexHandle
+}
+
+func (p *keyDataPolicy_v5) PINIndexContext(tpm *tpm2.TPMContext, session tpm2.SessionContext) (*pinIndexContext, error) {
+	pinIndexHandle := p.StaticData.PINIndexHandle
+	if pinIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, policyDataError{fmt.Errorf("invalid handle %v for PIN NV index", pinIndexHandle)}
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(pinIndexHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, pinIndexHandle):
+		// If there is no NV index at the expected handle then the key file is invalid and must be recreated.
+		return nil, policyDataError{errors.New("no PIN NV index found")}
+	case err != nil:
+		return nil, err
+	}
+
+	return &pinIndexContext{
+		tpm:        tpm,
+		index:      index,
+		session:    session,
+		updateKey:  p.StaticData.AuthPublicKey,
+		retryLimit: p.StaticData.PINRetryLimit}, nil
+}
+
+// ExecutePINPolicy executes a PolicySecret assertion for the PIN NV index using the
+// supplied PIN. An incorrect PIN increments the retry counter of the index, and a
+// correct PIN clears it. If the retry limit of the index has already been reached,
+// a PINLockoutError error is returned.
+func (p *keyDataPolicy_v5) ExecutePINPolicy(tpm *tpm2.TPMContext, pin tpm2.Auth, policySession, hmacSession tpm2.SessionContext) error {
+	context, err := p.PINIndexContext(tpm, hmacSession)
+	if err != nil {
+		return err
+	}
+	context.index.SetAuthValue(pin)
+
+	if _, _, err := tpm.PolicySecret(context.index, policySession, nil, nil, 0, hmacSession); err != nil {
+		if tpm2.IsTPMError(err, tpm2.ErrorAuthUnavailable, tpm2.CommandPolicySecret) {
+			return PINLockoutError{p.StaticData.PINIndexHandle}
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,523 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto"
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type policyV5SuiteNoTPM struct {
+	policyV3Mixin
+}
+
+type policyV5Suite struct {
+	tpm2test.TPMTest
+	policyV3Mixin
+}
+
+func (s *policyV5Suite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy | tpm2test.TPMFeaturePCR | tpm2test.TPMFeatureNV
+}
+
+var _ = Suite(&policyV5Suite{})
+var _ = Suite(&policyV5SuiteNoTPM{})
+
+func (s *policyV5SuiteNoTPM) mockPinIndexPub(handle tpm2.Handle) *tpm2.NVPublic {
+	return &tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypePinFail.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVOwnerRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		Size:    8}
+}
+
+func (s *policyV5SuiteNoTPM) TestComputePinIndexAuthPolicies(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)
+
+	policies := ComputeV5PinIndexAuthPolicies(tpm2.HashAlgorithmSHA256, authKeyPublic.Name())
+	c.Assert(policies, HasLen, 3)
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicySigned(authKeyPublic.Name(), nil)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	c.Check(policies[0], DeepEquals, trial.GetDigest())
+
+	trial = util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicySecret(tpm2.Name(mu.MustMarshalToBytes(tpm2.HandleOwner)), nil)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	c.Check(policies[1], DeepEquals, trial.GetDigest())
+
+	trial = util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyAuthValue()
+	trial.PolicyCommandCode(tpm2.CommandNVChangeAuth)
+	c.Check(policies[2], DeepEquals, trial.GetDigest())
+}
+
+func (s *policyV5SuiteNoTPM) TestNewKeyDataPolicy(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)
+
+	counterPub := &tpm2.NVPublic{
+		Index:   0x01800000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		Size:    8}
+	pinPub := s.mockPinIndexPub(0x01800001)
+
+	policyData, digest, err := NewKeyDataPolicyV5(tpm2.HashAlgorithmSHA256, authKeyPublic, counterPub, 10, pinPub, 3)
+	c.Assert(err, IsNil)
+	c.Assert(policyData, testutil.ConvertibleTo, &KeyDataPolicy_v5{})
+	c.Check(policyData.(*KeyDataPolicy_v5).StaticData.AuthPublicKey, DeepEquals, authKeyPublic)
+	c.Check(policyData.PCRPolicyCounterHandle(), Equals, counterPub.Index)
+	c.Check(policyData.PCRPolicySequence(), Equals, uint64(10))
+	c.Check(policyData.(*KeyDataPolicy_v5).PINIndexHandle(), Equals, pinPub.Index)
+	c.Check(policyData.(*KeyDataPolicy_v5).StaticData.PINRetryLimit, Equals, uint32(3))
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyAuthorize(ComputeV3PcrPolicyRefFromCounterName(counterPub.Name()), authKeyPublic.Name())
+	trial.PolicySecret(pinPub.Name(), nil)
+	c.Check(digest, DeepEquals, trial.GetDigest())
+}
+
+func (s *policyV5SuiteNoTPM) TestNewKeyDataPolicyNoPolicyCounter(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)
+
+	pinPub := s.mockPinIndexPub(0x01800001)
+
+	policyData, digest, err := NewKeyDataPolicyV5(tpm2.HashAlgorithmSHA256, authKeyPublic, nil, 0, pinPub, 3)
+	c.Assert(err, IsNil)
+	c.Check(policyData.PCRPolicyCounterHandle(), Equals, tpm2.HandleNull)
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyAuthorize(ComputeV3PcrPolicyRefFromCounterName(nil), authKeyPublic.Name())
+	trial.PolicySecret(pinPub.Name(), nil)
+	c.Check(digest, DeepEquals, trial.GetDigest())
+}
+
+func (s *policyV5SuiteNoTPM) TestNewKeyDataPolicyNoPINIndex(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)
+
+	_, _, err := NewKeyDataPolicyV5(tpm2.HashAlgorithmSHA256, authKeyPublic, nil, 0, nil, 3)
+	c.Check(err, ErrorMatches, "no PIN NV index supplied")
+}
+
+func (s *policyV5SuiteNoTPM) TestPCRPolicyCounterHandle(c *C) {
+	var data KeyDataPolicy = &KeyDataPolicy_v5{
+		StaticData: &StaticPolicyData_v5{
+			PCRPolicyCounterHandle: 0x01800000}}
+	c.Check(data.PCRPolicyCounterHandle(), Equals, tpm2.Handle(0x01800000))
+
+	data = &KeyDataPolicy_v5{
+		StaticData: &StaticPolicyData_v5{
+			PCRPolicyCounterHandle: tpm2.HandleNull}}
+	c.Check(data.PCRPolicyCounterHandle(), Equals, tpm2.HandleNull)
+}
+
+func (s *policyV5SuiteNoTPM) TestPCRPolicySequence(c *C) {
+	var data KeyDataPolicy = &KeyDataPolicy_v5{
+		PCRData: &PcrPolicyData_v5{
+			PolicySequence: 10}}
+	c.Check(data.PCRPolicySequence(), Equals, uint64(10))
+
+	data = &KeyDataPolicy_v5{
+		PCRData: &PcrPolicyData_v5{
+			PolicySequence: 500}}
+	c.Check(data.PCRPolicySequence(), Equals, uint64(500))
+}
+
+func (s *policyV5SuiteNoTPM) TestPINIndexHandle(c *C) {
+	data := &KeyDataPolicy_v5{
+		StaticData: &StaticPolicyData_v5{
+			PINIndexHandle: 0x01800001}}
+	c.Check(data.PINIndexHandle(), Equals, tpm2.Handle(0x01800001))
+
+	data = &KeyDataPolicy_v5{
+		StaticData: &StaticPolicyData_v5{
+			PINIndexHandle: 0x0180ff00}}
+	c.Check(data.PINIndexHandle(), Equals, tpm2.Handle(0x0180ff00))
+}
+
+func (s *policyV5SuiteNoTPM) TestUpdatePCRPolicyMatchesV3(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key)
+
+	counterName := s.mockPinIndexPub(0x01800000).Name()
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}}
+	pcrDigests := tpm2.DigestList{hash(crypto.SHA256, "1"), hash(crypto.SHA256, "2")}
+
+	v3 := &KeyDataPolicy_v3{
+		StaticData: &StaticPolicyData_v3{
+			AuthPublicKey:          authKeyPublic,
+			PCRPolicyCounterHandle: 0x01800000},
+		PCRData: &PcrPolicyData_v3{
+			PolicySequence: 1000}}
+	c.Check(v3.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, NewPcrPolicyParams(key, pcrs, pcrDigests, counterName)), IsNil)
+
+	v5 := &KeyDataPolicy_v5{
+		StaticData: &StaticPolicyData_v5{
+			AuthPublicKey:          authKeyPublic,
+			PCRPolicyCounterHandle: 0x01800000,
+			PINIndexHandle:         0x01800001},
+		PCRData: &PcrPolicyData_v5{
+			PolicySequence: 1000}}
+	c.Check(v5.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, NewPcrPolicyParams(key, pcrs, pcrDigests, counterName)), IsNil)
+
+	c.Check(v5.PCRData.Selection, tpm2_testutil.TPMValueDeepEquals, v3.PCRData.Selection)
+	c.Check(v5.PCRData.OrData, DeepEquals, v3.PCRData.OrData)
+	c.Check(v5.PCRData.PolicySequence, Equals, uint64(1001))
+	c.Check(v5.PCRData.AuthorizedPolicy, DeepEquals, v3.PCRData.AuthorizedPolicy)
+	c.Check(v5.PCRData.AuthorizedPolicySignature.SigAlg, Equals, tpm2.SigSchemeAlgECDSA)
+
+	// The v3 view shares the PCR data but doesn't modify the static data.
+	c.Check(v5.StaticData.PINIndexHandle, Equals, tpm2.Handle(0x01800001))
+}
+
+func (s *policyV5SuiteNoTPM) TestSetPCRPolicyFrom(c *C) {
+	key := make(secboot.AuxiliaryKey, 32)
+	rand.Read(key)
+
+	policyData1 := &KeyDataPolicy_v5{
+		StaticData: &StaticPolicyData_v5{
+			AuthPublicKey:          s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			PINIndexHandle:         0x01800001},
+		PCRData: &PcrPolicyData_v5{
+			PolicySequence: 5000}}
+
+	params := NewPcrPolicyParams(key,
+		tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}},
+		tpm2.DigestList{hash(crypto.SHA256, "1"), hash(crypto.SHA256, "2")},
+		nil)
+	c.Check(policyData1.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, params), IsNil)
+
+	var policyData2 KeyDataPolicy = &KeyDataPolicy_v5{
+		StaticData: &StaticPolicyData_v5{
+			AuthPublicKey:          s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, key),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			PINIndexHandle:         0x01800001}}
+	policyData2.SetPCRPolicyFrom(policyData1)
+
+	c.Check(policyData2.(*KeyDataPolicy_v5).PCRData, DeepEquals, policyData1.PCRData)
+}
+
+func (s *policyV5SuiteNoTPM) TestValidateAuthKey(c *C) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	data := &KeyDataPolicy_v5{
+		StaticData: &StaticPolicyData_v5{
+			AuthPublicKey: authKeyPublic}}
+	c.Check(data.ValidateAuthKey(authKey), IsNil)
+}
+
+func (s *policyV5SuiteNoTPM) TestValidateAuthKeyWrongKey(c *C) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	data := &KeyDataPolicy_v5{
+		StaticData: &StaticPolicyData_v5{
+			AuthPublicKey: authKeyPublic}}
+
+	rand.Read(authKey)
+
+	err := data.ValidateAuthKey(authKey)
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, "dynamic authorization policy signing private key doesn't match public key")
+}
+
+func (s *policyV5Suite) TestCreatePinIndex(c *C) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	handle := s.NextAvailableHandle(c, 0x01800000)
+
+	pub, err := CreatePinIndex(s.TPM().TPMContext, handle, authKeyPublic, authKey, 3, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+	c.Check(pub.Index, Equals, handle)
+	c.Check(pub.Attrs, Equals, tpm2.NVTypePinFail.WithAttrs(tpm2.AttrNVPolicyWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVOwnerRead|tpm2.AttrNVNoDA|tpm2.AttrNVWritten))
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyOR(ComputeV5PinIndexAuthPolicies(tpm2.HashAlgorithmSHA256, authKeyPublic.Name()))
+	c.Check(pub.AuthPolicy, DeepEquals, trial.GetDigest())
+
+	index, err := s.TPM().CreateResourceContextFromTPM(handle)
+	c.Assert(err, IsNil)
+	c.Check(index.Name(), DeepEquals, pub.Name())
+
+	params, err := s.TPM().NVReadPinCounterParams(s.TPM().OwnerHandleContext(), index, nil)
+	c.Check(err, IsNil)
+	c.Check(params, DeepEquals, &tpm2.NVPinCounterParams{Count: 0, Limit: 3})
+}
+
+func (s *policyV5Suite) TestCreatePinIndexWrongKey(c *C) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	rand.Read(authKey)
+
+	handle := s.NextAvailableHandle(c, 0x01800000)
+
+	_, err := CreatePinIndex(s.TPM().TPMContext, handle, authKeyPublic, authKey, 3, s.TPM().HmacSession())
+	c.Check(tpm2.IsTPMParameterError(err, tpm2.ErrorSignature, tpm2.CommandPolicySigned, 5), testutil.IsTrue)
+	c.Check(s.TPM().DoesHandleExist(handle), testutil.IsFalse)
+}
+
+// newPinPolicy creates a PIN NV index with the supplied retry limit and PIN and
+// a v5 policy that uses it, returning the policy, the auth key and the expected
+// digest of the PIN assertions.
+func (s *policyV5Suite) newPinPolicy(c *C, limit uint32, pin tpm2.Auth) (*KeyDataPolicy_v5, secboot.AuxiliaryKey, tpm2.Digest) {
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+	authKeyPublic := s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey)
+
+	pub, err := CreatePinIndex(s.TPM().TPMContext, s.NextAvailableHandle(c, 0x01800000), authKeyPublic, authKey, limit, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+
+	policyData, _, err := NewKeyDataPolicyV5(tpm2.HashAlgorithmSHA256, authKeyPublic, nil, 0, pub, limit)
+	c.Assert(err, IsNil)
+
+	if len(pin) > 0 {
+		context, err := policyData.(*KeyDataPolicy_v5).PINIndexContext(s.TPM().TPMContext, s.TPM().HmacSession())
+		c.Assert(err, IsNil)
+		c.Assert(context.ChangeAuth(nil, pin), IsNil)
+	}
+
+	trial := util.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicySecret(pub.Name(), nil)
+
+	return policyData.(*KeyDataPolicy_v5), authKey, trial.GetDigest()
+}
+
+func (s *policyV5Suite) executePINPolicy(c *C, policyData *KeyDataPolicy_v5, pin tpm2.Auth) (tpm2.Digest, error) {
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	executeErr := policyData.ExecutePINPolicy(s.TPM().TPMContext, pin, session, s.TPM().HmacSession())
+
+	digest, err := s.TPM().PolicyGetDigest(session)
+	c.Check(err, IsNil)
+	s.TPM().FlushContext(session)
+
+	return digest, executeErr
+}
+
+func (s *policyV5Suite) pinCounterParams(c *C, policyData *KeyDataPolicy_v5) *tpm2.NVPinCounterParams {
+	context, err := policyData.PINIndexContext(s.TPM().TPMContext, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+	params, err := context.Get()
+	c.Assert(err, IsNil)
+	return params
+}
+
+func (s *policyV5Suite) lockoutCounter(c *C) uint32 {
+	props, err := s.TPM().GetCapabilityTPMProperties(tpm2.PropertyLockoutCounter, 1)
+	c.Assert(err, IsNil)
+	c.Assert(props, HasLen, 1)
+	return props[0].Value
+}
+
+func (s *policyV5Suite) TestExecutePINPolicy(c *C) {
+	policyData, _, expected := s.newPinPolicy(c, 3, []byte("1234"))
+
+	digest, err := s.executePINPolicy(c, policyData, []byte("1234"))
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+	c.Check(s.pinCounterParams(c, policyData), DeepEquals, &tpm2.NVPinCounterParams{Count: 0, Limit: 3})
+}
+
+func (s *policyV5Suite) TestExecutePINPolicyEmptyPIN(c *C) {
+	policyData, _, expected := s.newPinPolicy(c, 3, nil)
+
+	digest, err := s.executePINPolicy(c, policyData, nil)
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+}
+
+func (s *policyV5Suite) TestExecutePINPolicyWrongPIN(c *C) {
+	policyData, _, expected := s.newPinPolicy(c, 3, []byte("1234"))
+
+	lockoutCounter := s.lockoutCounter(c)
+
+	_, err := s.executePINPolicy(c, policyData, []byte("4321"))
+	c.Check(tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, tpm2.CommandPolicySecret, 1), testutil.IsTrue)
+	c.Check(s.pinCounterParams(c, policyData), DeepEquals, &tpm2.NVPinCounterParams{Count: 1, Limit: 3})
+
+	_, err = s.executePINPolicy(c, policyData, []byte("5678"))
+	c.Check(tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, tpm2.CommandPolicySecret, 1), testutil.IsTrue)
+	c.Check(s.pinCounterParams(c, policyData), DeepEquals, &tpm2.NVPinCounterParams{Count: 2, Limit: 3})
+
+	// Reading the retry counter doesn't affect it.
+	c.Check(s.pinCounterParams(c, policyData), DeepEquals, &tpm2.NVPinCounterParams{Count: 2, Limit: 3})
+
+	// The TPM's dictionary attack counter is unaffected.
+	c.Check(s.lockoutCounter(c), Equals, lockoutCounter)
+
+	// A correct PIN clears the retry counter.
+	digest, err := s.executePINPolicy(c, policyData, []byte("1234"))
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+	c.Check(s.pinCounterParams(c, policyData), DeepEquals, &tpm2.NVPinCounterParams{Count: 0, Limit: 3})
+}
+
+func (s *policyV5Suite) TestExecutePINPolicyLockout(c *C) {
+	policyData, _, _ := s.newPinPolicy(c, 2, []byte("1234"))
+
+	for i := 0; i < 2; i++ {
+		_, err := s.executePINPolicy(c, policyData, []byte("4321"))
+		c.Check(tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, tpm2.CommandPolicySecret, 1), testutil.IsTrue)
+	}
+
+	// The correct PIN is rejected once the retry limit is reached.
+	_, err := s.executePINPolicy(c, policyData, []byte("1234"))
+	c.Check(err, Equals, PINLockoutError{policyData.PINIndexHandle()})
+	c.Check(err, ErrorMatches, "the PIN associated with the NV index at handle 0x[[:xdigit:]]{8} is locked out because of too many incorrect attempts")
+}
+
+func (s *policyV5Suite) TestPinIndexContextReset(c *C) {
+	policyData, authKey, expected := s.newPinPolicy(c, 1, []byte("1234"))
+
+	_, err := s.executePINPolicy(c, policyData, []byte("4321"))
+	c.Check(err, NotNil)
+	c.Check(s.pinCounterParams(c, policyData), DeepEquals, &tpm2.NVPinCounterParams{Count: 1, Limit: 1})
+
+	context, err := policyData.PINIndexContext(s.TPM().TPMContext, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+	c.Check(context.Reset(authKey), IsNil)
+	c.Check(s.pinCounterParams(c, policyData), DeepEquals, &tpm2.NVPinCounterParams{Count: 0, Limit: 1})
+
+	digest, err := s.executePINPolicy(c, policyData, []byte("1234"))
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+}
+
+func (s *policyV5Suite) TestPinIndexContextResetWrongKey(c *C) {
+	policyData, _, _ := s.newPinPolicy(c, 1, nil)
+
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+
+	context, err := policyData.PINIndexContext(s.TPM().TPMContext, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+	err = context.Reset(authKey)
+	c.Check(tpm2.IsTPMParameterError(err, tpm2.ErrorSignature, tpm2.CommandPolicySigned, 5), testutil.IsTrue)
+}
+
+func (s *policyV5Suite) TestPinIndexContextResetWithOwnerAuth(c *C) {
+	policyData, _, expected := s.newPinPolicy(c, 1, []byte("1234"))
+
+	_, err := s.executePINPolicy(c, policyData, []byte("4321"))
+	c.Check(err, NotNil)
+	_, err = s.executePINPolicy(c, policyData, []byte("1234"))
+	c.Check(err, testutil.ConvertibleTo, PINLockoutError{})
+
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("1234"))
+
+	context, err := policyData.PINIndexContext(s.TPM().TPMContext, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+	c.Check(context.ResetWithOwnerAuth(), IsNil)
+	c.Check(s.pinCounterParams(c, policyData), DeepEquals, &tpm2.NVPinCounterParams{Count: 0, Limit: 1})
+
+	digest, err := s.executePINPolicy(c, policyData, []byte("1234"))
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+}
+
+func (s *policyV5Suite) TestPinIndexContextResetWithOwnerAuthWrongAuth(c *C) {
+	policyData, _, _ := s.newPinPolicy(c, 1, nil)
+
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("1234"))
+	s.TPM().OwnerHandleContext().SetAuthValue([]byte("4321"))
+
+	context, err := policyData.PINIndexContext(s.TPM().TPMContext, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+	err = context.ResetWithOwnerAuth()
+	c.Check(tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, tpm2.CommandPolicySecret, 1), testutil.IsTrue)
+}
+
+func (s *policyV5Suite) TestPinIndexContextChangeAuth(c *C) {
+	policyData, _, expected := s.newPinPolicy(c, 3, []byte("1234"))
+
+	context, err := policyData.PINIndexContext(s.TPM().TPMContext, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+	c.Check(context.ChangeAuth([]byte("1234"), []byte("5678")), IsNil)
+
+	_, err = s.executePINPolicy(c, policyData, []byte("1234"))
+	c.Check(tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, tpm2.CommandPolicySecret, 1), testutil.IsTrue)
+
+	digest, err := s.executePINPolicy(c, policyData, []byte("5678"))
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+}
+
+func (s *policyV5Suite) TestPinIndexContextChangeAuthWrongPIN(c *C) {
+	policyData, _, _ := s.newPinPolicy(c, 3, []byte("1234"))
+
+	lockoutCounter := s.lockoutCounter(c)
+
+	context, err := policyData.PINIndexContext(s.TPM().TPMContext, s.TPM().HmacSession())
+	c.Assert(err, IsNil)
+	err = context.ChangeAuth([]byte("4321"), []byte("5678"))
+	c.Check(tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, tpm2.CommandNVChangeAuth, 1), testutil.IsTrue)
+	c.Check(s.pinCounterParams(c, policyData), DeepEquals, &tpm2.NVPinCounterParams{Count: 1, Limit: 3})
+	c.Check(s.lockoutCounter(c), Equals, lockoutCounter)
+}
+
+func (s *policyV5Suite) TestExecutePINPolicyErrorHandlingNoIndex(c *C) {
+	policyData, _, _ := s.newPinPolicy(c, 3, nil)
+
+	index, err := s.TPM().CreateResourceContextFromTPM(policyData.PINIndexHandle())
+	c.Assert(err, IsNil)
+	c.Check(s.TPM().NVUndefineSpace(s.TPM().OwnerHandleContext(), index, nil), IsNil)
+
+	_, err = s.executePINPolicy(c, policyData, nil)
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, "no PIN NV index found")
+}
+
+func (s *policyV5Suite) TestExecutePINPolicyErrorHandlingInvalidIndexHandle(c *C) {
+	policyData, _, _ := s.newPinPolicy(c, 3, nil)
+	policyData.StaticData.PINIndexHandle = 0x81000000
+
+	_, err := s.executePINPolicy(c, policyData, nil)
+	c.Check(IsPolicyDataError(err), testutil.IsTrue)
+	c.Check(err, ErrorMatches, "invalid handle 0x81000000 for PIN NV index")
+}
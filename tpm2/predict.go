@@ -0,0 +1,164 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// UnsealPrediction describes whether a sealed key object is expected to be
+// unsealable with a set of predicted PCR values.
+type UnsealPrediction struct {
+	// PCRPolicyRevoked indicates that the current PCR policy has been
+	// revoked by incrementing the PCR policy counter beyond the sequence
+	// number of the policy, in which case the key will not be unsealable
+	// regardless of the PCR values. For keys with a PCR policy NV index,
+	// this indicates that the NV index contains the digest of a different
+	// PCR policy, either because the PCR policy has been revoked or because
+	// it hasn't been authorized with RevokeOldPCRProtectionPolicies yet.
+	PCRPolicyRevoked bool
+
+	// RejectedPCRValues contains the supplied sets of PCR values that
+	// are not accepted by the current PCR policy.
+	RejectedPCRValues []tpm2.PCRValues
+}
+
+// Unsealable indicates whether the sealed key object is expected to be
+// unsealable with every supplied set of PCR values.
+func (p *UnsealPrediction) Unsealable() bool {
+	return !p.PCRPolicyRevoked && len(p.RejectedPCRValues) == 0
+}
+
+// predictUnsealImpl is a helper to predict whether this key can be unsealed
+// with each of the supplied sets of PCR values. If tpm is nil, the PCR policy
+// counter is not checked.
+func (k *sealedKeyDataBase) predictUnsealImpl(tpm *tpm2.TPMContext, values []tpm2.PCRValues, session tpm2.SessionContext) (*UnsealPrediction, error) {
+	if len(values) == 0 {
+		return nil, errors.New("no PCR values supplied")
+	}
+
+	policy := k.data.Policy()
+	prediction := new(UnsealPrediction)
+
+	if handle := policy.PCRPolicyCounterHandle(); tpm != nil && handle != tpm2.HandleNull {
+		counter, err := tpm.CreateResourceContextFromTPM(handle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, handle):
+			return nil, errors.New("no PCR policy counter found")
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+		}
+
+		counterPub, _, err := tpm.NVReadPublic(counter)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read public area of PCR policy counter: %w", err)
+		}
+
+		if nvPolicy, ok := policy.(nvAuthorizedKeyDataPolicy); ok {
+			context, err := nvPolicy.PCRPolicyIndexContext(tpm, counterPub, session)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot create context for PCR policy NV index: %w", err)
+			}
+
+			current, err := context.Get()
+			if err != nil {
+				return nil, xerrors.Errorf("cannot read current value of PCR policy NV index: %w", err)
+			}
+			prediction.PCRPolicyRevoked = !bytes.Equal(current, nvPolicy.PCRPolicyDigest())
+		} else {
+			context, err := policy.PCRPolicyCounterContext(tpm, counterPub, session)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+			}
+
+			current, err := context.Get()
+			if err != nil {
+				return nil, xerrors.Errorf("cannot read current value of PCR policy counter: %w", err)
+			}
+			prediction.PCRPolicyRevoked = current > policy.PCRPolicySequence()
+		}
+	}
+
+	alg := k.data.Public().NameAlg
+	for _, v := range values {
+		ok, err := policy.AcceptsPCRValues(alg, v)
+		if err != nil {
+			err = xerrors.Errorf("cannot check PCR values against policy: %w", err)
+			if isPolicyDataError(err) {
+				return nil, InvalidKeyDataError{err.Error()}
+			}
+			return nil, err
+		}
+		if !ok {
+			prediction.RejectedPCRValues = append(prediction.RejectedPCRValues, v)
+		}
+	}
+
+	return prediction, nil
+}
+
+// PredictUnseal predicts whether this sealed key object will be unsealable
+// with each of the supplied sets of PCR values, eg, those expected on the next
+// boot after a kernel or firmware update. It checks the supplied values
+// against the current authorized PCR policy without loading or unsealing the
+// sealed object, and so can be used before rebooting in order to avoid
+// unexpectedly booting into recovery.
+//
+// Each set of PCR values must contain a value for every PCR included in the
+// current PCR policy.
+//
+// If tpm is not nil, this also checks whether the current PCR policy has been
+// revoked using the PCR policy counter. If tpm is nil, this check is skipped.
+//
+// If the PCR policy metadata is invalid, a InvalidKeyDataError error will be
+// returned.
+func (k *SealedKeyData) PredictUnseal(tpm *Connection, values ...tpm2.PCRValues) (*UnsealPrediction, error) {
+	if tpm == nil {
+		return k.predictUnsealImpl(nil, values, nil)
+	}
+	return k.predictUnsealImpl(tpm.TPMContext, values, tpm.HmacSession())
+}
+
+// PredictUnsealWithProfile predicts whether this sealed key object will be
+// unsealable on a boot described by the supplied PCR protection profile. Every
+// combination of PCR values produced by the profile must be accepted by the
+// current PCR policy for the returned prediction to be unsealable. See the
+// documentation for PredictUnseal.
+//
+// If tpm is not nil, it is also used to read any PCR values that the profile
+// obtains from the TPM.
+func (k *SealedKeyData) PredictUnsealWithProfile(tpm *Connection, profile *PCRProtectionProfile) (*UnsealPrediction, error) {
+	var tpmContext *tpm2.TPMContext
+	if tpm != nil {
+		tpmContext = tpm.TPMContext
+	}
+
+	values, err := profile.ComputePCRValues(tpmContext)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+	}
+
+	return k.PredictUnseal(tpm, values...)
+}
@@ -0,0 +1,279 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto"
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/util"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type predictSuiteNoTPM struct {
+	policyV3Mixin
+}
+
+var _ = Suite(&predictSuiteNoTPM{})
+
+func (s *predictSuiteNoTPM) newSealedKeyData(c *C, pcrs tpm2.PCRSelectionList, values ...tpm2.PCRValues) *SealedKeyData {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+	authKey := make(secboot.AuxiliaryKey, 32)
+	rand.Read(authKey)
+
+	var pcrDigests tpm2.DigestList
+	for _, v := range values {
+		digest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, v)
+		c.Assert(err, IsNil)
+		pcrDigests = append(pcrDigests, digest)
+	}
+
+	policyData := &KeyDataPolicy_v3{
+		StaticData: &StaticPolicyData_v3{
+			AuthPublicKey:          s.newPolicyAuthPublicKey(c, tpm2.HashAlgorithmSHA256, authKey),
+			PCRPolicyCounterHandle: tpm2.HandleNull},
+		PCRData: &PcrPolicyData_v3{}}
+	c.Assert(policyData.UpdatePCRPolicy(tpm2.HashAlgorithmSHA256, NewPcrPolicyParams(authKey, pcrs, pcrDigests, nil)), IsNil)
+
+	var sealer mockKeySealer
+	kd, err := MakeKeyDataWithPolicy(key, authKey, &KeyDataPolicyParams{
+		Alg:        tpm2.HashAlgorithmSHA256,
+		PolicyData: policyData,
+		AuthPolicy: make(tpm2.Digest, 32)}, &sealer)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(kd)
+	c.Assert(err, IsNil)
+	return skd
+}
+
+func (s *predictSuiteNoTPM) TestPredictUnseal(c *C) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}}
+	values := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo"), 7: hash(crypto.SHA256, "bar")}}
+	skd := s.newSealedKeyData(c, pcrs, values)
+
+	prediction, err := skd.PredictUnseal(nil, values)
+	c.Assert(err, IsNil)
+	c.Check(prediction.Unsealable(), testutil.IsTrue)
+	c.Check(prediction.PCRPolicyRevoked, testutil.IsFalse)
+	c.Check(prediction.RejectedPCRValues, HasLen, 0)
+}
+
+func (s *predictSuiteNoTPM) TestPredictUnsealRejected(c *C) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}}
+	skd := s.newSealedKeyData(c, pcrs,
+		tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo"), 7: hash(crypto.SHA256, "bar")}})
+
+	accepted := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo"), 7: hash(crypto.SHA256, "bar")}}
+	rejected := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo2"), 7: hash(crypto.SHA256, "bar")}}
+
+	prediction, err := skd.PredictUnseal(nil, accepted, rejected)
+	c.Assert(err, IsNil)
+	c.Check(prediction.Unsealable(), testutil.IsFalse)
+	c.Check(prediction.PCRPolicyRevoked, testutil.IsFalse)
+	c.Check(prediction.RejectedPCRValues, DeepEquals, []tpm2.PCRValues{rejected})
+}
+
+func (s *predictSuiteNoTPM) TestPredictUnsealNoValues(c *C) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	skd := s.newSealedKeyData(c, pcrs, tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: hash(crypto.SHA256, "bar")}})
+
+	_, err := skd.PredictUnseal(nil)
+	c.Check(err, ErrorMatches, "no PCR values supplied")
+}
+
+func (s *predictSuiteNoTPM) TestPredictUnsealMissingPCR(c *C) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}}
+	skd := s.newSealedKeyData(c, pcrs,
+		tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo"), 7: hash(crypto.SHA256, "bar")}})
+
+	_, err := skd.PredictUnseal(nil, tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: hash(crypto.SHA256, "bar")}})
+	c.Check(err, ErrorMatches, "cannot check PCR values against policy: cannot compute PCR digest: .*")
+}
+
+func (s *predictSuiteNoTPM) TestPredictUnsealWithProfile(c *C) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}}
+	skd := s.newSealedKeyData(c, pcrs,
+		tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo1"), 7: hash(crypto.SHA256, "bar")}},
+		tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo2"), 7: hash(crypto.SHA256, "bar")}})
+
+	profile := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, hash(crypto.SHA256, "bar")).
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "foo1")),
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "foo2")))
+
+	prediction, err := skd.PredictUnsealWithProfile(nil, profile)
+	c.Assert(err, IsNil)
+	c.Check(prediction.Unsealable(), testutil.IsTrue)
+}
+
+func (s *predictSuiteNoTPM) TestPredictUnsealWithProfileRejected(c *C) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7}}}
+	skd := s.newSealedKeyData(c, pcrs,
+		tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo1"), 7: hash(crypto.SHA256, "bar")}})
+
+	profile := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, hash(crypto.SHA256, "bar")).
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "foo1")),
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 4, hash(crypto.SHA256, "foo2")))
+
+	prediction, err := skd.PredictUnsealWithProfile(nil, profile)
+	c.Assert(err, IsNil)
+	c.Check(prediction.Unsealable(), testutil.IsFalse)
+	c.Check(prediction.RejectedPCRValues, DeepEquals, []tpm2.PCRValues{
+		{tpm2.HashAlgorithmSHA256: {4: hash(crypto.SHA256, "foo2"), 7: hash(crypto.SHA256, "bar")}}})
+}
+
+type predictSuite struct {
+	tpm2test.TPMTest
+	primaryKeyMixin
+}
+
+func (s *predictSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *predictSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	s.primaryKeyMixin.tpmTest = &s.TPMTest.TPMTest
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&predictSuite{})
+
+func (s *predictSuite) TestPredictUnsealCurrentPCRValues(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+	k, _, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+
+	_, values, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}})
+	c.Assert(err, IsNil)
+
+	prediction, err := skd.PredictUnseal(s.TPM(), values)
+	c.Assert(err, IsNil)
+	c.Check(prediction.Unsealable(), testutil.IsTrue)
+
+	_, _, err = k.RecoverKeys()
+	c.Check(err, IsNil)
+}
+
+func (s *predictSuite) TestPredictUnsealRevokedPolicy(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+	k1, authKey, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	w := newMockKeyDataWriter()
+	c.Check(k1.WriteAtomic(w), IsNil)
+	k2, err := secboot.ReadKeyData(w.Reader())
+	c.Assert(err, IsNil)
+
+	skd1, err := NewSealedKeyData(k1)
+	c.Assert(err, IsNil)
+	skd2, err := NewSealedKeyData(k2)
+	c.Assert(err, IsNil)
+
+	c.Check(skd2.UpdatePCRProtectionPolicy(s.TPM(), authKey, params.PCRProfile), IsNil)
+	c.Check(skd2.RevokeOldPCRProtectionPolicies(s.TPM(), authKey), IsNil)
+
+	_, values, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}})
+	c.Assert(err, IsNil)
+
+	prediction, err := skd1.PredictUnseal(s.TPM(), values)
+	c.Assert(err, IsNil)
+	c.Check(prediction.PCRPolicyRevoked, testutil.IsTrue)
+	c.Check(prediction.RejectedPCRValues, HasLen, 0)
+	c.Check(prediction.Unsealable(), testutil.IsFalse)
+
+	prediction, err = skd2.PredictUnseal(s.TPM(), values)
+	c.Assert(err, IsNil)
+	c.Check(prediction.Unsealable(), testutil.IsTrue)
+}
+
+func (s *predictSuite) TestPredictUnsealNVAuthorizedRevokedPolicy(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		NVAuthorizedPCRPolicy:  true}
+	k1, authKey, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	w := newMockKeyDataWriter()
+	c.Check(k1.WriteAtomic(w), IsNil)
+	k2, err := secboot.ReadKeyData(w.Reader())
+	c.Assert(err, IsNil)
+
+	skd1, err := NewSealedKeyData(k1)
+	c.Assert(err, IsNil)
+	skd2, err := NewSealedKeyData(k2)
+	c.Assert(err, IsNil)
+
+	c.Check(skd2.UpdatePCRProtectionPolicy(s.TPM(), authKey, tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7})), IsNil)
+
+	_, values, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}})
+	c.Assert(err, IsNil)
+
+	// The update isn't committed yet.
+	prediction, err := skd2.PredictUnseal(s.TPM(), values)
+	c.Assert(err, IsNil)
+	c.Check(prediction.PCRPolicyRevoked, testutil.IsTrue)
+
+	c.Check(skd2.RevokeOldPCRProtectionPolicies(s.TPM(), authKey), IsNil)
+
+	prediction, err = skd1.PredictUnseal(s.TPM(), values)
+	c.Assert(err, IsNil)
+	c.Check(prediction.PCRPolicyRevoked, testutil.IsTrue)
+	c.Check(prediction.Unsealable(), testutil.IsFalse)
+
+	prediction, err = skd2.PredictUnseal(s.TPM(), values)
+	c.Assert(err, IsNil)
+	c.Check(prediction.Unsealable(), testutil.IsTrue)
+}
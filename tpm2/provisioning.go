@@ -20,6 +20,7 @@
 package tpm2
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
@@ -39,16 +40,22 @@ const (
 	// Presence Interface Specification", version 1.30, revision 00.52, 28 July 2015.
 	clearPPIRequest string = "5"
 
-	// DA lockout parameters.
-	maxTries        uint32 = 32
-	recoveryTime    uint32 = 7200
-	lockoutRecovery uint32 = 86400
+	// Default DA lockout parameters.
+	defaultMaxTries        uint32 = 32
+	defaultRecoveryTime    uint32 = 7200
+	defaultLockoutRecovery uint32 = 86400
 
 	// srkTemplateHandle is the NV index at which we can find a custom template for
 	// the storage primary key, if one is supplied during provisioning. The handle
 	// here is in the range reserved for owner indices, so there shouldn't be
 	// anything here on a new installation.
 	srkTemplateHandle tpm2.Handle = 0x01810001
+
+	// ownerPersistentRangeStart and ownerPersistentRangeEnd define the range of
+	// persistent object handles reserved for the owner by the TCG "Registry of
+	// Reserved TPM 2.0 Handles and Localities".
+	ownerPersistentRangeStart tpm2.Handle = 0x81000000
+	ownerPersistentRangeEnd   tpm2.Handle = 0x817fffff
 )
 
 // ProvisionMode is used to control the behaviour of Connection.EnsureProvisioned.
@@ -69,6 +76,109 @@ const (
 	ProvisionModeClear
 )
 
+// DictionaryAttackParams contains the parameters of the TPM's dictionary attack
+// protection logic.
+type DictionaryAttackParams struct {
+	// MaxTries is the number of authorization failures permitted before
+	// the TPM enters lockout mode. This must not be zero.
+	MaxTries uint32
+
+	// RecoveryTime is the time in seconds after which the authorization
+	// failure count is decremented by one. Setting this to zero disables
+	// the dictionary attack protection.
+	RecoveryTime uint32
+
+	// LockoutRecovery is the time in seconds that must elapse after an
+	// authorization failure for the lockout hierarchy before it can be
+	// used again.
+	LockoutRecovery uint32
+}
+
+// ProvisionOptions provides options to Connection.EnsureProvisionedWithOptions.
+type ProvisionOptions struct {
+	// DictionaryAttackParams specifies the parameters of the TPM's dictionary
+	// attack protection logic. If this is nil, a default of 32 tries, a recovery
+	// time of 7200 seconds and a lockout recovery time of 86400 seconds are used.
+	DictionaryAttackParams *DictionaryAttackParams
+
+	// SRKHandle is the persistent handle at which to create the storage root
+	// key, which must be in the range reserved for owner persistent objects
+	// (0x81000000 - 0x817fffff). If this is zero, the handle returned from
+	// Connection.SRKHandle is used. On success, the connection uses this handle
+	// for subsequent calls to ListResources, Deprovision and HealthReport. Note
+	// that keys are always sealed to the storage root key at the handle defined
+	// by the TCG (0x81000001).
+	SRKHandle tpm2.Handle
+
+	// SRKTemplate is a custom template to use for the storage root key. It will be
+	// persisted inside the TPM and used by future calls to EnsureProvisioned.
+	SRKTemplate *tpm2.Public
+
+	// DiscardStoredSRKTemplate indicates that a custom SRK template persisted
+	// by a previous call should be discarded if SRKTemplate is not supplied,
+	// so that the default template is used. If this is false, a previously
+	// persisted template is reused.
+	DiscardStoredSRKTemplate bool
+
+	// KeepOwnerClearEnabled indicates that owner clear should not be disabled. This
+	// permits the TPM to be cleared with the lockout hierarchy authorization value
+	// rather than only via the physical presence interface. Note that owner clear
+	// cannot be re-enabled with this option once it has been disabled.
+	KeepOwnerClearEnabled bool
+}
+
+// checkSRKHandle returns an error if the supplied handle is not valid for a
+// storage root key.
+func checkSRKHandle(handle tpm2.Handle) error {
+	if handle < ownerPersistentRangeStart || handle > ownerPersistentRangeEnd {
+		return fmt.Errorf("invalid SRK handle %v: not in the range reserved for owner persistent objects", handle)
+	}
+	return nil
+}
+
+// checkDictionaryAttackParams returns an error if the supplied dictionary attack
+// parameters are not valid.
+func checkDictionaryAttackParams(params *DictionaryAttackParams) error {
+	if params.MaxTries == 0 {
+		return errors.New("invalid dictionary attack parameters: MaxTries must not be zero")
+	}
+	return nil
+}
+
+// ProvisionResult describes the changes made to the TPM by
+// Connection.EnsureProvisionedWithOptions.
+type ProvisionResult struct {
+	Cleared bool // The TPM was cleared
+
+	// EndorsementKeyChanged indicates that the endorsement key was created
+	// or replaced with a different key.
+	EndorsementKeyChanged bool
+
+	// StorageRootKeyChanged indicates that the storage root key was created
+	// or replaced with a different key.
+	StorageRootKeyChanged bool
+
+	// DictionaryAttackParamsChanged indicates that the parameters of the
+	// TPM's dictionary attack protection logic were changed.
+	DictionaryAttackParamsChanged bool
+
+	OwnerClearDisabled bool // Owner clear was disabled
+	LockoutAuthSet     bool // The authorization value for the lockout hierarchy was set
+}
+
+// persistentObjectName returns the name of the persistent object at the specified
+// handle, or nil if there isn't one.
+func persistentObjectName(tpm *tpm2.TPMContext, handle tpm2.Handle) (tpm2.Name, error) {
+	obj, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return obj.Name(), nil
+}
+
 func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, template *tpm2.Public, handle tpm2.Handle, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
 	obj, err := tpm.CreateResourceContextFromTPM(handle)
 	switch {
@@ -98,36 +208,44 @@ func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, t
 	return obj, nil
 }
 
-func selectSrkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext) *tpm2.Public {
+// readSrkTemplate returns the template for the storage primary key, along with
+// the state of the custom template. If there is no valid custom template, or it
+// cannot be read, the default template is returned.
+func readSrkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext) (*tpm2.Public, SRKTemplateState) {
 	nv, err := tpm.CreateResourceContextFromTPM(srkTemplateHandle)
 	if err != nil {
-		return tcg.SRKTemplate
+		return tcg.SRKTemplate, SRKTemplateStateDefault
 	}
 
 	nvPub, _, err := tpm.NVReadPublic(nv, session.IncludeAttrs(tpm2.AttrAudit))
 	if err != nil {
-		return tcg.SRKTemplate
+		return tcg.SRKTemplate, SRKTemplateStateUnknown
 	}
 
 	b, err := tpm.NVRead(tpm.OwnerHandleContext(), nv, nvPub.Size, 0, session)
 	if err != nil {
-		return tcg.SRKTemplate
+		return tcg.SRKTemplate, SRKTemplateStateUnknown
 	}
 
 	var tmpl *tpm2.Public
 	if _, err := mu.UnmarshalFromBytes(b, &tmpl); err != nil {
-		return tcg.SRKTemplate
+		return tcg.SRKTemplate, SRKTemplateStateDefault
 	}
 
 	if !tmpl.IsStorageParent() {
-		return tcg.SRKTemplate
+		return tcg.SRKTemplate, SRKTemplateStateDefault
 	}
 
+	return tmpl, SRKTemplateStateCustom
+}
+
+func selectSrkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext) *tpm2.Public {
+	tmpl, _ := readSrkTemplate(tpm, session)
 	return tmpl
 }
 
-func provisionStoragePrimaryKey(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
-	return provisionPrimaryKey(tpm, tpm.OwnerHandleContext(), selectSrkTemplate(tpm, session), tcg.SRKHandle, session)
+func provisionStoragePrimaryKey(tpm *tpm2.TPMContext, handle tpm2.Handle, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	return provisionPrimaryKey(tpm, tpm.OwnerHandleContext(), selectSrkTemplate(tpm, session), handle, session)
 }
 
 func storeSrkTemplate(tpm *tpm2.TPMContext, template *tpm2.Public, session tpm2.SessionContext) error {
@@ -175,134 +293,174 @@ func removeStoredSrkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext)
 	return nil
 }
 
-func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAuth []byte, srkTemplate *tpm2.Public, useExistingSrkTemplate bool) error {
+func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAuth []byte, opts *ProvisionOptions) (*ProvisionResult, error) {
+	daParams := opts.DictionaryAttackParams
+	if daParams == nil {
+		daParams = &DictionaryAttackParams{
+			MaxTries:        defaultMaxTries,
+			RecoveryTime:    defaultRecoveryTime,
+			LockoutRecovery: defaultLockoutRecovery}
+	}
+	srkHandle := opts.SRKHandle
+	if srkHandle == 0 {
+		srkHandle = t.SRKHandle()
+	}
+
+	result := new(ProvisionResult)
 	session := t.HmacSession()
 
 	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, session.IncludeAttrs(tpm2.AttrAudit))
 	if err != nil {
-		return xerrors.Errorf("cannot fetch permanent properties: %w", err)
+		return nil, xerrors.Errorf("cannot fetch permanent properties: %w", err)
 	}
 	if props[0].Property != tpm2.PropertyPermanent {
-		return errors.New("TPM returned value for the wrong property")
+		return nil, errors.New("TPM returned value for the wrong property")
 	}
 	if mode == ProvisionModeClear {
 		if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrDisableClear > 0 {
-			return ErrTPMClearRequiresPPI
+			return nil, ErrTPMClearRequiresPPI
 		}
 
 		if err := t.Clear(t.LockoutHandleContext(), session); err != nil {
 			switch {
 			case isAuthFailError(err, tpm2.CommandClear, 1):
-				return AuthFailError{tpm2.HandleLockout}
+				return nil, AuthFailError{tpm2.HandleLockout}
 			case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandClear):
-				return ErrTPMLockout
+				return nil, ErrTPMLockout
 			}
-			return xerrors.Errorf("cannot clear the TPM: %w", err)
+			return nil, xerrors.Errorf("cannot clear the TPM: %w", err)
 		}
+		result.Cleared = true
 	}
 
 	// Provision an endorsement key
-	if _, err := provisionPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), tcg.EKTemplate, tcg.EKHandle, session); err != nil {
+	origEkName, err := persistentObjectName(t.TPMContext, tcg.EKHandle)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain name of existing endorsement key: %w", err)
+	}
+	ek, err := provisionPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), tcg.EKTemplate, tcg.EKHandle, session)
+	if err != nil {
 		switch {
 		case isAuthFailError(err, tpm2.CommandEvictControl, 1):
-			return AuthFailError{tpm2.HandleOwner}
+			return nil, AuthFailError{tpm2.HandleOwner}
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
-			return AuthFailError{tpm2.HandleEndorsement}
+			return nil, AuthFailError{tpm2.HandleEndorsement}
 		default:
-			return xerrors.Errorf("cannot provision endorsement key: %w", err)
+			return nil, xerrors.Errorf("cannot provision endorsement key: %w", err)
 		}
 	}
+	result.EndorsementKeyChanged = !bytes.Equal(ek.Name(), origEkName)
 
 	// Reinitialize the connection, which creates a new session that's salted with a value protected with the newly provisioned EK.
 	// This will have a symmetric algorithm for parameter encryption during HierarchyChangeAuth.
 	if err := t.init(); err != nil {
 		var verifyErr verificationError
 		if xerrors.As(err, &verifyErr) {
-			return TPMVerificationError{fmt.Sprintf("cannot reinitialize TPM connection after provisioning endorsement key: %v", err)}
+			return nil, TPMVerificationError{fmt.Sprintf("cannot reinitialize TPM connection after provisioning endorsement key: %v", err)}
 		}
-		return xerrors.Errorf("cannot reinitialize TPM connection after provisioning endorsement key: %w", err)
+		return nil, xerrors.Errorf("cannot reinitialize TPM connection after provisioning endorsement key: %w", err)
 	}
 	session = t.HmacSession()
 
 	// Provision a storage root key
-	if !useExistingSrkTemplate && mode != ProvisionModeClear {
+	origSrkName, err := persistentObjectName(t.TPMContext, srkHandle)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain name of existing storage root key: %w", err)
+	}
+	if (opts.SRKTemplate != nil || opts.DiscardStoredSRKTemplate) && mode != ProvisionModeClear {
 		// If we're not reusing the existing custom template, remove it. We don't
 		// need to do this if mode == ProvisionModeClear because it will have already
 		// been removed.
 		if err := removeStoredSrkTemplate(t.TPMContext, session); err != nil {
-			return xerrors.Errorf("cannot remove stored custom SRK template: %w", err)
+			return nil, xerrors.Errorf("cannot remove stored custom SRK template: %w", err)
 		}
 	}
-	if srkTemplate != nil {
+	if opts.SRKTemplate != nil {
 		// Persist the new custom template
-		if err := storeSrkTemplate(t.TPMContext, srkTemplate, session); err != nil {
-			return xerrors.Errorf("cannot store custom SRK template: %w", err)
+		if err := storeSrkTemplate(t.TPMContext, opts.SRKTemplate, session); err != nil {
+			return nil, xerrors.Errorf("cannot store custom SRK template: %w", err)
 		}
 	}
 
-	srk, err := provisionStoragePrimaryKey(t.TPMContext, session)
+	srk, err := provisionStoragePrimaryKey(t.TPMContext, srkHandle, session)
 	if err != nil {
 		switch {
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
-			return AuthFailError{tpm2.HandleOwner}
+			return nil, AuthFailError{tpm2.HandleOwner}
 		default:
-			return xerrors.Errorf("cannot provision storage root key: %w", err)
+			return nil, xerrors.Errorf("cannot provision storage root key: %w", err)
 		}
 	}
-	t.provisionedSrk = srk
+	t.srkHandle = srkHandle
+	if srkHandle == tcg.SRKHandle {
+		// Only cache the SRK if it is the one that keys are sealed to.
+		t.provisionedSrk = srk
+	}
+	result.StorageRootKeyChanged = !bytes.Equal(srk.Name(), origSrkName)
+
+	props, err = t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch permanent properties: %w", err)
+	}
+	if props[0].Property != tpm2.PropertyPermanent {
+		return nil, errors.New("TPM returned value for the wrong property")
+	}
+	permanent := tpm2.PermanentAttributes(props[0].Value)
+
+	props, err = t.GetCapabilityTPMProperties(tpm2.PropertyMaxAuthFail, 3, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch DA parameters: %w", err)
+	}
+	if props[0].Property != tpm2.PropertyMaxAuthFail || props[1].Property != tpm2.PropertyLockoutInterval || props[2].Property != tpm2.PropertyLockoutRecovery {
+		return nil, errors.New("TPM returned values for the wrong properties")
+	}
 
 	if mode == ProvisionModeWithoutLockout {
-		props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, session.IncludeAttrs(tpm2.AttrAudit))
-		if err != nil {
-			return xerrors.Errorf("cannot fetch permanent properties to determine if lockout hierarchy is required: %w", err)
+		required := tpm2.AttrLockoutAuthSet
+		if !opts.KeepOwnerClearEnabled {
+			required |= tpm2.AttrDisableClear
 		}
-		if props[0].Property != tpm2.PropertyPermanent {
-			return errors.New("TPM returned value for the wrong property")
-		}
-		required := tpm2.AttrLockoutAuthSet | tpm2.AttrDisableClear
-		if tpm2.PermanentAttributes(props[0].Value)&required != required {
-			return ErrTPMProvisioningRequiresLockout
+		if permanent&required != required {
+			return result, ErrTPMProvisioningRequiresLockout
 		}
 
-		props, err = t.GetCapabilityTPMProperties(tpm2.PropertyMaxAuthFail, 3, session.IncludeAttrs(tpm2.AttrAudit))
-		if err != nil {
-			return xerrors.Errorf("cannot fetch DA parameters to determine if lockout hierarchy is required: %w", err)
-		}
-		if props[0].Property != tpm2.PropertyMaxAuthFail || props[1].Property != tpm2.PropertyLockoutInterval || props[2].Property != tpm2.PropertyLockoutRecovery {
-			return errors.New("TPM returned values for the wrong properties")
-		}
-		if props[0].Value > maxTries || props[1].Value < recoveryTime || props[2].Value < lockoutRecovery {
-			return ErrTPMProvisioningRequiresLockout
+		if props[0].Value > daParams.MaxTries || props[1].Value < daParams.RecoveryTime || props[2].Value < daParams.LockoutRecovery {
+			return result, ErrTPMProvisioningRequiresLockout
 		}
 
-		return nil
+		return result, nil
 	}
 
 	// Perform actions that require the lockout hierarchy authorization.
 
 	// Set the DA parameters.
-	if err := t.DictionaryAttackParameters(t.LockoutHandleContext(), maxTries, recoveryTime, lockoutRecovery, session); err != nil {
+	if err := t.DictionaryAttackParameters(t.LockoutHandleContext(), daParams.MaxTries, daParams.RecoveryTime, daParams.LockoutRecovery, session); err != nil {
 		switch {
 		case isAuthFailError(err, tpm2.CommandDictionaryAttackParameters, 1):
-			return AuthFailError{tpm2.HandleLockout}
+			return nil, AuthFailError{tpm2.HandleLockout}
 		case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandDictionaryAttackParameters):
-			return ErrTPMLockout
+			return nil, ErrTPMLockout
 		}
-		return xerrors.Errorf("cannot configure dictionary attack parameters: %w", err)
+		return nil, xerrors.Errorf("cannot configure dictionary attack parameters: %w", err)
 	}
+	result.DictionaryAttackParamsChanged = props[0].Value != daParams.MaxTries || props[1].Value != daParams.RecoveryTime || props[2].Value != daParams.LockoutRecovery
 
 	// Disable owner clear
-	if err := t.ClearControl(t.LockoutHandleContext(), true, session); err != nil {
-		// Lockout auth failure or lockout mode would have been caught by DictionaryAttackParameters
-		return xerrors.Errorf("cannot disable owner clear: %w", err)
+	if !opts.KeepOwnerClearEnabled {
+		if err := t.ClearControl(t.LockoutHandleContext(), true, session); err != nil {
+			// Lockout auth failure or lockout mode would have been caught by DictionaryAttackParameters
+			return nil, xerrors.Errorf("cannot disable owner clear: %w", err)
+		}
+		result.OwnerClearDisabled = permanent&tpm2.AttrDisableClear == 0
 	}
 
 	// Set the lockout hierarchy authorization.
 	if err := t.HierarchyChangeAuth(t.LockoutHandleContext(), newLockoutAuth, session.IncludeAttrs(tpm2.AttrCommandEncrypt)); err != nil {
-		return xerrors.Errorf("cannot set the lockout hierarchy authorization value: %w", err)
+		return nil, xerrors.Errorf("cannot set the lockout hierarchy authorization value: %w", err)
 	}
+	result.LockoutAuthSet = true
 
-	return nil
+	return result, nil
 }
 
 // EnsureProvisionedWithCustomSRK prepares the TPM for full disk encryption. The mode parameter specifies the behaviour of this
@@ -361,7 +519,10 @@ func (t *Connection) EnsureProvisionedWithCustomSRK(mode ProvisionMode, newLocko
 		return errors.New("supplied SRK template is not valid for a parent key")
 	}
 
-	return t.ensureProvisionedInternal(mode, newLockoutAuth, srkTemplate, false)
+	_, err := t.ensureProvisionedInternal(mode, newLockoutAuth, &ProvisionOptions{
+		SRKTemplate:              srkTemplate,
+		DiscardStoredSRKTemplate: true})
+	return err
 }
 
 // EnsureProvisioned prepares the TPM for full disk encryption. The mode parameter specifies the behaviour of this function.
@@ -410,7 +571,47 @@ func (t *Connection) EnsureProvisionedWithCustomSRK(mode ProvisionMode, newLocko
 // completed without using the lockout hierarchy, but the function should be called again either with mode set to ProvisionModeFull
 // (if the authorization value for the lockout hierarchy is known), or ProvisionModeClear.
 func (t *Connection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []byte) error {
-	return t.ensureProvisionedInternal(mode, newLockoutAuth, nil, true)
+	_, err := t.ensureProvisionedInternal(mode, newLockoutAuth, new(ProvisionOptions))
+	return err
+}
+
+// EnsureProvisionedWithOptions prepares the TPM for full disk encryption in the same way as
+// EnsureProvisioned, but permits the parameters of the TPM's dictionary attack protection
+// logic, the storage root key template and handle, and whether owner clear is disabled to be
+// customized via the opts argument. If opts is nil, this behaves the same as EnsureProvisioned.
+// An error is returned if opts.SRKHandle is not in the range reserved for owner persistent
+// objects or if opts.DictionaryAttackParams specifies a MaxTries value of zero.
+//
+// If opts.SRKTemplate is supplied, it will be persisted inside the TPM in the same way as
+// EnsureProvisionedWithCustomSRK. If it isn't supplied, a template persisted by a previous call
+// will be used unless opts.DiscardStoredSRKTemplate is set or mode is ProvisionModeClear.
+//
+// If mode is ProvisionModeWithoutLockout, ErrTPMProvisioningRequiresLockout will be returned if
+// the TPM's dictionary attack parameters are less strict than the requested ones, or if owner
+// clear is not disabled and opts.KeepOwnerClearEnabled is not set.
+//
+// On success, this returns a summary of the changes made to the TPM. This is also returned
+// alongside a ErrTPMProvisioningRequiresLockout error, in which case it describes the
+// operations that could be completed without the lockout hierarchy.
+func (t *Connection) EnsureProvisionedWithOptions(mode ProvisionMode, newLockoutAuth []byte, opts *ProvisionOptions) (*ProvisionResult, error) {
+	if opts == nil {
+		opts = new(ProvisionOptions)
+	}
+	if opts.SRKTemplate != nil && !opts.SRKTemplate.IsStorageParent() {
+		return nil, errors.New("supplied SRK template is not valid for a parent key")
+	}
+	if opts.SRKHandle != 0 {
+		if err := checkSRKHandle(opts.SRKHandle); err != nil {
+			return nil, err
+		}
+	}
+	if opts.DictionaryAttackParams != nil {
+		if err := checkDictionaryAttackParams(opts.DictionaryAttackParams); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.ensureProvisionedInternal(mode, newLockoutAuth, opts)
 }
 
 // RequestTPMClearUsingPPI submits a request to the firmware to clear the TPM on the next reboot. This is the only way to clear
@@ -574,3 +574,190 @@ func (s *provisioningSuite) TestProvisionWithCustomSRKTemplateOverwritesExisting
 	c.Check(err, IsNil)
 	c.Check(tmplBytes, DeepEquals, mu.MustMarshalToBytes(&template2))
 }
+
+type testProvisionWithOptionsData struct {
+	mode     ProvisionMode
+	opts     *ProvisionOptions
+	expected *ProvisionResult
+
+	maxTries        uint32
+	recoveryTime    uint32
+	lockoutRecovery uint32
+	disableClear    tpm2.PermanentAttributes
+}
+
+func (s *provisioningSimulatorSuite) testProvisionWithOptions(c *C, data *testProvisionWithOptionsData) {
+	lockoutAuth := []byte("1234")
+
+	result, err := s.TPM().EnsureProvisionedWithOptions(data.mode, lockoutAuth, data.opts)
+	c.Check(err, IsNil)
+	s.AddCleanup(func() {
+		// github.com/canonical/go-tpm2/testutil cannot restore this because
+		// EnsureProvisioned uses command parameter encryption. We have to do
+		// this manually else the test fixture fails the test.
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+	c.Check(result, DeepEquals, data.expected)
+
+	s.validateEK(c)
+	s.validateSRK(c)
+
+	// Validate the DA parameters
+	value, err := s.TPM().GetCapabilityTPMProperty(tpm2.PropertyMaxAuthFail)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, data.maxTries)
+	value, err = s.TPM().GetCapabilityTPMProperty(tpm2.PropertyLockoutInterval)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, data.recoveryTime)
+	value, err = s.TPM().GetCapabilityTPMProperty(tpm2.PropertyLockoutRecovery)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, data.lockoutRecovery)
+
+	value, err = s.TPM().GetCapabilityTPMProperty(tpm2.PropertyPermanent)
+	c.Check(err, IsNil)
+	c.Check(tpm2.PermanentAttributes(value)&tpm2.AttrLockoutAuthSet, Equals, tpm2.AttrLockoutAuthSet)
+	c.Check(tpm2.PermanentAttributes(value)&tpm2.AttrDisableClear, Equals, data.disableClear)
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionWithOptionsDefault(c *C) {
+	s.testProvisionWithOptions(c, &testProvisionWithOptionsData{
+		mode: ProvisionModeFull,
+		expected: &ProvisionResult{
+			EndorsementKeyChanged:         true,
+			StorageRootKeyChanged:         true,
+			DictionaryAttackParamsChanged: true,
+			OwnerClearDisabled:            true,
+			LockoutAuthSet:                true},
+		maxTries:        32,
+		recoveryTime:    7200,
+		lockoutRecovery: 86400,
+		disableClear:    tpm2.AttrDisableClear})
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionWithOptionsClear(c *C) {
+	s.testProvisionWithOptions(c, &testProvisionWithOptionsData{
+		mode: ProvisionModeClear,
+		opts: new(ProvisionOptions),
+		expected: &ProvisionResult{
+			Cleared:                       true,
+			EndorsementKeyChanged:         true,
+			StorageRootKeyChanged:         true,
+			DictionaryAttackParamsChanged: true,
+			OwnerClearDisabled:            true,
+			LockoutAuthSet:                true},
+		maxTries:        32,
+		recoveryTime:    7200,
+		lockoutRecovery: 86400,
+		disableClear:    tpm2.AttrDisableClear})
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionWithOptionsDAParams(c *C) {
+	s.testProvisionWithOptions(c, &testProvisionWithOptionsData{
+		mode: ProvisionModeFull,
+		opts: &ProvisionOptions{
+			DictionaryAttackParams: &DictionaryAttackParams{
+				MaxTries:        8,
+				RecoveryTime:    86400,
+				LockoutRecovery: 172800}},
+		expected: &ProvisionResult{
+			EndorsementKeyChanged:         true,
+			StorageRootKeyChanged:         true,
+			DictionaryAttackParamsChanged: true,
+			OwnerClearDisabled:            true,
+			LockoutAuthSet:                true},
+		maxTries:        8,
+		recoveryTime:    86400,
+		lockoutRecovery: 172800,
+		disableClear:    tpm2.AttrDisableClear})
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionWithOptionsKeepOwnerClearEnabled(c *C) {
+	s.testProvisionWithOptions(c, &testProvisionWithOptionsData{
+		mode: ProvisionModeFull,
+		opts: &ProvisionOptions{KeepOwnerClearEnabled: true},
+		expected: &ProvisionResult{
+			EndorsementKeyChanged:         true,
+			StorageRootKeyChanged:         true,
+			DictionaryAttackParamsChanged: true,
+			LockoutAuthSet:                true},
+		maxTries:        32,
+		recoveryTime:    7200,
+		lockoutRecovery: 86400})
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionWithOptionsUnchanged(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeFull, []byte("1234")), IsNil)
+	s.AddCleanup(func() {
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+
+	result, err := s.TPM().EnsureProvisionedWithOptions(ProvisionModeWithoutLockout, nil, nil)
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, new(ProvisionResult))
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionWithOptionsWithoutLockoutStricterDAParams(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeFull, []byte("1234")), IsNil)
+	s.AddCleanup(func() {
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+
+	result, err := s.TPM().EnsureProvisionedWithOptions(ProvisionModeWithoutLockout, nil, &ProvisionOptions{
+		DictionaryAttackParams: &DictionaryAttackParams{
+			MaxTries:        8,
+			RecoveryTime:    7200,
+			LockoutRecovery: 86400}})
+	c.Check(err, Equals, ErrTPMProvisioningRequiresLockout)
+	c.Check(result, DeepEquals, new(ProvisionResult))
+}
+
+func (s *provisioningSuite) TestProvisionWithOptionsInvalidSRKTemplate(c *C) {
+	template := tpm2.Public{
+		Type:    tpm2.ObjectTypeRSA,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrSign,
+		Params: &tpm2.PublicParamsU{
+			RSADetail: &tpm2.RSAParams{
+				Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+				Scheme:    tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+				KeyBits:   2048}}}
+	_, err := s.TPM().EnsureProvisionedWithOptions(ProvisionModeFull, nil, &ProvisionOptions{SRKTemplate: &template})
+	c.Check(err, ErrorMatches, "supplied SRK template is not valid for a parent key")
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionWithOptionsSRKHandle(c *C) {
+	result, err := s.TPM().EnsureProvisionedWithOptions(ProvisionModeFull, []byte("1234"), &ProvisionOptions{SRKHandle: 0x81000002})
+	c.Check(err, IsNil)
+	s.AddCleanup(func() {
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+	c.Check(result.StorageRootKeyChanged, testutil.IsTrue)
+
+	s.validatePrimaryKeyAgainstTemplate(c, tpm2.HandleOwner, 0x81000002, tcg.SRKTemplate)
+	c.Check(s.TPM().DoesHandleExist(tcg.SRKHandle), testutil.IsFalse)
+	c.Check(s.TPM().SRKHandle(), Equals, tpm2.Handle(0x81000002))
+}
+
+func (s *provisioningSuite) TestProvisionWithOptionsInvalidSRKHandle(c *C) {
+	_, err := s.TPM().EnsureProvisionedWithOptions(ProvisionModeFull, nil, &ProvisionOptions{SRKHandle: 0x81800001})
+	c.Check(err, ErrorMatches, "invalid SRK handle 0x81800001: not in the range reserved for owner persistent objects")
+	c.Check(s.TPM().SRKHandle(), Equals, tcg.SRKHandle)
+}
+
+func (s *provisioningSuite) TestProvisionWithOptionsInvalidDAParams(c *C) {
+	_, err := s.TPM().EnsureProvisionedWithOptions(ProvisionModeFull, nil, &ProvisionOptions{
+		DictionaryAttackParams: &DictionaryAttackParams{
+			RecoveryTime:    7200,
+			LockoutRecovery: 86400}})
+	c.Check(err, ErrorMatches, "invalid dictionary attack parameters: MaxTries must not be zero")
+}
+
+func (s *provisioningSuite) TestSetSRKHandle(c *C) {
+	c.Check(s.TPM().SetSRKHandle(0x81000002), IsNil)
+	c.Check(s.TPM().SRKHandle(), Equals, tpm2.Handle(0x81000002))
+}
+
+func (s *provisioningSuite) TestSetSRKHandleInvalid(c *C) {
+	c.Check(s.TPM().SetSRKHandle(0x01810001), ErrorMatches, "invalid SRK handle 0x01810001: not in the range reserved for owner persistent objects")
+	c.Check(s.TPM().SRKHandle(), Equals, tcg.SRKHandle)
+}
@@ -0,0 +1,300 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// HierarchiesReport describes which of the TPM's hierarchies are enabled.
+type HierarchiesReport struct {
+	Platform    bool `json:"platform"`
+	PlatformNV  bool `json:"platform-nv"`
+	Storage     bool `json:"storage"`
+	Endorsement bool `json:"endorsement"`
+}
+
+// DictionaryAttackReport describes the state of the TPM's dictionary attack
+// protection logic.
+type DictionaryAttackReport struct {
+	Counter         uint32 `json:"counter"`          // The current authorization failure count
+	InLockout       bool   `json:"in-lockout"`       // Whether the TPM is in lockout mode
+	MaxTries        uint32 `json:"max-tries"`        // Failures permitted before the TPM enters lockout mode
+	RecoveryTime    uint32 `json:"recovery-time"`    // Seconds after which the failure count is decremented
+	LockoutRecovery uint32 `json:"lockout-recovery"` // Seconds before the lockout hierarchy can be used after a failure
+}
+
+// NVReport describes the NV storage of the TPM. The TPM doesn't report the
+// amount of unallocated NV memory, so this describes the number of indices
+// and counters instead.
+type NVReport struct {
+	Indices       uint32 `json:"indices"`         // The number of defined NV indices
+	Counters      uint32 `json:"counters"`        // The number of defined NV counters
+	CountersAvail uint32 `json:"counters-avail"`  // The number of NV counters that can still be defined
+	IndexMaxSize  uint32 `json:"index-max-size"`  // The maximum size of a NV index
+	BufferMaxSize uint32 `json:"buffer-max-size"` // The maximum size of a single NV read or write
+}
+
+// PersistentObjectsReport describes the persistent objects stored in the TPM.
+type PersistentObjectsReport struct {
+	Handles []tpm2.Handle // The handles of the persistent objects
+	Avail   uint32        // The number of persistent objects that can still be stored
+}
+
+// SRKTemplateState describes the state of the template for the storage root key.
+type SRKTemplateState int
+
+const (
+	// SRKTemplateStateDefault indicates that there is no valid custom template
+	// for the storage root key, so the default template is used.
+	SRKTemplateStateDefault SRKTemplateState = iota
+
+	// SRKTemplateStateCustom indicates that a custom template for the storage
+	// root key was supplied during provisioning.
+	SRKTemplateStateCustom
+
+	// SRKTemplateStateUnknown indicates that a custom template for the storage
+	// root key exists but could not be read, which happens if the authorization
+	// value for the storage hierarchy hasn't been provided.
+	SRKTemplateStateUnknown
+)
+
+func (s SRKTemplateState) String() string {
+	switch s {
+	case SRKTemplateStateDefault:
+		return "default"
+	case SRKTemplateStateCustom:
+		return "custom"
+	case SRKTemplateStateUnknown:
+		return "unknown"
+	default:
+		return fmt.Sprintf("%d", int(s))
+	}
+}
+
+func (s SRKTemplateState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// SRKReport describes the persistent storage root key.
+type SRKReport struct {
+	Present bool `json:"present"`
+
+	// TemplateState indicates whether a custom template for the storage root
+	// key was supplied during provisioning.
+	TemplateState SRKTemplateState `json:"template-state"`
+
+	// MatchesTemplate indicates that the storage root key was created using
+	// the expected template, which is the custom template if one was supplied.
+	// This is always false if TemplateState is SRKTemplateStateUnknown, as the
+	// expected template can't be determined.
+	MatchesTemplate bool `json:"matches-template"`
+}
+
+// HealthReport describes the state of a TPM, as returned from Connection.HealthReport.
+type HealthReport struct {
+	Manufacturer    tpm2.TPMManufacturer
+	VendorString    string
+	FirmwareVersion string
+
+	Hierarchies        HierarchiesReport
+	LockoutAuthSet     bool
+	OwnerClearDisabled bool
+	DictionaryAttack   DictionaryAttackReport
+
+	ActivePCRBanks []tpm2.HashAlgorithmId
+
+	NV                NVReport
+	PersistentObjects PersistentObjectsReport
+	SRK               SRKReport
+}
+
+type persistentObjectsReportJSON struct {
+	Handles []string `json:"handles"`
+	Avail   uint32   `json:"avail"`
+}
+
+func (r PersistentObjectsReport) MarshalJSON() ([]byte, error) {
+	j := persistentObjectsReportJSON{Handles: []string{}, Avail: r.Avail}
+	for _, h := range r.Handles {
+		j.Handles = append(j.Handles, fmt.Sprintf("0x%08x", uint32(h)))
+	}
+	return json.Marshal(j)
+}
+
+type healthReportJSON struct {
+	Manufacturer    string `json:"manufacturer"`
+	VendorString    string `json:"vendor-string"`
+	FirmwareVersion string `json:"firmware-version"`
+
+	Hierarchies        HierarchiesReport      `json:"hierarchies"`
+	LockoutAuthSet     bool                   `json:"lockout-auth-set"`
+	OwnerClearDisabled bool                   `json:"owner-clear-disabled"`
+	DictionaryAttack   DictionaryAttackReport `json:"dictionary-attack"`
+
+	ActivePCRBanks []string `json:"active-pcr-banks"`
+
+	NV                NVReport                `json:"nv"`
+	PersistentObjects PersistentObjectsReport `json:"persistent-objects"`
+	SRK               SRKReport               `json:"srk"`
+}
+
+func (r HealthReport) MarshalJSON() ([]byte, error) {
+	j := healthReportJSON{
+		Manufacturer:       r.Manufacturer.String(),
+		VendorString:       r.VendorString,
+		FirmwareVersion:    r.FirmwareVersion,
+		Hierarchies:        r.Hierarchies,
+		LockoutAuthSet:     r.LockoutAuthSet,
+		OwnerClearDisabled: r.OwnerClearDisabled,
+		DictionaryAttack:   r.DictionaryAttack,
+		ActivePCRBanks:     []string{},
+		NV:                 r.NV,
+		PersistentObjects:  r.PersistentObjects,
+		SRK:                r.SRK}
+	for _, alg := range r.ActivePCRBanks {
+		j.ActivePCRBanks = append(j.ActivePCRBanks, fmt.Sprintf("%v", alg))
+	}
+	return json.Marshal(j)
+}
+
+// getTPMProperties returns the values of the count properties starting from first
+// as a map, omitting properties that aren't reported by the TPM.
+func getTPMProperties(tpm *tpm2.TPMContext, first tpm2.Property, count uint32, session tpm2.SessionContext) (map[tpm2.Property]uint32, error) {
+	props, err := tpm.GetCapabilityTPMProperties(first, count, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[tpm2.Property]uint32)
+	for _, prop := range props {
+		values[prop.Property] = prop.Value
+	}
+	return values, nil
+}
+
+// makeVendorString decodes the vendor string from the TPM_PT_VENDOR_STRING_x properties.
+func makeVendorString(props map[tpm2.Property]uint32) string {
+	var b []byte
+	for _, p := range []tpm2.Property{tpm2.PropertyVendorString1, tpm2.PropertyVendorString2, tpm2.PropertyVendorString3, tpm2.PropertyVendorString4} {
+		v := props[p]
+		b = append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+}
+
+// makeFirmwareVersion decodes the firmware version from the TPM_PT_FIRMWARE_VERSION_x
+// properties. The format of these is vendor specific, but they are generally
+// interpreted as 4 16-bit components.
+func makeFirmwareVersion(props map[tpm2.Property]uint32) string {
+	v1 := props[tpm2.PropertyFirmwareVersion1]
+	v2 := props[tpm2.PropertyFirmwareVersion2]
+	return fmt.Sprintf("%d.%d.%d.%d", v1>>16, v1&0xffff, v2>>16, v2&0xffff)
+}
+
+func (t *Connection) healthReportImpl(session tpm2.SessionContext) (*HealthReport, error) {
+	fixed, err := getTPMProperties(t.TPMContext, tpm2.PropertyFixed, uint32(tpm2.PropertyMaxCapBuffer-tpm2.PropertyFixed)+1, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain fixed properties: %w", err)
+	}
+	variable, err := getTPMProperties(t.TPMContext, tpm2.PropertyVar, uint32(tpm2.PropertyLockoutRecovery-tpm2.PropertyVar)+1, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain variable properties: %w", err)
+	}
+
+	permanent := tpm2.PermanentAttributes(variable[tpm2.PropertyPermanent])
+	startupClear := tpm2.StartupClearAttributes(variable[tpm2.PropertyStartupClear])
+
+	report := &HealthReport{
+		Manufacturer:    tpm2.TPMManufacturer(fixed[tpm2.PropertyManufacturer]),
+		VendorString:    makeVendorString(fixed),
+		FirmwareVersion: makeFirmwareVersion(fixed),
+		Hierarchies: HierarchiesReport{
+			Platform:    startupClear&tpm2.AttrPhEnable > 0,
+			PlatformNV:  startupClear&tpm2.AttrPhEnableNV > 0,
+			Storage:     startupClear&tpm2.AttrShEnable > 0,
+			Endorsement: startupClear&tpm2.AttrEhEnable > 0},
+		LockoutAuthSet:     permanent&tpm2.AttrLockoutAuthSet > 0,
+		OwnerClearDisabled: permanent&tpm2.AttrDisableClear > 0,
+		DictionaryAttack: DictionaryAttackReport{
+			Counter:         variable[tpm2.PropertyLockoutCounter],
+			InLockout:       permanent&tpm2.AttrInLockout > 0,
+			MaxTries:        variable[tpm2.PropertyMaxAuthFail],
+			RecoveryTime:    variable[tpm2.PropertyLockoutInterval],
+			LockoutRecovery: variable[tpm2.PropertyLockoutRecovery]},
+		NV: NVReport{
+			Indices:       variable[tpm2.PropertyHRNVIndex],
+			Counters:      variable[tpm2.PropertyNVCounters],
+			CountersAvail: variable[tpm2.PropertyNVCountersAvail],
+			IndexMaxSize:  fixed[tpm2.PropertyNVIndexMax],
+			BufferMaxSize: fixed[tpm2.PropertyNVBufferMax]},
+		PersistentObjects: PersistentObjectsReport{
+			Avail: variable[tpm2.PropertyHRPersistentAvail]}}
+
+	report.ActivePCRBanks, err = activePCRBanks(t.TPMContext, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain PCR banks: %w", err)
+	}
+
+	report.PersistentObjects.Handles, err = t.GetCapabilityHandles(tpm2.HandleTypePersistent.BaseHandle(), tpm2.CapabilityMaxProperties, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain persistent handles: %w", err)
+	}
+
+	srkHandle := t.SRKHandle()
+	srk, err := t.CreateResourceContextFromTPM(srkHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, srkHandle):
+		// No SRK
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+	default:
+		report.SRK.Present = true
+	}
+
+	var template *tpm2.Public
+	template, report.SRK.TemplateState = readSrkTemplate(t.TPMContext, session)
+
+	if report.SRK.Present && report.SRK.TemplateState != SRKTemplateStateUnknown {
+		report.SRK.MatchesTemplate, err = isObjectPrimaryKeyWithTemplate(t.TPMContext, t.OwnerHandleContext(), srk, template, session)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine if SRK matches the expected template: %w", err)
+		}
+	}
+
+	return report, nil
+}
+
+// HealthReport returns a report of the state of the TPM, which is intended to assist
+// with diagnosing issues. It can be encoded to JSON. This doesn't require knowledge of
+// any authorization values, although reading a custom SRK template requires that the
+// authorization value for the storage hierarchy is known and has been provided by
+// calling Connection.OwnerHandleContext().SetAuthValue(). If it isn't available and a
+// custom SRK template exists, the template state is reported as SRKTemplateStateUnknown
+// and the storage root key isn't compared with any template.
+func (t *Connection) HealthReport() (*HealthReport, error) {
+	return t.healthReportImpl(t.HmacSession())
+}
@@ -0,0 +1,261 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"encoding/json"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type reportSuiteNoTPM struct{}
+
+type reportSimulatorSuite struct {
+	tpm2test.TPMSimulatorTest
+}
+
+var _ = Suite(&reportSuiteNoTPM{})
+var _ = Suite(&reportSimulatorSuite{})
+
+func (s *reportSuiteNoTPM) TestMarshalJSON(c *C) {
+	report := &HealthReport{
+		Manufacturer:    tpm2.TPMManufacturerIBM,
+		VendorString:    "SW TPM",
+		FirmwareVersion: "8217.4131.22.13878",
+		Hierarchies: HierarchiesReport{
+			Platform:    true,
+			PlatformNV:  true,
+			Storage:     true,
+			Endorsement: true},
+		LockoutAuthSet:     true,
+		OwnerClearDisabled: true,
+		DictionaryAttack: DictionaryAttackReport{
+			Counter:         2,
+			MaxTries:        32,
+			RecoveryTime:    7200,
+			LockoutRecovery: 86400},
+		ActivePCRBanks: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256},
+		NV: NVReport{
+			Indices:       3,
+			Counters:      1,
+			CountersAvail: 100,
+			IndexMaxSize:  2048,
+			BufferMaxSize: 1024},
+		PersistentObjects: PersistentObjectsReport{
+			Handles: []tpm2.Handle{tcg.SRKHandle, tcg.EKHandle},
+			Avail:   5},
+		SRK: SRKReport{
+			Present:         true,
+			MatchesTemplate: true}}
+
+	b, err := json.Marshal(report)
+	c.Check(err, IsNil)
+
+	var decoded map[string]interface{}
+	c.Check(json.Unmarshal(b, &decoded), IsNil)
+	c.Check(decoded, DeepEquals, map[string]interface{}{
+		"manufacturer":     "IBM",
+		"vendor-string":    "SW TPM",
+		"firmware-version": "8217.4131.22.13878",
+		"hierarchies": map[string]interface{}{
+			"platform":    true,
+			"platform-nv": true,
+			"storage":     true,
+			"endorsement": true},
+		"lockout-auth-set":     true,
+		"owner-clear-disabled": true,
+		"dictionary-attack": map[string]interface{}{
+			"counter":          float64(2),
+			"in-lockout":       false,
+			"max-tries":        float64(32),
+			"recovery-time":    float64(7200),
+			"lockout-recovery": float64(86400)},
+		"active-pcr-banks": []interface{}{"TPM_ALG_SHA1", "TPM_ALG_SHA256"},
+		"nv": map[string]interface{}{
+			"indices":         float64(3),
+			"counters":        float64(1),
+			"counters-avail":  float64(100),
+			"index-max-size":  float64(2048),
+			"buffer-max-size": float64(1024)},
+		"persistent-objects": map[string]interface{}{
+			"handles": []interface{}{"0x81000001", "0x81010001"},
+			"avail":   float64(5)},
+		"srk": map[string]interface{}{
+			"present":          true,
+			"template-state":   "default",
+			"matches-template": true}})
+}
+
+func (s *reportSuiteNoTPM) TestSRKTemplateStateMarshalJSON(c *C) {
+	for _, t := range []struct {
+		state    SRKTemplateState
+		expected string
+	}{
+		{SRKTemplateStateDefault, `"default"`},
+		{SRKTemplateStateCustom, `"custom"`},
+		{SRKTemplateStateUnknown, `"unknown"`},
+	} {
+		b, err := json.Marshal(t.state)
+		c.Check(err, IsNil)
+		c.Check(string(b), Equals, t.expected)
+	}
+}
+
+func (s *reportSimulatorSuite) TestHealthReportNewTPM(c *C) {
+	report, err := s.TPM().HealthReport()
+	c.Assert(err, IsNil)
+
+	manufacturer, err := s.TPM().GetManufacturer()
+	c.Check(err, IsNil)
+	c.Check(report.Manufacturer, Equals, manufacturer)
+	c.Check(report.VendorString, Not(Equals), "")
+
+	c.Check(report.Hierarchies, DeepEquals, HierarchiesReport{
+		Platform:    true,
+		PlatformNV:  true,
+		Storage:     true,
+		Endorsement: true})
+	c.Check(report.LockoutAuthSet, testutil.IsFalse)
+	c.Check(report.OwnerClearDisabled, testutil.IsFalse)
+	c.Check(report.DictionaryAttack.InLockout, testutil.IsFalse)
+
+	banks, err := s.TPM().ActivePCRBanks()
+	c.Check(err, IsNil)
+	c.Check(report.ActivePCRBanks, DeepEquals, banks)
+
+	c.Check(report.SRK, DeepEquals, SRKReport{})
+
+	_, err = json.Marshal(report)
+	c.Check(err, IsNil)
+}
+
+func (s *reportSimulatorSuite) TestHealthReportProvisioned(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeFull, []byte("1234")), IsNil)
+	s.AddCleanup(func() {
+		// github.com/canonical/go-tpm2/testutil cannot restore this because
+		// EnsureProvisioned uses command parameter encryption. We have to do
+		// this manually else the test fixture fails the test.
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+
+	report, err := s.TPM().HealthReport()
+	c.Assert(err, IsNil)
+
+	c.Check(report.LockoutAuthSet, testutil.IsTrue)
+	c.Check(report.OwnerClearDisabled, testutil.IsTrue)
+	c.Check(report.DictionaryAttack, DeepEquals, DictionaryAttackReport{
+		MaxTries:        32,
+		RecoveryTime:    7200,
+		LockoutRecovery: 86400})
+	c.Check(report.PersistentObjects.Handles, DeepEquals, []tpm2.Handle{tcg.SRKHandle, tcg.EKHandle})
+	c.Check(report.SRK, DeepEquals, SRKReport{
+		Present:         true,
+		MatchesTemplate: true})
+}
+
+func (s *reportSimulatorSuite) TestHealthReportCustomSRKHandle(c *C) {
+	_, err := s.TPM().EnsureProvisionedWithOptions(ProvisionModeWithoutLockout, nil, &ProvisionOptions{SRKHandle: 0x81000002})
+	c.Check(err, Equals, ErrTPMProvisioningRequiresLockout)
+
+	report, err := s.TPM().HealthReport()
+	c.Assert(err, IsNil)
+	c.Check(report.PersistentObjects.Handles, DeepEquals, []tpm2.Handle{0x81000002, tcg.EKHandle})
+	c.Check(report.SRK, DeepEquals, SRKReport{
+		Present:         true,
+		MatchesTemplate: true})
+}
+
+func (s *reportSimulatorSuite) TestHealthReportSRKMismatch(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil), Equals, ErrTPMProvisioningRequiresLockout)
+
+	// Replace the SRK with a key created from a different template.
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	s.EvictControl(c, tpm2.HandleOwner, srk, srk.Handle())
+
+	template := tcg.MakeDefaultSRKTemplate()
+	template.Attrs &^= tpm2.AttrNoDA
+	object := s.CreatePrimary(c, tpm2.HandleOwner, template)
+	s.EvictControl(c, tpm2.HandleOwner, object, tcg.SRKHandle)
+
+	report, err := s.TPM().HealthReport()
+	c.Assert(err, IsNil)
+	c.Check(report.SRK, DeepEquals, SRKReport{Present: true})
+}
+
+func (s *reportSimulatorSuite) provisionWithCustomSRKTemplate(c *C) {
+	template := tpm2.Public{
+		Type:    tpm2.ObjectTypeRSA,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrNoDA |
+			tpm2.AttrRestricted | tpm2.AttrDecrypt,
+		Params: &tpm2.PublicParamsU{
+			RSADetail: &tpm2.RSAParams{
+				Symmetric: tpm2.SymDefObject{
+					Algorithm: tpm2.SymObjectAlgorithmAES,
+					KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+					Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}},
+				Scheme:   tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+				KeyBits:  2048,
+				Exponent: 0}}}
+	c.Check(s.TPM().EnsureProvisionedWithCustomSRK(ProvisionModeWithoutLockout, nil, &template), Equals, ErrTPMProvisioningRequiresLockout)
+}
+
+func (s *reportSimulatorSuite) TestHealthReportCustomSRKTemplate(c *C) {
+	s.provisionWithCustomSRKTemplate(c)
+
+	report, err := s.TPM().HealthReport()
+	c.Assert(err, IsNil)
+	c.Check(report.SRK, DeepEquals, SRKReport{
+		Present:         true,
+		TemplateState:   SRKTemplateStateCustom,
+		MatchesTemplate: true})
+}
+
+func (s *reportSimulatorSuite) TestHealthReportCustomSRKTemplateNoOwnerAuth(c *C) {
+	s.provisionWithCustomSRKTemplate(c)
+
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("1234"))
+	s.TPM().OwnerHandleContext().SetAuthValue(nil)
+
+	// The template can't be read, so the state is reported as unknown
+	// rather than comparing the SRK with the default template.
+	report, err := s.TPM().HealthReport()
+	c.Assert(err, IsNil)
+	c.Check(report.SRK, DeepEquals, SRKReport{
+		Present:       true,
+		TemplateState: SRKTemplateStateUnknown})
+}
+
+func (s *reportSimulatorSuite) TestHealthReportInLockout(c *C) {
+	c.Check(s.TPM().DictionaryAttackParameters(s.TPM().LockoutHandleContext(), 0, 7200, 86400, nil), IsNil)
+
+	report, err := s.TPM().HealthReport()
+	c.Assert(err, IsNil)
+	c.Check(report.DictionaryAttack.InLockout, testutil.IsTrue)
+	c.Check(report.DictionaryAttack.MaxTries, Equals, uint32(0))
+}
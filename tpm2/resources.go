@@ -0,0 +1,409 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// ResourceType describes the type of a TPM resource created by this package.
+type ResourceType int
+
+const (
+	// ResourceTypeStorageRootKey corresponds to the persistent storage root key.
+	ResourceTypeStorageRootKey ResourceType = iota + 1
+
+	// ResourceTypeEndorsementKey corresponds to the persistent endorsement key.
+	ResourceTypeEndorsementKey
+
+	// ResourceTypeSRKTemplate corresponds to the NV index containing a custom
+	// template for the storage root key.
+	ResourceTypeSRKTemplate
+
+	// ResourceTypePCRPolicyCounter corresponds to a NV counter used for revoking
+	// the PCR policies of sealed keys, created at the handle specified by
+	// ProtectKeyParams.PCRPolicyCounterHandle.
+	ResourceTypePCRPolicyCounter
+
+	// ResourceTypePINIndex corresponds to a NV index that implements the PIN
+	// for a sealed key, created at the handle specified by
+	// ProtectKeyParams.PINIndexHandle.
+	ResourceTypePINIndex
+
+	// ResourceTypeLegacyLockIndex corresponds to the global NV index used for
+	// locking access to legacy (version 0) sealed key objects.
+	ResourceTypeLegacyLockIndex
+
+	// ResourceTypePCRPolicyIndex corresponds to a NV index that stores the
+	// digest of the authorized PCR policy for a sealed key, created at the
+	// handle specified by ProtectKeyParams.PCRPolicyCounterHandle when
+	// ProtectKeyParams.NVAuthorizedPCRPolicy is set.
+	ResourceTypePCRPolicyIndex
+)
+
+func (t ResourceType) String() string {
+	switch t {
+	case ResourceTypeStorageRootKey:
+		return "storage-root-key"
+	case ResourceTypeEndorsementKey:
+		return "endorsement-key"
+	case ResourceTypeSRKTemplate:
+		return "srk-template"
+	case ResourceTypePCRPolicyCounter:
+		return "pcr-policy-counter"
+	case ResourceTypePINIndex:
+		return "pin-index"
+	case ResourceTypeLegacyLockIndex:
+		return "legacy-lock-index"
+	case ResourceTypePCRPolicyIndex:
+		return "pcr-policy-index"
+	default:
+		return fmt.Sprintf("%d", int(t))
+	}
+}
+
+// Resource describes a persistent object or NV index created by this package.
+type Resource struct {
+	Handle tpm2.Handle
+	Type   ResourceType
+}
+
+// DeprovisionMode is used to control the behaviour of Connection.Deprovision.
+type DeprovisionMode int
+
+const (
+	// DeprovisionModeWithoutLockout specifies that the resources created in the
+	// storage hierarchy should be removed, without performing operations that
+	// require the use of the lockout hierarchy.
+	DeprovisionModeWithoutLockout DeprovisionMode = iota
+
+	// DeprovisionModeFull specifies that the resources created in the storage
+	// hierarchy should be removed, and that the authorization value for the
+	// lockout hierarchy should be cleared. This requires use of the lockout
+	// hierarchy.
+	DeprovisionModeFull
+)
+
+const (
+	// ownerNVIndexRangeStart and ownerNVIndexRangeEnd define the range of NV
+	// index handles reserved for the owner by the TCG "Registry of Reserved
+	// TPM 2.0 Handles and Localities". This package only creates NV indices
+	// in this range.
+	ownerNVIndexRangeStart tpm2.Handle = 0x01800000
+	ownerNVIndexRangeEnd   tpm2.Handle = 0x01bfffff
+)
+
+// classifyNVIndex determines the type of the NV index with the supplied public
+// area, returning false if it doesn't look like one created by this package.
+func classifyNVIndex(pub *tpm2.NVPublic) (ResourceType, bool) {
+	if pub.Index < ownerNVIndexRangeStart || pub.Index > ownerNVIndexRangeEnd {
+		return 0, false
+	}
+	if pub.NameAlg != tpm2.HashAlgorithmSHA256 {
+		return 0, false
+	}
+
+	// Ignore attributes that are set by the TPM.
+	attrs := pub.Attrs &^ (tpm2.AttrNVWritten | tpm2.AttrNVWriteLocked | tpm2.AttrNVReadLocked)
+
+	switch {
+	case pub.Index == srkTemplateHandle && attrs == tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite|tpm2.AttrNVWriteDefine|tpm2.AttrNVOwnerRead|tpm2.AttrNVNoDA):
+		return ResourceTypeSRKTemplate, true
+	case pub.Index == lockNVHandle && attrs == tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA|tpm2.AttrNVReadStClear):
+		return ResourceTypeLegacyLockIndex, true
+	}
+
+	// The remaining indices can only be written with a policy, so they must have
+	// a policy digest for the name algorithm.
+	if len(pub.AuthPolicy) != pub.NameAlg.Size() {
+		return 0, false
+	}
+
+	switch {
+	case attrs == tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA):
+		// PCR policy counter for v2, v3 and v5 keys.
+		return ResourceTypePCRPolicyCounter, true
+	case attrs == pcrPolicyIndexAttrs && int(pub.Size) == pcrPolicyIndexSize:
+		// PCR policy index for v4 keys, which contains a TPMT_HA.
+		return ResourceTypePCRPolicyIndex, true
+	case attrs == pinIndexAttrs:
+		// PIN NV index for v5 keys.
+		return ResourceTypePINIndex, true
+	}
+
+	return 0, false
+}
+
+func (t *Connection) listResourcesImpl(session tpm2.SessionContext) (resources []Resource, err error) {
+	for _, r := range []Resource{{Handle: t.SRKHandle(), Type: ResourceTypeStorageRootKey}, {Handle: tcg.EKHandle, Type: ResourceTypeEndorsementKey}} {
+		name, err := persistentObjectName(t.TPMContext, r.Handle)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create context for persistent object at %v: %w", r.Handle, err)
+		}
+		if name == nil {
+			continue
+		}
+		resources = append(resources, r)
+	}
+
+	handles, err := t.GetCapabilityHandles(ownerNVIndexRangeStart, tpm2.CapabilityMaxProperties, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain NV index handles: %w", err)
+	}
+	for _, handle := range handles {
+		if handle > ownerNVIndexRangeEnd {
+			break
+		}
+		index, err := t.CreateResourceContextFromTPM(handle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, handle):
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create context for NV index at %v: %w", handle, err)
+		}
+		pub, _, err := t.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read public area of NV index at %v: %w", handle, err)
+		}
+		resourceType, ok := classifyNVIndex(pub)
+		if !ok {
+			continue
+		}
+		resources = append(resources, Resource{Handle: handle, Type: resourceType})
+	}
+
+	return resources, nil
+}
+
+// ListResources returns the persistent objects and NV indices that appear to have been
+// created by this package, either during provisioning or when protecting keys. As NV
+// indices can be created at caller specified handles, these are identified by their
+// attributes, so this may include indices in the owner range (0x01800000 - 0x01bfffff)
+// that were created by other software with identical attributes.
+func (t *Connection) ListResources() ([]Resource, error) {
+	return t.listResourcesImpl(t.HmacSession())
+}
+
+func (t *Connection) findUnreferencedResourcesImpl(keys []*SealedKeyData, session tpm2.SessionContext) ([]Resource, error) {
+	referenced := make(map[tpm2.Handle]bool)
+	for _, k := range keys {
+		if h := k.PCRPolicyCounterHandle(); h != tpm2.HandleNull {
+			referenced[h] = true
+		}
+		if h := k.PINIndexHandle(); h != 0 {
+			referenced[h] = true
+		}
+	}
+
+	resources, err := t.listResourcesImpl(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var unreferenced []Resource
+	for _, r := range resources {
+		switch r.Type {
+		case ResourceTypePCRPolicyCounter, ResourceTypePCRPolicyIndex, ResourceTypePINIndex:
+		default:
+			continue
+		}
+		if referenced[r.Handle] {
+			continue
+		}
+		unreferenced = append(unreferenced, r)
+	}
+
+	return unreferenced, nil
+}
+
+// FindUnreferencedResources returns the PCR policy counters, PCR policy NV indices and
+// PIN NV indices that appear to have been created by this package and which are not
+// referenced by any of the supplied keys. The supplied keys must include every key that
+// is still in use, else this will return resources that are still required. As these
+// are identified by their attributes, the returned resources should be confirmed before
+// they are passed to RemoveResources.
+func (t *Connection) FindUnreferencedResources(keys []*SealedKeyData) ([]Resource, error) {
+	return t.findUnreferencedResourcesImpl(keys, t.HmacSession())
+}
+
+// checkResource checks that the supplied resource still exists with the expected
+// type, returning false if it has already been removed.
+func (t *Connection) checkResource(r Resource, session tpm2.SessionContext) (tpm2.ResourceContext, bool, error) {
+	context, err := t.CreateResourceContextFromTPM(r.Handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, r.Handle):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, xerrors.Errorf("cannot create context: %w", err)
+	}
+
+	switch r.Handle.Type() {
+	case tpm2.HandleTypeNVIndex:
+		pub, _, err := t.NVReadPublic(context, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, false, xerrors.Errorf("cannot read public area: %w", err)
+		}
+		if resourceType, ok := classifyNVIndex(pub); !ok || resourceType != r.Type {
+			return nil, false, fmt.Errorf("NV index is not a %v", r.Type)
+		}
+	case tpm2.HandleTypePersistent:
+		switch {
+		case r.Type == ResourceTypeStorageRootKey && r.Handle == t.SRKHandle():
+		case r.Type == ResourceTypeEndorsementKey && r.Handle == tcg.EKHandle:
+		default:
+			return nil, false, fmt.Errorf("persistent object is not a %v", r.Type)
+		}
+	default:
+		return nil, false, errors.New("invalid handle type")
+	}
+
+	return context, true, nil
+}
+
+func (t *Connection) removeResource(r Resource, session tpm2.SessionContext) error {
+	context, exists, err := t.checkResource(r, session)
+	switch {
+	case err != nil:
+		return err
+	case !exists:
+		// Already removed.
+		return nil
+	}
+
+	switch r.Handle.Type() {
+	case tpm2.HandleTypeNVIndex:
+		if err := t.NVUndefineSpace(t.OwnerHandleContext(), context, session); err != nil {
+			if isAuthFailError(err, tpm2.CommandNVUndefineSpace, 1) {
+				return AuthFailError{tpm2.HandleOwner}
+			}
+			return err
+		}
+	default:
+		if _, err := t.EvictControl(t.OwnerHandleContext(), context, r.Handle, session); err != nil {
+			if isAuthFailError(err, tpm2.CommandEvictControl, 1) {
+				return AuthFailError{tpm2.HandleOwner}
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Connection) removeResources(resources []Resource, session tpm2.SessionContext) (removed []Resource, err error) {
+	for _, r := range resources {
+		if err := t.removeResource(r, session); err != nil {
+			if _, ok := err.(AuthFailError); ok {
+				return removed, err
+			}
+			return removed, xerrors.Errorf("cannot remove %v at %v: %w", r.Type, r.Handle, err)
+		}
+		removed = append(removed, r)
+	}
+	return removed, nil
+}
+
+// RemoveResources removes the supplied resources, which will generally be a list that
+// has been returned by FindUnreferencedResources or ListResources and then confirmed by
+// the caller, and returns the resources that were removed. Only the supplied resources
+// are removed. Before removing each resource, this checks that it still appears to be a
+// resource of the specified type that was created by this package, and returns an error
+// if it isn't. Resources that don't exist are skipped. Removing a resource that is
+// still referenced by a key will make that key permanently unrecoverable.
+//
+// This requires knowledge of the authorization value for the storage hierarchy, which
+// must be provided by calling Connection.OwnerHandleContext().SetAuthValue() prior to
+// calling this function. If the wrong value is provided, a AuthFailError error will be
+// returned. On error, the resources that were removed before the error occurred are
+// also returned.
+func (t *Connection) RemoveResources(resources []Resource) ([]Resource, error) {
+	return t.removeResources(resources, t.HmacSession())
+}
+
+// Deprovision undoes the provisioning performed by EnsureProvisioned without clearing the
+// TPM, and returns the resources that were removed. This makes every key protected by this
+// TPM permanently unrecoverable.
+//
+// In all modes, this removes the storage root key, any custom SRK template and any legacy
+// lock NV index, which exist at fixed handles. PCR policy counters, PCR policy NV indices
+// and PIN NV indices are created at caller specified handles and are only identified by
+// their attributes, so they are not removed here. These should be obtained with
+// ListResources, confirmed and then passed to RemoveResources. The endorsement key is not
+// removed because it may be used by other software. This requires knowledge of the authorization value for the storage
+// hierarchy, which must be provided by calling Connection.OwnerHandleContext().SetAuthValue()
+// prior to calling this function. If the wrong value is provided, a AuthFailError error will
+// be returned.
+//
+// If mode is DeprovisionModeFull, the authorization value for the lockout hierarchy will
+// also be cleared. This requires knowledge of the current authorization value, which must
+// be provided by calling Connection.LockoutHandleContext().SetAuthValue() prior to calling
+// this function. If the wrong value is provided, a AuthFailError error will be returned and
+// the TPM will have entered dictionary attack lockout mode for the lockout hierarchy.
+//
+// Owner clear cannot be re-enabled and the dictionary attack parameters are not restored,
+// as the former requires use of the platform hierarchy and the original values of the
+// latter are not known.
+//
+// On error, the resources that were removed before the error occurred are also returned.
+func (t *Connection) Deprovision(mode DeprovisionMode) ([]Resource, error) {
+	session := t.HmacSession()
+
+	resources, err := t.listResourcesImpl(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var toRemove []Resource
+	for _, r := range resources {
+		switch r.Type {
+		case ResourceTypeStorageRootKey, ResourceTypeSRKTemplate, ResourceTypeLegacyLockIndex:
+			toRemove = append(toRemove, r)
+		}
+	}
+
+	removed, err := t.removeResources(toRemove, session)
+	t.provisionedSrk = nil
+	if err != nil {
+		return removed, err
+	}
+
+	if mode == DeprovisionModeWithoutLockout {
+		return removed, nil
+	}
+
+	if err := t.HierarchyChangeAuth(t.LockoutHandleContext(), nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt)); err != nil {
+		switch {
+		case isAuthFailError(err, tpm2.CommandHierarchyChangeAuth, 1):
+			return removed, AuthFailError{tpm2.HandleLockout}
+		case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandHierarchyChangeAuth):
+			return removed, ErrTPMLockout
+		}
+		return removed, xerrors.Errorf("cannot clear the lockout hierarchy authorization value: %w", err)
+	}
+
+	return removed, nil
+}
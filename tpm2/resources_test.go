@@ -0,0 +1,385 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type resourcesSuiteNoTPM struct{}
+
+type resourcesSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *resourcesSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy |
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *resourcesSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&resourcesSuiteNoTPM{})
+var _ = Suite(&resourcesSuite{})
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexPCRPolicyCounter(c *C) {
+	resourceType, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:      0x01810000,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		AuthPolicy: make(tpm2.Digest, 32),
+		Size:       8})
+	c.Check(ok, testutil.IsTrue)
+	c.Check(resourceType, Equals, ResourceTypePCRPolicyCounter)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexPCRPolicyIndex(c *C) {
+	resourceType, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:      0x01810000,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		AuthPolicy: make(tpm2.Digest, 32),
+		Size:       34})
+	c.Check(ok, testutil.IsTrue)
+	c.Check(resourceType, Equals, ResourceTypePCRPolicyIndex)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexPCRPolicyIndexWrongSize(c *C) {
+	_, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:      0x01810000,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		AuthPolicy: make(tpm2.Digest, 32),
+		Size:       42})
+	c.Check(ok, testutil.IsFalse)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexNoAuthPolicy(c *C) {
+	_, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:   0x01810000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		Size:    8})
+	c.Check(ok, testutil.IsFalse)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexPIN(c *C) {
+	resourceType, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:      0x01810000,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypePinFail.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVOwnerRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		AuthPolicy: make(tpm2.Digest, 32),
+		Size:       8})
+	c.Check(ok, testutil.IsTrue)
+	c.Check(resourceType, Equals, ResourceTypePINIndex)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexSRKTemplate(c *C) {
+	resourceType, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:   0x01810001,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVWriteDefine | tpm2.AttrNVOwnerRead | tpm2.AttrNVNoDA),
+		Size:    64})
+	c.Check(ok, testutil.IsTrue)
+	c.Check(resourceType, Equals, ResourceTypeSRKTemplate)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexLegacyLockIndex(c *C) {
+	resourceType, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:   LockNVHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVReadStClear),
+		Size:    0})
+	c.Check(ok, testutil.IsTrue)
+	c.Check(resourceType, Equals, ResourceTypeLegacyLockIndex)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexPCRPolicyCounterAtSRKTemplateHandle(c *C) {
+	resourceType, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:      0x01810001,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		AuthPolicy: make(tpm2.Digest, 32),
+		Size:       8})
+	c.Check(ok, testutil.IsTrue)
+	c.Check(resourceType, Equals, ResourceTypePCRPolicyCounter)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexUnrelatedAtLegacyLockHandle(c *C) {
+	_, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:   LockNVHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8})
+	c.Check(ok, testutil.IsFalse)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexOutsideOwnerRange(c *C) {
+	for _, handle := range []tpm2.Handle{0x01000000, 0x017fffff, 0x01c00000, 0x01c10000} {
+		_, ok := ClassifyNVIndex(&tpm2.NVPublic{
+			Index:      handle,
+			NameAlg:    tpm2.HashAlgorithmSHA256,
+			Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+			AuthPolicy: make(tpm2.Digest, 32),
+			Size:       8})
+		c.Check(ok, testutil.IsFalse, Commentf("handle %v", handle))
+	}
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexUnrelated(c *C) {
+	_, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:   0x01810000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8})
+	c.Check(ok, testutil.IsFalse)
+}
+
+func (s *resourcesSuiteNoTPM) TestClassifyNVIndexWrongNameAlg(c *C) {
+	_, ok := ClassifyNVIndex(&tpm2.NVPublic{
+		Index:      0x01810000,
+		NameAlg:    tpm2.HashAlgorithmSHA1,
+		Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVWritten),
+		AuthPolicy: make(tpm2.Digest, 32),
+		Size:       8})
+	c.Check(ok, testutil.IsFalse)
+}
+
+func (s *resourcesSuite) protectKey(c *C, params *ProtectKeyParams) *SealedKeyData {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	params.PCRProfile = tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23})
+	k, _, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	return skd
+}
+
+func (s *resourcesSuite) TestListResources(c *C) {
+	k1 := s.protectKey(c, &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+	k2 := s.protectKey(c, &ProtectKeyParams{
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		PINIndexHandle:         s.NextAvailableHandle(c, 0x01810100)})
+
+	resources, err := s.TPM().ListResources()
+	c.Check(err, IsNil)
+	c.Check(Resource{Handle: tcg.SRKHandle, Type: ResourceTypeStorageRootKey}, testutil.InSlice(Equals), resources)
+	c.Check(Resource{Handle: tcg.EKHandle, Type: ResourceTypeEndorsementKey}, testutil.InSlice(Equals), resources)
+	c.Check(Resource{Handle: k1.PCRPolicyCounterHandle(), Type: ResourceTypePCRPolicyCounter}, testutil.InSlice(Equals), resources)
+	c.Check(Resource{Handle: k2.PCRPolicyCounterHandle(), Type: ResourceTypePCRPolicyCounter}, testutil.InSlice(Equals), resources)
+	c.Check(Resource{Handle: k2.PINIndexHandle(), Type: ResourceTypePINIndex}, testutil.InSlice(Equals), resources)
+}
+
+func (s *resourcesSuite) TestFindUnreferencedResources(c *C) {
+	k1 := s.protectKey(c, &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+	k2 := s.protectKey(c, &ProtectKeyParams{
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		PINIndexHandle:         s.NextAvailableHandle(c, 0x01810100)})
+
+	unreferenced, err := s.TPM().FindUnreferencedResources([]*SealedKeyData{k1})
+	c.Check(err, IsNil)
+	c.Check(unreferenced, DeepEquals, []Resource{
+		{Handle: k2.PCRPolicyCounterHandle(), Type: ResourceTypePCRPolicyCounter},
+		{Handle: k2.PINIndexHandle(), Type: ResourceTypePINIndex}})
+
+	unreferenced, err = s.TPM().FindUnreferencedResources([]*SealedKeyData{k1, k2})
+	c.Check(err, IsNil)
+	c.Check(unreferenced, HasLen, 0)
+}
+
+func (s *resourcesSuite) TestFindUnreferencedResourcesPCRPolicyIndex(c *C) {
+	k1 := s.protectKey(c, &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+	k2 := s.protectKey(c, &ProtectKeyParams{
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		NVAuthorizedPCRPolicy:  true})
+
+	unreferenced, err := s.TPM().FindUnreferencedResources([]*SealedKeyData{k1})
+	c.Check(err, IsNil)
+	c.Check(unreferenced, DeepEquals, []Resource{{Handle: k2.PCRPolicyCounterHandle(), Type: ResourceTypePCRPolicyIndex}})
+
+	unreferenced, err = s.TPM().FindUnreferencedResources([]*SealedKeyData{k1, k2})
+	c.Check(err, IsNil)
+	c.Check(unreferenced, HasLen, 0)
+}
+
+func (s *resourcesSuite) TestFindUnreferencedResourcesIgnoresForeignIndices(c *C) {
+	// These have the same attributes as a PCR policy NV index, but one has a
+	// different size and the other has no authorization policy.
+	foreign1 := tpm2.NVPublic{
+		Index:      s.NextAvailableHandle(c, 0x01810000),
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		AuthPolicy: make(tpm2.Digest, 32),
+		Size:       8}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &foreign1)
+	foreign2 := tpm2.NVPublic{
+		Index:   s.NextAvailableHandle(c, 0x01810000),
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    34}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &foreign2)
+
+	resources, err := s.TPM().ListResources()
+	c.Check(err, IsNil)
+	for _, r := range resources {
+		c.Check(r.Handle, Not(Equals), foreign1.Index)
+		c.Check(r.Handle, Not(Equals), foreign2.Index)
+	}
+
+	unreferenced, err := s.TPM().FindUnreferencedResources(nil)
+	c.Check(err, IsNil)
+	c.Check(unreferenced, HasLen, 0)
+}
+
+func (s *resourcesSuite) TestRemoveResources(c *C) {
+	k1 := s.protectKey(c, &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+	k2 := s.protectKey(c, &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+
+	unreferenced, err := s.TPM().FindUnreferencedResources([]*SealedKeyData{k2})
+	c.Check(err, IsNil)
+
+	removed, err := s.TPM().RemoveResources(unreferenced)
+	c.Check(err, IsNil)
+	c.Check(removed, DeepEquals, []Resource{{Handle: k1.PCRPolicyCounterHandle(), Type: ResourceTypePCRPolicyCounter}})
+
+	c.Check(s.TPM().DoesHandleExist(k1.PCRPolicyCounterHandle()), testutil.IsFalse)
+	c.Check(s.TPM().DoesHandleExist(k2.PCRPolicyCounterHandle()), testutil.IsTrue)
+}
+
+func (s *resourcesSuite) TestRemoveResourcesOnlyRemovesSupplied(c *C) {
+	k1 := s.protectKey(c, &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+	k2 := s.protectKey(c, &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+
+	removed, err := s.TPM().RemoveResources([]Resource{{Handle: k2.PCRPolicyCounterHandle(), Type: ResourceTypePCRPolicyCounter}})
+	c.Check(err, IsNil)
+	c.Check(removed, DeepEquals, []Resource{{Handle: k2.PCRPolicyCounterHandle(), Type: ResourceTypePCRPolicyCounter}})
+
+	c.Check(s.TPM().DoesHandleExist(k1.PCRPolicyCounterHandle()), testutil.IsTrue)
+	c.Check(s.TPM().DoesHandleExist(k2.PCRPolicyCounterHandle()), testutil.IsFalse)
+}
+
+func (s *resourcesSuite) TestRemoveResourcesAlreadyRemoved(c *C) {
+	handle := s.NextAvailableHandle(c, 0x01810000)
+
+	removed, err := s.TPM().RemoveResources([]Resource{{Handle: handle, Type: ResourceTypePCRPolicyCounter}})
+	c.Check(err, IsNil)
+	c.Check(removed, DeepEquals, []Resource{{Handle: handle, Type: ResourceTypePCRPolicyCounter}})
+}
+
+func (s *resourcesSuite) TestRemoveResourcesWrongType(c *C) {
+	k := s.protectKey(c, &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+
+	removed, err := s.TPM().RemoveResources([]Resource{{Handle: k.PCRPolicyCounterHandle(), Type: ResourceTypePINIndex}})
+	c.Check(err, ErrorMatches, "cannot remove pin-index at 0x[[:xdigit:]]{8}: NV index is not a pin-index")
+	c.Check(removed, HasLen, 0)
+
+	c.Check(s.TPM().DoesHandleExist(k.PCRPolicyCounterHandle()), testutil.IsTrue)
+}
+
+func (s *resourcesSuite) TestRemoveResourcesUnrelatedIndex(c *C) {
+	nvPub := tpm2.NVPublic{
+		Index:   s.NextAvailableHandle(c, 0x01810000),
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &nvPub)
+
+	removed, err := s.TPM().RemoveResources([]Resource{{Handle: nvPub.Index, Type: ResourceTypePCRPolicyCounter}})
+	c.Check(err, ErrorMatches, "cannot remove pcr-policy-counter at 0x[[:xdigit:]]{8}: NV index is not a pcr-policy-counter")
+	c.Check(removed, HasLen, 0)
+
+	c.Check(s.TPM().DoesHandleExist(nvPub.Index), testutil.IsTrue)
+}
+
+func (s *resourcesSuite) TestRemoveResourcesOwnerAuthFail(c *C) {
+	k := s.protectKey(c, &ProtectKeyParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("1234"))
+	s.TPM().OwnerHandleContext().SetAuthValue(nil)
+
+	removed, err := s.TPM().RemoveResources([]Resource{{Handle: k.PCRPolicyCounterHandle(), Type: ResourceTypePCRPolicyCounter}})
+	c.Check(err, Equals, AuthFailError{tpm2.HandleOwner})
+	c.Check(removed, HasLen, 0)
+}
+
+func (s *resourcesSuite) TestDeprovisionWithoutLockout(c *C) {
+	k := s.protectKey(c, &ProtectKeyParams{
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		PINIndexHandle:         s.NextAvailableHandle(c, 0x01810100)})
+
+	removed, err := s.TPM().Deprovision(DeprovisionModeWithoutLockout)
+	c.Check(err, IsNil)
+	c.Check(removed, DeepEquals, []Resource{{Handle: tcg.SRKHandle, Type: ResourceTypeStorageRootKey}})
+
+	// Resources at caller specified handles are not removed.
+	c.Check(s.TPM().DoesHandleExist(tcg.SRKHandle), testutil.IsFalse)
+	c.Check(s.TPM().DoesHandleExist(tcg.EKHandle), testutil.IsTrue)
+	c.Check(s.TPM().DoesHandleExist(k.PCRPolicyCounterHandle()), testutil.IsTrue)
+	c.Check(s.TPM().DoesHandleExist(k.PINIndexHandle()), testutil.IsTrue)
+}
+
+func (s *resourcesSuite) TestDeprovisionFull(c *C) {
+	s.HierarchyChangeAuth(c, tpm2.HandleLockout, []byte("1234"))
+
+	_, err := s.TPM().Deprovision(DeprovisionModeFull)
+	c.Check(err, IsNil)
+
+	c.Check(s.TPM().DoesHandleExist(tcg.SRKHandle), testutil.IsFalse)
+
+	value, err := s.TPM().GetCapabilityTPMProperty(tpm2.PropertyPermanent)
+	c.Check(err, IsNil)
+	c.Check(tpm2.PermanentAttributes(value)&tpm2.AttrLockoutAuthSet, Equals, tpm2.PermanentAttributes(0))
+}
+
+func (s *resourcesSuite) TestDeprovisionCustomSRKHandle(c *C) {
+	_, err := s.TPM().EnsureProvisionedWithOptions(ProvisionModeWithoutLockout, nil, &ProvisionOptions{SRKHandle: 0x81000002})
+	c.Check(err, testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+
+	resources, err := s.TPM().ListResources()
+	c.Check(err, IsNil)
+	c.Check(Resource{Handle: 0x81000002, Type: ResourceTypeStorageRootKey}, testutil.InSlice(Equals), resources)
+
+	removed, err := s.TPM().Deprovision(DeprovisionModeWithoutLockout)
+	c.Check(err, IsNil)
+	c.Check(removed, DeepEquals, []Resource{{Handle: 0x81000002, Type: ResourceTypeStorageRootKey}})
+
+	c.Check(s.TPM().DoesHandleExist(0x81000002), testutil.IsFalse)
+}
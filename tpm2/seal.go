@@ -44,6 +44,26 @@ type ProtectKeyParams struct {
 	// by calling SealedKeyData.UpdatePCRProtectionPolicy.
 	PCRProfile *PCRProtectionProfile
 
+	// SelectStrongestPCRBank indicates that the PCR policy should only be
+	// computed from the values in PCRProfile for the strongest PCR bank that
+	// is also active on the TPM and present in the TCG event log. This makes
+	// it possible to supply a profile that covers several PCR banks. If there
+	// isn't a suitable bank, ErrNoSuitablePCRBank will be returned. This is
+	// only used by ProtectKeyWithTPM and ProtectKeysWithTPM, and is equivalent
+	// to calling PCRProtectionProfile.SelectStrongestPCRBank on PCRProfile,
+	// which also applies to subsequent PCR policy updates.
+	SelectStrongestPCRBank bool
+
+	// NVAuthorizedPCRPolicy indicates that the NV index created at PCRPolicyCounterHandle
+	// should contain the digest of the authorized PCR policy, which is checked with
+	// TPM2_PolicyAuthorizeNV, rather than being a PCR policy counter. This creates version
+	// 4 key data. A new PCR policy for a key created this way is authorized by a single NV
+	// write in RevokeOldPCRProtectionPolicies, which also revokes the previous PCR policy.
+	// If this is set, PCRPolicyCounterHandle
+	// must not be tpm2.HandleNull. This is only used by ProtectKeyWithTPM and
+	// ProtectKeysWithTPM.
+	NVAuthorizedPCRPolicy bool
+
 	// PCRPolicyCounterHandle is the handle at which to create a NV index for PCR
 	// authorization policy revocation support. The handle must either be tpm2.HandleNull
 	// (in which case, no NV index will be created and the sealed key will not benefit
@@ -54,6 +74,25 @@ type ProtectKeyParams struct {
 	// owner objects (0x01800000 - 0x01bfffff).
 	PCRPolicyCounterHandle tpm2.Handle
 
+	// PINIndexHandle is the handle at which to create a NV index that verifies the PIN
+	// of the newly created key with a retry limit, which is independent of the TPM's
+	// dictionary attack protection. This creates version 5 key data. If this is not zero,
+	// it must be a valid NV index handle (MSO == 0x01), subject to the same considerations
+	// as PCRPolicyCounterHandle. The PIN is the authorization value of the NV index, and
+	// the sealed object is exempt from the TPM's dictionary attack protection, so
+	// incorrect PIN attempts don't affect the TPM's lockout counter. The PIN is initially
+	// empty and can be set with secboot.KeyData.SetPassphrase. Once the retry limit has
+	// been reached, recovering the key fails with a PINLockoutError until
+	// SealedKeyData.ResetPINLockout is called. This is only used by ProtectKeyWithTPM and
+	// ProtectKeysWithTPM with a single key, and cannot be combined with
+	// NVAuthorizedPCRPolicy.
+	PINIndexHandle tpm2.Handle
+
+	// PINRetryLimit is the number of incorrect PIN attempts permitted before the key
+	// is locked out. If this is zero, a default of 5 is used. This is only used if
+	// PINIndexHandle is set.
+	PINRetryLimit uint32
+
 	// AuthKey is the key used to authorize changes to the newly create key,
 	// via the SealedKeyObject.UpdatePCRProtectionPolicy and
 	// secboot.KeyData.SetAuthorizedSnapModels APIs. If set, this should be a
@@ -151,50 +190,67 @@ type keyDataPolicyParams struct {
 	AuthPolicy tpm2.Digest
 }
 
-// makeKeyDataPolicy creates the policy data required to seal a key with makeKeyDataWithPolicy
-// and creates a PCR policy counter if required.
-func makeKeyDataPolicy(tpm *tpm2.TPMContext, pcrPolicyCounterHandle tpm2.Handle, authKey secboot.AuxiliaryKey,
-	session tpm2.SessionContext) (data *keyDataPolicyParams, pcrPolicyCounterOut *createdPcrPolicyCounter,
-	authKeyOut secboot.AuxiliaryKey, err error) {
-	// Create an auth key.
+// makePolicyAuthKey creates an auth key if one isn't supplied, and returns it along with
+// the public area of the key derived from it for authorizing dynamic authorization policies.
+func makePolicyAuthKey(authKey secboot.AuxiliaryKey) (secboot.AuxiliaryKey, *tpm2.Public, error) {
 	if authKey == nil {
 		authKey = make(secboot.AuxiliaryKey, 32)
 		if _, err := rand.Read(authKey); err != nil {
-			return nil, nil, nil, xerrors.Errorf("cannot create key for signing dynamic authorization policies: %w", err)
+			return nil, nil, xerrors.Errorf("cannot create key for signing dynamic authorization policies: %w", err)
 		}
 	}
 	authPublicKey, err := newPolicyAuthPublicKey(authKey)
 	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot derive public area of key for signing dynamic authorization policies: %w", err)
+		return nil, nil, xerrors.Errorf("cannot derive public area of key for signing dynamic authorization policies: %w", err)
 	}
+	return authKey, authPublicKey, nil
+}
 
-	// Create PCR policy counter, if requested.
-	var pcrPolicyCount uint64
-	var pcrPolicyCounter *createdPcrPolicyCounter
-	if pcrPolicyCounterHandle != tpm2.HandleNull {
-		if tpm == nil {
-			return nil, nil, nil, errors.New("cannot create a PCR policy counter without a TPM connection")
-		}
+// makePcrPolicyCounter creates a PCR policy counter if required, returning it
+// along with its initial value.
+func makePcrPolicyCounter(tpm *tpm2.TPMContext, pcrPolicyCounterHandle tpm2.Handle, authPublicKey *tpm2.Public,
+	session tpm2.SessionContext) (*createdPcrPolicyCounter, uint64, error) {
+	if pcrPolicyCounterHandle == tpm2.HandleNull {
+		return nil, 0, nil
+	}
 
-		var pub *tpm2.NVPublic
-		pub, pcrPolicyCount, err = createPcrPolicyCounter(tpm, pcrPolicyCounterHandle, authPublicKey, session)
-		switch {
-		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
-			return nil, nil, nil, TPMResourceExistsError{pcrPolicyCounterHandle}
-		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
-			return nil, nil, nil, AuthFailError{tpm2.HandleOwner}
-		case err != nil:
-			return nil, nil, nil, xerrors.Errorf("cannot create new PCR policy counter: %w", err)
-		}
+	if tpm == nil {
+		return nil, 0, errors.New("cannot create a PCR policy counter without a TPM connection")
+	}
+
+	pub, pcrPolicyCount, err := createPcrPolicyCounter(tpm, pcrPolicyCounterHandle, authPublicKey, session)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+		return nil, 0, TPMResourceExistsError{pcrPolicyCounterHandle}
+	case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+		return nil, 0, AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return nil, 0, xerrors.Errorf("cannot create new PCR policy counter: %w", err)
+	}
 
-		pcrPolicyCounter = &createdPcrPolicyCounter{
-			tpm:     tpm,
-			session: session,
-			pub:     pub}
+	return &createdPcrPolicyCounter{
+		tpm:     tpm,
+		session: session,
+		pub:     pub}, pcrPolicyCount, nil
+}
 
-		defer func() { pcrPolicyCounter.undefineOnError(err) }()
+// makeKeyDataPolicy creates the policy data required to seal a key with makeKeyDataWithPolicy
+// and creates a PCR policy counter if required.
+func makeKeyDataPolicy(tpm *tpm2.TPMContext, pcrPolicyCounterHandle tpm2.Handle, authKey secboot.AuxiliaryKey,
+	session tpm2.SessionContext) (data *keyDataPolicyParams, pcrPolicyCounterOut *createdPcrPolicyCounter,
+	authKeyOut secboot.AuxiliaryKey, err error) {
+	authKey, authPublicKey, err := makePolicyAuthKey(authKey)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
+	// Create PCR policy counter, if requested.
+	pcrPolicyCounter, pcrPolicyCount, err := makePcrPolicyCounter(tpm, pcrPolicyCounterHandle, authPublicKey, session)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() { pcrPolicyCounter.undefineOnError(err) }()
+
 	alg := tpm2.HashAlgorithmSHA256
 
 	// Create the initial policy data
@@ -209,32 +265,159 @@ func makeKeyDataPolicy(tpm *tpm2.TPMContext, pcrPolicyCounterHandle tpm2.Handle,
 		AuthPolicy: authPolicy}, pcrPolicyCounter, authKey, nil
 }
 
+// makeKeyDataPolicyV4 creates the policy data required to seal a key with makeKeyDataWithPolicy
+// using a PCR policy that is authorized by a NV index, and creates the NV index.
+func makeKeyDataPolicyV4(tpm *tpm2.TPMContext, pcrPolicyIndexHandle tpm2.Handle, authKey secboot.AuxiliaryKey,
+	session tpm2.SessionContext) (data *keyDataPolicyParams, pcrPolicyIndexOut *createdPcrPolicyCounter,
+	authKeyOut secboot.AuxiliaryKey, err error) {
+	if tpm == nil {
+		return nil, nil, nil, errors.New("cannot create a PCR policy NV index without a TPM connection")
+	}
+	if pcrPolicyIndexHandle == tpm2.HandleNull {
+		return nil, nil, nil, errors.New("a PCR policy NV index handle is required")
+	}
+
+	authKey, authPublicKey, err := makePolicyAuthKey(authKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	pub, err := createPcrPolicyIndex(tpm, pcrPolicyIndexHandle, authPublicKey, authKey, session)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+		return nil, nil, nil, TPMResourceExistsError{pcrPolicyIndexHandle}
+	case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+		return nil, nil, nil, AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return nil, nil, nil, xerrors.Errorf("cannot create new PCR policy NV index: %w", err)
+	}
+
+	pcrPolicyIndex := &createdPcrPolicyCounter{
+		tpm:     tpm,
+		session: session,
+		pub:     pub}
+	defer func() { pcrPolicyIndex.undefineOnError(err) }()
+
+	alg := tpm2.HashAlgorithmSHA256
+
+	// Create the initial policy data
+	policyData, authPolicy, err := newKeyDataPolicyV4(alg, authPublicKey, pub)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create initial policy data: %w", err)
+	}
+
+	return &keyDataPolicyParams{
+		Alg:        alg,
+		PolicyData: policyData,
+		AuthPolicy: authPolicy}, pcrPolicyIndex, authKey, nil
+}
+
+// makeKeyDataPolicyV5 creates the policy data required to seal a key with makeKeyDataWithPolicy
+// using a PIN with its own retry limit, and creates the PIN NV index and a PCR policy counter if
+// required.
+func makeKeyDataPolicyV5(tpm *tpm2.TPMContext, pcrPolicyCounterHandle, pinIndexHandle tpm2.Handle, pinRetryLimit uint32,
+	authKey secboot.AuxiliaryKey, session tpm2.SessionContext) (data *keyDataPolicyParams, pcrPolicyCounterOut,
+	pinIndexOut *createdPcrPolicyCounter, authKeyOut secboot.AuxiliaryKey, err error) {
+	if tpm == nil {
+		return nil, nil, nil, nil, errors.New("cannot create a PIN NV index without a TPM connection")
+	}
+	if pinRetryLimit == 0 {
+		pinRetryLimit = defaultPINRetryLimit
+	}
+
+	authKey, authPublicKey, err := makePolicyAuthKey(authKey)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	// Create PCR policy counter, if requested.
+	pcrPolicyCounter, pcrPolicyCount, err := makePcrPolicyCounter(tpm, pcrPolicyCounterHandle, authPublicKey, session)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	defer func() { pcrPolicyCounter.undefineOnError(err) }()
+
+	pub, err := createPinIndex(tpm, pinIndexHandle, authPublicKey, authKey, pinRetryLimit, session)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+		return nil, nil, nil, nil, TPMResourceExistsError{pinIndexHandle}
+	case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+		return nil, nil, nil, nil, AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return nil, nil, nil, nil, xerrors.Errorf("cannot create new PIN NV index: %w", err)
+	}
+
+	pinIndex := &createdPcrPolicyCounter{
+		tpm:     tpm,
+		session: session,
+		pub:     pub}
+	defer func() { pinIndex.undefineOnError(err) }()
+
+	alg := tpm2.HashAlgorithmSHA256
+
+	// Create the initial policy data
+	policyData, authPolicy, err := newKeyDataPolicyV5(alg, authPublicKey, pcrPolicyCounter.Pub(), pcrPolicyCount, pub, pinRetryLimit)
+	if err != nil {
+		return nil, nil, nil, nil, xerrors.Errorf("cannot create initial policy data: %w", err)
+	}
+
+	return &keyDataPolicyParams{
+		Alg:        alg,
+		PolicyData: policyData,
+		AuthPolicy: authPolicy}, pcrPolicyCounter, pinIndex, authKey, nil
+}
+
 // keyDataParams contains the parameters required to seal a new key with makeKeyData.
 type keyDataParams struct {
 	PCRPolicyCounterHandle tpm2.Handle
 	PCRProfile             *PCRProtectionProfile
+
+	// NVAuthorizedPCRPolicy indicates that PCRPolicyCounterHandle
+	// is the handle of a NV index for authorizing PCR policies with
+	// TPM2_PolicyAuthorizeNV.
+	NVAuthorizedPCRPolicy bool
+
+	// PINIndexHandle is the handle at which to create a PIN NV index,
+	// or zero if the key should not be protected by a PIN.
+	PINIndexHandle tpm2.Handle
+	PINRetryLimit  uint32
 }
 
 // makeKeyData protects the supplied keys using the supplied keySealer and
-// parameters. If required, a PCR policy counter is created. The returned key
-// will have an initial PCR policy as specified via the supplied parameters.
+// parameters. If required, a PCR policy counter and a PIN NV index are created.
+// The returned key will have an initial PCR policy as specified via the supplied
+// parameters.
 func makeKeyData(tpm *tpm2.TPMContext, key secboot.DiskUnlockKey, authKey secboot.AuxiliaryKey, params *keyDataParams,
 	sealer keySealer, session tpm2.SessionContext) (protectedKey *secboot.KeyData, authKeyOut secboot.AuxiliaryKey,
-	pcrPolicyCounterOut *createdPcrPolicyCounter, err error) {
-	policy, pcrPolicyCounter, authKey, err := makeKeyDataPolicy(tpm, params.PCRPolicyCounterHandle, authKey, session)
+	pcrPolicyCounterOut, pinIndexOut *createdPcrPolicyCounter, err error) {
+	var policy *keyDataPolicyParams
+	var pcrPolicyCounter *createdPcrPolicyCounter
+	var pinIndex *createdPcrPolicyCounter
+	switch {
+	case params.PINIndexHandle != 0 && params.NVAuthorizedPCRPolicy:
+		return nil, nil, nil, nil, errors.New("cannot create a key with both a PIN NV index and a PCR policy NV index")
+	case params.PINIndexHandle != 0:
+		policy, pcrPolicyCounter, pinIndex, authKey, err = makeKeyDataPolicyV5(tpm, params.PCRPolicyCounterHandle, params.PINIndexHandle,
+			params.PINRetryLimit, authKey, session)
+	case params.NVAuthorizedPCRPolicy:
+		policy, pcrPolicyCounter, authKey, err = makeKeyDataPolicyV4(tpm, params.PCRPolicyCounterHandle, authKey, session)
+	default:
+		policy, pcrPolicyCounter, authKey, err = makeKeyDataPolicy(tpm, params.PCRPolicyCounterHandle, authKey, session)
+	}
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 	defer func() { pcrPolicyCounter.undefineOnError(err) }()
+	defer func() { pinIndex.undefineOnError(err) }()
 
 	protectedKey, err = makeKeyDataWithPolicy(key, authKey, policy, sealer)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	skd, err := NewSealedKeyData(protectedKey)
 	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot obtain SealedKeyObject from KeyData: %w", err)
+		return nil, nil, nil, nil, xerrors.Errorf("cannot obtain SealedKeyObject from KeyData: %w", err)
 	}
 
 	pcrProfile := params.PCRProfile
@@ -242,13 +425,18 @@ func makeKeyData(tpm *tpm2.TPMContext, key secboot.DiskUnlockKey, authKey secboo
 		pcrProfile = NewPCRProtectionProfile()
 	}
 	if err := skdbUpdatePCRProtectionPolicyImpl(&skd.sealedKeyDataBase, tpm, authKey, pcrPolicyCounter.Pub(), pcrProfile, session); err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot set initial PCR policy: %w", err)
+		return nil, nil, nil, nil, xerrors.Errorf("cannot set initial PCR policy: %w", err)
+	}
+	if policy, ok := skd.data.Policy().(nvAuthorizedKeyDataPolicy); ok {
+		if err := authorizePCRPolicyWithNVIndex(tpm, policy, pcrPolicyCounter.Pub(), authKey, session); err != nil {
+			return nil, nil, nil, nil, xerrors.Errorf("cannot authorize initial PCR policy: %w", err)
+		}
 	}
 	if err := protectedKey.MarshalAndUpdatePlatformHandle(skd); err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot update platform handle: %w", err)
+		return nil, nil, nil, nil, xerrors.Errorf("cannot update platform handle: %w", err)
 	}
 
-	return protectedKey, authKey, pcrPolicyCounter, nil
+	return protectedKey, authKey, pcrPolicyCounter, pinIndex, nil
 }
 
 // ProtectKeyWithExternalStorageKey seals the supplied disk encryption key to the TPM storage
@@ -290,10 +478,16 @@ func ProtectKeyWithExternalStorageKey(tpmKey *tpm2.Public, key secboot.DiskUnloc
 	if params.PCRPolicyCounterHandle != tpm2.HandleNull {
 		return nil, nil, errors.New("PCR policy counter handle must be tpm2.HandleNull when creating an importable sealed key")
 	}
+	if params.NVAuthorizedPCRPolicy {
+		return nil, nil, errors.New("cannot create an importable sealed key with a PCR policy NV index")
+	}
+	if params.PINIndexHandle != 0 {
+		return nil, nil, errors.New("cannot create an importable sealed key with a PIN NV index")
+	}
 
 	sealer := &importableObjectKeySealer{tpmKey: tpmKey}
 
-	protectedKey, authKey, _, err = makeKeyData(nil, key, params.AuthKey, &keyDataParams{
+	protectedKey, authKey, _, _, err = makeKeyData(nil, key, params.AuthKey, &keyDataParams{
 		PCRPolicyCounterHandle: params.PCRPolicyCounterHandle,
 		PCRProfile:             params.PCRProfile}, sealer, nil)
 	if err != nil {
@@ -327,7 +521,9 @@ func ProtectKeyWithExternalStorageKey(tpmKey *tpm2.Public, key secboot.DiskUnloc
 // All keys will be created with the same authorization policy, and will be protected with
 // a PCR policy computed from the PCRProtectionProfile supplied via the PCRProfile field
 // of the params argument. The PCR policy can be updated later on via the
-// UpdateKeyPCRProtectionPolicyMultiple API.
+// UpdateKeyPCRProtectionPolicyMultiple API. If the SelectStrongestPCRBank field of params
+// is set, the PCR policy is only computed from the values for the strongest PCR bank in the
+// supplied profile that is also active on the TPM and present in the TCG event log.
 //
 // The sealed keys will be created with the snap models provided via the AuthorizedSnapModels
 // field of params authorized to access the data protected by these keys. The set
@@ -353,21 +549,39 @@ func ProtectKeysWithTPM(tpm *Connection, keys []secboot.DiskUnlockKey, params *P
 	if len(keys) == 0 {
 		return nil, nil, errors.New("no keys provided")
 	}
+	if params.PINIndexHandle != 0 && len(keys) > 1 {
+		return nil, nil, errors.New("cannot protect more than one key with a PIN NV index")
+	}
+
+	pcrProfile := params.PCRProfile
+	if pcrProfile != nil && (params.SelectStrongestPCRBank || pcrProfile.selectStrongestBank) {
+		pcrProfile, err = selectStrongestPCRBankForProfile(tpm.TPMContext, pcrProfile, tpm.HmacSession())
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot select PCR bank: %w", err)
+		}
+	}
 
-	sealer := &sealedObjectKeySealer{tpm}
+	sealer := &sealedObjectKeySealer{
+		tpm:  tpm,
+		noDA: params.PINIndexHandle != 0}
 
 	var protectedKey *secboot.KeyData
 	var pcrPolicyCounter *createdPcrPolicyCounter
+	var pinIndex *createdPcrPolicyCounter
 
-	protectedKey, authKey, pcrPolicyCounter, err = makeKeyData(tpm.TPMContext, keys[0], params.AuthKey,
+	protectedKey, authKey, pcrPolicyCounter, pinIndex, err = makeKeyData(tpm.TPMContext, keys[0], params.AuthKey,
 		&keyDataParams{
 			PCRPolicyCounterHandle: params.PCRPolicyCounterHandle,
-			PCRProfile:             params.PCRProfile},
+			PCRProfile:             pcrProfile,
+			NVAuthorizedPCRPolicy:  params.NVAuthorizedPCRPolicy,
+			PINIndexHandle:         params.PINIndexHandle,
+			PINRetryLimit:          params.PINRetryLimit},
 		sealer, tpm.HmacSession())
 	if err != nil {
 		return nil, nil, err
 	}
 	defer func() { pcrPolicyCounter.undefineOnError(err) }()
+	defer func() { pinIndex.undefineOnError(err) }()
 	protectedKeys = append(protectedKeys, protectedKey)
 
 	skd, err := NewSealedKeyData(protectedKey)
@@ -35,6 +35,7 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/tcg"
 )
 
 func makeSealedKeyTemplate() *tpm2.Public {
@@ -258,7 +259,7 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	srk := tpm.provisionedSrk
 	if srk == nil {
 		var err error
-		srk, err = provisionStoragePrimaryKey(tpm.TPMContext, session)
+		srk, err = provisionStoragePrimaryKey(tpm.TPMContext, tcg.SRKHandle, session)
 		switch {
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
 			return nil, AuthFailError{tpm2.HandleOwner}
@@ -338,6 +338,54 @@ func (s *sealSuite) TestProtectKeyWithTPMWithProvidedAuthKey(c *C) {
 		AuthKey: authKey})
 }
 
+func (s *sealSuite) TestProtectKeyWithTPMNVAuthorizedPCRPolicy(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		NVAuthorizedPCRPolicy:  true}
+
+	k, authKey, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.Validate(s.TPM().TPMContext, authKey, s.TPM().HmacSession()), IsNil)
+
+	c.Check(skd.Version(), Equals, uint32(4))
+	c.Check(skd.PCRPolicyCounterHandle(), Equals, params.PCRPolicyCounterHandle)
+
+	policyAuthPublicKey, err := NewPolicyAuthPublicKey(authKey)
+	c.Assert(err, IsNil)
+
+	index, err := s.TPM().CreateResourceContextFromTPM(params.PCRPolicyCounterHandle)
+	c.Assert(err, IsNil)
+	pcrPolicyIndexPub, _, err := s.TPM().NVReadPublic(index)
+	c.Check(err, IsNil)
+
+	expectedPolicyData, expectedPolicyDigest, err := NewKeyDataPolicyV4(tpm2.HashAlgorithmSHA256, policyAuthPublicKey, pcrPolicyIndexPub)
+	c.Assert(err, IsNil)
+
+	c.Check(skd.Data().Public().NameAlg, Equals, tpm2.HashAlgorithmSHA256)
+	c.Check(skd.Data().Public().AuthPolicy, DeepEquals, expectedPolicyDigest)
+	c.Check(skd.Data().Policy().(*KeyDataPolicy_v4).StaticData, tpm2_testutil.TPMValueDeepEquals, expectedPolicyData.(*KeyDataPolicy_v4).StaticData)
+
+	keyUnsealed, authKeyUnsealed, err := k.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, authKey)
+
+	// Verify that the key is sealed with the supplied PCR profile by changing
+	// the PCR values.
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+}
+
 type testProtectKeysWithTPMData struct {
 	n      int
 	params *ProtectKeyParams
@@ -621,6 +669,37 @@ func (s *sealSuite) TestProtectKeyWithTPMErrorHandlingPCRPolicyCounterExists(c *
 	c.Check(err.(TPMResourceExistsError).Handle, Equals, public.Index)
 }
 
+func (s *sealSuite) TestProtectKeyWithTPMErrorHandlingNVAuthorizedPCRPolicyNoIndexHandle(c *C) {
+	err := s.testProtectKeyWithTPMErrorHandling(c, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NVAuthorizedPCRPolicy:  true})
+	c.Check(err, ErrorMatches, "a PCR policy NV index handle is required")
+}
+
+func (s *sealSuite) TestProtectKeyWithTPMErrorHandlingNVAuthorizedPCRPolicyIndexExists(c *C) {
+	public := tpm2.NVPublic{
+		Index:   s.NextAvailableHandle(c, 0x0181ffff),
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    0}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &public)
+
+	err := s.testProtectKeyWithTPMErrorHandling(c, &ProtectKeyParams{
+		PCRPolicyCounterHandle: public.Index,
+		NVAuthorizedPCRPolicy:  true})
+	c.Assert(err, testutil.ConvertibleTo, TPMResourceExistsError{})
+	c.Check(err.(TPMResourceExistsError).Handle, Equals, public.Index)
+}
+
+func (s *sealSuite) TestProtectKeyWithTPMErrorHandlingNVAuthorizedPCRPolicyInvalidPCRProfile(c *C) {
+	err := s.testProtectKeyWithTPMErrorHandling(c, &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 50, make([]byte, tpm2.HashAlgorithmSHA256.Size())),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181ffff), // verify that this gets undefined on error
+		NVAuthorizedPCRPolicy:  true})
+	c.Check(err, ErrorMatches, "cannot set initial PCR policy: PCR protection profile contains digests for unsupported PCRs")
+}
+
 func (s *sealSuite) TestProtectKeyWithTPMErrorHandlingInvalidPCRProfile(c *C) {
 	err := s.testProtectKeyWithTPMErrorHandling(c, &ProtectKeyParams{
 		PCRProfile: tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}).
@@ -773,6 +852,14 @@ func (s *sealSuite) TestProtectKeyWithExternalStorageKeyErrorHandlingWithPCRPoli
 	c.Check(err, ErrorMatches, "PCR policy counter handle must be tpm2.HandleNull when creating an importable sealed key")
 }
 
+func (s *sealSuite) TestProtectKeyWithExternalStorageKeyErrorHandlingWithNVAuthorizedPCRPolicy(c *C) {
+	err := s.testProtectKeyWithExternalStorageKeyErrorHandling(c, &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		NVAuthorizedPCRPolicy:  true})
+	c.Check(err, ErrorMatches, "cannot create an importable sealed key with a PCR policy NV index")
+}
+
 type mockKeySealer struct {
 	called bool
 }
@@ -1132,8 +1219,9 @@ func (s *sealSuiteNoTPM) testMakeKeyData(c *C, data *testMakeKeyDataData) {
 	key := make(secboot.DiskUnlockKey, 32)
 	rand.Read(key)
 
-	kd, authKeyOut, pcrPolicyCounter, err := MakeKeyData(mockTpm, key, data.authKey, data.params, &sealer, mockSession)
+	kd, authKeyOut, pcrPolicyCounter, pinIndex, err := MakeKeyData(mockTpm, key, data.authKey, data.params, &sealer, mockSession)
 	c.Assert(err, IsNil)
+	c.Check(pinIndex, IsNil)
 
 	c.Assert(s.lastAuthKey, NotNil)
 	c.Assert(mockPolicyData, NotNil)
@@ -1208,3 +1296,20 @@ func (s *sealSuiteNoTPM) TestMakeKeyDataNilPCRProfile(c *C) {
 		params: &KeyDataParams{
 			PCRPolicyCounterHandle: tpm2.HandleNull}})
 }
+
+func (s *sealSuiteNoTPM) TestMakeKeyDataPINIndexWithNVAuthorizedPCRPolicy(c *C) {
+	var sealer mockKeySealer
+	_, _, _, _, err := MakeKeyData(new(tpm2.TPMContext), make(secboot.DiskUnlockKey, 32), nil, &KeyDataParams{
+		PCRPolicyCounterHandle: 0x01810000,
+		NVAuthorizedPCRPolicy:  true,
+		PINIndexHandle:         0x01810001}, &sealer, new(mockSessionContext))
+	c.Check(err, ErrorMatches, "cannot create a key with both a PIN NV index and a PCR policy NV index")
+}
+
+func (s *sealSuiteNoTPM) TestMakeKeyDataPINIndexNoTPM(c *C) {
+	var sealer mockKeySealer
+	_, _, _, _, err := MakeKeyData(nil, make(secboot.DiskUnlockKey, 32), nil, &KeyDataParams{
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PINIndexHandle:         0x01810001}, &sealer, nil)
+	c.Check(err, ErrorMatches, "cannot create a PIN NV index without a TPM connection")
+}
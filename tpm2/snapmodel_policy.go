@@ -129,8 +129,18 @@ type SnapModelProfileParams struct {
 	// PCRIndex is the PCR that snap-bootstrap measures the model to.
 	PCRIndex int
 
-	// Models is the set of models to add to the PCR profile.
+	// Models is the set of models to add to the PCR profile. If Rules is
+	// set, this is the set of candidate models to match against the rules.
 	Models []secboot.SnapModel
+
+	// Rules optionally restricts the models added to the PCR profile to
+	// those from Models that match at least one of these rules. The PCR
+	// measurement binds to a digest of the exact model, so a PCR policy
+	// can't express a rule directly - the rules have to be expanded
+	// against a set of known models instead. This allows the same rules
+	// supplied to secboot.KeyData.SetSnapModelAuthRules to be used to
+	// filter a list of candidate models, such as all of a brand's models.
+	Rules []secboot.SnapModelAuthRule
 }
 
 // AddSnapModelProfile adds the snap model profile to the PCR protection profile, as measured by snap-bootstrap, in order to generate
@@ -162,7 +172,8 @@ type SnapModelProfileParams struct {
 //
 // The PCR index that snap-bootstrap measures the model to can be specified via the PCRIndex field of params.
 //
-// The set of models to add to the PCRProtectionProfile is specified via the Models field of params.
+// The set of models to add to the PCRProtectionProfile is specified via the Models field of params. If the Rules field of params
+// is set, only the models that match at least one of the rules are added, and an error is returned if none of them match.
 func AddSnapModelProfile(branch *PCRProtectionProfileBranch, params *SnapModelProfileParams) error {
 	if params.PCRIndex < 0 {
 		return errors.New("invalid PCR index")
@@ -171,10 +182,29 @@ func AddSnapModelProfile(branch *PCRProtectionProfileBranch, params *SnapModelPr
 		return errors.New("no models provided")
 	}
 
+	models := params.Models
+	if len(params.Rules) > 0 {
+		models = nil
+		for _, model := range params.Models {
+			if model == nil {
+				return errors.New("nil model")
+			}
+			for i := range params.Rules {
+				if params.Rules[i].Matches(model) {
+					models = append(models, model)
+					break
+				}
+			}
+		}
+		if len(models) == 0 {
+			return errors.New("no models match the supplied rules")
+		}
+	}
+
 	branch.ExtendPCR(params.PCRAlgorithm, params.PCRIndex, computeSnapSystemEpochDigest(params.PCRAlgorithm, zeroSnapSystemEpoch))
 
 	bp := branch.AddBranchPoint()
-	for _, model := range params.Models {
+	for _, model := range models {
 		if model == nil {
 			return errors.New("nil model")
 		}
@@ -421,6 +421,70 @@ func (s *snapModelProfileSuite) TestAddSnapModelProfile12(c *C) {
 	})
 }
 
+func (s *snapModelProfileSuite) TestAddSnapModelProfile13(c *C) {
+	// Test that rules filter the supplied models.
+	s.testAddSnapModelProfile(c, &testAddSnapModelProfileData{
+		params: &SnapModelProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			PCRIndex:     12,
+			Models: []secboot.SnapModel{
+				testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+					"authority-id": "fake-brand",
+					"series":       "16",
+					"brand-id":     "fake-brand",
+					"model":        "fake-model",
+					"grade":        "secured",
+				}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+				testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+					"authority-id": "fake-brand",
+					"series":       "16",
+					"brand-id":     "fake-brand",
+					"model":        "other-model",
+					"grade":        "secured",
+				}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+				testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+					"authority-id": "fake-brand",
+					"series":       "16",
+					"brand-id":     "fake-brand",
+					"model":        "fake-model",
+					"grade":        "dangerous",
+				}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+			},
+			Rules: []secboot.SnapModelAuthRule{
+				{BrandID: "fake-brand", Grade: "secured", ModelPrefix: "fake-"},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					12: testutil.DecodeHexString(c, "bd7851fd994a7f899364dbc96a95dffeaa250cd7ea33b4b6c313866169e779bc"),
+				},
+			},
+		},
+	})
+}
+
+func (s *snapModelProfileSuite) TestAddSnapModelProfileNoMatchingModels(c *C) {
+	profile := NewPCRProtectionProfile()
+	err := AddSnapModelProfile(profile.RootBranch(), &SnapModelProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     12,
+		Models: []secboot.SnapModel{
+			testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+				"authority-id": "fake-brand",
+				"series":       "16",
+				"brand-id":     "fake-brand",
+				"model":        "fake-model",
+				"grade":        "secured",
+			}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		},
+		Rules: []secboot.SnapModelAuthRule{
+			{BrandID: "other-brand", Grade: "secured"},
+		},
+	})
+	c.Check(err, ErrorMatches, "no models match the supplied rules")
+}
+
 type snapModelMeasureSuite struct {
 	tpm2test.TPMTest
 }
@@ -63,6 +63,7 @@ type Connection struct {
 	verifiedDeviceAttributes *DeviceAttributes
 	ek                       tpm2.ResourceContext
 	provisionedSrk           tpm2.ResourceContext
+	srkHandle                tpm2.Handle
 	hmacSession              tpm2.SessionContext
 }
 
@@ -97,6 +98,29 @@ func (t *Connection) VerifiedDeviceAttributes() *DeviceAttributes {
 	return t.verifiedDeviceAttributes
 }
 
+// SRKHandle returns the persistent handle of the storage root key that is used by
+// EnsureProvisioned, ListResources, Deprovision and HealthReport. This is the handle
+// defined by the TCG (0x81000001) unless it has been changed with SetSRKHandle or
+// EnsureProvisionedWithOptions.
+func (t *Connection) SRKHandle() tpm2.Handle {
+	if t.srkHandle == 0 {
+		return tcg.SRKHandle
+	}
+	return t.srkHandle
+}
+
+// SetSRKHandle changes the persistent handle of the storage root key that is used by
+// EnsureProvisioned, ListResources, Deprovision and HealthReport. The handle must be
+// in the range reserved for owner persistent objects (0x81000000 - 0x817fffff). Note
+// that keys are always sealed to the storage root key at the handle defined by the TCG.
+func (t *Connection) SetSRKHandle(handle tpm2.Handle) error {
+	if err := checkSRKHandle(handle); err != nil {
+		return err
+	}
+	t.srkHandle = handle
+	return nil
+}
+
 // EndorsementKey returns a reference to the TPM's persistent endorsement key, if one exists. If the endorsement key certificate has
 // been verified, the returned ResourceContext will correspond to the object for which the certificate was issued and can safely be
 // used to share secrets with the TPM.
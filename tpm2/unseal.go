@@ -116,7 +116,10 @@ func (k *sealedKeyDataBase) unsealDataFromTPM(tpm *tpm2.TPMContext, authValue []
 	}
 	defer tpm.FlushContext(keyObject)
 
-	keyObject.SetAuthValue(authValue)
+	pinPolicy, hasPIN := k.data.Policy().(pinKeyDataPolicy)
+	if !hasPIN {
+		keyObject.SetAuthValue(authValue)
+	}
 
 	// Begin and execute policy session
 	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.Public().NameAlg)
@@ -136,6 +139,16 @@ func (k *sealedKeyDataBase) unsealDataFromTPM(tpm *tpm2.TPMContext, authValue []
 		return nil, err
 	}
 
+	if hasPIN {
+		if err := pinPolicy.ExecutePINPolicy(tpm, authValue, policySession, hmacSession); err != nil {
+			err = xerrors.Errorf("cannot complete PIN authorization policy assertions: %w", err)
+			if isPolicyDataError(err) {
+				return nil, InvalidKeyDataError{err.Error()}
+			}
+			return nil, err
+		}
+	}
+
 	// Unseal
 	data, err = tpm.Unseal(keyObject, policySession, hmacSession.IncludeAttrs(tpm2.AttrResponseEncrypt))
 	switch {
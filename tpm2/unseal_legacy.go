@@ -23,6 +23,7 @@ import (
 	"github.com/canonical/go-tpm2/mu"
 
 	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/secmem"
 )
 
 // UnsealFromTPM will load the TPM sealed object in to the TPM and attempt to
@@ -84,10 +85,16 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection) (key secboot.DiskUnlock
 		return secboot.DiskUnlockKey(data), nil, nil
 	}
 
+	defer secmem.Wipe(data)
+
 	var sealedData sealedData
 	if _, err := mu.UnmarshalFromBytes(data, &sealedData); err != nil {
 		return nil, nil, InvalidKeyDataError{err.Error()}
 	}
 
-	return sealedData.Key, sealedData.AuthPrivateKey, nil
+	// Return copies of the keys so that the unsealed data can be wiped
+	// regardless of whether the unmarshalled keys alias it.
+	key = append(secboot.DiskUnlockKey(nil), sealedData.Key...)
+	authKey = append(secboot.AuxiliaryKey(nil), sealedData.AuthPrivateKey...)
+	return key, authKey, nil
 }
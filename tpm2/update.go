@@ -43,6 +43,10 @@ var skdbUpdatePCRProtectionPolicyImpl = (*sealedKeyDataBase).updatePCRProtection
 //
 // If k.data.policy().pcrPolicyCounterHandle() is not tpm2.HandleNull, then counterPub
 // must be supplied, and it must correspond to the public area associated with that handle.
+//
+// This only updates the metadata. For key data that authorizes PCR policies with a NV
+// index (v4), the new PCR policy must subsequently be authorized with
+// authorizePCRPolicyWithNVIndex.
 func (k *sealedKeyDataBase) updatePCRProtectionPolicyImpl(tpm *tpm2.TPMContext, key secboot.AuxiliaryKey,
 	counterPub *tpm2.NVPublic, profile *PCRProtectionProfile, session tpm2.SessionContext) error {
 	var counterName tpm2.Name
@@ -109,6 +113,34 @@ func (k *sealedKeyDataBase) updatePCRProtectionPolicyImpl(tpm *tpm2.TPMContext,
 	return k.data.Policy().UpdatePCRPolicy(alg, params)
 }
 
+// authorizePCRPolicyWithNVIndex writes the digest of the current PCR policy of the
+// supplied policy to the PCR policy NV index with the supplied public area, which
+// authorizes it and revokes the previous PCR policy. It does nothing if the NV index
+// already contains this digest.
+func authorizePCRPolicyWithNVIndex(tpm *tpm2.TPMContext, policy nvAuthorizedKeyDataPolicy, pub *tpm2.NVPublic, key secboot.AuxiliaryKey, session tpm2.SessionContext) error {
+	if tpm == nil || pub == nil {
+		return errors.New("cannot authorize PCR policy without a TPM connection and PCR policy NV index")
+	}
+
+	context, err := policy.PCRPolicyIndexContext(tpm, pub, session)
+	if err != nil {
+		return xerrors.Errorf("cannot create context for PCR policy NV index: %w", err)
+	}
+
+	current, err := context.Get()
+	if err != nil {
+		return xerrors.Errorf("cannot read current PCR policy digest: %w", err)
+	}
+	if bytes.Equal(current, policy.PCRPolicyDigest()) {
+		return nil
+	}
+
+	if err := context.Write(policy.PCRPolicyDigest(), key); err != nil {
+		return xerrors.Errorf("cannot write PCR policy digest: %w", err)
+	}
+	return nil
+}
+
 func (k *sealedKeyDataBase) revokeOldPCRProtectionPoliciesImpl(tpm *tpm2.TPMContext, key secboot.AuxiliaryKey, session tpm2.SessionContext) error {
 	pcrPolicyCounterPub, err := k.validateData(tpm, session)
 	if err != nil {
@@ -122,6 +154,10 @@ func (k *sealedKeyDataBase) revokeOldPCRProtectionPoliciesImpl(tpm *tpm2.TPMCont
 		return nil
 	}
 
+	if policy, ok := k.data.Policy().(nvAuthorizedKeyDataPolicy); ok {
+		return authorizePCRPolicyWithNVIndex(tpm, policy, pcrPolicyCounterPub, key, session)
+	}
+
 	target := k.data.Policy().PCRPolicySequence()
 
 	context, err := k.data.Policy().PCRPolicyCounterContext(tpm, pcrPolicyCounterPub, session)
@@ -179,6 +215,12 @@ func updateKeyPCRProtectionPoliciesCommon(tpm *tpm2.TPMContext, keys []*sealedKe
 	if pcrProfile == nil {
 		pcrProfile = NewPCRProtectionProfile()
 	}
+	if pcrProfile.selectStrongestBank {
+		pcrProfile, err = selectStrongestPCRBankForProfile(tpm, pcrProfile, session)
+		if err != nil {
+			return xerrors.Errorf("cannot select PCR bank: %w", err)
+		}
+	}
 	if err := primaryKey.updatePCRProtectionPolicyImpl(tpm, authKey, pcrPolicyCounterPub, pcrProfile, session); err != nil {
 		return xerrors.Errorf("cannot update PCR authorization policy: %w", err)
 	}
@@ -236,6 +278,12 @@ func updateKeyPCRProtectionPolicies(tpm *tpm2.TPMContext, keys []*SealedKeyData,
 // incremented by 1 compared with the value associated with the current PCR policy. This does not increment the NV
 // counter on the TPM - this can be done with a subsequent call to RevokeOldPCRProtectionPolicies.
 //
+// If the sealed key was created with a PCR policy NV index (version 4), the new PCR policy is not authorized until
+// its digest is written to the NV index with a subsequent call to RevokeOldPCRProtectionPolicies, which also revokes
+// the previous PCR policy. Until then, only the previous key data can be unsealed. The updated key data should be
+// persisted before calling RevokeOldPCRProtectionPolicies, else the key will not be unsealable if the update is
+// interrupted.
+//
 // On success, this SealedKeyObject will have an updated authorization policy that includes a PCR policy computed
 // from the supplied PCRProtectionProfile. It must be persisted using SealedKeyObject.WriteAtomic.
 func (k *SealedKeyData) UpdatePCRProtectionPolicy(tpm *Connection, authKey secboot.AuxiliaryKey, pcrProfile *PCRProtectionProfile) error {
@@ -248,6 +296,10 @@ func (k *SealedKeyData) UpdatePCRProtectionPolicy(tpm *Connection, authKey secbo
 // and become invalid. The PCR policy sequence number is incremented on each call to UpdatePCRProtectionPolicy.
 // If the key data was not created with a PCR policy counter, then this function does nothing.
 //
+// If the key data was created with a PCR policy NV index (version 4), this writes the digest of the current PCR
+// policy to the NV index, which authorizes it and revokes all other PCR policies. This completes the update
+// started by UpdatePCRProtectionPolicy.
+//
 // The caller must also specify the private part of the authorization key that was either returned by SealKeyToTPM
 // or SealedKeyObject.UnsealFromTPM.
 //
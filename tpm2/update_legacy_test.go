@@ -190,6 +190,42 @@ func (s *updateLegacySuite) TestUpdateKeyPCRProtectionPolicyMultiple(c *C) {
 	}
 }
 
+func (s *updateLegacySuite) TestUpdateKeyPCRProtectionPolicyMultipleSelectStrongestPCRBank(c *C) {
+	restore := MockEventLogPath("../efi/testdata/eventlog_sb.bin")
+	defer restore()
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	dir := c.MkDir()
+
+	var requests []*SealKeyRequest
+	for i := 0; i < 2; i++ {
+		requests = append(requests, &SealKeyRequest{Key: key, Path: filepath.Join(dir, fmt.Sprintf("key%d", i))})
+	}
+
+	authKey, err := SealKeyToTPMMultiple(s.TPM(), requests, &KeyCreationParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+	c.Check(err, IsNil)
+
+	var keys []*SealedKeyObject
+	for _, r := range requests {
+		k, err := ReadSealedKeyObjectFromFile(r.Path)
+		c.Assert(err, IsNil)
+		keys = append(keys, k)
+	}
+
+	// The SHA-1 values can't be satisfied, so this only works if the SHA-256
+	// bank is selected.
+	profile := tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23})
+	profile.RootBranch().AddPCRValue(tpm2.HashAlgorithmSHA1, 7, testutil.DecodeHexString(c, "ffffffffffffffffffffffffffffffffffffffff"))
+	c.Check(UpdateKeyPCRProtectionPolicyMultiple(s.TPM(), keys, authKey, profile.SelectStrongestPCRBank()), IsNil)
+
+	for _, k := range keys {
+		_, _, err := k.UnsealFromTPM(s.TPM())
+		c.Check(err, IsNil)
+	}
+}
+
 func (s *updateLegacySuite) TestUpdateKeyPCRProtectionPolicyMultipleUnrelated1(c *C) {
 	// Test that UpdateKeyPCRProtectionPolicyMultiple rejects keys that have the
 	// same auth key, but different policies because they use independent PCR policy
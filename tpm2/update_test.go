@@ -26,6 +26,8 @@ import (
 
 	. "gopkg.in/check.v1"
 
+	"golang.org/x/xerrors"
+
 	"github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/testutil"
 	"github.com/snapcore/secboot/internal/tpm2test"
@@ -58,6 +60,7 @@ var _ = Suite(&updateSuite{})
 type testUpdatePCRProtectionPolicyData struct {
 	pcrPolicyCounterHandle tpm2.Handle
 	authKey                secboot.AuxiliaryKey
+	nvAuthorizedPCRPolicy  bool
 }
 
 func (s *updateSuite) testUpdatePCRProtectionPolicy(c *C, data *testUpdatePCRProtectionPolicyData) {
@@ -68,7 +71,8 @@ func (s *updateSuite) testUpdatePCRProtectionPolicy(c *C, data *testUpdatePCRPro
 	params := &ProtectKeyParams{
 		PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.DecodeHexString(c, "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")),
 		PCRPolicyCounterHandle: data.pcrPolicyCounterHandle,
-		AuthKey:                data.authKey}
+		AuthKey:                data.authKey,
+		NVAuthorizedPCRPolicy:  data.nvAuthorizedPCRPolicy}
 	k, authKey, err := ProtectKeyWithTPM(s.TPM(), key, params)
 	c.Assert(err, IsNil)
 
@@ -81,6 +85,13 @@ func (s *updateSuite) testUpdatePCRProtectionPolicy(c *C, data *testUpdatePCRPro
 
 	c.Check(skd.UpdatePCRProtectionPolicy(s.TPM(), authKey, tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23})), IsNil)
 
+	if data.nvAuthorizedPCRPolicy {
+		// The new PCR policy isn't authorized until it is written to the NV index.
+		_, _, err = k.RecoverKeys()
+		c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: the PCR policy is not authorized")
+		c.Check(skd.RevokeOldPCRProtectionPolicies(s.TPM(), authKey), IsNil)
+	}
+
 	_, _, err = k.RecoverKeys()
 	c.Check(err, IsNil)
 
@@ -110,6 +121,103 @@ func (s *updateSuite) TestUpdatePCRProtectionPolicyWithProvidedAuthKey(c *C) {
 		authKey:                authKey})
 }
 
+func (s *updateSuite) TestUpdatePCRProtectionPolicyNVAuthorized(c *C) {
+	s.testUpdatePCRProtectionPolicy(c, &testUpdatePCRProtectionPolicyData{
+		pcrPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		nvAuthorizedPCRPolicy:  true})
+}
+
+func (s *updateSuite) TestUpdatePCRProtectionPolicyNVAuthorizedRevokesOld(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		NVAuthorizedPCRPolicy:  true}
+	k1, authKey, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	w := newMockKeyDataWriter()
+	c.Check(k1.WriteAtomic(w), IsNil)
+
+	k2, err := secboot.ReadKeyData(w.Reader())
+	c.Assert(err, IsNil)
+
+	skd, err := NewSealedKeyData(k2)
+	c.Assert(err, IsNil)
+	c.Check(skd.UpdatePCRProtectionPolicy(s.TPM(), authKey, tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7})), IsNil)
+
+	// Updating the PCR policy of k2 only updates its metadata, so k1 can
+	// still be recovered and k2 can't until the update is committed.
+	_, _, err = k1.RecoverKeys()
+	c.Check(err, IsNil)
+	_, _, err = k2.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: the PCR policy is not authorized")
+
+	// Committing the update writes the new PCR policy digest to the NV index,
+	// which revokes the PCR policy of k1.
+	c.Check(skd.RevokeOldPCRProtectionPolicies(s.TPM(), authKey), IsNil)
+
+	_, _, err = k2.RecoverKeys()
+	c.Check(err, IsNil)
+	_, _, err = k1.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: the PCR policy is not authorized")
+
+	// Committing again does nothing.
+	c.Check(skd.RevokeOldPCRProtectionPolicies(s.TPM(), authKey), IsNil)
+	_, _, err = k2.RecoverKeys()
+	c.Check(err, IsNil)
+}
+
+func (s *updateSuite) TestUpdatePCRProtectionPolicySelectStrongestPCRBank(c *C) {
+	restore := MockEventLogPath("../efi/testdata/eventlog_sb.bin")
+	defer restore()
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	params := &ProtectKeyParams{
+		PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.DecodeHexString(c, "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+	k, authKey, err := ProtectKeyWithTPM(s.TPM(), key, params)
+	c.Assert(err, IsNil)
+
+	// Supply a profile with values for the SHA-1 and SHA-256 banks, where the
+	// SHA-1 values can't be satisfied. This only works if the SHA-256 bank is
+	// selected.
+	profile := tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23})
+	profile.RootBranch().AddPCRValue(tpm2.HashAlgorithmSHA1, 7, testutil.DecodeHexString(c, "ffffffffffffffffffffffffffffffffffffffff"))
+
+	skd, err := NewSealedKeyData(k)
+	c.Assert(err, IsNil)
+	c.Check(skd.UpdatePCRProtectionPolicy(s.TPM(), authKey, profile), IsNil)
+	_, _, err = k.RecoverKeys()
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+
+	c.Check(skd.UpdatePCRProtectionPolicy(s.TPM(), authKey, profile.SelectStrongestPCRBank()), IsNil)
+	_, _, err = k.RecoverKeys()
+	c.Check(err, IsNil)
+}
+
+func (s *updateSuite) TestUpdateKeyDataPCRProtectionPolicySelectStrongestPCRBankNoneSuitable(c *C) {
+	restore := MockEventLogPath("../efi/testdata/eventlog_sb.bin")
+	defer restore()
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	k, authKey, err := ProtectKeyWithTPM(s.TPM(), key, &ProtectKeyParams{PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	// The event log doesn't contain SHA-384 digests.
+	profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA384, 7, make(tpm2.Digest, 48)).SelectStrongestPCRBank()
+	err = UpdateKeyDataPCRProtectionPolicy(s.TPM(), authKey, profile, k)
+	c.Check(err, ErrorMatches, "cannot select PCR bank: no suitable PCR bank is available")
+	c.Check(xerrors.Is(err, ErrNoSuitablePCRBank), testutil.IsTrue)
+}
+
 func (s *updateSuite) testRevokeOldPCRProtectionPolicies(c *C, params *ProtectKeyParams) error {
 	key := make(secboot.DiskUnlockKey, 32)
 	rand.Read(key)
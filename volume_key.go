@@ -0,0 +1,209 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/secmem"
+)
+
+var volumeKeyKDFLabel = []byte("VOLUME-UNLOCK-KEY")
+
+// deriveVolumeKey derives the unlock key for the LUKS2 container with the
+// specified UUID from the supplied root key, using HKDF.
+func deriveVolumeKey(alg hashAlg, rootKey DiskUnlockKey, volumeUUID string) (DiskUnlockKey, error) {
+	if !alg.Available() {
+		return nil, errors.New("invalid digest algorithm")
+	}
+	if volumeUUID == "" {
+		return nil, errors.New("empty volume UUID")
+	}
+
+	info := make([]byte, 0, len(volumeKeyKDFLabel)+1+len(volumeUUID))
+	info = append(info, volumeKeyKDFLabel...)
+	info = append(info, 0)
+	info = append(info, volumeUUID...)
+
+	r := hkdf.New(func() hash.Hash { return alg.New() }, rootKey, nil, info)
+	key := make(DiskUnlockKey, len(rootKey))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DerivesVolumeKeys indicates whether the key recovered from this key data
+// is a root key from which the unlock keys for individual volumes are
+// derived, as enabled with EnableVolumeKeyDerivation.
+func (d *KeyData) DerivesVolumeKeys() bool {
+	return d.data.VolumeKeyDerivation != nil
+}
+
+// EnableVolumeKeyDerivation marks the key recovered from this key data as a
+// root key, from which the unlock key for each volume is derived using HKDF
+// with the UUID of the volume's LUKS2 container. This permits a single key
+// data object to be used to unlock multiple volumes, so that only one key
+// needs to be sealed and updated on each change to the platform's
+// protection policy.
+//
+// The unlock key for each volume can be obtained with DeriveVolumeUnlockKey,
+// and should be used to initialize the LUKS2 container of that volume. Once
+// enabled, ActivateVolumeWithKeyData automatically derives the correct key
+// for the volume being activated.
+//
+// This makes changes to the key data, which will need to persisted afterwards
+// using WriteAtomic.
+//
+// The supplied auxKey is obtained using one of the RecoverKeys* functions. If
+// the supplied auxKey is incorrect, then an error will be returned.
+func (d *KeyData) EnableVolumeKeyDerivation(auxKey AuxiliaryKey, alg crypto.Hash) error {
+	if err := d.checkAuxKey(auxKey); err != nil {
+		return err
+	}
+	if !hashAlg(alg).Available() {
+		return errors.New("invalid digest algorithm")
+	}
+
+	d.data.VolumeKeyDerivation = &hkdfData{Alg: hashAlg(alg)}
+
+	if d.data.MetadataMAC != nil {
+		if err := d.UpdateMetadataMAC(auxKey); err != nil {
+			return xerrors.Errorf("cannot update metadata MAC: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeriveVolumeUnlockKey derives the unlock key for the volume with the
+// specified LUKS2 container UUID from the supplied root key, which is
+// obtained from this key data using one of the RecoverKeys* functions. This
+// will return an error if volume key derivation hasn't been enabled with
+// EnableVolumeKeyDerivation.
+func (d *KeyData) DeriveVolumeUnlockKey(rootKey DiskUnlockKey, volumeUUID string) (DiskUnlockKey, error) {
+	if d.data.VolumeKeyDerivation == nil {
+		return nil, errors.New("volume key derivation is not enabled")
+	}
+	return deriveVolumeKey(d.data.VolumeKeyDerivation.Alg, rootKey, volumeUUID)
+}
+
+type rootKeyCacheEntry struct {
+	rootKey *secmem.Buffer
+	auxKey  *secmem.Buffer
+}
+
+// RootKeyCache caches the root keys recovered by ActivateVolumeWithKeyData
+// from key data objects with volume key derivation enabled, so that subsequent
+// volumes can be activated with the same key data object without recovering
+// the root key from the platform's secure device again or requesting a
+// passphrase again. It is owned by the caller, who should call Clear once all
+// of the volumes that share a root key have been activated. The zero value is
+// ready to use.
+type RootKeyCache struct {
+	mu      sync.Mutex
+	entries map[string]*rootKeyCacheEntry
+}
+
+// get returns copies of the root key and auxiliary key cached for the
+// supplied key data in secure buffers, which must be freed by the caller.
+func (c *RootKeyCache) get(d *KeyData) (rootKey, auxKey *secmem.Buffer, ok bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+
+	id, err := d.UniqueID()
+	if err != nil {
+		return nil, nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[string(id)]
+	if !ok {
+		return nil, nil, false
+	}
+
+	rootKey, err = secmem.NewFromBytes(entry.rootKey.Bytes())
+	if err != nil {
+		return nil, nil, false
+	}
+	auxKey, err = secmem.NewFromBytes(entry.auxKey.Bytes())
+	if err != nil {
+		rootKey.Free()
+		return nil, nil, false
+	}
+	return rootKey, auxKey, true
+}
+
+// add adds copies of the supplied root key and auxiliary key to the cache
+// for the supplied key data.
+func (c *RootKeyCache) add(d *KeyData, rootKey DiskUnlockKey, auxKey AuxiliaryKey) error {
+	if c == nil {
+		return nil
+	}
+
+	id, err := d.UniqueID()
+	if err != nil {
+		return err
+	}
+
+	rootKeyBuf, err := secmem.NewFromBytes(rootKey)
+	if err != nil {
+		return err
+	}
+	auxKeyBuf, err := secmem.NewFromBytes(auxKey)
+	if err != nil {
+		rootKeyBuf.Free()
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*rootKeyCacheEntry)
+	}
+	if entry, ok := c.entries[string(id)]; ok {
+		entry.rootKey.Free()
+		entry.auxKey.Free()
+	}
+	c.entries[string(id)] = &rootKeyCacheEntry{rootKey: rootKeyBuf, auxKey: auxKeyBuf}
+	return nil
+}
+
+// Clear wipes all of the root keys in this cache.
+func (c *RootKeyCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, entry := range c.entries {
+		entry.rootKey.Free()
+		entry.auxKey.Free()
+		delete(c.entries, id)
+	}
+}
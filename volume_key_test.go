@@ -0,0 +1,145 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type volumeKeySuite struct {
+	keyDataTestBase
+}
+
+var _ = Suite(&volumeKeySuite{})
+
+func (s *volumeKeySuite) newKeyData(c *C) (*KeyData, DiskUnlockKey, AuxiliaryKey) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	return keyData, key, auxKey
+}
+
+func (s *volumeKeySuite) TestEnableVolumeKeyDerivation(c *C) {
+	keyData, _, auxKey := s.newKeyData(c)
+	c.Check(keyData.DerivesVolumeKeys(), testutil.IsFalse)
+
+	c.Check(keyData.EnableVolumeKeyDerivation(auxKey, crypto.SHA256), IsNil)
+	c.Check(keyData.DerivesVolumeKeys(), testutil.IsTrue)
+	c.Check(keyData.VerifyMetadataMAC(auxKey), IsNil)
+
+	info, err := keyData.Inspect()
+	c.Assert(err, IsNil)
+	c.Check(info.DerivesVolumeKeys, testutil.IsTrue)
+}
+
+func (s *volumeKeySuite) TestEnableVolumeKeyDerivationWithWrongKey(c *C) {
+	keyData, _, _ := s.newKeyData(c)
+
+	c.Check(keyData.EnableVolumeKeyDerivation(make(AuxiliaryKey, 32), crypto.SHA256), ErrorMatches, "incorrect key supplied")
+	c.Check(keyData.DerivesVolumeKeys(), testutil.IsFalse)
+}
+
+func (s *volumeKeySuite) TestEnableVolumeKeyDerivationInvalidAlg(c *C) {
+	keyData, _, auxKey := s.newKeyData(c)
+
+	c.Check(keyData.EnableVolumeKeyDerivation(auxKey, crypto.MD5SHA1), ErrorMatches, "invalid digest algorithm")
+}
+
+type testDeriveVolumeUnlockKeyData struct {
+	alg  crypto.Hash
+	uuid string
+}
+
+func (s *volumeKeySuite) testDeriveVolumeUnlockKey(c *C, data *testDeriveVolumeUnlockKeyData) {
+	keyData, rootKey, auxKey := s.newKeyData(c)
+	c.Check(keyData.EnableVolumeKeyDerivation(auxKey, data.alg), IsNil)
+
+	key, err := keyData.DeriveVolumeUnlockKey(rootKey, data.uuid)
+	c.Assert(err, IsNil)
+
+	r := hkdf.New(data.alg.New, rootKey, nil, append([]byte("VOLUME-UNLOCK-KEY\x00"), data.uuid...))
+	expected := make(DiskUnlockKey, len(rootKey))
+	_, err = io.ReadFull(r, expected)
+	c.Assert(err, IsNil)
+	c.Check(key, DeepEquals, expected)
+	c.Check(key, Not(DeepEquals), rootKey)
+}
+
+func (s *volumeKeySuite) TestDeriveVolumeUnlockKey(c *C) {
+	s.testDeriveVolumeUnlockKey(c, &testDeriveVolumeUnlockKeyData{
+		alg:  crypto.SHA256,
+		uuid: "6503ce5c-c2fb-49e9-a560-71928d8ded0e"})
+}
+
+func (s *volumeKeySuite) TestDeriveVolumeUnlockKeyDifferentUUID(c *C) {
+	s.testDeriveVolumeUnlockKey(c, &testDeriveVolumeUnlockKeyData{
+		alg:  crypto.SHA256,
+		uuid: "971ccc5f-5843-445b-9cac-65234c203543"})
+}
+
+func (s *volumeKeySuite) TestDeriveVolumeUnlockKeySHA384(c *C) {
+	s.testDeriveVolumeUnlockKey(c, &testDeriveVolumeUnlockKeyData{
+		alg:  crypto.SHA384,
+		uuid: "6503ce5c-c2fb-49e9-a560-71928d8ded0e"})
+}
+
+func (s *volumeKeySuite) TestDeriveVolumeUnlockKeyNotEnabled(c *C) {
+	keyData, rootKey, _ := s.newKeyData(c)
+
+	_, err := keyData.DeriveVolumeUnlockKey(rootKey, "6503ce5c-c2fb-49e9-a560-71928d8ded0e")
+	c.Check(err, ErrorMatches, "volume key derivation is not enabled")
+}
+
+func (s *volumeKeySuite) TestDeriveVolumeUnlockKeyEmptyUUID(c *C) {
+	keyData, rootKey, auxKey := s.newKeyData(c)
+	c.Check(keyData.EnableVolumeKeyDerivation(auxKey, crypto.SHA256), IsNil)
+
+	_, err := keyData.DeriveVolumeUnlockKey(rootKey, "")
+	c.Check(err, ErrorMatches, "empty volume UUID")
+}
+
+func (s *volumeKeySuite) TestVolumeKeyDerivationPersisted(c *C) {
+	keyData, rootKey, auxKey := s.newKeyData(c)
+	c.Check(keyData.EnableVolumeKeyDerivation(auxKey, crypto.SHA256), IsNil)
+
+	expected, err := keyData.DeriveVolumeUnlockKey(rootKey, "6503ce5c-c2fb-49e9-a560-71928d8ded0e")
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	c.Check(keyData.DerivesVolumeKeys(), testutil.IsTrue)
+
+	key, err := keyData.DeriveVolumeUnlockKey(rootKey, "6503ce5c-c2fb-49e9-a560-71928d8ded0e")
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, expected)
+}
@@ -0,0 +1,177 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/xerrors"
+)
+
+var devDiskPath = "/dev/disk"
+
+type volumeLocatorKind int
+
+const (
+	volumeLocatorPath volumeLocatorKind = iota
+	volumeLocatorUUID
+	volumeLocatorLabel
+	volumeLocatorPartUUID
+)
+
+// VolumeLocator identifies a volume either by its device path or by a
+// stable identifier, so that it can be found even if its device path
+// changes, eg, between boot stages.
+//
+// Anywhere that this package accepts a source device path, a locator in
+// the fstab style string form ("UUID=<uuid>", "LABEL=<label>" or
+// "PARTUUID=<partuuid>") can be supplied instead.
+type VolumeLocator struct {
+	kind  volumeLocatorKind
+	value string
+}
+
+// VolumeByPath returns a VolumeLocator for the specified device path.
+func VolumeByPath(path string) VolumeLocator {
+	return VolumeLocator{kind: volumeLocatorPath, value: path}
+}
+
+// VolumeByUUID returns a VolumeLocator for the volume with the specified
+// filesystem or LUKS UUID.
+func VolumeByUUID(uuid string) VolumeLocator {
+	return VolumeLocator{kind: volumeLocatorUUID, value: uuid}
+}
+
+// VolumeByLabel returns a VolumeLocator for the volume with the specified
+// filesystem or LUKS label.
+func VolumeByLabel(label string) VolumeLocator {
+	return VolumeLocator{kind: volumeLocatorLabel, value: label}
+}
+
+// VolumeByPartUUID returns a VolumeLocator for the GPT partition with the
+// specified unique partition GUID.
+func VolumeByPartUUID(partuuid string) VolumeLocator {
+	return VolumeLocator{kind: volumeLocatorPartUUID, value: partuuid}
+}
+
+// ParseVolumeLocator parses a VolumeLocator from its string form, which is
+// either "UUID=<uuid>", "LABEL=<label>", "PARTUUID=<partuuid>" or a device
+// path.
+func ParseVolumeLocator(s string) (VolumeLocator, error) {
+	for _, kind := range []struct {
+		prefix string
+		kind   volumeLocatorKind
+	}{
+		{prefix: "UUID=", kind: volumeLocatorUUID},
+		{prefix: "LABEL=", kind: volumeLocatorLabel},
+		{prefix: "PARTUUID=", kind: volumeLocatorPartUUID},
+	} {
+		if !strings.HasPrefix(s, kind.prefix) {
+			continue
+		}
+		value := s[len(kind.prefix):]
+		if value == "" {
+			return VolumeLocator{}, fmt.Errorf("empty value in volume locator %q", s)
+		}
+		return VolumeLocator{kind: kind.kind, value: value}, nil
+	}
+
+	if s == "" {
+		return VolumeLocator{}, errors.New("empty volume locator")
+	}
+	return VolumeByPath(s), nil
+}
+
+// String implements fmt.Stringer, returning the form accepted by
+// ParseVolumeLocator.
+func (l VolumeLocator) String() string {
+	switch l.kind {
+	case volumeLocatorUUID:
+		return "UUID=" + l.value
+	case volumeLocatorLabel:
+		return "LABEL=" + l.value
+	case volumeLocatorPartUUID:
+		return "PARTUUID=" + l.value
+	default:
+		return l.value
+	}
+}
+
+// udevEncode encodes a string in the same way as udev does for the names
+// of symlinks in /dev/disk/by-label, where characters other than
+// alphanumerics, valid multi-byte UTF-8 sequences and "#+-.:=@_" are
+// encoded as \xNN.
+func udevEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, sz := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case sz > 1 && r != utf8.RuneError:
+			b.WriteString(s[i : i+sz])
+		case (r >= '0' && r <= '9') || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || strings.ContainsRune("#+-.:=@_", r):
+			b.WriteByte(s[i])
+		default:
+			fmt.Fprintf(&b, "\\x%02x", s[i])
+		}
+		i += sz
+	}
+	return b.String()
+}
+
+// DevicePath returns the path of the device identified by this locator.
+// Locators other than those created from a device path are resolved via
+// the symlinks that udev creates in /dev/disk, and the canonical device
+// path is returned.
+func (l VolumeLocator) DevicePath() (string, error) {
+	var link string
+	switch l.kind {
+	case volumeLocatorPath:
+		if l.value == "" {
+			return "", errors.New("empty device path")
+		}
+		return l.value, nil
+	case volumeLocatorUUID:
+		link = filepath.Join(devDiskPath, "by-uuid", l.value)
+	case volumeLocatorLabel:
+		link = filepath.Join(devDiskPath, "by-label", udevEncode(l.value))
+	case volumeLocatorPartUUID:
+		link = filepath.Join(devDiskPath, "by-partuuid", strings.ToLower(l.value))
+	}
+
+	path, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return "", xerrors.Errorf("cannot resolve %s: %w", l, err)
+	}
+	return path, nil
+}
+
+// resolveDevicePath returns the device path for the supplied string, which
+// may be a device path or any other form accepted by ParseVolumeLocator.
+func resolveDevicePath(s string) (string, error) {
+	l, err := ParseVolumeLocator(s)
+	if err != nil {
+		return "", err
+	}
+	return l.DevicePath()
+}
@@ -0,0 +1,147 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type volumeLocatorSuite struct {
+	snapd_testutil.BaseTest
+
+	dir string
+}
+
+var _ = Suite(&volumeLocatorSuite{})
+
+func (s *volumeLocatorSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.dir = c.MkDir()
+	s.AddCleanup(MockDevDiskPath(filepath.Join(s.dir, "dev/disk")))
+}
+
+// mockDevice creates a mock device node at the specified path relative to the
+// test directory, along with the supplied udev symlinks (relative to /dev/disk)
+// that point to it. It returns the absolute path of the device.
+func (s *volumeLocatorSuite) mockDevice(c *C, path string, links ...string) string {
+	path = filepath.Join(s.dir, path)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, nil, 0644), IsNil)
+
+	for _, link := range links {
+		link = filepath.Join(s.dir, "dev/disk", link)
+		c.Assert(os.MkdirAll(filepath.Dir(link), 0755), IsNil)
+		target, err := filepath.Rel(filepath.Dir(link), path)
+		c.Assert(err, IsNil)
+		c.Assert(os.Symlink(target, link), IsNil)
+	}
+
+	return path
+}
+
+type testParseVolumeLocatorData struct {
+	str      string
+	expected VolumeLocator
+}
+
+func (s *volumeLocatorSuite) testParseVolumeLocator(c *C, data *testParseVolumeLocatorData) {
+	l, err := ParseVolumeLocator(data.str)
+	c.Assert(err, IsNil)
+	c.Check(l, Equals, data.expected)
+	c.Check(l.String(), Equals, data.str)
+}
+
+func (s *volumeLocatorSuite) TestParseVolumeLocatorPath(c *C) {
+	s.testParseVolumeLocator(c, &testParseVolumeLocatorData{
+		str:      "/dev/sda1",
+		expected: VolumeByPath("/dev/sda1")})
+}
+
+func (s *volumeLocatorSuite) TestParseVolumeLocatorUUID(c *C) {
+	s.testParseVolumeLocator(c, &testParseVolumeLocatorData{
+		str:      "UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e",
+		expected: VolumeByUUID("6503ce5c-c2fb-49e9-a560-71928d8ded0e")})
+}
+
+func (s *volumeLocatorSuite) TestParseVolumeLocatorLabel(c *C) {
+	s.testParseVolumeLocator(c, &testParseVolumeLocatorData{
+		str:      "LABEL=ubuntu-data-enc",
+		expected: VolumeByLabel("ubuntu-data-enc")})
+}
+
+func (s *volumeLocatorSuite) TestParseVolumeLocatorPartUUID(c *C) {
+	s.testParseVolumeLocator(c, &testParseVolumeLocatorData{
+		str:      "PARTUUID=7d0fc8c4-5b8b-4c4e-8e4e-2bd1e9a0f1c3",
+		expected: VolumeByPartUUID("7d0fc8c4-5b8b-4c4e-8e4e-2bd1e9a0f1c3")})
+}
+
+func (s *volumeLocatorSuite) TestParseVolumeLocatorEmpty(c *C) {
+	_, err := ParseVolumeLocator("")
+	c.Check(err, ErrorMatches, "empty volume locator")
+}
+
+func (s *volumeLocatorSuite) TestParseVolumeLocatorEmptyValue(c *C) {
+	_, err := ParseVolumeLocator("UUID=")
+	c.Check(err, ErrorMatches, `empty value in volume locator "UUID="`)
+}
+
+func (s *volumeLocatorSuite) TestDevicePathFromPath(c *C) {
+	path, err := VolumeByPath("/dev/sda1").DevicePath()
+	c.Check(err, IsNil)
+	c.Check(path, Equals, "/dev/sda1")
+}
+
+func (s *volumeLocatorSuite) TestDevicePathFromUUID(c *C) {
+	expected := s.mockDevice(c, "dev/sda2", "by-uuid/6503ce5c-c2fb-49e9-a560-71928d8ded0e")
+
+	path, err := VolumeByUUID("6503ce5c-c2fb-49e9-a560-71928d8ded0e").DevicePath()
+	c.Check(err, IsNil)
+	c.Check(path, Equals, expected)
+}
+
+func (s *volumeLocatorSuite) TestDevicePathFromLabel(c *C) {
+	expected := s.mockDevice(c, "dev/sda3", `by-label/my\x20data\x2fvol`)
+
+	path, err := VolumeByLabel("my data/vol").DevicePath()
+	c.Check(err, IsNil)
+	c.Check(path, Equals, expected)
+}
+
+func (s *volumeLocatorSuite) TestDevicePathFromPartUUID(c *C) {
+	expected := s.mockDevice(c, "dev/nvme0n1p2", "by-partuuid/7d0fc8c4-5b8b-4c4e-8e4e-2bd1e9a0f1c3")
+
+	path, err := VolumeByPartUUID("7D0FC8C4-5B8B-4C4E-8E4E-2BD1E9A0F1C3").DevicePath()
+	c.Check(err, IsNil)
+	c.Check(path, Equals, expected)
+}
+
+func (s *volumeLocatorSuite) TestDevicePathNotFound(c *C) {
+	_, err := VolumeByUUID("6503ce5c-c2fb-49e9-a560-71928d8ded0e").DevicePath()
+	c.Check(err, ErrorMatches, `cannot resolve UUID=6503ce5c-c2fb-49e9-a560-71928d8ded0e: lstat .*: no such file or directory`)
+}